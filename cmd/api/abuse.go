@@ -0,0 +1,363 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// abuseGuard holds the client bans in force, and counts how often each client has
+// been turned away by the rate limiter so that persistent offenders can be banned.
+// Bans are loaded from the database periodically, so ones made or lifted by other
+// instances take effect within a minute. tarpitted bounds how many requests can be
+// held in the tarpit at once.
+type abuseGuard struct {
+	mu        sync.Mutex
+	bans      map[string]*data.ClientBan
+	strikes   map[string]*abuseStrikes
+	tarpitted chan struct{}
+}
+
+type abuseStrikes struct {
+	count int
+	since time.Time
+}
+
+func newAbuseGuard(maxTarpitted int) *abuseGuard {
+	return &abuseGuard{
+		bans:      make(map[string]*data.ClientBan),
+		strikes:   make(map[string]*abuseStrikes),
+		tarpitted: make(chan struct{}, maxTarpitted),
+	}
+}
+
+// banned returns the ban on the IP address, or nil if it isn't banned.
+func (g *abuseGuard) banned(ip string) *data.ClientBan {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[ip]
+	if !ok {
+		return nil
+	}
+	if !ban.Active() {
+		delete(g.bans, ip)
+		return nil
+	}
+	return ban
+}
+
+// add bans the IP address in memory, and returns false if it was already banned.
+func (g *abuseGuard) add(ban *data.ClientBan) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if existing, ok := g.bans[ban.IP]; ok && existing.Active() {
+		return false
+	}
+	g.bans[ban.IP] = ban
+	delete(g.strikes, ban.IP)
+	return true
+}
+
+// remove lifts the ban on the IP address, and forgets its strikes so that it isn't
+// banned again by the next rate limited request.
+func (g *abuseGuard) remove(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.bans, ip)
+	delete(g.strikes, ip)
+}
+
+// saved records the ID the ban on the IP address was saved with.
+func (g *abuseGuard) saved(ip string, id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ban, ok := g.bans[ip]; ok {
+		ban.ID = id
+	}
+}
+
+// replace swaps the bans in force for those loaded from the database, and forgets
+// strikes older than window. Bans which were never saved, such as those made by a
+// read-only server, are kept until they expire.
+func (g *abuseGuard) replace(bans []*data.ClientBan, window time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	previous := g.bans
+	g.bans = make(map[string]*data.ClientBan, len(bans))
+	for ip, ban := range previous {
+		if ban.ID == 0 && ban.Active() {
+			g.bans[ip] = ban
+		}
+	}
+	for _, ban := range bans {
+		g.bans[ban.IP] = ban
+	}
+	for ip, s := range g.strikes {
+		if time.Since(s.since) > window {
+			delete(g.strikes, ip)
+		}
+	}
+}
+
+// strike counts a rate limiter rejection for the IP address and returns how many
+// there have been within window.
+func (g *abuseGuard) strike(ip string, window time.Duration) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.strikes[ip]
+	if !ok || time.Since(s.since) > window {
+		s = &abuseStrikes{since: time.Now()}
+		g.strikes[ip] = s
+	}
+	s.count++
+	return s.count
+}
+
+// loadClientBans refreshes the bans in force from the database.
+func (app *application) loadClientBans() {
+	bans, err := app.models.ClientBans.GetActive()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.abuse.replace(bans, app.config.abuse.window)
+}
+
+// banClient tarpits or shadow bans the IP address for -abuse-ban-duration, with the
+// action set by -abuse-action, and records the decision. Addresses on -abuse-allowlist
+// are never banned.
+func (app *application) banClient(ip, reason string) {
+	if app.allowlisted(ip) {
+		return
+	}
+	ban := &data.ClientBan{
+		IP:        ip,
+		Action:    app.config.abuse.action,
+		Reason:    reason,
+		ExpiresAt: time.Now().Add(app.config.abuse.banDuration),
+	}
+	if !app.abuse.add(ban) {
+		return
+	}
+
+	// The ban is already in force in memory, so a failure here only means it's not
+	// shared with other instances or logged in the database.
+	if !app.config.readOnly {
+		record := *ban
+		err := app.models.ClientBans.Insert(&record)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"ip": ip})
+		} else {
+			app.abuse.saved(ip, record.ID)
+		}
+	}
+	app.logger.PrintInfo("client banned", map[string]string{
+		"ip":      ip,
+		"action":  ban.Action,
+		"reason":  reason,
+		"expires": ban.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// guardAbuse handles requests to the honeypot paths, which no real client has a
+// reason to visit, by banning the client. Requests from banned clients are delayed
+// by -tarpit-delay and, if they're shadow banned, answered with an empty response
+// instead of reaching the API. It runs after the rate limiter, so a banned client
+// can't hold more than a few requests in the tarpit, and after authentication, so
+// that admins sharing an address with a banned client can still use the API and
+// lift the ban.
+func (app *application) guardAbuse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if app.exemptFromBans(r, ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.config.abuse.honeypots[r.URL.Path] {
+			app.banClient(ip, fmt.Sprintf("requested honeypot %s", r.URL.Path))
+			app.tarpit(r)
+			app.decoyResponse(w, r)
+			return
+		}
+
+		ban := app.abuse.banned(ip)
+		if ban == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		app.tarpit(r)
+		if ban.Action == data.BanShadow {
+			app.decoyResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// exemptFromBans reports whether the request comes from an address on
+// -abuse-allowlist, or from an admin.
+func (app *application) exemptFromBans(r *http.Request, ip string) bool {
+	if app.allowlisted(ip) {
+		return true
+	}
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || !user.Activated {
+		return false
+	}
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return false
+	}
+	return permissions.Include("admin")
+}
+
+// allowlisted reports whether the IP address is on -abuse-allowlist.
+func (app *application) allowlisted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range app.config.abuse.allowlist {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarpit holds the request for -tarpit-delay, or until the client gives up. At most
+// -tarpit-max requests are held at once; any more go through straight away.
+func (app *application) tarpit(r *http.Request) {
+	select {
+	case app.abuse.tarpitted <- struct{}{}:
+		defer func() { <-app.abuse.tarpitted }()
+	default:
+		return
+	}
+	timer := time.NewTimer(app.config.abuse.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// decoyResponse is a successful but empty response, so scrapers can't easily tell
+// that they've been caught.
+func (app *application) decoyResponse(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listClientBansHandler shows the ban decisions, newest first. ?active=true limits it
+// to the bans still in force.
+func (app *application) listClientBansHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	active := app.readBool(qs, "active", v)
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-id",
+		SortSafelist: []string{"-id"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bans, metadata, err := app.models.ClientBans.GetAll(active != nil && *active, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"client_bans": bans, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// liftClientBanHandler ends a ban straight away, for when a real client was caught
+// by mistake.
+func (app *application) liftClientBanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ban, err := app.models.ClientBans.Lift(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.abuse.remove(ban.IP)
+	app.logger.PrintInfo("client ban lifted", map[string]string{"ip": ban.IP, "id": fmt.Sprint(ban.ID)})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"client_ban": ban}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// parseHoneypotPaths parses the comma separated -honeypot-paths flag.
+func parseHoneypotPaths(list string) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	for _, path := range strings.Split(list, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("honeypot path %q must start with /", path)
+		}
+		paths[path] = true
+	}
+	return paths, nil
+}
+
+// parseAllowlist parses the comma separated -abuse-allowlist flag, of IP addresses
+// and CIDR ranges.
+func parseAllowlist(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("abuse allowlist entry %q isn't an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("abuse allowlist entry %q isn't an IP address or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
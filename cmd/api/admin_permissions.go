@@ -0,0 +1,173 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// listPermissionsHandler lists every permission code, for admins choosing what to
+// grant.
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPermissionUsersHandler lists the users holding a permission, whether through
+// one of their roles or a direct grant, including by a wildcard such as books:*.
+func (app *application) listPermissionUsersHandler(w http.ResponseWriter, r *http.Request) {
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	all, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !all.Contains(code) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+	v := validator.New()
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readString(qs, "sort", "id"),
+		SortSafelist: []string{"id", "name", "email", "created_at", "last_login_at", "last_seen_at",
+			"-id", "-name", "-email", "-created_at", "-last_login_at", "-last_seen_at"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Permissions.GetUsers(code, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// writeUserPermissions responds with the user's effective permissions, and the ones
+// granted to them directly rather than through a role.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	granted, err := app.models.Permissions.GetGrantedForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions, "granted": granted}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// readPermissionCodes reads the {"permissions": [...]} body shared by the grant and
+// revoke endpoints and checks that every code exists. If it's invalid a response is
+// sent and nil is returned.
+func (app *application) readPermissionCodes(w http.ResponseWriter, r *http.Request) []string {
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil
+	}
+
+	all, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+
+	v := validator.New()
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(all.Contains(code), "permissions", "must only contain existing permissions")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil
+	}
+	return input.Permissions
+}
+
+// grantUserPermissionsHandler grants permissions to a user directly, on top of those
+// their roles give them.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	codes := app.readPermissionCodes(w, r)
+	if codes == nil {
+		return
+	}
+
+	err := app.models.Permissions.AddForUser(user.ID, codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.writeUserPermissions(w, r, user)
+}
+
+// revokeUserPermissionsHandler revokes permissions granted to a user directly. It
+// can't take away permissions which come from the user's roles; remove the role for
+// that.
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	codes := app.readPermissionCodes(w, r)
+	if codes == nil {
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(user.ID, codes...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.writeUserPermissions(w, r, user)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// listUsersHandler lists users for admins. ?inactive_days=N lists only the users who
+// haven't been seen for at least N days, including those never seen at all. ?q=
+// searches names and emails by word prefixes, and sorts the best matches first unless
+// another sort is asked for.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Q             string
+		Email         string
+		Activated     *bool
+		InactiveSince *time.Time
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Q = app.readString(qs, "q", "")
+	input.Email = app.readString(qs, "email", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	if qs.Has("inactive_days") {
+		days := app.readInt(qs, "inactive_days", 0, v)
+		v.Check(days >= 1, "inactive_days", "must be at least 1")
+		since := time.Now().AddDate(0, 0, -days)
+		input.InactiveSince = &since
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "last_login_at", "last_seen_at",
+		"-id", "-name", "-email", "-created_at", "-last_login_at", "-last_seen_at"}
+	if input.Q != "" {
+		input.Filters.Sort = app.readString(qs, "sort", "-relevance")
+		input.Filters.SortSafelist = append(input.Filters.SortSafelist, "relevance", "-relevance")
+		data.ValidateUserSearch(v, input.Q)
+		v.Check(input.Email == "", "email", "can't be used with q")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var users []*data.User
+	var metadata data.Metadata
+	var err error
+	if input.Q != "" {
+		users, metadata, err = app.models.Users.Search(input.Q, input.Activated, input.InactiveSince, input.Filters, r)
+	} else {
+		users, metadata, err = app.models.Users.GetAll(input.Email, input.Activated, input.InactiveSince, input.Filters, r)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam looks up the user whose ID is in the URL, sending a 404 response and
+// returning nil if there isn't one.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.resolveUserIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user, err := app.models.Users.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+func (app *application) listUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+
+	v := validator.New()
+	v.Check(input.Role != "", "role", "must be provided")
+	if v.Check(validator.PermittedValue(input.Role, names...), "role", "must be one of: "+strings.Join(names, ", ")); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, input.Role)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+
+	userRoles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": userRoles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	role := httprouter.ParamsFromContext(r.Context()).ByName("role")
+
+	err := app.models.Roles.RemoveForUser(user.ID, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+
+	userRoles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": userRoles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
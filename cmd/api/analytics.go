@@ -0,0 +1,127 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// analyticsBackfillDays is how far back exportAnalytics looks for days which haven't
+// been exported, such as while the server was down.
+const analyticsBackfillDays = 7
+
+// exportAnalytics writes a CSV file of each anonymized dataset for each whole UTC day
+// which hasn't been exported yet, named like searches/2024-05-01.csv. Days are only
+// exported once they're over, so each file is complete.
+func (app *application) exportAnalytics() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for i := analyticsBackfillDays; i >= 1; i-- {
+		from := today.AddDate(0, 0, -i)
+		for _, dataset := range data.AnalyticsDatasets {
+			select {
+			case <-app.done:
+				return
+			default:
+			}
+
+			_, err := app.exportAnalyticsDay(context.Background(), dataset, from, false)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"dataset": dataset.Name, "day": from.Format("2006-01-02")})
+				return
+			}
+		}
+	}
+}
+
+// exportAnalyticsDay exports a dataset's rows for the day starting at from, unless
+// it has been exported already and replace isn't set. It returns the number of rows
+// exported.
+func (app *application) exportAnalyticsDay(ctx context.Context, dataset data.AnalyticsDataset, from time.Time, replace bool) (int, error) {
+	name := fmt.Sprintf("%s/%s.csv", dataset.Name, from.Format("2006-01-02"))
+	if !replace {
+		exists, err := app.exports.Exists(name)
+		if err != nil || exists {
+			return 0, err
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := app.models.Analytics.Export(ctx, dataset, from, from.AddDate(0, 0, 1), []byte(app.config.analytics.key), &buf)
+	if err != nil {
+		return 0, err
+	}
+	err = app.exports.Put(name, &buf)
+	if err != nil {
+		return 0, err
+	}
+
+	app.logger.PrintInfo("analytics exported", map[string]string{"file": name, "rows": strconv.Itoa(n)})
+	return n, nil
+}
+
+// analyticsExport is the input of an analytics_export job.
+type analyticsExport struct {
+	Day string `json:"day"`
+}
+
+// exportAnalyticsHandler exports every dataset for a past day straight away, replacing
+// the files already exported for it, such as after a dataset has gained a column.
+func (app *application) exportAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.exports == nil {
+		app.stateConflictResponse(w, r, "analytics exports are not enabled")
+		return
+	}
+
+	var input analyticsExport
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	day, err := time.Parse("2006-01-02", input.Day)
+	v.Check(input.Day != "", "day", "must be provided")
+	v.Check(input.Day == "" || err == nil, "day", "must be a date like 2024-05-01")
+	v.Check(err != nil || day.Before(time.Now().UTC().Truncate(24*time.Hour)), "day", "must be over")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.respondAsyncable(w, r, "analytics_export", input)
+}
+
+// runAnalyticsExport exports every dataset for the day in the job's payload,
+// reporting progress after each one.
+func (app *application) runAnalyticsExport(ctx context.Context, job *data.Job) (envelope, error) {
+	var input analyticsExport
+	err := json.Unmarshal(job.Payload, &input)
+	if err != nil {
+		return nil, err
+	}
+	from, err := time.Parse("2006-01-02", input.Day)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := app.jobProgress(job)
+	rows := make(map[string]int, len(data.AnalyticsDatasets))
+	for i, dataset := range data.AnalyticsDatasets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rows[dataset.Name], err = app.exportAnalyticsDay(ctx, dataset, from, true)
+		if err != nil {
+			return nil, err
+		}
+		progress(int64(i+1), int64(len(data.AnalyticsDatasets)))
+	}
+	return envelope{"day": input.Day, "rows": rows}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/geoip"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// recordLogin records a successful login, then checks it for signs that someone else
+// is using the account in the background. It returns the login event, or nil if it
+// couldn't be recorded.
+func (app *application) recordLogin(r *http.Request, user *data.User, detail string) *data.SecurityEvent {
+	login := app.recordSecurityEvent(r, user, "", data.EventLogin, data.OutcomeSuccess, detail)
+	if login == nil || !app.config.anomalies.enabled {
+		return login
+	}
+	u := *user
+	app.background(func() {
+		app.checkLogin(&u, login)
+	})
+	return login
+}
+
+// loginAnomalies returns the reasons the login looks unusual, if any:
+//
+//   - it's from a country the user hasn't logged in from before or, without a geoip
+//     database, from a new IP address;
+//   - many accounts have logged in from the same IP address recently;
+//   - the user would have had to travel implausibly fast since their last login.
+//
+// Logins to accounts which have never logged in before aren't unusual.
+func (app *application) loginAnomalies(user *data.User, login *data.SecurityEvent) ([]string, error) {
+	var reasons []string
+
+	history, err := app.models.SecurityEvents.LoginHistory(user.ID, login.ID, login.IP, login.Country, login.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	if history.Logins > 0 {
+		switch {
+		case login.Country != "" && !history.SeenCountry:
+			reasons = append(reasons, fmt.Sprintf("first login from %s", login.Country))
+		case login.Country == "" && app.geoip == nil && !history.SeenIP:
+			reasons = append(reasons, "first login from this IP address")
+		}
+	}
+
+	if app.config.anomalies.accountsPerIP > 0 {
+		n, err := app.models.SecurityEvents.CountUsersFromIP(login.IP, login.CreatedAt.Add(-app.config.anomalies.accountsWindow))
+		if err != nil {
+			return nil, err
+		}
+		if n >= app.config.anomalies.accountsPerIP {
+			reasons = append(reasons, fmt.Sprintf("%d accounts logged in from this IP address recently", n))
+		}
+	}
+
+	if app.config.anomalies.maxSpeed > 0 && history.Previous != nil {
+		from, ok1 := app.geoip.Lookup(history.Previous.IP)
+		to, ok2 := app.geoip.Lookup(login.IP)
+		if ok1 && ok2 {
+			// Nearby locations are left alone, as geoip databases are rarely
+			// accurate to better than a city.
+			km := geoip.Distance(from, to)
+			hours := login.CreatedAt.Sub(history.Previous.CreatedAt).Hours()
+			if hours < 1.0/60 {
+				hours = 1.0 / 60
+			}
+			if km > 100 && km/hours > app.config.anomalies.maxSpeed {
+				reasons = append(reasons, fmt.Sprintf("%.0f km from the previous login %s earlier", km,
+					login.CreatedAt.Sub(history.Previous.CreatedAt).Round(time.Minute)))
+			}
+		}
+	}
+
+	return reasons, nil
+}
+
+// checkLogin records a suspicious login event for the admin security feed and emails
+// the user if the login looks unusual.
+func (app *application) checkLogin(user *data.User, login *data.SecurityEvent) {
+	reasons, err := app.loginAnomalies(user, login)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+		return
+	}
+	if len(reasons) == 0 {
+		return
+	}
+
+	err = app.models.SecurityEvents.Insert(&data.SecurityEvent{
+		UserID:    &user.ID,
+		Email:     user.Email,
+		Event:     data.EventSuspiciousLogin,
+		Outcome:   data.OutcomeSuccess,
+		Detail:    strings.Join(reasons, "; "),
+		IP:        login.IP,
+		UserAgent: login.UserAgent,
+		Country:   login.Country,
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+	}
+
+	where := login.IP
+	if login.Country != "" {
+		where = fmt.Sprintf("%s (%s)", login.IP, login.Country)
+	}
+	tmplData := map[string]any{
+		"name":       user.Name,
+		"loggedInAt": login.CreatedAt.UTC().Format("2 January 2006 at 15:04 UTC"),
+		"where":      where,
+		"userAgent":  login.UserAgent,
+		"reasons":    reasons,
+	}
+	err = app.mailer.SendLocalized(user.Email, app.userLanguage(user.ID), "suspicious_login.tmpl", tmplData)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// createAPIKeyHandler creates a long-lived API key for the authenticated user. The
+// plaintext key is only ever returned in this response. Keys can't be used to create
+// more keys, nor can scoped tokens, and admins impersonating a user can't create keys
+// for them.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	if app.contextGetAPIKey(r) != nil || user.ImpersonatorID != 0 || user.TokenScopes != nil {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{Name: input.Name, Scopes: input.Scopes}
+
+	v := validator.New()
+	if data.ValidateAPIKey(v, key, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key, err = app.models.APIKeys.New(user.ID, key.Name, key.Scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventAPIKeyCreated, data.OutcomeSuccess, key.Name)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/api-keys/%d", key.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.models.APIKeys.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.APIKeys.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventAPIKeyRevoked, data.OutcomeSuccess, fmt.Sprintf("api key %d", id))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// prefersAsync reports whether the client sent Prefer: respond-async (RFC 7240),
+// asking for a long-running request to be answered with a job to poll rather than
+// holding the connection open.
+func prefersAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondAsyncable answers a long-running request by running a job of the given kind
+// with payload as its input. Normally the job runs straight away and its result is
+// the response. If the client prefers, the job is queued instead, and the response is
+// 202 Accepted with the job's status at the Location, which links to the result once
+// the job has completed. A read-only server can't queue jobs, so it always answers
+// straight away.
+func (app *application) respondAsyncable(w http.ResponseWriter, r *http.Request, kind string, payload any) {
+	var js []byte
+	if payload != nil {
+		var err error
+		js, err = json.Marshal(payload)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !prefersAsync(r) || app.config.readOnly {
+		run, ok := lookupJobKind(kind)
+		if !ok {
+			app.serverErrorResponse(w, r, fmt.Errorf("unknown job kind %q", kind))
+			return
+		}
+		env, err := run.run(app, r.Context(), &data.Job{Kind: kind, Payload: js})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusOK, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	job := &data.Job{
+		Kind:    kind,
+		UserID:  app.contextGetUser(r).ID,
+		Payload: js,
+	}
+	err := app.enqueueJob(job)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+	headers.Set("Preference-Applied", "respond-async")
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setResultURL links a completed job to its result.
+func setResultURL(job *data.Job) {
+	if job.HasResult {
+		job.ResultURL = fmt.Sprintf("/v1/jobs/%d/result", job.ID)
+	}
+}
+
+// readOwnJob returns the job named in the URL if it's an asynchronous request made by
+// the user, or the user is an admin. Otherwise it sends a 404 and returns nil, so
+// users can't find out about each other's jobs.
+func (app *application) readOwnJob(w http.ResponseWriter, r *http.Request) *data.Job {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+	if job.UserID != user.ID {
+		permissions, err := app.permissionsFor(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil
+		}
+		if !permissions.Include("admin") {
+			app.notFoundResponse(w, r)
+			return nil
+		}
+	}
+	return job
+}
+
+// showAsyncJobHandler reports the status and progress of an asynchronous request.
+func (app *application) showAsyncJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := app.readOwnJob(w, r)
+	if job == nil {
+		return
+	}
+	setResultURL(job)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showAsyncJobResultHandler responds with what the asynchronous request would have
+// responded with, once its job has completed.
+func (app *application) showAsyncJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	job := app.readOwnJob(w, r)
+	if job == nil {
+		return
+	}
+	if !job.HasResult {
+		app.stateConflictResponse(w, r, fmt.Sprintf("the job is %s and has no result", job.Status))
+		return
+	}
+
+	result, err := app.models.Jobs.GetResult(job.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(result, &fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := make(envelope, len(fields))
+	for name, value := range fields {
+		env[name] = value
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelAsyncJobHandler stops an asynchronous request which is still queued or
+// running.
+func (app *application) cancelAsyncJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := app.readOwnJob(w, r)
+	if job == nil {
+		return
+	}
+	app.cancelJob(w, r, job)
+}
@@ -5,9 +5,81 @@ import (
 	"books.reading.kz/internal/validator"
 	"errors"
 	"fmt"
+	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+// wantRawPages reports whether page counts should be sent as bare integers. That's the
+// default from API version 2026-10-15, and older clients can opt in with the
+// ?format=raw query string parameter or by accepting the application/vnd.books.raw+json
+// media type.
+func (app *application) wantRawPages(r *http.Request) bool {
+	return app.apiVersionAtLeast(r, apiVersion20261015) ||
+		r.URL.Query().Get("format") == "raw" ||
+		strings.Contains(r.Header.Get("Accept"), "application/vnd.books.raw+json")
+}
+
+// presentBook returns the value that should be encoded for a single book in a response.
+func (app *application) presentBook(r *http.Request, book *data.Book) any {
+	if app.wantRawPages(r) {
+		return data.NewRawPagesBook(book)
+	}
+	return book
+}
+
+// presentBooks is the same as presentBook, but for a list of books.
+func (app *application) presentBooks(r *http.Request, books []*data.Book) any {
+	if !app.wantRawPages(r) {
+		return books
+	}
+	raw := make([]data.RawPagesBook, len(books))
+	for i, book := range books {
+		raw[i] = data.NewRawPagesBook(book)
+	}
+	return raw
+}
+
+// withholdContent removes the content of institution-only books from the response
+// unless the user is a library member, which is someone with a library card, or
+// staff who can edit the catalog. Anonymous users, when the catalog is public, are
+// never members.
+func (app *application) withholdContent(r *http.Request, books []*data.Book) error {
+	restricted := false
+	for _, book := range books {
+		if book.DigitalRights.InstitutionOnly {
+			restricted = true
+			break
+		}
+	}
+	if !restricted {
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+	if !user.IsAnonymous() {
+		permissions, err := app.permissionsFor(r, user)
+		if err != nil {
+			return err
+		}
+		if permissions.Include("books:write") {
+			return nil
+		}
+		member, err := app.models.Cards.HasCard(user.ID)
+		if err != nil {
+			return err
+		}
+		if member {
+			return nil
+		}
+	}
+	for _, book := range books {
+		book.WithholdContent()
+	}
+	return nil
+}
+
 func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Title   string     `json:"title"`
@@ -15,6 +87,8 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 		Year    int32      `json:"year"`
 		Pages   data.Pages `json:"pages"`
 		Genres  []string   `json:"genres"`
+		// DigitalRights can be left out for books without licence restrictions.
+		DigitalRights data.DigitalRights `json:"digital_rights"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -24,11 +98,13 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	book := &data.Book{
-		Title:   input.Title,
-		Year:    input.Year,
-		Content: input.Content,
-		Pages:   input.Pages,
-		Genres:  input.Genres,
+		Title:         input.Title,
+		Year:          input.Year,
+		Content:       input.Content,
+		Pages:         input.Pages,
+		Genres:        input.Genres,
+		DigitalRights: input.DigitalRights,
+		CreatedBy:     app.contextGetUser(r).ID,
 	}
 
 	v := validator.New()
@@ -52,7 +128,7 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/books/%d", book.ID))
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"book": book}, headers)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"book": app.presentBook(r, book)}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -61,13 +137,20 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 
 func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request) {
 
-	id, err := app.readIDParam(r)
+	id, err := app.resolveBookIDParam(r)
 
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
+	v := validator.New()
+	expand := app.readExpand(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	book, err := app.models.Book.Get(id, r)
 	if err != nil {
 		switch {
@@ -79,7 +162,59 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	err = app.expandBooks(r.Context(), []*data.Book{book}, expand)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.withholdContent(r, []*data.Book{book})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(book.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": app.presentBook(r, book)}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showBookBySlugHandler looks a book up by its slug. If the slug used to belong to the
+// book before its title was changed, the client is redirected to the current one.
+func (app *application) showBookBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+	book, err := app.models.Book.GetBySlug(slug, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if book.Slug != slug {
+		headers := make(http.Header)
+		headers.Set("Location", "/v1/books/slug/"+url.PathEscape(book.Slug))
+
+		err = app.writeJSON(w, http.StatusMovedPermanently, envelope{"message": "book has moved", "slug": book.Slug}, headers)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.withholdContent(r, []*data.Book{book})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": app.presentBook(r, book)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -87,7 +222,7 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 
 func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request) {
 
-	id, err := app.readIDParam(r)
+	id, err := app.resolveBookIDParam(r)
 
 	if err != nil {
 		app.notFoundResponse(w, r)
@@ -105,12 +240,25 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !app.canModifyBook(w, r, book) {
+		return
+	}
+
+	// If the client sent an If-Match header, make sure that they're updating the
+	// version of the book that they last saw.
+	if !app.ifMatch(r, book.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	var input struct {
 		Title   *string     `json:"title"`
 		Content *string     `json:"content"`
 		Year    *int32      `json:"year"`
 		Pages   *data.Pages `json:"pages"`
 		Genres  []string    `json:"genres"`
+		// DigitalRights replaces both flags when it's sent.
+		DigitalRights *data.DigitalRights `json:"digital_rights"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -139,6 +287,10 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		book.Genres = input.Genres
 	}
 
+	if input.DigitalRights != nil {
+		book.DigitalRights = *input.DigitalRights
+	}
+
 	v := validator.New()
 
 	if data.ValidateBook(v, book); !v.Valid() {
@@ -149,6 +301,8 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 	err = app.models.Book.Update(book, r)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -157,7 +311,10 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(book.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": app.presentBook(r, book)}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -165,17 +322,45 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r)
+	id, err := app.resolveBookIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	err = app.models.Book.Delete(id, r)
+	book, err := app.models.Book.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.canModifyBook(w, r, book) {
+		return
+	}
+
+	// When an If-Match header is sent, only delete the book if it hasn't changed since
+	// the client last fetched it.
+	var version string
+	if r.Header.Get("If-Match") != "" {
+		if !app.ifMatch(r, book.Version) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		version = book.Version
+	}
+
+	err = app.models.Book.Delete(id, version, r)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -191,9 +376,12 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 
 func (app *application) listBookHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string
-		Content string
-		Genres  []string
+		Title  string
+		Search string
+		Genres []string
+		Branch string
+		Mine   *bool
+		Expand []string
 		data.Filters
 	}
 
@@ -202,8 +390,11 @@ func (app *application) listBookHandler(w http.ResponseWriter, r *http.Request)
 	qs := r.URL.Query()
 
 	input.Title = app.readString(qs, "title", "")
-	input.Content = app.readString(qs, "content", "")
+	input.Search = app.readString(qs, "q", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Branch = app.readString(qs, "branch", "")
+	input.Mine = app.readBool(qs, "mine", v)
+	input.Expand = app.readExpand(r, v)
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
@@ -217,15 +408,69 @@ func (app *application) listBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	books, metadata, err := app.models.Book.GetAll(input.Title, input.Content, input.Genres, input.Filters, r)
+	// ?mine=true only lists the books the user added themselves.
+	var createdBy int64
+	if input.Mine != nil && *input.Mine {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		createdBy = user.ID
+	}
+
+	books, metadata, err := app.models.Book.GetAll(input.Title, input.Search, input.Genres, createdBy, input.Branch, input.Filters, r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Log new searches for the analytics export, but not each page of one.
+	if query := strings.TrimSpace(input.Title + " " + input.Search); query != "" && input.Filters.Page == 1 && !app.config.readOnly {
+		userID := app.contextGetUser(r).ID
+		app.background(func() {
+			err := app.models.Searches.Record(userID, query, metadata.TotalRecords)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.expandBooks(r.Context(), books, input.Expand)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.withholdContent(r, books)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 	// Send a JSON response containing the movie data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": app.presentBooks(r, books), "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 
 }
+
+// canModifyBook checks that the user may update or delete the book. Users can always
+// change the books they added, and changing anyone else's needs the books:moderate
+// permission. If they aren't allowed a 403 response is sent and false is returned.
+func (app *application) canModifyBook(w http.ResponseWriter, r *http.Request, book *data.Book) bool {
+	user := app.contextGetUser(r)
+	if book.CreatedBy != 0 && book.CreatedBy == user.ID {
+		return true
+	}
+
+	permissions, err := app.permissionsFor(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !permissions.Include("books:moderate") {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// bootstrapHandler creates the first admin, for provisioning tools which have no admin
+// to log in as yet. It's authorized by the -bootstrap-token sent in the
+// X-Bootstrap-Token header, and only works once: repeating the same request returns
+// the admin it created with 200 instead of 201, so it's safe to run on every deploy,
+// while bootstrapping a different email address, or after an admin has been made some
+// other way, is a conflict.
+func (app *application) bootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.bootstrap.token == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+	token := r.Header.Get("X-Bootstrap-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.config.bootstrap.token)) != 1 {
+		app.errorResponse(w, r, http.StatusUnauthorized, "invalid or missing bootstrap token")
+		return
+	}
+
+	var input struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := &data.User{
+		Name:  input.Name,
+		Email: input.Email,
+	}
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	created, err := app.models.Bootstrap.Run(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyBootstrapped):
+			app.stateConflictResponse(w, r, "an admin has already been bootstrapped")
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		app.logger.PrintInfo("bootstrapped admin", map[string]string{"user_id": strconv.FormatInt(user.ID, 10)})
+	}
+	err = app.writeJSON(w, status, envelope{"user": user, "created": created}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
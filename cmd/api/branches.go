@@ -0,0 +1,297 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// readBranchParam fetches the branch named by the :id parameter. If it can't be
+// fetched an error response is sent and nil is returned.
+func (app *application) readBranchParam(w http.ResponseWriter, r *http.Request) *data.LibraryBranch {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	branch, err := app.models.Branches.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return branch
+}
+
+func (app *application) listBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	branches, err := app.models.Branches.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"branches": branches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showBranchHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"branch": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createBranchHandler adds a library site. Loan policy values which aren't given
+// default to a 21 day loan period, 2 renewals and 10 loans at a time, and the branch
+// doesn't take pickup bookings unless a pickup capacity is given.
+func (app *application) createBranchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name              string `json:"name"`
+		Address           string `json:"address"`
+		Phone             string `json:"phone"`
+		Timezone          string `json:"timezone"`
+		PickupSlotMinutes *int32 `json:"pickup_slot_minutes"`
+		PickupCapacity    int32  `json:"pickup_capacity"`
+		LoanPolicy        struct {
+			LoanPeriodDays *int32 `json:"loan_period_days"`
+			MaxRenewals    *int32 `json:"max_renewals"`
+			MaxLoans       *int32 `json:"max_loans"`
+			DailyFine      *int32 `json:"daily_fine"`
+			MaxFine        *int32 `json:"max_fine"`
+			ReplacementFee *int32 `json:"replacement_fee"`
+		} `json:"loan_policy"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	branch := &data.LibraryBranch{
+		Name:              input.Name,
+		Address:           input.Address,
+		Phone:             input.Phone,
+		Timezone:          input.Timezone,
+		LoanPolicy:        data.LoanPolicy{LoanPeriodDays: 21, MaxRenewals: 2, MaxLoans: 10},
+		PickupSlotMinutes: 30,
+		PickupCapacity:    input.PickupCapacity,
+	}
+	if branch.Timezone == "" {
+		branch.Timezone = "UTC"
+	}
+	if input.PickupSlotMinutes != nil {
+		branch.PickupSlotMinutes = *input.PickupSlotMinutes
+	}
+	if input.LoanPolicy.LoanPeriodDays != nil {
+		branch.LoanPolicy.LoanPeriodDays = *input.LoanPolicy.LoanPeriodDays
+	}
+	if input.LoanPolicy.MaxRenewals != nil {
+		branch.LoanPolicy.MaxRenewals = *input.LoanPolicy.MaxRenewals
+	}
+	if input.LoanPolicy.MaxLoans != nil {
+		branch.LoanPolicy.MaxLoans = *input.LoanPolicy.MaxLoans
+	}
+	if input.LoanPolicy.DailyFine != nil {
+		branch.LoanPolicy.DailyFine = *input.LoanPolicy.DailyFine
+	}
+	if input.LoanPolicy.MaxFine != nil {
+		branch.LoanPolicy.MaxFine = *input.LoanPolicy.MaxFine
+	}
+	if input.LoanPolicy.ReplacementFee != nil {
+		branch.LoanPolicy.ReplacementFee = *input.LoanPolicy.ReplacementFee
+	}
+
+	v := validator.New()
+	if data.ValidateBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Branches.Insert(branch)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBranch):
+			v.AddError("name", "a branch with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/branches/%d", branch.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"branch": branch}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateBranchHandler changes a branch's details or loan policy. Renaming a branch
+// renames it on its copies too.
+func (app *application) updateBranchHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	var input struct {
+		Name              *string `json:"name"`
+		Address           *string `json:"address"`
+		Phone             *string `json:"phone"`
+		Timezone          *string `json:"timezone"`
+		PickupSlotMinutes *int32  `json:"pickup_slot_minutes"`
+		PickupCapacity    *int32  `json:"pickup_capacity"`
+		LoanPolicy        struct {
+			LoanPeriodDays *int32 `json:"loan_period_days"`
+			MaxRenewals    *int32 `json:"max_renewals"`
+			MaxLoans       *int32 `json:"max_loans"`
+			DailyFine      *int32 `json:"daily_fine"`
+			MaxFine        *int32 `json:"max_fine"`
+			ReplacementFee *int32 `json:"replacement_fee"`
+		} `json:"loan_policy"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		branch.Name = *input.Name
+	}
+	if input.Address != nil {
+		branch.Address = *input.Address
+	}
+	if input.Phone != nil {
+		branch.Phone = *input.Phone
+	}
+	if input.Timezone != nil {
+		branch.Timezone = *input.Timezone
+	}
+	if input.PickupSlotMinutes != nil {
+		branch.PickupSlotMinutes = *input.PickupSlotMinutes
+	}
+	if input.PickupCapacity != nil {
+		branch.PickupCapacity = *input.PickupCapacity
+	}
+	if input.LoanPolicy.LoanPeriodDays != nil {
+		branch.LoanPolicy.LoanPeriodDays = *input.LoanPolicy.LoanPeriodDays
+	}
+	if input.LoanPolicy.MaxRenewals != nil {
+		branch.LoanPolicy.MaxRenewals = *input.LoanPolicy.MaxRenewals
+	}
+	if input.LoanPolicy.MaxLoans != nil {
+		branch.LoanPolicy.MaxLoans = *input.LoanPolicy.MaxLoans
+	}
+	if input.LoanPolicy.DailyFine != nil {
+		branch.LoanPolicy.DailyFine = *input.LoanPolicy.DailyFine
+	}
+	if input.LoanPolicy.MaxFine != nil {
+		branch.LoanPolicy.MaxFine = *input.LoanPolicy.MaxFine
+	}
+	if input.LoanPolicy.ReplacementFee != nil {
+		branch.LoanPolicy.ReplacementFee = *input.LoanPolicy.ReplacementFee
+	}
+
+	v := validator.New()
+	if data.ValidateBranch(v, branch); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Branches.Update(branch)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBranch):
+			v.AddError("name", "a branch with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"branch": branch}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteBranchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Branches.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBranchInUse):
+			app.stateConflictResponse(w, r, "the branch still has copies, move or delete them first")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "branch successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listBranchCopiesHandler is the branch's inventory: every copy shelved there, with
+// the book it's a copy of.
+func (app *application) listBranchCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	qs := r.URL.Query()
+	v := validator.New()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "call_number"),
+		SortSafelist: copySortSafelist,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	copies, metadata, err := app.models.Copies.Find(data.CopyLookup{Branch: branch.Name}, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"copies": copies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/mailer"
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+	"net/http"
+	"time"
+)
+
+// trackingPixel is a transparent 1x1 GIF, returned when a campaign email is opened.
+var trackingPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// dispatchCampaigns sends every campaign which is due. It's run periodically, so a
+// campaign interrupted by a restart carries on where it left off.
+func (app *application) dispatchCampaigns() {
+	campaigns, err := app.models.Campaigns.GetAll(true)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, campaign := range campaigns {
+		err := app.sendCampaign(campaign)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"campaign_id": fmt.Sprint(campaign.ID)})
+		}
+	}
+}
+
+// sendCampaign emails the campaign to its pending recipients, no faster than
+// -campaign-rate emails per second. It stops early if the campaign is cancelled, the
+// server shuts down or the mail quota for bulk mail is used up, and the next dispatch
+// carries on.
+func (app *application) sendCampaign(campaign *data.Campaign) error {
+	if campaign.Status == data.CampaignScheduled {
+		err := app.models.Campaigns.Start(campaign)
+		if err != nil {
+			return err
+		}
+		app.logger.PrintInfo("campaign started", map[string]string{"campaign_id": fmt.Sprint(campaign.ID)})
+	}
+
+	books, err := app.models.Book.GetNewArrivals(context.Background(), 10)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-app.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	limiter := rate.NewLimiter(rate.Limit(app.config.campaigns.rate), 1)
+	// Claim about a minute's worth of recipients at a time, so that they're sent to
+	// well before another instance could take them to be abandoned.
+	batch := int(app.config.campaigns.rate * 60)
+	if batch < 1 {
+		batch = 1
+	} else if batch > 100 {
+		batch = 100
+	}
+
+	for {
+		current, err := app.models.Campaigns.Get(campaign.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != data.CampaignSending {
+			return nil
+		}
+
+		recipients, err := app.models.Campaigns.ClaimRecipients(campaign.ID, batch)
+		if err != nil {
+			return err
+		}
+		if len(recipients) == 0 {
+			// Another instance is still sending to the recipients it claimed, and will
+			// mark the campaign as sent when it's done.
+			if current.Stats.Pending > 0 {
+				return nil
+			}
+			err = app.models.Campaigns.SetStatus(campaign.ID, data.CampaignSent, data.CampaignSending)
+			if err != nil && !errors.Is(err, data.ErrEditConflict) {
+				return err
+			}
+			app.logger.PrintInfo("campaign sent", map[string]string{"campaign_id": fmt.Sprint(campaign.ID)})
+			return nil
+		}
+
+		// handBack returns the recipients who haven't been sent to yet to pending,
+		// rather than leave them until the claim times out.
+		handBack := func(rest []*data.CampaignRecipient) error {
+			for _, recipient := range rest {
+				err := app.models.Campaigns.MarkRecipient(campaign.ID, recipient.UserID, data.RecipientPending, "")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for i, recipient := range recipients {
+			if limiter.Wait(ctx) != nil {
+				return handBack(recipients[i:])
+			}
+
+			tmplData := map[string]any{
+				"name":    recipient.Name,
+				"books":   books,
+				"openURL": app.config.baseURL + "/v1/campaigns/opens/" + recipient.OpenToken,
+			}
+
+			status, message := data.RecipientSent, ""
+			err := app.mailer.Bulk().SendLocalized(recipient.Email, app.userLanguage(recipient.UserID), campaign.Template, tmplData)
+			var overQuota *mailer.OverQuotaError
+			if errors.As(err, &overQuota) {
+				app.logger.PrintInfo("campaign paused, the mail quota is used up", map[string]string{"campaign_id": fmt.Sprint(campaign.ID), "retry_after": overQuota.RetryAfter.Round(time.Second).String()})
+				return handBack(recipients[i:])
+			}
+			if err != nil {
+				status, message = data.RecipientFailed, err.Error()
+			}
+
+			err = app.models.Campaigns.MarkRecipient(campaign.ID, recipient.UserID, status, message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (app *application) createCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string                `json:"name"`
+		Template    string                `json:"template"`
+		Audience    data.CampaignAudience `json:"audience"`
+		ScheduledAt *time.Time            `json:"scheduled_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	campaign := &data.Campaign{
+		Name:        input.Name,
+		Template:    input.Template,
+		Audience:    input.Audience,
+		ScheduledAt: time.Now(),
+	}
+	if input.ScheduledAt != nil {
+		campaign.ScheduledAt = *input.ScheduledAt
+	}
+
+	v := validator.New()
+	if data.ValidateCampaign(v, campaign); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Campaigns.Insert(campaign)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/campaigns/%d", campaign.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"campaign": campaign}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := app.models.Campaigns.GetAll(false)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"campaigns": campaigns}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	campaign, err := app.models.Campaigns.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"campaign": campaign}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelCampaignHandler stops a campaign which hasn't finished sending. Emails which
+// have already gone out can't be recalled.
+func (app *application) cancelCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	campaign, err := app.models.Campaigns.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Campaigns.SetStatus(campaign.ID, data.CampaignCancelled, data.CampaignScheduled, data.CampaignSending)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.stateConflictResponse(w, r, fmt.Sprintf("a %s campaign can't be cancelled", campaign.Status))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	campaign.Status = data.CampaignCancelled
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"campaign": campaign}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordCampaignBouncesHandler records bounce reports for a campaign, for example as
+// forwarded from the SMTP provider's bounce notifications.
+func (app *application) recordCampaignBouncesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Emails []string `json:"emails"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Emails) >= 1, "emails", "must contain at least 1 email address")
+	for _, email := range input.Emails {
+		v.Check(validator.Matches(email, validator.EmailRX), "emails", "must only contain valid email addresses")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bounced, err := app.models.Campaigns.RecordBounces(id, input.Emails)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bounced": bounced}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// campaignOpenHandler serves the tracking pixel embedded in campaign emails, and
+// records that the email was opened, except in read-only mode. It always returns the
+// pixel, so the response doesn't reveal whether a token is valid.
+func (app *application) campaignOpenHandler(w http.ResponseWriter, r *http.Request) {
+	token := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	// rejectWrites lets GETs through.
+	if !app.config.readOnly {
+		err := app.models.Campaigns.RecordOpen(token)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(trackingPixel)
+}
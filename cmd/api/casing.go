@@ -0,0 +1,70 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The casings responses can use for their field names. snake_case is what every type
+// is tagged with; camelCase is produced from it by writeJSON. Request bodies are
+// accepted in either, as readJSON converts camelCase keys back.
+const (
+	caseSnake = "snake_case"
+	caseCamel = "camelCase"
+)
+
+// casingWriter carries the field name casing chosen for a response down to
+// writeJSON, which has the response writer but not the request.
+type casingWriter struct {
+	http.ResponseWriter
+	casing string
+}
+
+func (cw *casingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// jsonCasing picks the field name casing for each response: the one asked for with a
+// profile parameter in the Accept header, as in
+// Accept: application/json; profile="camelCase", or else the -json-case default.
+func (app *application) jsonCasing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		casing := app.config.jsonCase
+		if requested := acceptedCasing(r.Header.Get("Accept")); requested != "" {
+			casing = requested
+		}
+		w.Header().Add("Vary", "Accept")
+		next.ServeHTTP(&casingWriter{ResponseWriter: w, casing: casing}, r)
+	})
+}
+
+// acceptedCasing returns the casing named by the first profile parameter in an Accept
+// header, or "" if there isn't one it knows.
+func acceptedCasing(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		_, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		switch params["profile"] {
+		case caseSnake, caseCamel:
+			return params["profile"]
+		}
+	}
+	return ""
+}
+
+// responseCasing returns the casing chosen for the response written to w.
+func responseCasing(w http.ResponseWriter) string {
+	for {
+		switch rw := w.(type) {
+		case *casingWriter:
+			return rw.casing
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return caseSnake
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// showCatalogFingerprintHandler exports a fingerprint of the catalog, which can be
+// posted to the diff endpoint in another environment to compare the two.
+func (app *application) showCatalogFingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "catalog_fingerprint", nil)
+}
+
+func (app *application) runCatalogFingerprint(ctx context.Context, job *data.Job) (envelope, error) {
+	fp, err := app.models.Catalog.Fingerprint(ctx, app.config.env, app.jobProgress(job))
+	return envelope{"fingerprint": fp}, err
+}
+
+// diffCatalogHandler compares the catalog with a fingerprint exported from another
+// environment, such as staging's against production after a migration or sync job,
+// and reports the books missing on either side and those whose metadata differs.
+func (app *application) diffCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Fingerprint *data.CatalogFingerprint `json:"fingerprint"`
+	}
+	// A fingerprint entry is around 150 bytes, so this allows for a few hundred
+	// thousand books.
+	err := app.readJSONLimit(w, r, &input, 64<<20)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Fingerprint != nil, "fingerprint", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.respondAsyncable(w, r, "catalog_diff", input.Fingerprint)
+}
+
+// runCatalogDiff compares the catalog with the fingerprint in the job's payload.
+func (app *application) runCatalogDiff(ctx context.Context, job *data.Job) (envelope, error) {
+	var remote data.CatalogFingerprint
+	err := json.Unmarshal(job.Payload, &remote)
+	if err != nil {
+		return nil, err
+	}
+	local, err := app.models.Catalog.Fingerprint(ctx, app.config.env, app.jobProgress(job))
+	if err != nil {
+		return nil, err
+	}
+	return envelope{
+		"local":  envelope{"environment": local.Environment, "books": local.Books, "hash": local.Hash, "id_strategy": local.IDStrategy},
+		"remote": envelope{"environment": remote.Environment, "books": len(remote.Entries), "hash": remote.Hash, "id_strategy": remote.IDStrategy},
+		"diff":   data.DiffCatalogs(local, &remote),
+	}, nil
+}
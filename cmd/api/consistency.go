@@ -0,0 +1,83 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentWriters records when each user last made a change.
+type recentWriters struct {
+	mu    sync.Mutex
+	users map[int64]time.Time
+}
+
+func (rw *recentWriters) add(userID int64) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.users == nil {
+		rw.users = make(map[int64]time.Time)
+	}
+	rw.users[userID] = time.Now()
+}
+
+// wroteWithin reports whether the user made a change in the last d.
+func (rw *recentWriters) wroteWithin(userID int64, d time.Duration) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	last, ok := rw.users[userID]
+	return ok && time.Since(last) < d
+}
+
+// prune forgets writes made more than d ago.
+func (rw *recentWriters) prune(d time.Duration) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for userID, last := range rw.users {
+		if time.Since(last) > d {
+			delete(rw.users, userID)
+		}
+	}
+}
+
+// readYourWrites decides whether a request's reads may go to the read replica. They
+// go to the primary when:
+//
+//   - the request changes something (anything other than GET, HEAD or OPTIONS);
+//   - the user made a change within the last -db-replica-stickiness; or
+//   - the client asks for it with an "X-Consistency: strong" header, for example
+//     when another instance handled its write.
+//
+// It must run after authenticate() so that the user is known. The recent writes are
+// only tracked per instance, which is what the header is for.
+func (app *application) readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.db.replicaDSN == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		primary := r.Header.Get("X-Consistency") == "strong"
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if !user.IsAnonymous() && app.writers.wroteWithin(user.ID, app.config.db.replicaStickiness) {
+				primary = true
+			}
+		default:
+			primary = true
+			if !user.IsAnonymous() {
+				app.writers.add(user.ID)
+			}
+		}
+
+		if primary {
+			r = r.WithContext(data.WithPrimary(r.Context()))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
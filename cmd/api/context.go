@@ -2,6 +2,7 @@ package main
 
 import (
 	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/jwt"
 	"context"
 	"net/http"
 )
@@ -32,3 +33,70 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+const apiVersionContextKey = contextKey("apiVersion")
+
+// The contextSetAPIVersion() method returns a new copy of the request with the API
+// version that applies to it added to the context.
+func (app *application) contextSetAPIVersion(r *http.Request, version string) *http.Request {
+	ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIVersion() method returns the API version for the request, falling
+// back to the default version if the pinAPIVersion() middleware hasn't run.
+func (app *application) contextGetAPIVersion(r *http.Request) string {
+	version, ok := r.Context().Value(apiVersionContextKey).(string)
+	if !ok {
+		return defaultAPIVersion
+	}
+	return version
+}
+
+const apiKeyContextKey = contextKey("apiKey")
+
+// The contextSetAPIKey() method records that the request was authenticated with an
+// API key rather than an authentication token.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() method returns the API key used to authenticate the request,
+// or nil if there wasn't one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+const claimsContextKey = contextKey("claims")
+
+// The contextSetClaims() method records the claims of the JWT the request was
+// authenticated with.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() method returns the claims of the request's JWT, or nil if it
+// wasn't authenticated with one.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+const deviceContextKey = contextKey("device")
+
+// The contextSetDevice() method records that the request was made by a kiosk, which
+// authenticated with its device key.
+func (app *application) contextSetDevice(r *http.Request, device *data.Device) *http.Request {
+	ctx := context.WithValue(r.Context(), deviceContextKey, device)
+	return r.WithContext(ctx)
+}
+
+// The contextGetDevice() method returns the kiosk which made the request, or nil if it
+// wasn't made by one.
+func (app *application) contextGetDevice(r *http.Request) *data.Device {
+	device, _ := r.Context().Value(deviceContextKey).(*data.Device)
+	return device
+}
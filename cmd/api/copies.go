@@ -0,0 +1,293 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// copySortSafelist are the sort values accepted when looking up copies.
+var copySortSafelist = []string{"call_number", "shelf", "barcode", "id", "-call_number", "-shelf", "-barcode", "-id"}
+
+// readCopyParam fetches the copy named by the :id parameter. If it can't be fetched an
+// error response is sent and nil is returned.
+func (app *application) readCopyParam(w http.ResponseWriter, r *http.Request) *data.Copy {
+	id, err := app.resolveCopyIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	c, err := app.models.Copies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return c
+}
+
+// createCopyHandler adds a physical copy of the book, shelved at the given location.
+func (app *application) createCopyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveBookIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Book.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Barcode    string `json:"barcode"`
+		Branch     string `json:"branch"`
+		Room       string `json:"room"`
+		Shelf      string `json:"shelf"`
+		CallNumber string `json:"call_number"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	c := &data.Copy{
+		BookID:     id,
+		Barcode:    input.Barcode,
+		Branch:     input.Branch,
+		Room:       input.Room,
+		Shelf:      input.Shelf,
+		CallNumber: input.CallNumber,
+	}
+
+	v := validator.New()
+	if data.ValidateCopy(v, c, app.locations); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Copies.Insert(c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBarcode):
+			v.AddError("barcode", "a copy with this barcode already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownBranch):
+			v.AddError("branch", "branch does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/copies/%d", c.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"copy": c}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listBookCopiesHandler lists the copies of a book and where to find them.
+func (app *application) listBookCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveBookIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Book.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	copies, err := app.models.Copies.GetForBooks(r.Context(), []int64{id})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	list := copies[id]
+	if list == nil {
+		list = []*data.Copy{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"copies": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCopyHandler(w http.ResponseWriter, r *http.Request) {
+	c := app.readCopyParam(w, r)
+	if c == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"copy": c}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCopyHandler changes a copy's barcode or moves it to another location.
+func (app *application) updateCopyHandler(w http.ResponseWriter, r *http.Request) {
+	c := app.readCopyParam(w, r)
+	if c == nil {
+		return
+	}
+
+	var input struct {
+		Barcode    *string `json:"barcode"`
+		Branch     *string `json:"branch"`
+		Room       *string `json:"room"`
+		Shelf      *string `json:"shelf"`
+		CallNumber *string `json:"call_number"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Barcode != nil {
+		c.Barcode = *input.Barcode
+	}
+	if input.Branch != nil {
+		c.Branch = *input.Branch
+	}
+	if input.Room != nil {
+		c.Room = *input.Room
+	}
+	if input.Shelf != nil {
+		c.Shelf = *input.Shelf
+	}
+	if input.CallNumber != nil {
+		c.CallNumber = *input.CallNumber
+	}
+
+	v := validator.New()
+	if data.ValidateCopy(v, c, app.locations); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Copies.Update(c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateBarcode):
+			v.AddError("barcode", "a copy with this barcode already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownBranch):
+			v.AddError("branch", "branch does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"copy": c}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCopyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveCopyIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Copies.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "copy successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// findCopiesHandler looks copies up by location, for staff finding books on the
+// shelves. ?call_number= matches call numbers starting with the value.
+func (app *application) findCopiesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+
+	lookup := data.CopyLookup{
+		Branch:     app.readString(qs, "branch", ""),
+		Room:       app.readString(qs, "room", ""),
+		Shelf:      app.readString(qs, "shelf", ""),
+		CallNumber: app.readString(qs, "call_number", ""),
+	}
+	v.Check(lookup.Branch != "" || lookup.CallNumber != "", "branch", "a branch or call number must be provided")
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "call_number"),
+		SortSafelist: copySortSafelist,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	copies, metadata, err := app.models.Copies.Find(lookup, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"copies": copies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLocationsHandler returns the location taxonomy copies are validated against, so
+// clients can offer the branches, rooms and shelves to choose from.
+func (app *application) showLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	locations := app.locations
+	if locations == nil {
+		locations = &data.LocationTaxonomy{Branches: []data.BranchLocations{}}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"locations": locations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/mailer"
+	"books.reading.kz/internal/validator"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// linkTemplates are the emails with a one-time link in them. Their bodies aren't kept
+// when they're dead-lettered, so the tokens in the links aren't stored at rest; the
+// user asks for a new one instead.
+var linkTemplates = map[string]bool{
+	"user_welcome.tmpl":  true,
+	"email_change.tmpl":  true,
+	"new_device.tmpl":    true,
+	"weekly_digest.tmpl": true,
+}
+
+// deadLetterMail records an email which couldn't be sent after every retry, so it
+// isn't lost and can be resent by an admin once the mail server is back. A read-only
+// server can only log it. Attachments aren't kept, so a resent email goes without
+// them; the log says how many were dropped.
+func (app *application) deadLetterMail(f mailer.Failure) {
+	properties := map[string]string{
+		"template":   f.Template,
+		"message_id": f.Message.MessageID,
+		"attempts":   strconv.Itoa(f.Attempts),
+	}
+	if n := len(f.Message.Attachments); n > 0 {
+		properties["attachments_dropped"] = strconv.Itoa(n)
+	}
+	if app.config.readOnly {
+		app.logger.PrintError(fmt.Errorf("email not sent: %w", f.Err), properties)
+		return
+	}
+
+	letter := &data.DeadLetter{
+		Recipient: f.Message.To,
+		Sender:    f.Message.From,
+		Template:  f.Template,
+		Subject:   f.Message.Subject,
+		PlainBody: f.Message.PlainBody,
+		HTMLBody:  f.Message.HTMLBody,
+		Attempts:  f.Attempts,
+		Error:     f.Err.Error(),
+	}
+	if linkTemplates[f.Template] {
+		letter.PlainBody, letter.HTMLBody, letter.Redacted = "", "", true
+	}
+	err := app.models.DeadLetters.Insert(letter)
+	if err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+	properties["dead_letter_id"] = strconv.FormatInt(letter.ID, 10)
+	app.logger.PrintError(fmt.Errorf("email dead-lettered: %w", f.Err), properties)
+}
+
+// listDeadLettersHandler lists emails which couldn't be sent, newest first. With
+// pending=true it leaves out those which have since been resent.
+func (app *application) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	pending := app.readBool(qs, "pending", v)
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-id",
+		SortSafelist: []string{"-id"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	letters, metadata, err := app.models.DeadLetters.GetAll(pending != nil && *pending, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dead_letters": letters, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resendDeadLetterHandler queues one more attempt to send a dead-lettered email, as a
+// dead_letter_resend job, so the request doesn't wait for the mail quota or the mail
+// server. The dead letter is claimed first, so that it's only sent once however many
+// times it's resent at once. If it fails again the job reports the error and the dead
+// letter goes back to pending.
+func (app *application) resendDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	letter, err := app.models.DeadLetters.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if letter.Redacted {
+		app.stateConflictResponse(w, r, "this email had a one-time link in it, so it wasn't kept; the user must ask for a new one")
+		return
+	}
+
+	letter, err = app.models.DeadLetters.Claim(letter.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.stateConflictResponse(w, r, "this email has already been resent")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	payload, err := json.Marshal(deadLetterResend{DeadLetterID: letter.ID})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	job := &data.Job{Kind: "dead_letter_resend", UserID: app.contextGetUser(r).ID, Payload: payload}
+	err = app.enqueueJob(job)
+	if err != nil {
+		if err := app.models.DeadLetters.Release(letter.ID); err != nil {
+			app.logError(r, err)
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"dead_letter": letter, "job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deprecation describes a route, or some of its query string parameters, which are
+// going away. If Params and NumericID are empty the whole route is deprecated and the
+// response gets Deprecation (RFC 9745), Sunset (RFC 8594) and Link headers. Otherwise
+// only requests using one of the listed parameters, or a numeric :id, are warned
+// about.
+type deprecation struct {
+	Since   time.Time
+	Sunset  time.Time
+	Link    string
+	Message string
+	Params  map[string]string
+	// NumericID is the warning for requests which name the resource in the :id
+	// parameter by its numeric ID instead of its external ID.
+	NumericID string
+}
+
+// deprecations holds the deprecation metadata for our routes. Entries are applied
+// automatically when the matching route is registered on a routeTable.
+var deprecations = map[route]deprecation{
+	{method: http.MethodGet, path: "/v1/books"}: {
+		Params: map[string]string{
+			"content": "the content parameter has no effect and will be removed, use q for full-text search instead",
+		},
+	},
+}
+
+// numericIDRoutes accept an external ID in their :id parameter. Numeric IDs still work
+// there, but are deprecated since JavaScript clients can't represent the larger ones.
+var numericIDRoutes = []route{
+	{method: http.MethodGet, path: "/v1/books/:id"},
+	{method: http.MethodPatch, path: "/v1/books/:id"},
+	{method: http.MethodDelete, path: "/v1/books/:id"},
+	{method: http.MethodGet, path: "/v1/books/:id/copies"},
+	{method: http.MethodPost, path: "/v1/books/:id/copies"},
+	{method: http.MethodPost, path: "/v1/books/:id/sessions"},
+	{method: http.MethodGet, path: "/v1/copies/:id"},
+	{method: http.MethodPatch, path: "/v1/copies/:id"},
+	{method: http.MethodDelete, path: "/v1/copies/:id"},
+	{method: http.MethodPost, path: "/v1/reading-sessions/:id/stop"},
+	{method: http.MethodGet, path: "/v1/lists/:id"},
+	{method: http.MethodPatch, path: "/v1/lists/:id"},
+	{method: http.MethodDelete, path: "/v1/lists/:id"},
+	{method: http.MethodPost, path: "/v1/lists/:id/items"},
+	{method: http.MethodDelete, path: "/v1/lists/:id/items/:bookID"},
+	{method: http.MethodPatch, path: "/v1/lists/:id/items/:bookID/position"},
+	{method: http.MethodGet, path: "/v1/list-templates/:id"},
+	{method: http.MethodPost, path: "/v1/list-templates/:id/clone"},
+	{method: http.MethodGet, path: "/v1/loans/:id/receipt"},
+	{method: http.MethodPost, path: "/v1/loans/:id/receipt"},
+	{method: http.MethodGet, path: "/v1/librarian/loans/:id/escalations"},
+	{method: http.MethodPost, path: "/v1/librarian/loans/:id/forgive"},
+	{method: http.MethodPut, path: "/v1/librarian/loans/:id/due-date"},
+	{method: http.MethodGet, path: "/v1/users/:id"},
+	{method: http.MethodPut, path: "/v1/librarian/users/:id/card"},
+	{method: http.MethodGet, path: "/v1/admin/users/:id/roles"},
+	{method: http.MethodPost, path: "/v1/admin/users/:id/roles"},
+	{method: http.MethodDelete, path: "/v1/admin/users/:id/roles/:role"},
+	{method: http.MethodPost, path: "/v1/admin/users/:id/impersonate"},
+	{method: http.MethodGet, path: "/v1/admin/users/:id/permissions"},
+	{method: http.MethodPut, path: "/v1/admin/users/:id/permissions"},
+	{method: http.MethodDelete, path: "/v1/admin/users/:id/permissions"},
+}
+
+func init() {
+	for _, r := range numericIDRoutes {
+		d := deprecations[r]
+		d.NumericID = "numeric IDs in URLs are deprecated, use the external_id instead"
+		deprecations[r] = d
+	}
+}
+
+// warningWriter wraps an http.ResponseWriter and collects warnings which writeJSON()
+// adds to the response body.
+type warningWriter struct {
+	http.ResponseWriter
+	warnings []string
+}
+
+func (ww *warningWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+// addWarning records a warning to be sent to the client. It does nothing if the
+// response writer wasn't wrapped by the deprecated() middleware.
+func addWarning(w http.ResponseWriter, message string) {
+	if ww, ok := w.(*warningWriter); ok {
+		ww.warnings = append(ww.warnings, message)
+	}
+}
+
+func (d deprecation) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww, ok := w.(*warningWriter)
+		if !ok {
+			ww = &warningWriter{ResponseWriter: w}
+		}
+
+		if len(d.Params) == 0 && d.NumericID == "" {
+			if d.Since.IsZero() {
+				ww.Header().Set("Deprecation", "true")
+			} else {
+				ww.Header().Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+			}
+			if !d.Sunset.IsZero() {
+				ww.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if d.Link != "" {
+				ww.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", d.Link))
+			}
+
+			message := d.Message
+			if message == "" {
+				message = fmt.Sprintf("%s %s is deprecated", r.Method, r.URL.Path)
+			}
+			if !d.Sunset.IsZero() {
+				message = fmt.Sprintf("%s and will be removed on %s", message, d.Sunset.Format("2006-01-02"))
+			}
+			addWarning(ww, message)
+		}
+
+		qs := r.URL.Query()
+		for param, message := range d.Params {
+			if qs.Has(param) {
+				addWarning(ww, message)
+			}
+		}
+
+		if d.NumericID != "" {
+			// Snowflake external IDs are numeric too, but much larger than numeric IDs.
+			id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+			_, err := strconv.ParseInt(id, 10, 64)
+			if err == nil && !data.IsExternalID(id) {
+				addWarning(ww, d.NumericID)
+			}
+		}
+
+		next.ServeHTTP(ww, r)
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/mailer"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
+
+// sendDigests emails the digest to every user who is due one. Users with nothing
+// new in their followed genres and no reading to report are skipped, but still marked
+// as sent so they're not checked again until their next digest is due.
+func (app *application) sendDigests() {
+	for {
+		recipients, err := app.models.Digests.GetDue(100)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		if len(recipients) == 0 {
+			return
+		}
+
+		for _, recipient := range recipients {
+			select {
+			case <-app.done:
+				return
+			default:
+			}
+
+			err := app.sendDigest(recipient)
+			var overQuota *mailer.OverQuotaError
+			if errors.As(err, &overQuota) {
+				// The rest are left due until the next run, when there's room for them.
+				app.logger.PrintInfo("digests paused, the mail quota is used up", map[string]string{"retry_after": overQuota.RetryAfter.Round(time.Second).String()})
+				return
+			}
+			if err != nil {
+				// Leave the user due, but stop this run so a broken mailer doesn't make
+				// us spin through everyone.
+				app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(recipient.UserID)})
+				return
+			}
+		}
+	}
+}
+
+// unsubscribeTokenTTL is how long the unsubscribe link in a digest works. Each digest
+// replaces the link in the one before.
+const unsubscribeTokenTTL = 60 * 24 * time.Hour
+
+// sendDigest emails the user the books added in their followed genres and the
+// reading they've done since their last digest, with a link to unsubscribe. The link
+// is also in the List-Unsubscribe header, which mail clients show as an unsubscribe
+// button that posts to it without opening a browser.
+func (app *application) sendDigest(recipient *data.DigestRecipient) error {
+	now := time.Now()
+
+	books, err := app.models.Digests.GetNewBooks(recipient.UserID, recipient.Since, 20)
+	if err != nil {
+		return err
+	}
+	progress, err := app.models.Digests.GetProgress(recipient.UserID, recipient.Since)
+	if err != nil {
+		return err
+	}
+
+	if len(books) > 0 || progress.Sessions > 0 {
+		streak, err := app.models.ReadingSessions.GetStreak(recipient.UserID, recipient.Timezone)
+		if err != nil {
+			return err
+		}
+		token, err := app.models.Tokens.Replace(recipient.UserID, unsubscribeTokenTTL, data.ScopeUnsubscribe)
+		if err != nil {
+			return err
+		}
+
+		unsubscribeURL := app.config.baseURL + "/v1/users/digest/unsubscribe/" + token.Plaintext
+		tmplData := map[string]any{
+			"name":           recipient.Name,
+			"books":          books,
+			"progress":       progress,
+			"streak":         streak,
+			"since":          recipient.Since.Format("2 January"),
+			"sinceDate":      recipient.Since,
+			"unsubscribeURL": unsubscribeURL,
+		}
+		headers := map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+		err = app.mailer.Bulk().WithHeaders(headers).SendLocalized(recipient.Email, app.userLanguage(recipient.UserID), "weekly_digest.tmpl", tmplData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.models.Digests.MarkSent(recipient.UserID, now)
+}
+
+// unsubscribeDigestHandler turns off the digest of the user the unsubscribe token from
+// one was sent to, without them having to log in. The token isn't used up, so a link
+// followed twice works both times.
+func (app *application) unsubscribeDigestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeUnsubscribe, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unsubscribe token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Digests.Unsubscribe(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been unsubscribed from the reading digest"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUnsubscribeDigestPageHandler is where the unsubscribe link in a digest opens. It
+// only asks the user to confirm, which posts to unsubscribeDigestLinkHandler.
+func (app *application) showUnsubscribeDigestPageHandler(w http.ResponseWriter, r *http.Request) {
+	app.writePage(w, r, http.StatusOK, page{
+		Title:   "Unsubscribe from the reading digest",
+		Message: "You won't be sent the weekly reading digest any more. You can turn it back on in your notification settings.",
+		Button:  "Unsubscribe",
+	})
+}
+
+// unsubscribeDigestLinkHandler unsubscribes the user the digest was sent to, when
+// they confirm on the unsubscribe page or their mail client posts to the link in the
+// List-Unsubscribe header. The token isn't used up, so doing both works.
+func (app *application) unsubscribeDigestLinkHandler(w http.ResponseWriter, r *http.Request) {
+	plaintext := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	var user *data.User
+	err := data.ErrRecordNotFound
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, plaintext); v.Valid() {
+		user, err = app.models.Users.GetForToken(data.ScopeUnsubscribe, plaintext)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && wantsHTML(r):
+			app.writePage(w, r, http.StatusUnprocessableEntity, page{
+				Title:   "Unsubscribe from the reading digest",
+				Message: "This link is invalid or has expired. You can turn the digest off in your notification settings.",
+			})
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unsubscribe token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Digests.Unsubscribe(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wantsHTML(r) {
+		app.writePage(w, r, http.StatusOK, page{
+			Title:   "Unsubscribed",
+			Message: "You have been unsubscribed from the reading digest.",
+		})
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been unsubscribed from the reading digest"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Digests.GetPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateNotificationPreferencesHandler partially updates the user's notification
+// preferences. followed_genres replaces the whole list when it's sent.
+func (app *application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WeeklyDigest   *bool    `json:"weekly_digest"`
+		FollowedGenres []string `json:"followed_genres"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Digests.GetPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.WeeklyDigest != nil {
+		prefs.WeeklyDigest = *input.WeeklyDigest
+	}
+	if input.FollowedGenres != nil {
+		prefs.FollowedGenres = input.FollowedGenres
+	}
+
+	v := validator.New()
+	if data.ValidateNotificationPreferences(v, prefs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Digests.UpdatePreferences(user.ID, prefs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -33,6 +35,11 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since you fetched it, please fetch the latest version and try again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
 	app.errorResponse(w, r, http.StatusNotFound, message)
@@ -56,11 +63,62 @@ func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *htt
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// twoFactorRequiredResponse is sent when the password was right but the user has
+// two-factor authentication enabled and didn't send a code.
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a two-factor authentication code is required"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// twoFactorChallengeResponse is sent when a social login succeeded but the user has
+// two-factor authentication enabled. The challenge token is sent with a code to POST
+// /v1/tokens/two-factor to finish logging in.
+func (app *application) twoFactorChallengeResponse(w http.ResponseWriter, r *http.Request, challenge string) {
+	env := envelope{
+		"error":            "a two-factor authentication code is required",
+		"two_factor_token": challenge,
+	}
+	err := app.writeJSON(w, http.StatusUnauthorized, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reauthenticationRequiredResponse is sent when the user is logged in, but not
+// recently enough to be trusted with changing how they log in.
+func (app *application) reauthenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must log in again to do this"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// accountLockedResponse is sent when logins for the account are blocked after too many
+// failures. Retry-After tells the client when they can try again.
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, lockedUntil time.Time) {
+	seconds := int(time.Until(lockedUntil).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := "too many failed login attempts, your account is temporarily locked"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// activationRateLimitedResponse is sent when an activation email was sent to the
+// account too recently to send another.
+func (app *application) activationRateLimitedResponse(w http.ResponseWriter, r *http.Request, retryAt time.Time) {
+	seconds := int(time.Until(retryAt).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := "an activation email was sent recently, please wait before asking for another"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) readOnlyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this server is read-only and can't make changes, please try again later or use the main API"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	message := "invalid or missing authentication token"
@@ -76,7 +134,58 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+// deviceRequiredResponse is sent when a kiosk endpoint is called without a device key.
+func (app *application) deviceRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Device")
+	message := "this resource can only be used by a registered kiosk"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// kioskErrorResponse is sent when a kiosk can't complete a checkout or return. The code
+// is stable so that the kiosk can show its own message for each case.
+func (app *application) kioskErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	env := envelope{"error": message, "code": code}
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (app *application) accountFrozenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been frozen and can't be logged in to or changed, please contact the library"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// stateConflictResponse is used when a job or campaign isn't in a state which allows
+// the requested action.
+func (app *application) stateConflictResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// routeNotFoundResponse is used when no route matches the request. If there are
+// routes which are a near miss for the requested URL they are included in the response
+// to help the client spot the typo.
+func (app *application) routeNotFoundResponse(w http.ResponseWriter, r *http.Request, suggestions []string) {
+	if len(suggestions) == 0 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	env := envelope{
+		"error":       "the requested resource could not be found",
+		"hint":        fmt.Sprintf("%s - did you mean %s?", r.URL.Path, suggestions[0]),
+		"suggestions": suggestions,
+	}
+
+	err := app.writeJSON(w, http.StatusNotFound, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// runEscalations takes each escalation step for the loans it's due for, emailing the
+// member with the step's template. Reminders and overdue notices are skipped for
+// loans which the following step is already due for, so a member whose loan was
+// missed for a while isn't sent a pile of stale emails at once.
+func (app *application) runEscalations() {
+	steps := app.config.escalation.steps
+	for i, step := range steps {
+		var next *data.EscalationStep
+		if step.NotifyOnly() && i+1 < len(steps) {
+			next = &steps[i+1]
+		}
+		if !app.runEscalationStep(step, next) {
+			return
+		}
+	}
+}
+
+// runEscalationStep takes step for every loan it's due for. It returns false if the
+// run should stop, because the server is shutting down or something went wrong.
+func (app *application) runEscalationStep(step data.EscalationStep, next *data.EscalationStep) bool {
+	for {
+		notices, err := app.models.Escalations.GetDue(step, next, 100)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return false
+		}
+		if len(notices) == 0 {
+			return true
+		}
+
+		for _, notice := range notices {
+			select {
+			case <-app.done:
+				return false
+			default:
+			}
+
+			err := app.escalate(step, notice)
+			if err != nil {
+				// The email is retried on a later run, but stop this one so a broken
+				// mailer doesn't make us spin through every loan.
+				app.logger.PrintError(err, map[string]string{"loan_id": fmt.Sprint(notice.LoanID), "step": step.Name})
+				return false
+			}
+		}
+	}
+}
+
+func (app *application) escalate(step data.EscalationStep, notice *data.EscalationNotice) error {
+	var amount int64
+	if step.Name == data.EscalationInvoice {
+		amount = int64(notice.ReplacementFee)
+	}
+
+	claimed, err := app.models.Escalations.Claim(notice.LoanID, step.Name, amount)
+	if err != nil || !claimed {
+		return err
+	}
+
+	dueAt := notice.DueAt
+	if loc, err := time.LoadLocation(notice.Timezone); err == nil {
+		dueAt = dueAt.In(loc)
+	}
+	tmplData := map[string]any{
+		"name":   notice.Name,
+		"title":  notice.Title,
+		"branch": notice.Branch,
+		"due":    dueAt.Format("2 January 2006"),
+		"amount": fmt.Sprintf("%d.%02d %s", amount/100, amount%100, app.config.currency),
+	}
+	// If the email fails the step stays taken, so a block or invoice isn't lifted,
+	// and the email is retried once the claim has aged.
+	err = app.mailer.SendLocalized(notice.Email, app.userLanguage(notice.UserID), step.Template(), tmplData)
+	if err != nil {
+		return err
+	}
+	return app.models.Escalations.MarkNotified(notice.LoanID, step.Name)
+}
+
+// checkNotBlocked sends a response and returns false if the member has been blocked
+// from borrowing for a long overdue loan. Kiosk checkouts are refused by
+// Loans.Checkout itself; anything else which lends to a member checks here first.
+func (app *application) checkNotBlocked(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	blocked, err := app.models.Escalations.IsBlocked(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "borrowing is blocked until a long overdue item is returned or the loan is forgiven")
+		return false
+	}
+	return true
+}
+
+// writeLoanEscalations sends the loan with the escalation steps taken for it.
+func (app *application) writeLoanEscalations(w http.ResponseWriter, r *http.Request, loan *data.Loan) {
+	escalations, err := app.models.Escalations.GetForLoan(loan.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"loan": loan, "escalations": escalations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLoanEscalationsHandler shows staff which escalation steps have been taken for a loan.
+func (app *application) showLoanEscalationsHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+	app.writeLoanEscalations(w, r, loan)
+}
+
+// forgiveLoanHandler lets staff stop escalating an open loan, which lifts any block on
+// the member and voids any replacement invoice for it.
+func (app *application) forgiveLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	var input struct {
+		Note string `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(len(input.Note) <= 500, "note", "must not be more than 500 bytes long"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Escalations.Forgive(loan, app.contextGetUser(r).ID, input.Note)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotOnLoan):
+			app.stateConflictResponse(w, r, "the loan has already been returned or forgiven")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeLoanEscalations(w, r, loan)
+}
+
+// updateLoanDueDateHandler lets staff override an open loan's due date. Steps which
+// have been taken but aren't due under the new date are undone, so extending a loan
+// lifts a block and taking it back in brings the reminders forward.
+func (app *application) updateLoanDueDateHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	var input struct {
+		DueAt time.Time `json:"due_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(!input.DueAt.IsZero(), "due_at", "must be provided")
+	v.Check(input.DueAt.After(loan.CheckedOutAt), "due_at", "must be after the loan was checked out")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Escalations.Reschedule(loan, input.DueAt, app.config.escalation.steps)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotOnLoan):
+			app.stateConflictResponse(w, r, "the loan has already been returned or forgiven")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeLoanEscalations(w, r, loan)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"context"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// bookExpander loads extra data for a page of books. Each expander must only write to
+// its own fields on the books, as expanders run concurrently.
+type bookExpander func(app *application, ctx context.Context, books []*data.Book, ids []int64) error
+
+// bookExpansions holds the values accepted by the ?expand= query string parameter on
+// the book endpoints.
+var bookExpansions = map[string]bookExpander{
+	"availability": func(app *application, ctx context.Context, books []*data.Book, ids []int64) error {
+		availability, err := app.models.Branches.GetAvailability(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			book.Availability = availability[book.ID]
+		}
+		return nil
+	},
+	"copies": func(app *application, ctx context.Context, books []*data.Book, ids []int64) error {
+		copies, err := app.models.Copies.GetForBooks(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			book.Copies = copies[book.ID]
+		}
+		return nil
+	},
+	"previous_slugs": func(app *application, ctx context.Context, books []*data.Book, ids []int64) error {
+		slugs, err := app.models.Book.GetPreviousSlugs(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			book.PreviousSlugs = slugs[book.ID]
+		}
+		return nil
+	},
+	"similar": func(app *application, ctx context.Context, books []*data.Book, ids []int64) error {
+		similar, err := app.models.Book.GetSimilar(ctx, ids, 3)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			book.Similar = similar[book.ID]
+		}
+		return nil
+	},
+}
+
+// readExpand reads the comma separated ?expand= parameter, adding a validation error
+// for any unknown values.
+func (app *application) readExpand(r *http.Request, v *validator.Validator) []string {
+	expand := app.readCSV(r.URL.Query(), "expand", nil)
+
+	permitted := make([]string, 0, len(bookExpansions))
+	for name := range bookExpansions {
+		permitted = append(permitted, name)
+	}
+	sort.Strings(permitted)
+
+	for _, name := range expand {
+		v.Check(validator.PermittedValue(name, permitted...), "expand", "must be a comma separated list of: "+strings.Join(permitted, ", "))
+	}
+	v.Check(validator.Unique(expand), "expand", "must not contain duplicate values")
+	return expand
+}
+
+// expandBooks runs the requested expansions concurrently. At most
+// app.config.expand.parallelism queries run at once, and they all share a context
+// which is cancelled as soon as one of them fails.
+func (app *application) expandBooks(ctx context.Context, books []*data.Book, expand []string) error {
+	if len(books) == 0 || len(expand) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(app.config.expand.parallelism)
+
+	for _, name := range expand {
+		expander := bookExpansions[name]
+		g.Go(func() error {
+			return expander(app, ctx, books, ids)
+		})
+	}
+
+	return g.Wait()
+}
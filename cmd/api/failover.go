@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// targetSessionAttrs maps the values accepted by -db-target-session-attrs to the
+// pgconn functions which check a new connection. They're the same as libpq's
+// target_session_attrs.
+var targetSessionAttrs = map[string]pgconn.ValidateConnectFunc{
+	"any":            nil,
+	"read-write":     pgconn.ValidateConnectTargetSessionAttrsReadWrite,
+	"read-only":      pgconn.ValidateConnectTargetSessionAttrsReadOnly,
+	"primary":        pgconn.ValidateConnectTargetSessionAttrsPrimary,
+	"standby":        pgconn.ValidateConnectTargetSessionAttrsStandby,
+	"prefer-standby": pgconn.ValidateConnectTargetSessionAttrsPreferStandby,
+}
+
+// needsPrimary reports whether the configured session attributes require a
+// connection to the primary.
+func (cfg config) needsPrimary() bool {
+	return cfg.db.targetSessionAttrs == "read-write" || cfg.db.targetSessionAttrs == "primary"
+}
+
+// configureFailover sets up the pool so that it follows a primary switchover. With
+// several hosts in the DSN (host=a,b or postgres://a,b/db), new connections are
+// checked against the target session attributes and skip servers which don't match.
+// Connections to a server which has since become a standby are dropped rather than
+// handed out. A target_session_attrs set in the DSN takes precedence over the flag.
+func configureFailover(cfg config, poolConfig *pgxpool.Config) error {
+	validate, ok := targetSessionAttrs[cfg.db.targetSessionAttrs]
+	if !ok {
+		return fmt.Errorf("invalid -db-target-session-attrs value %q", cfg.db.targetSessionAttrs)
+	}
+	if poolConfig.ConnConfig.ValidateConnect == nil {
+		poolConfig.ConnConfig.ValidateConnect = validate
+	}
+
+	if cfg.db.healthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = cfg.db.healthCheckPeriod
+	}
+
+	if cfg.needsPrimary() {
+		// PostgreSQL 14 and later report in_hot_standby to the client whenever it
+		// changes, so a demoted primary can be spotted without a round trip.
+		poolConfig.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			return conn.PgConn().ParameterStatus("in_hot_standby") != "on"
+		}
+	}
+	return nil
+}
+
+// watchPrimary periodically checks that the pool is still connected to a primary. If
+// the server has been demoted, or can't be reached at all, every connection is closed
+// so that the pool reconnects, picking the new primary from the hosts in the DSN.
+func (app *application) watchPrimary(db *pgxpool.Pool) {
+	if !app.config.needsPrimary() || app.config.db.healthCheckPeriod <= 0 {
+		return
+	}
+
+	app.periodic(app.config.db.healthCheckPeriod, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var inRecovery bool
+		err := db.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+		switch {
+		case err != nil:
+			app.logger.PrintError(err, map[string]string{"action": "resetting database connection pool"})
+			db.Reset()
+		case inRecovery:
+			app.logger.PrintInfo("database server is no longer the primary, resetting connection pool", nil)
+			db.Reset()
+		}
+	})
+}
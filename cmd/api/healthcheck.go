@@ -1,16 +1,26 @@
 package main
 
 import (
+	"expvar"
+	"fmt"
 	"net/http"
 )
 
+// healthcheckHandler reports whether the server is available. It's degraded if the
+// database schema didn't match the code at startup and the server is only serving
+// reads because of it.
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	status := "available"
+	if !app.schema.Compatible {
+		status = "degraded"
+	}
 	env := envelope{
-		"status": "available",
+		"status": status,
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
 		},
+		"schema": app.schema,
 	}
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
@@ -18,3 +28,37 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readinessHandler tells load balancers whether to send the server traffic yet. It
+// responds 503 until the warm-up is done, if -warmup is on.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+	if !app.ready.Load() {
+		status, code = "warming up", http.StatusServiceUnavailable
+	}
+	err := app.writeJSON(w, code, envelope{"status": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// metricsHandler publishes the expvar metrics, such as the integrity findings and
+// mail and permission cache counters, to admins. It's expvar.Handler without the
+// cmdline variable, which has the database DSN, SMTP password and bootstrap token in
+// it when they're passed as flags.
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/jsoncase"
 	"books.reading.kz/internal/validator"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type envelope map[string]any
@@ -31,14 +36,79 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// resolveBookIDParam reads the "id" URL parameter of a book route, which can be either
+// the book's numeric ID or its external ID.
+func (app *application) resolveBookIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.Book.ResolveExternalID)
+}
+
+// resolveUserIDParam is resolveBookIDParam for user routes.
+func (app *application) resolveUserIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.Users.ResolveExternalID)
+}
+
+// resolveCopyIDParam is resolveBookIDParam for copy routes.
+func (app *application) resolveCopyIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.Copies.ResolveExternalID)
+}
+
+// resolveListIDParam is resolveBookIDParam for reading list and template routes.
+func (app *application) resolveListIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.ReadingLists.ResolveExternalID)
+}
+
+// resolveSessionIDParam is resolveBookIDParam for reading session routes.
+func (app *application) resolveSessionIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.ReadingSessions.ResolveExternalID)
+}
+
+// resolveLoanIDParam is resolveBookIDParam for loan routes.
+func (app *application) resolveLoanIDParam(r *http.Request) (int64, error) {
+	return app.resolveIDParam(r, app.models.Loans.ResolveExternalID)
+}
+
+func (app *application) resolveIDParam(r *http.Request, resolve func(string) (int64, error)) (int64, error) {
+	param := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if !data.IsExternalID(param) {
+		return app.readIDParam(r)
+	}
+	return resolve(param)
+}
+
+// clientIP returns the IP address the request came from.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	return app.readJSONLimit(w, r, dst, 1_048_576)
+}
 
-	maxBytes := 1_048_576
+// readJSONLimit is readJSON for the few endpoints which accept bodies bigger than
+// the usual 1MB.
+func (app *application) readJSONLimit(w http.ResponseWriter, r *http.Request, dst any, maxBytes int) error {
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-	dec := json.NewDecoder(r.Body)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		}
+		return err
+	}
+	// Bodies can use camelCase keys, like the responses can. Badly-formed JSON is
+	// left as it is, so the errors below point at the right character.
+	if snake, err := jsoncase.Snake(body); err == nil {
+		body = snake
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
 	dec.DisallowUnknownFields()
 
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 	if err != nil {
 
 		var syntaxError *json.SyntaxError
@@ -86,10 +156,23 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 }
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+	// Include any deprecation warnings collected for this request.
+	if ww, ok := w.(*warningWriter); ok && len(ww.warnings) > 0 {
+		data["warnings"] = ww.warnings
+	}
+
+	start := time.Now()
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
 		return err
 	}
+	if responseCasing(w) == caseCamel {
+		js, err = jsoncase.Camel(js, "\t")
+		if err != nil {
+			return err
+		}
+	}
+	recordTiming(w, "encode", time.Since(start))
 	js = append(js, '\n')
 	for key, value := range headers {
 		w.Header()[key] = value
@@ -102,6 +185,28 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// ifMatch reports whether the request's If-Match header allows it to modify a record
+// with the given version. Requests without the header always match, so the header is
+// optional for clients.
+func (app *application) ifMatch(r *http.Request, version string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || strings.Trim(tag, `"`) == version {
+			return true
+		}
+	}
+	return false
+}
+
+// etag returns the ETag header value for a record with the given version.
+func etag(version string) string {
+	return strconv.Quote(version)
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 
 	s := qs.Get(key)
@@ -137,6 +242,24 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool reads an optional boolean from the query string. It returns nil if the key
+// isn't present, and records a validation error if the value can't be parsed.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
@@ -153,3 +276,28 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The periodic() helper runs fn every interval in a background goroutine until the
+// done channel is closed during graceful shutdown. A panic in fn is logged and does
+// not stop later runs.
+func (app *application) periodic(interval time.Duration, fn func()) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				func() {
+					defer func() {
+						if err := recover(); err != nil {
+							app.logger.PrintError(fmt.Errorf("%s", err), nil)
+						}
+					}()
+					fn()
+				}()
+			case <-app.done:
+				return
+			}
+		}
+	})
+}
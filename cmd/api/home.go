@@ -0,0 +1,82 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// homePayload is everything the front-end needs to render the landing page.
+type homePayload struct {
+	NewArrivals []*data.BookSummary `json:"new_arrivals"`
+	Genres      []data.GenreCount   `json:"genres"`
+	ComputedAt  time.Time           `json:"computed_at"`
+}
+
+// homeCache holds the most recently computed home page payload. The payload is the
+// same for every user, so it's built in the background rather than per request.
+type homeCache struct {
+	mu      sync.RWMutex
+	payload *homePayload
+}
+
+func (hc *homeCache) get() *homePayload {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.payload
+}
+
+func (hc *homeCache) set(payload *homePayload) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.payload = payload
+}
+
+// refreshHome rebuilds the home page payload and stores it in the cache.
+func (app *application) refreshHome() (*homePayload, error) {
+	ctx := context.Background()
+
+	newArrivals, err := app.models.Book.GetNewArrivals(ctx, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	genres, err := app.models.Book.GetGenreCounts(ctx, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &homePayload{
+		NewArrivals: newArrivals,
+		Genres:      genres,
+		ComputedAt:  time.Now().UTC(),
+	}
+	app.home.set(payload)
+	return payload, nil
+}
+
+func (app *application) showHomeHandler(w http.ResponseWriter, r *http.Request) {
+	payload := app.home.get()
+	if payload == nil || app.config.home.refresh <= 0 {
+		// The first background refresh only happens one interval after startup, so
+		// the first request builds the payload itself. With caching disabled every
+		// request does.
+		var err error
+		payload, err = app.refreshHome()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(app.config.home.refresh.Seconds())))
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"home": payload}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/oauth"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
+
+// passwordLoginMethod is what the identity endpoints call logging in with an email
+// address and password, alongside the social login providers' names.
+const passwordLoginMethod = "password"
+
+// writeLoginMethods responds with the ways the user can log in.
+func (app *application) writeLoginMethods(w http.ResponseWriter, r *http.Request, user *data.User) {
+	methods, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"login_methods": methods}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listIdentitiesHandler shows whether the user can log in with their password and
+// which social login providers they've linked.
+func (app *application) listIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeLoginMethods(w, r, app.contextGetUser(r))
+}
+
+// linkIdentityHandler adds a way of logging in to the user. For "password" the body
+// is the password they want to log in with, for users who only had a social login.
+// For a provider the response is the URL of its consent page, and the provider's
+// callback links the account the user logs in with there. If that account belongs to
+// another user, such as one they registered twice, it's moved over to this one.
+func (app *application) linkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if httprouter.ParamsFromContext(r.Context()).ByName("provider") == passwordLoginMethod {
+		app.enablePassword(w, r, user)
+		return
+	}
+
+	provider := app.oauthProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	// The state is a token tying the callback to this user, so that it links the
+	// account instead of logging in with it.
+	token, err := app.models.Tokens.Replace(user.ID, oauthStateTTL, data.ScopeOAuthLink)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.setOAuthState(w, provider, token.Plaintext)
+
+	env := envelope{"authorization_url": provider.AuthCodeURL(token.Plaintext, app.oauthRedirectURI(provider))}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// enablePassword lets a user who only had a social login log in with a password too.
+// Users who already have one change it at PUT /v1/users/me/password.
+func (app *application) enablePassword(w http.ResponseWriter, r *http.Request, user *data.User) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordForUser(v, input.Password, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	methods, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if methods.Password {
+		app.stateConflictResponse(w, r, "you can already log in with a password, change it at /v1/users/me/password instead")
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Identities.EnablePassword(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventIdentityLinked, data.OutcomeSuccess, passwordLoginMethod)
+
+	app.writeLoginMethods(w, r, user)
+}
+
+// linkOAuthIdentity completes linking the provider's account to the user, for the
+// callback. The account is taken from any other user it belongs to, unless it's the
+// only way they can log in, and that user is told it has gone.
+func (app *application) linkOAuthIdentity(w http.ResponseWriter, r *http.Request, user *data.User, identity *oauth.Identity) {
+	previousID, err := app.models.Identities.Move(user.ID, identity.Provider, identity.Subject)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrLastLoginMethod):
+			app.stateConflictResponse(w, r, "this account is the only way of logging in to another user, set a password or link another account there before moving it")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	detail := identity.Provider
+	if previousID != 0 {
+		detail += fmt.Sprintf(" (moved from user %d)", previousID)
+		app.notifyIdentityMoved(r, previousID, user, identity.Provider)
+	}
+	app.recordSecurityEvent(r, user, "", data.EventIdentityLinked, data.OutcomeSuccess, detail)
+
+	app.writeLoginMethods(w, r, user)
+}
+
+// notifyIdentityMoved records that the provider's account was taken from the user
+// with the given ID and linked to another, and emails them, as they may not have been
+// the one who did it.
+func (app *application) notifyIdentityMoved(r *http.Request, previousID int64, user *data.User, provider string) {
+	previous, err := app.models.Users.Get(previousID, r)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+	app.tokenCache.invalidateUser(previous.ID)
+	app.recordSecurityEvent(r, previous, "", data.EventIdentityUnlinked, data.OutcomeSuccess,
+		fmt.Sprintf("%s (moved to user %d)", provider, user.ID))
+
+	ip := clientIP(r)
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":     previous.Name,
+			"provider": provider,
+			"movedAt":  time.Now().UTC().Format("2 January 2006 at 15:04 UTC"),
+			"ip":       ip,
+		}
+		err := app.mailer.SendLocalized(previous.Email, app.userLanguage(previous.ID), "identity_moved.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// unlinkIdentityHandler removes a way of logging in from the user: "password" stops
+// them logging in with their password, and a provider's name unlinks their accounts
+// there. It's refused if it would leave them with no way to log in.
+func (app *application) unlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	method := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+
+	var err error
+	if method == passwordLoginMethod {
+		err = app.models.Identities.DisablePassword(user.ID)
+	} else {
+		// Providers which are no longer configured can still be unlinked.
+		err = app.models.Identities.Unlink(user.ID, method)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastLoginMethod):
+			app.stateConflictResponse(w, r, "you can't remove your only way of logging in, link another one first")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventIdentityUnlinked, data.OutcomeSuccess, method)
+
+	app.writeLoginMethods(w, r, user)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// flagImpersonatedRequest logs a request made with an impersonation token and adds it
+// to the impersonated user's audit trail, so that everything the admin did as them
+// can be traced. A read-only server only logs it.
+func (app *application) flagImpersonatedRequest(r *http.Request, user *data.User) {
+	app.logger.PrintInfo("impersonated request", map[string]string{
+		"user_id":         fmt.Sprint(user.ID),
+		"impersonator_id": fmt.Sprint(user.ImpersonatorID),
+		"request_method":  r.Method,
+		"request_url":     r.URL.String(),
+	})
+	if app.config.readOnly {
+		return
+	}
+	detail := fmt.Sprintf("by user %d: %s %s", user.ImpersonatorID, r.Method, r.URL.Path)
+	app.recordSecurityEvent(r, user, "", data.EventImpersonatedRequest, data.OutcomeSuccess, detail)
+}
+
+// createImpersonationTokenHandler mints a short-lived authentication token which lets
+// the admin act as another user, for example to reproduce a problem they reported.
+// Admins can't impersonate themselves, other users who could impersonate, or users
+// with any permission they don't have themselves, and an impersonation token can't be
+// used to mint another.
+func (app *application) createImpersonationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	admin := app.contextGetUser(r)
+	if app.contextGetAPIKey(r) != nil || admin.ImpersonatorID != 0 || admin.TokenScopes != nil {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	target := app.readUserParam(w, r)
+	if target == nil {
+		return
+	}
+
+	var input struct {
+		Minutes *int `json:"minutes"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ttl := 15 * time.Minute
+	if input.Minutes != nil {
+		ttl = time.Duration(*input.Minutes) * time.Minute
+	}
+
+	v := validator.New()
+	v.Check(target.ID != admin.ID, "user", "must not be yourself")
+	v.Check(ttl >= time.Minute && ttl <= app.config.impersonation.maxTTL, "minutes", fmt.Sprintf("must be between 1 and %d", int(app.config.impersonation.maxTTL.Minutes())))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(target.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions.Include("admin") || permissions.Include("users:impersonate") {
+		app.recordSecurityEvent(r, admin, "", data.EventImpersonation, data.OutcomeFailure, fmt.Sprintf("user %d is privileged", target.ID))
+		app.notPermittedResponse(w, r)
+		return
+	}
+	// Impersonating someone mustn't give the admin permissions they don't have.
+	adminPermissions, err := app.permissionsFor(r, admin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !adminPermissions.Covers(permissions) {
+		app.recordSecurityEvent(r, admin, "", data.EventImpersonation, data.OutcomeFailure, fmt.Sprintf("user %d has permissions user %d doesn't", target.ID, admin.ID))
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.NewImpersonation(target.ID, admin.ID, ttl, r.UserAgent(), clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	detail := fmt.Sprintf("user %d by user %d for %s", target.ID, admin.ID, ttl)
+	app.recordSecurityEvent(r, admin, "", data.EventImpersonation, data.OutcomeSuccess, detail)
+	app.recordSecurityEvent(r, target, "", data.EventImpersonation, data.OutcomeSuccess, detail)
+
+	env := envelope{
+		"authentication_token": map[string]any{
+			"token":        token.Plaintext,
+			"type":         "impersonation",
+			"user_id":      target.ID,
+			"expiry":       token.Expiry.UTC().Truncate(time.Second),
+			"impersonator": admin.ID,
+		},
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
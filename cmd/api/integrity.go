@@ -0,0 +1,73 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+)
+
+// integrityFindings holds the number of problems found by the most recent integrity
+// check, keyed by check name. It's published on the /debug/vars endpoint.
+var integrityFindings = expvar.NewMap("integrity_findings")
+
+// runIntegrityCheck runs the database consistency checker, records the results in the
+// integrity_findings metric and logs a summary if any problems were found.
+func (app *application) runIntegrityCheck(ctx context.Context, repair bool, progress data.ProgressFunc) (*data.IntegrityReport, error) {
+	report, err := app.models.Integrity.Check(ctx, repair, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	for _, finding := range report.Findings {
+		count := new(expvar.Int)
+		count.Set(int64(finding.Count))
+		integrityFindings.Set(finding.Check, count)
+
+		if finding.Count > 0 {
+			properties[finding.Check] = strconv.Itoa(finding.Count)
+			if finding.Repaired > 0 {
+				properties[finding.Check+"_repaired"] = strconv.FormatInt(finding.Repaired, 10)
+			}
+		}
+	}
+
+	if len(properties) > 0 {
+		app.logger.PrintInfo("database integrity problems found", properties)
+	}
+
+	return report, nil
+}
+
+func (app *application) showIntegrityReportHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "integrity_report", nil)
+}
+
+func (app *application) runIntegrityReport(ctx context.Context, job *data.Job) (envelope, error) {
+	report, err := app.runIntegrityCheck(ctx, false, app.jobProgress(job))
+	return envelope{"integrity": report}, err
+}
+
+// repairIntegrityHandler runs the checker and fixes the problems which are safe to
+// repair automatically. Everything else is only reported.
+func (app *application) repairIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "integrity_repair", nil)
+}
+
+func (app *application) runIntegrityRepair(ctx context.Context, job *data.Job) (envelope, error) {
+	report, err := app.runIntegrityCheck(ctx, true, app.jobProgress(job))
+	return envelope{"integrity": report}, err
+}
+
+// showIndexAdvisorHandler EXPLAINs the hot queries against the current table
+// statistics and reports likely missing indexes, unused indexes and table bloat.
+func (app *application) showIndexAdvisorHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "index_advisor", nil)
+}
+
+func (app *application) runIndexAdvisor(ctx context.Context, job *data.Job) (envelope, error) {
+	report, err := app.models.Advisor.Advise(ctx, app.jobProgress(job))
+	return envelope{"advisor": report}, err
+}
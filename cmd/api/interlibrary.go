@@ -0,0 +1,296 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// interlibrarySortSafelist are the sort values accepted when listing inter-library
+// loans.
+var interlibrarySortSafelist = []string{"id", "title", "status", "due_date", "created_at", "updated_at", "-id", "-title", "-status", "-due_date", "-created_at", "-updated_at"}
+
+// readInterlibraryFilters reads the ?status= filter and the paging and sorting
+// parameters shared by the inter-library loan lists. If they're invalid a response is
+// sent and false is returned.
+func (app *application) readInterlibraryFilters(w http.ResponseWriter, r *http.Request, qs url.Values) (string, data.Filters, bool) {
+	v := validator.New()
+
+	status := app.readString(qs, "status", "")
+	if status != "" {
+		v.Check(validator.PermittedValue(status, data.InterlibraryRequested, data.InterlibraryShipped, data.InterlibraryReceived, data.InterlibraryReturned, data.InterlibraryCancelled), "status", "invalid status")
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: interlibrarySortSafelist,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return "", filters, false
+	}
+	return status, filters, true
+}
+
+// readInterlibraryLoanParam fetches the loan named by the :id parameter. If it can't be
+// fetched an error response is sent and nil is returned.
+func (app *application) readInterlibraryLoanParam(w http.ResponseWriter, r *http.Request) *data.InterlibraryLoan {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	loan, err := app.models.InterlibraryLoans.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return loan
+}
+
+// parseDueDate parses a YYYY-MM-DD due date, adding a validation error if it's
+// malformed. An empty string clears the date.
+func parseDueDate(v *validator.Validator, s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError("due_date", "must be a date in the format YYYY-MM-DD")
+		return nil
+	}
+	return &date
+}
+
+// createInterlibraryLoanHandler records a request to a partner library for an item on
+// behalf of a member.
+func (app *application) createInterlibraryLoanHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID         int64  `json:"user_id"`
+		Title          string `json:"title"`
+		ISBN           string `json:"isbn"`
+		PartnerLibrary string `json:"partner_library"`
+		PartnerContact string `json:"partner_contact"`
+		Note           string `json:"note"`
+		DueDate        string `json:"due_date"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	loan := &data.InterlibraryLoan{
+		UserID:         input.UserID,
+		Title:          input.Title,
+		ISBN:           data.NormalizeISBN(input.ISBN),
+		PartnerLibrary: input.PartnerLibrary,
+		PartnerContact: input.PartnerContact,
+		Note:           input.Note,
+		DueDate:        parseDueDate(v, input.DueDate),
+	}
+
+	v.Check(loan.UserID > 0, "user_id", "must be provided")
+	if data.ValidateInterlibraryLoan(v, loan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.Get(loan.UserID, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "user does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkNotBlocked(w, r, loan.UserID) {
+		return
+	}
+
+	err = app.models.InterlibraryLoans.Insert(loan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/librarian/interlibrary-loans/%d", loan.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"interlibrary_loan": loan}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listInterlibraryLoansHandler lists the items borrowed from partner libraries for the
+// member.
+func (app *application) listInterlibraryLoansHandler(w http.ResponseWriter, r *http.Request) {
+	status, filters, ok := app.readInterlibraryFilters(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	loans, metadata, err := app.models.InterlibraryLoans.GetAll(app.contextGetUser(r).ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"interlibrary_loans": loans, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAllInterlibraryLoansHandler lists every inter-library loan for librarians, for
+// example ?status=received for the items which are in our possession.
+func (app *application) listAllInterlibraryLoansHandler(w http.ResponseWriter, r *http.Request) {
+	status, filters, ok := app.readInterlibraryFilters(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	loans, metadata, err := app.models.InterlibraryLoans.GetAll(0, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"interlibrary_loans": loans, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showInterlibraryLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readInterlibraryLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"interlibrary_loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateInterlibraryLoanHandler lets a librarian move a loan through its statuses,
+// which records the date of each step, and update the partner's details and the due
+// date. The member is emailed when the item arrives.
+func (app *application) updateInterlibraryLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readInterlibraryLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	var input struct {
+		Status         *string `json:"status"`
+		PartnerLibrary *string `json:"partner_library"`
+		PartnerContact *string `json:"partner_contact"`
+		Note           *string `json:"note"`
+		DueDate        *string `json:"due_date"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Status != nil && *input.Status != loan.Status {
+		if !validator.PermittedValue(*input.Status, data.InterlibraryTransitions[loan.Status]...) {
+			app.stateConflictResponse(w, r, fmt.Sprintf("an inter-library loan can't be moved from %s to %s", loan.Status, *input.Status))
+			return
+		}
+		now := time.Now()
+		switch *input.Status {
+		case data.InterlibraryShipped:
+			loan.ShippedAt = &now
+		case data.InterlibraryReceived:
+			loan.ReceivedAt = &now
+		case data.InterlibraryReturned:
+			loan.ReturnedAt = &now
+		}
+		loan.Status = *input.Status
+	}
+	if input.PartnerLibrary != nil {
+		loan.PartnerLibrary = *input.PartnerLibrary
+	}
+	if input.PartnerContact != nil {
+		loan.PartnerContact = *input.PartnerContact
+	}
+	if input.Note != nil {
+		loan.Note = *input.Note
+	}
+	if input.DueDate != nil {
+		loan.DueDate = parseDueDate(v, *input.DueDate)
+	}
+
+	if data.ValidateInterlibraryLoan(v, loan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.InterlibraryLoans.Update(loan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Status != nil && *input.Status == data.InterlibraryReceived {
+		app.notifyInterlibraryReceived(r, loan)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"interlibrary_loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// notifyInterlibraryReceived emails the member in the background to say that the item
+// they asked for has arrived.
+func (app *application) notifyInterlibraryReceived(r *http.Request, loan *data.InterlibraryLoan) {
+	user, err := app.models.Users.Get(loan.UserID, r)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":    user.Name,
+			"title":   loan.Title,
+			"partner": loan.PartnerLibrary,
+			"dueDate": loan.DueDate,
+		}
+		err := app.sendNotification(user, data.EmailInterlibrary, "interlibrary_received.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
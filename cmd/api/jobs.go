@@ -0,0 +1,345 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jobRunner keeps track of the jobs which are being processed by this instance, so
+// that they can be cancelled.
+type jobRunner struct {
+	mu      sync.Mutex
+	cancels map[int64]context.CancelFunc
+	// abandoned are the jobs stopped because another instance has taken them over,
+	// which mustn't record anything more.
+	abandoned map[int64]bool
+}
+
+func (jr *jobRunner) add(id int64, cancel context.CancelFunc) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.cancels == nil {
+		jr.cancels = make(map[int64]context.CancelFunc)
+	}
+	jr.cancels[id] = cancel
+}
+
+func (jr *jobRunner) remove(id int64) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	delete(jr.cancels, id)
+	delete(jr.abandoned, id)
+}
+
+// cancel stops the job with the given id. It returns false if the job isn't running.
+func (jr *jobRunner) cancel(id int64) bool {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	cancel, ok := jr.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// abandon stops the job with the given id without it recording that it stopped.
+func (jr *jobRunner) abandon(id int64) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	cancel, ok := jr.cancels[id]
+	if !ok {
+		return
+	}
+	if jr.abandoned == nil {
+		jr.abandoned = make(map[int64]bool)
+	}
+	jr.abandoned[id] = true
+	cancel()
+}
+
+// lost reports whether the job with the given id was abandoned.
+func (jr *jobRunner) lost(id int64) bool {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	return jr.abandoned[id]
+}
+
+func (jr *jobRunner) running(id int64) bool {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	_, ok := jr.cancels[id]
+	return ok
+}
+
+// ids returns the ids of the jobs being processed.
+func (jr *jobRunner) ids() []int64 {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	ids := make([]int64, 0, len(jr.cancels))
+	for id := range jr.cancels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// jobProgressInterval is the least time between saves of a job's progress, so a
+// job which reports it often doesn't write to the jobs table as often.
+const jobProgressInterval = time.Second
+
+// jobProgress returns a ProgressFunc which records a job's progress and saves it,
+// at most every jobProgressInterval. A job being run for a synchronous request has
+// no row to save it to.
+func (app *application) jobProgress(job *data.Job) data.ProgressFunc {
+	var saved time.Time
+	return func(done, total int64) {
+		job.Processed = done
+		job.Total = total
+		if job.ID == 0 || (done < total && time.Since(saved) < jobProgressInterval) {
+			return
+		}
+		saved = time.Now()
+		err := app.models.Jobs.Update(job)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job_id": strconv.FormatInt(job.ID, 10), "kind": job.Kind})
+		}
+	}
+}
+
+// runBackfillJob processes a backfill batch by batch, saving the cursor and progress
+// after every batch so that it can carry on from there if it's stopped.
+func (app *application) runBackfillJob(ctx context.Context, job *data.Job) (envelope, error) {
+	backfill, ok := data.LookupBackfill(job.Kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown backfill %q", job.Kind)
+	}
+	for {
+		cursor, processed, err := app.models.Jobs.RunBackfillBatch(ctx, backfill, job.Cursor, job.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if processed == 0 {
+			return nil, nil
+		}
+
+		job.Cursor = cursor
+		job.Processed += processed
+		err = app.models.Jobs.Update(job)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (app *application) createJobHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Kind        string `json:"kind"`
+		BatchSize   *int   `json:"batch_size"`
+		Priority    *int   `json:"priority"`
+		MaxAttempts *int   `json:"max_attempts"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job := &data.Job{
+		Kind:        input.Kind,
+		Status:      data.JobStatusQueued,
+		BatchSize:   500,
+		Priority:    backfillKind.priority,
+		MaxAttempts: backfillKind.attempts,
+	}
+	if input.BatchSize != nil {
+		job.BatchSize = *input.BatchSize
+	}
+	if input.Priority != nil {
+		job.Priority = *input.Priority
+	}
+	if input.MaxAttempts != nil {
+		job.MaxAttempts = *input.MaxAttempts
+	}
+
+	v := validator.New()
+	if data.ValidateJob(v, job); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	backfill, _ := data.LookupBackfill(job.Kind)
+	job.Total, err = app.models.Jobs.CountBackfill(backfill)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.enqueueJob(job)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/jobs/%d", job.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listJobsHandler lists the latest jobs, or with ?status= only those in the queue,
+// running and so on.
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	status := app.readString(r.URL.Query(), "status", "")
+	v := validator.New()
+	v.Check(status == "" || validator.PermittedValue(status, data.JobStatusQueued, data.JobStatusRunning,
+		data.JobStatusCancelled, data.JobStatusFailed, data.JobStatusCompleted), "status", "invalid status")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, err := app.models.Jobs.GetAll(status)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, job := range jobs {
+		setResultURL(job)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"jobs": jobs, "backfills": data.Backfills}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	setResultURL(job)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cancelJob(w, r, job)
+}
+
+// cancelJob cancels a queued job, or asks the instance running a running one to stop
+// it. That's this one or, within a heartbeat, another.
+func (app *application) cancelJob(w http.ResponseWriter, r *http.Request, job *data.Job) {
+	_, err := app.models.Jobs.Cancel(job.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.stateConflictResponse(w, r, fmt.Sprintf("a %s job cannot be cancelled", job.Status))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.jobs.cancel(job.ID)
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "job cancellation requested"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler queues a cancelled or failed job again, with its attempts reset.
+// Backfills carry on from where they stopped, and asynchronous requests start again
+// with the input they were made with.
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if _, ok := lookupJobKind(job.Kind); !ok {
+		app.stateConflictResponse(w, r, fmt.Sprintf("a %s job cannot be retried", job.Kind))
+		return
+	}
+	// A running job which isn't locked by a worker was left behind by an instance from
+	// before the queue, so it is safe to pick it up again, unless it's this one's.
+	if app.jobs.running(job.ID) {
+		app.stateConflictResponse(w, r, fmt.Sprintf("a %s job cannot be retried", job.Status))
+		return
+	}
+
+	status := job.Status
+	job, err = app.models.Jobs.Retry(job.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.stateConflictResponse(w, r, fmt.Sprintf("a %s job cannot be retried", status))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.queue.notify()
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// kioskLookupCopy finds the copy with the scanned barcode, sending an unknown_barcode
+// response and returning nil if there isn't one.
+func (app *application) kioskLookupCopy(w http.ResponseWriter, r *http.Request, barcode string) *data.Copy {
+	c, err := app.models.Copies.GetByBarcode(barcode)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.kioskErrorResponse(w, r, http.StatusNotFound, "unknown_barcode", "this item isn't in our catalog, please take it to the desk")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return c
+}
+
+// kioskCheckoutHandler lends the scanned copy to the member whose card was scanned, in
+// one call. Anything which stops the checkout is reported with a kiosk error code.
+func (app *application) kioskCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CardNumber string `json:"card_number"`
+		Barcode    string `json:"barcode"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateCardNumber(v, input.CardNumber)
+	v.Check(input.Barcode != "", "barcode", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	device := app.contextGetDevice(r)
+
+	userID, err := app.models.Cards.GetUserID(input.CardNumber)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.kioskErrorResponse(w, r, http.StatusNotFound, "unknown_card", "this card isn't registered, please ask at the desk")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	member, err := app.models.Users.Get(userID, r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !member.Activated {
+		app.kioskErrorResponse(w, r, http.StatusForbidden, "account_inactive", "your account isn't activated yet, please ask at the desk")
+		return
+	}
+	if member.FrozenAt != nil {
+		app.kioskErrorResponse(w, r, http.StatusForbidden, "account_frozen", "you can't borrow at the moment, please ask at the desk")
+		return
+	}
+	c := app.kioskLookupCopy(w, r, input.Barcode)
+	if c == nil {
+		return
+	}
+
+	branch, err := app.models.Branches.Get(device.BranchID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if c.Branch != branch.Name {
+		app.kioskErrorResponse(w, r, http.StatusConflict, "wrong_branch", fmt.Sprintf("this item belongs to %s, please take it to the desk", c.Branch))
+		return
+	}
+
+	loan := &data.Loan{
+		CopyID:   c.ID,
+		Barcode:  c.Barcode,
+		Book:     c.Book,
+		UserID:   member.ID,
+		DeviceID: &device.ID,
+		DueAt:    time.Now().AddDate(0, 0, int(branch.LoanPolicy.LoanPeriodDays)),
+	}
+
+	err = app.models.Loans.Checkout(loan, branch.LoanPolicy.MaxLoans)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrBorrowingBlocked):
+			app.kioskErrorResponse(w, r, http.StatusForbidden, "account_blocked", "you can't borrow while you have a long overdue item, please ask at the desk")
+		case errors.Is(err, data.ErrCopyOnLoan):
+			app.kioskErrorResponse(w, r, http.StatusConflict, "already_on_loan", "this item is still on loan, please take it to the desk")
+		case errors.Is(err, data.ErrLoanLimit):
+			message := fmt.Sprintf("you already have %d items on loan, which is the most you can borrow", branch.LoanPolicy.MaxLoans)
+			app.kioskErrorResponse(w, r, http.StatusConflict, "loan_limit_reached", message)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"loan": loan, "member": member.Name}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// kioskReturnHandler takes back the scanned copy. Copies can be returned at any
+// branch; transfer_to tells the kiosk when the copy has to go back to another one.
+func (app *application) kioskReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Barcode string `json:"barcode"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Barcode != "", "barcode", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	c := app.kioskLookupCopy(w, r, input.Barcode)
+	if c == nil {
+		return
+	}
+
+	loan, err := app.models.Loans.Return(c.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotOnLoan):
+			app.kioskErrorResponse(w, r, http.StatusConflict, "not_on_loan", "this item isn't on loan, please take it to the desk")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	loan.Barcode = c.Barcode
+	loan.Book = c.Book
+
+	env := envelope{"loan": loan, "overdue": loan.ReturnedAt.After(loan.DueAt)}
+
+	branch, err := app.models.Branches.Get(app.contextGetDevice(r).BranchID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if c.Branch != branch.Name {
+		env["transfer_to"] = c.Branch
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// kioskHeartbeatHandler is called regularly by kiosks so that they can be monitored.
+func (app *application) kioskHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status          string `json:"status"`
+		SoftwareVersion string `json:"software_version"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateHeartbeat(v, input.Status, input.SoftwareVersion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	device := app.contextGetDevice(r)
+	device.Status = input.Status
+	device.SoftwareVersion = input.SoftwareVersion
+
+	err = app.models.Devices.Heartbeat(device)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	device.Online = true
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"device": device}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createDeviceHandler registers a kiosk at a branch. The device key is only ever
+// returned in this response.
+func (app *application) createDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name     string `json:"name"`
+		BranchID int64  `json:"branch_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	device := &data.Device{Name: input.Name, BranchID: input.BranchID}
+
+	v := validator.New()
+	if data.ValidateDevice(v, device); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Devices.New(device)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownBranch):
+			v.AddError("branch_id", "branch does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"device": device}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDevicesHandler lists the kiosks and whether they're online, meaning they've
+// been seen recently. ?offline=true lists only the ones which aren't.
+func (app *application) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	offline := app.readBool(r.URL.Query(), "offline", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	devices, err := app.models.Devices.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	result := []*data.Device{}
+	for _, device := range devices {
+		device.Online = device.LastSeenAt != nil && time.Since(*device.LastSeenAt) < app.config.devices.offlineAfter
+		if offline == nil || *offline != device.Online {
+			result = append(result, device)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"devices": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteDeviceHandler removes a kiosk, which stops its key working.
+func (app *application) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Devices.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "device successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setLibraryCardHandler issues a library card to a member, replacing their old one.
+// Members scan their card at kiosks.
+func (app *application) setLibraryCardHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		CardNumber string `json:"card_number"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateCardNumber(v, input.CardNumber); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Cards.Set(user.ID, input.CardNumber)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCard):
+			v.AddError("card_number", "is already issued to another member")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"card_number": input.CardNumber}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
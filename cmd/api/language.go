@@ -0,0 +1,63 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/mailer"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setSignupLanguage makes the language the browser asks for with Accept-Language the
+// new user's email language, until they pick one in their preferences. It returns the
+// language their emails should be in.
+func (app *application) setSignupLanguage(r *http.Request, userID int64) (string, error) {
+	language := acceptedLanguage(r.Header.Get("Accept-Language"))
+	if language == "" || language == mailer.DefaultLanguage {
+		return mailer.DefaultLanguage, nil
+	}
+	prefs := data.DefaultPreferences()
+	prefs.Language = language
+	err := app.models.Preferences.Update(userID, prefs)
+	if err != nil {
+		return "", err
+	}
+	return language, nil
+}
+
+// userLanguage returns the language the user wants their emails in. If their
+// preferences can't be loaded the error is logged and the default language is used,
+// since a transactional email in the wrong language beats none at all.
+func (app *application) userLanguage(userID int64) string {
+	prefs, err := app.models.Preferences.Get(userID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(userID, 10)})
+		return mailer.DefaultLanguage
+	}
+	return prefs.Language
+}
+
+// acceptedLanguage returns the language in data.Languages which an Accept-Language
+// header prefers, matching on the primary subtag so kk-KZ counts as kk, or "" if it
+// doesn't accept any of them.
+func acceptedLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, language := range data.Languages {
+			if primary == language && q > bestQ {
+				best, bestQ = language, q
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// checkFrozen refuses the login if the user's account is under a legal hold. The
+// response is the same as for wrong credentials, so that it doesn't confirm that the
+// password or code which was given is right; the hold is only recorded in the
+// security log. If the login can't go ahead a response is sent and false is returned.
+func (app *application) checkFrozen(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	if user.FrozenAt == nil {
+		return true
+	}
+	app.recordSecurityEvent(r, user, "", data.EventLogin, data.OutcomeFailure, "account frozen")
+	app.invalidCredentialsResponse(w, r)
+	return false
+}
+
+// rejectFrozenWrites refuses every request which could change something when it's
+// made as a user whose account is under a legal hold, however they authenticated.
+// Their sessions are revoked when the hold is placed, so this only matters for a
+// request which was already on its way.
+func (app *application) rejectFrozenWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions &&
+			app.contextGetUser(r).FrozenAt != nil {
+			app.accountFrozenResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// placeLegalHoldHandler freezes the user's account for an investigation, before any
+// deletion or anonymization can run. The reason is kept with the hold. Every session
+// and token the user has is revoked, JWTs included, and their API keys stop working
+// until the hold is released.
+func (app *application) placeLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	v := validator.New()
+	data.ValidateLegalHoldReason(v, input.Reason)
+	v.Check(user.ID != admin.ID, "user", "you can't freeze your own account")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hold := &data.LegalHold{
+		UserID:   user.ID,
+		Reason:   input.Reason,
+		PlacedBy: &admin.ID,
+	}
+	err = app.models.LegalHolds.Place(hold)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAccountFrozen):
+			v.AddError("user", "account is already frozen")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	revoked, err := app.models.Tokens.DeleteEveryForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	_, err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+
+	detail := fmt.Sprintf("user %d by user %d, %d tokens revoked: %s", user.ID, admin.ID, revoked, input.Reason)
+	app.recordSecurityEvent(r, admin, "", data.EventLegalHoldPlaced, data.OutcomeSuccess, detail)
+	app.recordSecurityEvent(r, user, "", data.EventLegalHoldPlaced, data.OutcomeSuccess, detail)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"legal_hold": hold}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// releaseLegalHoldHandler unfreezes the user's account. A reason is needed for the
+// record here too.
+func (app *application) releaseLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateLegalHoldReason(v, input.Reason); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	hold, err := app.models.LegalHolds.Release(user.ID, admin.ID, input.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+
+	detail := fmt.Sprintf("user %d by user %d: %s", user.ID, admin.ID, input.Reason)
+	app.recordSecurityEvent(r, admin, "", data.EventLegalHoldReleased, data.OutcomeSuccess, detail)
+	app.recordSecurityEvent(r, user, "", data.EventLegalHoldReleased, data.OutcomeSuccess, detail)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"legal_hold": hold}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listLegalHoldsHandler lists the accounts which are frozen now.
+func (app *application) listLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	holds, err := app.models.LegalHolds.GetAll(0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"legal_holds": holds}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserLegalHoldsHandler lists every hold the user's account has been under,
+// including released ones.
+func (app *application) listUserLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	holds, err := app.models.LegalHolds.GetAll(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"legal_holds": holds}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+// readListParam fetches the list named by the :id parameter. Lists are private, so one
+// belonging to another user is reported as not found. If it can't be fetched an error
+// response is sent and nil is returned.
+func (app *application) readListParam(w http.ResponseWriter, r *http.Request) *data.ReadingList {
+	id, err := app.resolveListIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	list, err := app.models.ReadingLists.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	if list.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return list
+}
+
+func (app *application) readBookIDParam(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("bookID"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid bookID parameter")
+	}
+	return id, nil
+}
+
+// writeList sends the list with its items in their current order.
+func (app *application) writeList(w http.ResponseWriter, r *http.Request, status int, id int64, headers http.Header) {
+	list, err := app.models.ReadingLists.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, status, envelope{"list": list}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createListHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Template    bool   `json:"template"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	list := &data.ReadingList{
+		UserID:      app.contextGetUser(r).ID,
+		Name:        input.Name,
+		Description: input.Description,
+		Template:    input.Template,
+	}
+
+	v := validator.New()
+	if data.ValidateReadingList(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.ReadingLists.Insert(list)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/lists/%d", list.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"list": list}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listListsHandler lists the user's lists. Archived lists are hidden unless
+// ?archived=true is sent, in which case only they are listed.
+func (app *application) listListsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	archived := app.readBool(r.URL.Query(), "archived", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	lists, err := app.models.ReadingLists.GetAllForUser(app.contextGetUser(r).ID, archived != nil && *archived)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lists": lists}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showListHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"list": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateListHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Archived    *bool   `json:"archived"`
+		Template    *bool   `json:"template"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		list.Name = *input.Name
+	}
+	if input.Description != nil {
+		list.Description = *input.Description
+	}
+	if input.Archived != nil {
+		list.Archived = *input.Archived
+	}
+	if input.Template != nil {
+		list.Template = *input.Template
+	}
+
+	v := validator.New()
+	if data.ValidateReadingList(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.ReadingLists.Update(list)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"list": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listListTemplatesHandler lists the templates published by any user, most cloned
+// first by default.
+func (app *application) listListTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-clone_count")
+	input.Filters.SortSafelist = []string{"id", "name", "created_at", "clone_count", "-id", "-name", "-created_at", "-clone_count"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	lists, metadata, err := app.models.ReadingLists.GetTemplates(input.Name, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"templates": lists, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showListTemplateHandler shows a published template with its books. Unlike other
+// lists, templates can be seen by everyone.
+func (app *application) showListTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveListIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	list, err := app.models.ReadingLists.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !list.Template || list.Archived {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"template": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cloneListTemplateHandler copies a template into a new list of the user's own.
+func (app *application) cloneListTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveListIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	list, err := app.models.ReadingLists.Clone(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/lists/%d", list.ID))
+
+	app.writeList(w, r, http.StatusCreated, list.ID, headers)
+}
+
+func (app *application) deleteListHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	err := app.models.ReadingLists.Delete(list.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "list successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addListItemHandler adds a book to the end of the list.
+func (app *application) addListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	var input struct {
+		BookID int64 `json:"book_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.BookID > 0, "book_id", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Book.Get(input.BookID, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("book_id", "book does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.ReadingLists.AddItem(list.ID, input.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateListItem):
+			v.AddError("book_id", "book is already in the list")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeList(w, r, http.StatusCreated, list.ID, nil)
+}
+
+func (app *application) removeListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	bookID, err := app.readBookIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.ReadingLists.RemoveItem(list.ID, bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeList(w, r, http.StatusOK, list.ID, nil)
+}
+
+// moveListItemHandler moves a book to a new 1-based position in the list, for
+// drag-and-drop reordering. The whole list is returned, so the client can replace its
+// copy rather than trying to replay the move.
+func (app *application) moveListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list := app.readListParam(w, r)
+	if list == nil {
+		return
+	}
+
+	bookID, err := app.readBookIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Position int `json:"position"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Position > 0, "position", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.ReadingLists.MoveItem(list.ID, bookID, input.Position)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeList(w, r, http.StatusOK, list.ID, nil)
+}
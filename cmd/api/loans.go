@@ -0,0 +1,148 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/receipt"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// readLoanParam looks up the loan whose ID is in the URL. Members can only see their
+// own loans, while staff with loans:manage can see anyone's. It sends a 404 response
+// and returns nil if there's no loan the user can see.
+func (app *application) readLoanParam(w http.ResponseWriter, r *http.Request) *data.Loan {
+	id, err := app.resolveLoanIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	loan, err := app.models.Loans.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+	if loan.UserID != user.ID {
+		permissions, err := app.permissionsFor(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil
+		}
+		if !permissions.Include("loans:manage") {
+			app.notFoundResponse(w, r)
+			return nil
+		}
+	}
+	return loan
+}
+
+// loanReceipt builds the receipt for the loan, and returns it with the member it's for.
+func (app *application) loanReceipt(r *http.Request, loan *data.Loan) (*receipt.Receipt, *data.User, error) {
+	member, err := app.models.Users.Get(loan.UserID, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	branch, err := app.models.Branches.GetByName(loan.Branch)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(branch.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rc := &receipt.Receipt{
+		Branch:       branch.Name,
+		Address:      branch.Address,
+		Phone:        branch.Phone,
+		LoanID:       loan.ID,
+		Member:       member.Name,
+		Title:        loan.Book.Title,
+		Barcode:      loan.Barcode,
+		CheckedOutAt: loan.CheckedOutAt,
+		DueAt:        loan.DueAt,
+		ReturnedAt:   loan.ReturnedAt,
+		DailyFine:    branch.LoanPolicy.DailyFine,
+		MaxFine:      branch.LoanPolicy.MaxFine,
+		Currency:     app.config.currency,
+		Location:     loc,
+	}
+	if loan.ReturnedAt != nil {
+		rc.Fine = branch.LoanPolicy.Fine(loan.DueAt, *loan.ReturnedAt)
+	}
+	return rc, member, nil
+}
+
+// showLoanReceiptHandler sends a printable receipt for a loan, or for its return once
+// the copy is back. ?format=escpos sends it as ESC/POS commands for a receipt printer
+// instead of plain text.
+func (app *application) showLoanReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	format := app.readString(r.URL.Query(), "format", "text")
+	if v.Check(validator.PermittedValue(format, "text", "escpos"), "format", "must be text or escpos"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	loan := app.readLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	rc, _, err := app.loanReceipt(r, loan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	switch format {
+	case "escpos":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(rc.ESCPOS())
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(rc.Text()))
+	}
+}
+
+// emailLoanReceiptHandler emails the loan's receipt to the member in the background.
+func (app *application) emailLoanReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	loan := app.readLoanParam(w, r)
+	if loan == nil {
+		return
+	}
+
+	rc, member, err := app.loanReceipt(r, loan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":    member.Name,
+			"title":   loan.Book.Title,
+			"branch":  rc.Branch,
+			"receipt": rc.Text(),
+		}
+		err := app.mailer.SendLocalized(member.Email, app.userLanguage(member.ID), "loan_receipt.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "the receipt will be emailed to the member"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
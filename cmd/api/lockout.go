@@ -0,0 +1,100 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// lockoutPolicy returns the configured lockout policy.
+func (app *application) lockoutPolicy() data.LockoutPolicy {
+	return data.LockoutPolicy{
+		Threshold: app.config.lockout.threshold,
+		Duration:  app.config.lockout.duration,
+		Max:       app.config.lockout.max,
+	}
+}
+
+// checkLockout sends an accountLockedResponse and returns false if the user's logins
+// from this client are locked.
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	return app.checkLockoutFor(w, r, user, data.EventLogin)
+}
+
+// checkLockoutFor is checkLockout for anything else which checks the user's password,
+// such as changing it, recording the refusal as event. Logins and these checks share
+// one failure count, so they can't be used to guess the password twice as fast.
+func (app *application) checkLockoutFor(w http.ResponseWriter, r *http.Request, user *data.User, event string) bool {
+	if app.config.lockout.threshold <= 0 {
+		return true
+	}
+
+	lockedUntil, err := app.models.Lockouts.GetLockedUntil(user.ID, clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !lockedUntil.IsZero() {
+		app.recordSecurityEvent(r, user, "", event, data.OutcomeFailure, "account locked")
+		app.accountLockedResponse(w, r, lockedUntil)
+		return false
+	}
+	return true
+}
+
+// loginFailedResponse records a failed login for the user, with the reason for the
+// audit trail, and sends the response. If the failure locks the account, the user is
+// emailed so they know someone may be trying to get in.
+func (app *application) loginFailedResponse(w http.ResponseWriter, r *http.Request, user *data.User, reason string) {
+	app.failedResponseFor(w, r, user, data.EventLogin, reason)
+}
+
+// failedResponseFor is loginFailedResponse for the checks checkLockoutFor guards.
+func (app *application) failedResponseFor(w http.ResponseWriter, r *http.Request, user *data.User, event, reason string) {
+	app.recordSecurityEvent(r, user, "", event, data.OutcomeFailure, reason)
+
+	if app.config.lockout.threshold <= 0 {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ip := clientIP(r)
+	lockedUntil, err := app.models.Lockouts.RecordFailure(user.ID, ip, app.lockoutPolicy())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if lockedUntil.IsZero() {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":        user.Name,
+			"ip":          ip,
+			"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+		}
+		err := app.mailer.SendLocalized(user.Email, app.userLanguage(user.ID), "account_locked.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	app.logger.PrintInfo("account locked after failed logins", map[string]string{
+		"user_id":      strconv.FormatInt(user.ID, 10),
+		"ip":           ip,
+		"locked_until": lockedUntil.Format(time.RFC3339),
+	})
+
+	app.accountLockedResponse(w, r, lockedUntil)
+}
+
+// loginSucceeded clears the user's failed login count for this client.
+func (app *application) loginSucceeded(r *http.Request, user *data.User) error {
+	if app.config.lockout.threshold <= 0 {
+		return nil
+	}
+	return app.models.Lockouts.Reset(user.ID, clientIP(r))
+}
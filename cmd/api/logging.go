@@ -0,0 +1,118 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/jsonlog"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logLevelRefresh is how often each instance picks up the log level set by an admin.
+const logLevelRefresh = time.Minute
+
+// writeLogLevel responds with the minimum severity this instance is logging, and the
+// level set by an admin for every instance, if there is one.
+func (app *application) writeLogLevel(w http.ResponseWriter, r *http.Request, shared *data.LogLevel) {
+	env := envelope{
+		"log_level": strings.ToLower(app.logger.MinLevel().String()),
+		"instance":  app.queue.worker,
+	}
+	if shared != nil {
+		env["shared"] = shared
+	}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLogLevelHandler shows the minimum severity this instance logs, and the level
+// set for every instance. They differ for up to a minute after it's changed.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	shared, err := app.models.LogLevel.Get()
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeLogLevel(w, r, shared)
+}
+
+// updateLogLevelHandler changes the minimum severity every instance logs, such as to
+// debug while looking into a problem, without restarting them. The level is stored in
+// the database: this instance changes straight away, and the others, including ones
+// started later, pick it up within a minute, overriding their -log-level.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(err == nil, "level", "must be debug, info, warn or error")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	shared := &data.LogLevel{
+		Level:     strings.ToLower(level.String()),
+		ChangedBy: app.contextGetUser(r).Email,
+		ChangedOn: app.queue.worker,
+	}
+	err = app.models.LogLevel.Set(shared)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.applyLogLevel(level, shared)
+
+	app.writeLogLevel(w, r, shared)
+}
+
+// loadLogLevel applies the log level set by an admin, if there is one.
+func (app *application) loadLogLevel() {
+	shared, err := app.models.LogLevel.Get()
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	level, err := jsonlog.ParseLevel(shared.Level)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.applyLogLevel(level, shared)
+}
+
+// applyLogLevel changes the minimum severity this instance logs, if it's different.
+// The change is logged while the lower of the two levels is in force, so it shows up
+// if either includes info entries.
+func (app *application) applyLogLevel(level jsonlog.Level, shared *data.LogLevel) {
+	previous := app.logger.MinLevel()
+	if level == previous {
+		return
+	}
+	properties := map[string]string{
+		"from":       strings.ToLower(previous.String()),
+		"to":         strings.ToLower(level.String()),
+		"by":         shared.ChangedBy,
+		"changed_on": shared.ChangedOn,
+	}
+	if level > previous {
+		app.logger.PrintInfo("log level changed", properties)
+		app.logger.SetMinLevel(level)
+	} else {
+		app.logger.SetMinLevel(level)
+		app.logger.PrintInfo("log level changed", properties)
+	}
+}
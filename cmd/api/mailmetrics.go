@@ -0,0 +1,122 @@
+package main
+
+import (
+	"books.reading.kz/internal/mailer"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mailMetrics counts email deliveries by template, published at /debug/vars: sent and
+// failed count emails, retried counts attempts after the first, and latency holds a
+// histogram of how long each attempt took.
+var (
+	mailMetrics = expvar.NewMap("mail")
+	mailSent    = new(expvar.Map).Init()
+	mailFailed  = new(expvar.Map).Init()
+	mailRetried = new(expvar.Map).Init()
+	mailLatency = new(expvar.Map).Init()
+	// mailLatencyMu makes adding a template's histogram atomic.
+	mailLatencyMu sync.Mutex
+)
+
+func init() {
+	mailMetrics.Set("sent", mailSent)
+	mailMetrics.Set("failed", mailFailed)
+	mailMetrics.Set("retried", mailRetried)
+	mailMetrics.Set("latency", mailLatency)
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets. SMTP servers
+// answer in well under a second when they're healthy, and the dialer gives up at 5.
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is an expvar.Var counting durations into latencyBuckets. Like Prometheus
+// histograms the buckets are cumulative, each counting the durations up to its bound.
+type histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	count  int64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]int64, len(latencyBuckets)+1)
+	for i, bound := range latencyBuckets {
+		buckets[strconv.FormatFloat(bound.Seconds(), 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+	js, _ := json.Marshal(map[string]any{
+		"buckets":     buckets,
+		"count":       h.count,
+		"sum_seconds": h.sum.Seconds(),
+	})
+	return string(js)
+}
+
+// observeMail records an attempt at delivering an email in the mail metrics and logs
+// it. Emails which couldn't be sent at all are also logged by deadLetterMail.
+func (app *application) observeMail(a mailer.Attempt) {
+	template := a.Template
+	if template == "" {
+		template = "unknown"
+	}
+
+	mailLatencyMu.Lock()
+	h, ok := mailLatency.Get(template).(*histogram)
+	if !ok {
+		h = newHistogram()
+		mailLatency.Set(template, h)
+	}
+	mailLatencyMu.Unlock()
+	h.observe(a.Duration)
+
+	if a.Number > 1 {
+		mailRetried.Add(template, 1)
+	}
+	properties := map[string]string{
+		"template":    template,
+		"message_id":  a.MessageID,
+		"attempt":     strconv.Itoa(a.Number),
+		"duration_ms": strconv.FormatInt(a.Duration.Milliseconds(), 10),
+	}
+	if a.Err == nil {
+		mailSent.Add(template, 1)
+		app.logger.PrintInfo("email sent", properties)
+		return
+	}
+	if a.Final {
+		mailFailed.Add(template, 1)
+	}
+	properties["final"] = strconv.FormatBool(a.Final)
+	app.logger.PrintError(fmt.Errorf("email attempt failed: %w", a.Err), properties)
+}
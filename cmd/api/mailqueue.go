@@ -0,0 +1,117 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/mailer"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// mailQuota is the mailer.Quota kept in the database, so every instance counts
+// against the same limits.
+type mailQuota struct {
+	app *application
+}
+
+func (q mailQuota) Take(bulk bool) (time.Duration, error) {
+	return q.app.models.MailQuota.Take(q.app.config.mail.quota, bulk)
+}
+
+// queuedMail is the payload of a mail_send job. The attachments are kept apart from
+// the message, as a Message leaves their data out of its JSON.
+type queuedMail struct {
+	Message     mailer.Message     `json:"message"`
+	Attachments []queuedAttachment `json:"attachments,omitempty"`
+}
+
+type queuedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// deadLetterResend is the payload of a dead_letter_resend job.
+type deadLetterResend struct {
+	DeadLetterID int64 `json:"dead_letter_id"`
+}
+
+// deferMail queues an email which was over the mail quota, to be sent by a mail_send
+// job once there might be room for it. Queuing it in the database rather than waiting
+// in memory means it survives a restart, and it can be sent by any instance.
+func (app *application) deferMail(message mailer.Message, delay time.Duration) error {
+	payload := queuedMail{Message: message}
+	for _, a := range message.Attachments {
+		payload.Attachments = append(payload.Attachments, queuedAttachment{Filename: a.Filename, ContentType: a.ContentType, Data: a.Data})
+	}
+	payload.Message.Attachments = nil
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return app.enqueueJob(&data.Job{Kind: "mail_send", RunAt: time.Now().Add(delay), Payload: js})
+}
+
+// runMailSend sends an email deferred by deferMail. If the quota is still used up it's
+// deferred again without using an attempt, and if it can't be sent by its last
+// attempt it's dead-lettered.
+func (app *application) runMailSend(ctx context.Context, job *data.Job) (envelope, error) {
+	var input queuedMail
+	err := json.Unmarshal(job.Payload, &input)
+	if err != nil {
+		return nil, err
+	}
+	message := input.Message
+	for _, a := range input.Attachments {
+		message.Attachments = append(message.Attachments, mailer.Attachment{Filename: a.Filename, ContentType: a.ContentType, Data: a.Data})
+	}
+
+	err = app.mailer.SendMessage(message)
+	var overQuota *mailer.OverQuotaError
+	switch {
+	case errors.As(err, &overQuota):
+		return nil, &jobDeferred{after: overQuota.RetryAfter, err: err}
+	case err != nil && job.Attempts >= job.MaxAttempts:
+		app.deadLetterMail(mailer.Failure{Template: message.Template, Message: message, Attempts: job.Attempts, Err: err})
+		return nil, err
+	case err != nil:
+		return nil, err
+	}
+	return nil, nil
+}
+
+// runDeadLetterResend makes one more attempt to send a dead letter which has been
+// claimed for resending. If it fails, the dead letter goes back to pending.
+func (app *application) runDeadLetterResend(ctx context.Context, job *data.Job) (envelope, error) {
+	var input deadLetterResend
+	err := json.Unmarshal(job.Payload, &input)
+	if err != nil {
+		return nil, err
+	}
+	letter, err := app.models.DeadLetters.Get(input.DeadLetterID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.mailer.SendMessage(mailer.Message{
+		Template:  letter.Template,
+		To:        letter.Recipient,
+		From:      letter.Sender,
+		Subject:   letter.Subject,
+		PlainBody: letter.PlainBody,
+		HTMLBody:  letter.HTMLBody,
+	})
+	var overQuota *mailer.OverQuotaError
+	if errors.As(err, &overQuota) {
+		return nil, &jobDeferred{after: overQuota.RetryAfter, err: err}
+	}
+	if err != nil {
+		if err := app.models.DeadLetters.Release(letter.ID); err != nil {
+			app.logger.PrintError(err, map[string]string{"dead_letter_id": fmt.Sprint(letter.ID)})
+		}
+		return nil, fmt.Errorf("the email could not be sent: %w", err)
+	}
+	return envelope{"dead_letter": letter}, nil
+}
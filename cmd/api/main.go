@@ -2,14 +2,28 @@ package main
 
 import (
 	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/geoip"
 	"books.reading.kz/internal/jsonlog"
+	"books.reading.kz/internal/jwt"
 	"books.reading.kz/internal/mailer"
+	"books.reading.kz/internal/oauth"
+	"books.reading.kz/internal/storage"
+	"books.reading.kz/internal/timing"
+	"books.reading.kz/internal/totp"
+	"books.reading.kz/internal/validator"
+	"books.reading.kz/internal/webauthn"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,23 +32,267 @@ const version = "1.0.0"
 type config struct {
 	port int
 	env  string
-	db   struct {
+	// logLevel is the minimum severity logged until an admin sets one for every
+	// instance, which then overrides it.
+	logLevel string
+	// logFile, when it's set, is written to instead of stdout, and rotated once it
+	// reaches maxSize megabytes or maxAge. stdout writes to stdout as well.
+	logFile struct {
+		path       string
+		maxSize    int
+		maxAge     time.Duration
+		maxBackups int
+		stdout     bool
+	}
+
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		// targetSessionAttrs and healthCheckPeriod control how the pool follows a
+		// failover between database servers.
+		targetSessionAttrs string
+		healthCheckPeriod  time.Duration
+		// replicaDSN is an optional read replica. After a write, a user's reads go to
+		// the primary for replicaStickiness so they see their own changes.
+		replicaDSN        string
+		replicaStickiness time.Duration
+	}
+	// schema configures the check of the database's migration version at startup.
+	schema struct {
+		mismatch string
+		maxAhead int64
+	}
+	// readOnly turns off everything which writes to the database, for replicas which
+	// only serve reads.
+	readOnly bool
+	// publicCatalog lets anonymous clients list and show books.
+	publicCatalog bool
+	// robots configures robots.txt. text is read from file at startup.
+	robots struct {
+		file       string
+		text       string
+		crawlDelay time.Duration
+	}
+	// bootstrap holds the one-time token which lets provisioning create the first
+	// admin through POST /v1/bootstrap. The endpoint is off when it's empty.
+	bootstrap struct {
+		token     string
+		tokenFile string
 	}
 	limiter struct {
 		rps     float64 //e requests-per-second
 		burst   int
 		enabled bool
 	}
+	mail struct {
+		// provider is the name of the mailer.Provider emails are sent through;
+		// smtp uses the smtp settings below and the others the provider ones.
+		provider string
+		settings mailer.ProviderConfig
+		// templateDir optionally holds templates which override the embedded ones.
+		templateDir string
+		// dkimDomain, dkimSelector and dkimKeyFile turn on DKIM signing of emails
+		// sent over SMTP, with the PEM private key in dkimKeyFile.
+		dkimDomain   string
+		dkimSelector string
+		dkimKeyFile  string
+		// quota caps how many emails every instance together sends a minute and an
+		// hour, and how much of that bulk mail can use.
+		quota data.MailQuota
+	}
 	smtp struct {
 		host     string
 		port     int
 		username string
 		password string
 		sender   string
+		// retry says how many times to try sending each email before it's
+		// dead-lettered.
+		retry mailer.RetryPolicy
+	}
+	sandbox  bool
+	recorder struct {
+		size int
+	}
+	debug struct {
+		serverTiming bool
+	}
+	integrity struct {
+		interval   time.Duration
+		autoRepair bool
+	}
+	expand struct {
+		parallelism int
+	}
+	home struct {
+		refresh time.Duration
+	}
+	// warmup configures the optional warm-up run at startup, which /readyz waits for.
+	// conns is how many pool connections the hot queries are prepared on.
+	warmup struct {
+		enabled bool
+		timeout time.Duration
+		conns   int
+	}
+	activation struct {
+		// resendInterval is how long a user has to wait between activation emails.
+		resendInterval time.Duration
+	}
+	// locationsFile is an optional JSON location taxonomy which copies' branches, rooms
+	// and shelves are checked against.
+	locationsFile string
+	// currency is the currency fines are charged in, shown on receipts.
+	currency string
+	// jsonCase is the field name casing of responses which don't ask for one, either
+	// snake_case or camelCase.
+	jsonCase string
+	// ids says how the external IDs of new records are generated: one of
+	// data.IDStrategies, with node the Snowflake node ID.
+	ids struct {
+		strategy string
+		node     int
+	}
+	// baseURL is the public address of the API, used for links in emails.
+	baseURL   string
+	campaigns struct {
+		rate     float64
+		interval time.Duration
+	}
+	tokens struct {
+		cleanupInterval time.Duration
+		// cacheSize and cacheTTL configure the in-process token to user cache.
+		cacheSize int
+		cacheTTL  time.Duration
+		// permissionCacheSize and permissionCacheTTL configure the in-process cache of
+		// users' permissions.
+		permissionCacheSize int
+		permissionCacheTTL  time.Duration
+		// usageInterval is how often recorded token uses are written to the database.
+		usageInterval time.Duration
+		// idleTimeout is how long an authentication token can go unused before it's
+		// deleted. Zero keeps tokens until they expire.
+		idleTimeout time.Duration
+		// reauthWindow is how recently the user must have logged in to change the ways
+		// they can log in.
+		reauthWindow time.Duration
+	}
+	// abuse configures the scraper defences. honeypots is parsed from
+	// honeypotList.
+	abuse struct {
+		honeypotList  string
+		honeypots     map[string]bool
+		allowlistList string
+		allowlist     []*net.IPNet
+		action        string
+		banDuration   time.Duration
+		threshold     int
+		window        time.Duration
+		delay         time.Duration
+		maxTarpitted  int
+	}
+	// anomalies configures the checks made on each successful login. geoipFile is
+	// needed for the country and travel checks. newDevices emails users about
+	// sessions started from devices they haven't used before.
+	anomalies struct {
+		enabled        bool
+		newDevices     bool
+		geoipFile      string
+		accountsPerIP  int
+		accountsWindow time.Duration
+		maxSpeed       float64
+	}
+	activity struct {
+		// lastSeenInterval is how often a user's last_seen_at is updated while they're
+		// making requests.
+		lastSeenInterval time.Duration
+	}
+	impersonation struct {
+		// maxTTL is the longest an impersonation token can be valid for.
+		maxTTL time.Duration
+	}
+	devices struct {
+		// offlineAfter is how long a kiosk can go without being seen before it's
+		// reported as offline.
+		offlineAfter time.Duration
+	}
+	readingSessions struct {
+		timeout time.Duration
+	}
+	digests struct {
+		interval time.Duration
+	}
+	analytics struct {
+		// dir is where anonymized usage exports are written. Exports are off if
+		// it's empty.
+		dir      string
+		key      string
+		interval time.Duration
+	}
+	retention struct {
+		policy   data.RetentionPolicy
+		interval time.Duration
+		// dryRun makes the scheduled runs only report what they would delete.
+		dryRun bool
+	}
+	// jobs configures this instance's job workers. concurrency is parsed from
+	// concurrencyList.
+	jobs struct {
+		workers         int
+		pollInterval    time.Duration
+		concurrencyList string
+		concurrency     map[string]int
+		// retention is how long finished jobs, with their payloads and results, are
+		// kept for.
+		retention time.Duration
+	}
+	escalation struct {
+		interval time.Duration
+		// stepList is the -escalation-steps flag, which is parsed into steps.
+		stepList string
+		steps    []data.EscalationStep
+	}
+	oauth struct {
+		google struct {
+			clientID     string
+			clientSecret string
+		}
+		github struct {
+			clientID     string
+			clientSecret string
+		}
+	}
+	totp struct {
+		key string
+	}
+	// webauthn configures passkeys. originList is the comma separated -webauthn-origins
+	// flag.
+	webauthn struct {
+		rpID       string
+		originList string
+	}
+	// passwordDenylist is an optional file of leaked passwords, one per line, which
+	// new passwords are checked against as well as the built in list.
+	passwordDenylist string
+	// passwordHashing configures how new password hashes are made. Existing hashes
+	// are rehashed with these settings when their user next logs in.
+	passwordHashing struct {
+		algorithm     string
+		bcryptCost    int
+		argon2Time    uint
+		argon2Memory  uint
+		argon2Threads uint
+	}
+	lockout struct {
+		threshold int
+		duration  time.Duration
+		max       time.Duration
+	}
+	jwt struct {
+		enabled bool
+		keys    string
+		ttl     time.Duration
 	}
 }
 
@@ -44,6 +302,54 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	// done is closed when the server starts shutting down, to tell periodic
+	// background jobs to stop.
+	done chan struct{}
+	jobs jobRunner
+	// queue counts the jobs this instance's workers are running.
+	queue *jobQueue
+	// inbox holds the emails "sent" in sandbox mode. It's nil otherwise.
+	inbox *mailer.Inbox
+	// recorder keeps debug recordings of requests. It's nil unless enabled with the
+	// -debug-recording-size flag.
+	recorder *requestRecorder
+	home     homeCache
+	// ready is set once the server has warmed up, or straight away without a warm-up.
+	ready atomic.Bool
+	// jwtKeys verifies JWT access tokens. It's nil unless -jwt-keys is set.
+	jwtKeys *jwt.Keys
+	// writers remembers which users recently made a change, for read-your-writes
+	// consistency when a replica is configured.
+	writers recentWriters
+	// oauthProviders are the configured social login providers, keyed by the name used
+	// in /v1/auth/:provider URLs.
+	oauthProviders map[string]*oauth.Provider
+	// totp encrypts two-factor secrets. It's nil unless -totp-key is set, in which
+	// case users can't enroll.
+	totp *totp.Cipher
+	// webauthn checks passkey registrations and logins. It's nil unless
+	// -webauthn-rp-id is set, in which case passkeys can't be used.
+	webauthn *webauthn.RelyingParty
+	// locations is the location taxonomy loaded from -locations-file, or nil.
+	locations *data.LocationTaxonomy
+	// tokenCache caches the users authentication tokens belong to. It's nil if
+	// disabled with -token-cache-size=0.
+	tokenCache *tokenCache
+	// geoip locates IP addresses for login anomaly checks. It's nil unless
+	// -geoip-file is set.
+	geoip *geoip.Database
+	// schema is the result of the schema check made at startup.
+	schema data.SchemaStatus
+	// permissionCache caches users' permissions. It's nil if disabled with
+	// -permission-cache-ttl=0.
+	permissionCache *permissionCache
+	// abuse holds the client bans in force.
+	abuse *abuseGuard
+	// tokenUsage batches up the last-used details of authentication tokens.
+	tokenUsage *tokenUsage
+	// exports is where analytics exports are saved. It's nil unless -analytics-dir
+	// is set.
+	exports storage.Store
 }
 
 func main() {
@@ -51,25 +357,341 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.logLevel, "log-level", "info", "Minimum severity of log entries written (debug|info|warn|error)")
+	flag.StringVar(&cfg.logFile.path, "log-file", "", "File to write the log to instead of stdout")
+	flag.IntVar(&cfg.logFile.maxSize, "log-file-max-size", 100, "Size in megabytes at which the log file is rotated (0 disables)")
+	flag.DurationVar(&cfg.logFile.maxAge, "log-file-max-age", 24*time.Hour, "Age at which the log file is rotated (0 disables)")
+	flag.IntVar(&cfg.logFile.maxBackups, "log-file-backups", 7, "Number of rotated log files to keep (0 keeps them all)")
+	flag.BoolVar(&cfg.logFile.stdout, "log-stdout", false, "Write the log to stdout as well as -log-file")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("BOOK_DB_DSN"), "PostgreSQL DSN")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.StringVar(&cfg.db.targetSessionAttrs, "db-target-session-attrs", "read-write", "Kind of server to connect to when the DSN lists several hosts (any|read-write|read-only|primary|standby|prefer-standby), any by default with -read-only")
+	flag.StringVar(&cfg.db.replicaDSN, "db-replica-dsn", os.Getenv("BOOK_DB_REPLICA_DSN"), "PostgreSQL DSN of a read replica (optional)")
+	flag.DurationVar(&cfg.db.replicaStickiness, "db-replica-stickiness", 5*time.Second, "How long a user's reads go to the primary after they make a change")
+	flag.DurationVar(&cfg.db.healthCheckPeriod, "db-health-check-period", 15*time.Second, "Interval between health checks of the database connections")
 
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.abuse.honeypotList, "honeypot-paths", "", "Comma separated decoy paths, such as /v1/books/export, which get any client requesting them banned")
+	flag.StringVar(&cfg.abuse.action, "abuse-action", data.BanTarpit, "What's done to banned clients (tarpit|shadow_ban)")
+	flag.DurationVar(&cfg.abuse.banDuration, "abuse-ban-duration", 24*time.Hour, "How long a client stays banned")
+	flag.IntVar(&cfg.abuse.threshold, "abuse-threshold", 50, "Rate limited requests within -abuse-window which get a client banned (0 disables)")
+	flag.DurationVar(&cfg.abuse.window, "abuse-window", 10*time.Minute, "Window rate limited requests are counted over")
+	flag.DurationVar(&cfg.abuse.delay, "tarpit-delay", 10*time.Second, "How long each request from a banned client is held for")
+	flag.IntVar(&cfg.abuse.maxTarpitted, "tarpit-max", 1000, "Most requests held by the tarpit at once; banned clients' requests beyond this aren't delayed")
+	flag.StringVar(&cfg.abuse.allowlistList, "abuse-allowlist", "", "Comma separated IP addresses and CIDR ranges, such as office NATs, which are never banned")
+	flag.StringVar(&cfg.schema.mismatch, "schema-mismatch", "refuse", "What to do if the database schema doesn't match this version of the code (refuse|degraded|ignore); degraded serves read-only")
+	flag.Int64Var(&cfg.schema.maxAhead, "schema-max-ahead", 10, "How many migrations newer than this code the database schema can be")
+	flag.BoolVar(&cfg.readOnly, "read-only", false, "Refuse every request which makes changes with 503, and don't run background jobs which write")
+	flag.BoolVar(&cfg.publicCatalog, "public-catalog", false, "Let unauthenticated clients list and show books (still rate limited)")
+	flag.StringVar(&cfg.jsonCase, "json-case", caseSnake, "Field name casing of JSON responses, snake_case or camelCase; clients can ask for either with an Accept profile")
+	flag.StringVar(&cfg.ids.strategy, "id-strategy", data.IDUUIDv4, "How external IDs of new books, users, copies, lists, reading sessions and loans are generated: "+strings.Join(data.IDStrategies, ", "))
+	flag.IntVar(&cfg.ids.node, "snowflake-node", 0, "Node ID put into Snowflake IDs, unique to each shard (0-1023)")
+	flag.StringVar(&cfg.bootstrap.token, "bootstrap-token", os.Getenv("BOOK_BOOTSTRAP_TOKEN"), "Token which allows creating the first admin with POST /v1/bootstrap (optional)")
+	flag.StringVar(&cfg.bootstrap.tokenFile, "bootstrap-token-file", "", "File to read the bootstrap token from, instead of -bootstrap-token")
+	flag.StringVar(&cfg.robots.file, "robots-file", "", "File served as robots.txt instead of the one generated from the crawler policy")
+	flag.DurationVar(&cfg.robots.crawlDelay, "crawl-delay", 0, "Delay crawlers are asked to leave between requests (0 keeps them within the rate limiter)")
+
+	// The SMTP defaults suit a local catcher such as MailHog.
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 1025, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("BOOK_SMTP_USERNAME"), "SMTP username (none for no authentication)")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("BOOK_SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Book-Inspire <no-reply@localhost>", "Sender of emails, whichever -mail-provider sends them")
+
+	mailProviderUsage := "How emails are sent: " + strings.Join(mailer.Providers, ", ") + " (required; log and file only in development)"
+	flag.StringVar(&cfg.mail.provider, "mail-provider", "", mailProviderUsage)
+	flag.StringVar(&cfg.mail.provider, "mail-backend", "", "Alias of -mail-provider")
+	flag.StringVar(&cfg.mail.settings.Dir, "mail-dir", "tmp/mail", "Maildir the file provider saves emails in")
+	flag.StringVar(&cfg.mail.settings.APIKey, "mail-api-key", os.Getenv("BOOK_MAIL_API_KEY"), "SendGrid or Mailgun API key")
+	flag.StringVar(&cfg.mail.settings.BaseURL, "mail-api-url", "", "Replaces the provider's API address, e.g. https://api.eu.mailgun.net (optional)")
+	flag.StringVar(&cfg.mail.templateDir, "mail-template-dir", "", "Directory of email templates which replace the built-in ones with the same file names (optional)")
+	flag.StringVar(&cfg.mail.dkimDomain, "dkim-domain", "", "Domain emails sent over SMTP are DKIM signed for (optional)")
+	flag.StringVar(&cfg.mail.dkimSelector, "dkim-selector", "", "DKIM selector the public key is published under, at <selector>._domainkey.<domain>")
+	flag.StringVar(&cfg.mail.dkimKeyFile, "dkim-key-file", "", "PEM file with the RSA or Ed25519 DKIM private key")
+	flag.StringVar(&cfg.mail.settings.MailgunDomain, "mailgun-domain", "", "Mailgun sending domain")
+	flag.StringVar(&cfg.mail.settings.SESRegion, "ses-region", os.Getenv("AWS_REGION"), "Amazon SES region")
+	flag.StringVar(&cfg.mail.settings.SESAccessKeyID, "ses-access-key-id", os.Getenv("AWS_ACCESS_KEY_ID"), "Amazon SES access key ID")
+	flag.StringVar(&cfg.mail.settings.SESSecretAccessKey, "ses-secret-access-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Amazon SES secret access key")
+	cfg.mail.settings.SESSessionToken = os.Getenv("AWS_SESSION_TOKEN")
+
+	flag.IntVar(&cfg.smtp.retry.Attempts, "smtp-attempts", 3, "Attempts at sending each email before it's dead-lettered")
+	flag.DurationVar(&cfg.smtp.retry.Backoff, "smtp-backoff", 2*time.Second, "Wait before the first retry of an email, doubling for each retry after")
+	flag.DurationVar(&cfg.smtp.retry.MaxBackoff, "smtp-max-backoff", 30*time.Second, "Longest wait between retries of an email")
+	flag.IntVar(&cfg.mail.quota.PerMinute, "mail-rate-minute", 0, "Most emails sent a minute by every instance together, with the rest queued (0 for no limit)")
+	flag.IntVar(&cfg.mail.quota.PerHour, "mail-rate-hour", 0, "Most emails sent an hour by every instance together, with the rest queued (0 for no limit)")
+	flag.IntVar(&cfg.mail.quota.BulkPercent, "mail-bulk-percent", 80, "Percentage of the mail rate limits campaigns and digests can use, keeping the rest for transactional mail")
+	flag.BoolVar(&cfg.sandbox, "sandbox", false, "Sandbox mode: store emails in a local inbox at /v1/dev/emails instead of sending them")
+
+	flag.IntVar(&cfg.recorder.size, "debug-recording-size", 0, "Number of debug request recordings to keep (0 disables recording)")
+
+	flag.BoolVar(&cfg.debug.serverTiming, "debug-server-timing", false, "Include a Server-Timing header with a breakdown of where each request spent its time")
+
+	flag.DurationVar(&cfg.integrity.interval, "integrity-interval", time.Hour, "Interval between database integrity checks (0 disables)")
+	flag.BoolVar(&cfg.integrity.autoRepair, "integrity-auto-repair", false, "Automatically repair safe database integrity problems")
+
+	flag.StringVar(&cfg.oauth.google.clientID, "oauth-google-client-id", os.Getenv("BOOK_OAUTH_GOOGLE_CLIENT_ID"), "Google OAuth client ID (enables Google login)")
+	flag.StringVar(&cfg.oauth.google.clientSecret, "oauth-google-client-secret", os.Getenv("BOOK_OAUTH_GOOGLE_CLIENT_SECRET"), "Google OAuth client secret")
+	flag.StringVar(&cfg.oauth.github.clientID, "oauth-github-client-id", os.Getenv("BOOK_OAUTH_GITHUB_CLIENT_ID"), "GitHub OAuth client ID (enables GitHub login)")
+	flag.StringVar(&cfg.oauth.github.clientSecret, "oauth-github-client-secret", os.Getenv("BOOK_OAUTH_GITHUB_CLIENT_SECRET"), "GitHub OAuth client secret")
+
+	flag.StringVar(&cfg.webauthn.rpID, "webauthn-rp-id", "", "Domain passkeys are registered for, such as books.example.kz (enables passkey login)")
+	flag.StringVar(&cfg.webauthn.originList, "webauthn-origins", "", "Comma separated origins of the pages passkeys are used from (default https://<webauthn-rp-id>)")
+	flag.StringVar(&cfg.totp.key, "totp-key", os.Getenv("BOOK_TOTP_KEY"), "Base64 encoded 32 byte key used to encrypt two-factor secrets (enables two-factor authentication)")
+
+	flag.StringVar(&cfg.passwordHashing.algorithm, "password-hash", data.DefaultPasswordHashing.Algorithm, "Algorithm new password hashes are made with (bcrypt|argon2id)")
+	flag.IntVar(&cfg.passwordHashing.bcryptCost, "bcrypt-cost", data.DefaultPasswordHashing.BcryptCost, "bcrypt cost factor")
+	flag.UintVar(&cfg.passwordHashing.argon2Time, "argon2-time", uint(data.DefaultPasswordHashing.Argon2Time), "Argon2id passes over memory")
+	flag.UintVar(&cfg.passwordHashing.argon2Memory, "argon2-memory", uint(data.DefaultPasswordHashing.Argon2Memory), "Argon2id memory in KiB")
+	flag.UintVar(&cfg.passwordHashing.argon2Threads, "argon2-threads", uint(data.DefaultPasswordHashing.Argon2Threads), "Argon2id parallelism")
+	flag.StringVar(&cfg.passwordDenylist, "password-denylist", "", "File of leaked or common passwords, one per line, which new passwords may not use")
+
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Failed logins in a row from one IP before the account is locked for that IP (0 disables lockout)")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", time.Minute, "How long the first lockout lasts; each further lockout doubles it")
+	flag.DurationVar(&cfg.lockout.max, "lockout-max", 24*time.Hour, "Longest a lockout can last")
+
+	flag.BoolVar(&cfg.jwt.enabled, "jwt-enabled", false, "Issue stateless JWT access tokens instead of database-backed tokens")
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", os.Getenv("BOOK_JWT_KEYS"), "Comma separated id:secret JWT signing keys; the first signs new tokens, all are accepted")
+	flag.DurationVar(&cfg.jwt.ttl, "jwt-ttl", 15*time.Minute, "Lifetime of JWT access tokens")
 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.office365.com", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 587, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "211037@astanait.edu.kz", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "Aitu2021!", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "211037@astanait.edu.kz", "SMTP sender")
+	flag.DurationVar(&cfg.activation.resendInterval, "activation-resend-interval", 5*time.Minute, "How long a user has to wait before another activation email can be sent to them")
+
+	flag.StringVar(&cfg.locationsFile, "locations-file", "", "JSON file of the branches, rooms and shelves copies can be shelved at (any location is accepted if not set)")
+
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4000", "Public base URL of the API, used for links in emails")
+
+	flag.Float64Var(&cfg.campaigns.rate, "campaign-rate", 5, "Maximum number of campaign emails each instance sends per second")
+	flag.DurationVar(&cfg.campaigns.interval, "campaign-interval", 30*time.Second, "Interval between checks for email campaigns which are due")
+
+	flag.DurationVar(&cfg.activity.lastSeenInterval, "last-seen-interval", 5*time.Minute, "How often a user's last seen time is updated while they're active (0 disables)")
+	flag.StringVar(&cfg.currency, "currency", "KZT", "Currency code fines are charged in, shown on receipts")
+	flag.DurationVar(&cfg.impersonation.maxTTL, "impersonation-max-ttl", time.Hour, "Longest time an admin's impersonation token can be valid for")
+	flag.DurationVar(&cfg.devices.offlineAfter, "device-offline-after", 5*time.Minute, "How long a kiosk can go without a heartbeat before it's reported as offline")
+	flag.DurationVar(&cfg.tokens.cleanupInterval, "token-cleanup-interval", time.Hour, "Interval between deletions of expired tokens (0 disables)")
+	flag.IntVar(&cfg.tokens.cacheSize, "token-cache-size", 10000, "Number of authentication tokens whose users are cached in memory (0 disables the cache)")
+	flag.DurationVar(&cfg.tokens.cacheTTL, "token-cache-ttl", 30*time.Second, "How long a token's user is cached for before it's looked up again")
+	flag.IntVar(&cfg.tokens.permissionCacheSize, "permission-cache-size", 10000, "Number of users whose permissions are cached in memory")
+	flag.DurationVar(&cfg.tokens.permissionCacheTTL, "permission-cache-ttl", 10*time.Second, "How long a user's permissions are cached for (0 disables the cache)")
+	flag.DurationVar(&cfg.tokens.usageInterval, "token-usage-interval", time.Minute, "Interval between writes of when authentication tokens were last used (0 disables tracking)")
+	flag.DurationVar(&cfg.tokens.idleTimeout, "token-idle-timeout", 30*24*time.Hour, "How long an authentication token can go unused before it's deleted (0 disables)")
+	flag.DurationVar(&cfg.tokens.reauthWindow, "reauth-window", 10*time.Minute, "How recently a user must have logged in to link or unlink a way of logging in")
+	flag.BoolVar(&cfg.anomalies.enabled, "login-alerts", true, "Check logins for signs of account takeover and email the user about suspicious ones")
+	flag.StringVar(&cfg.anomalies.geoipFile, "geoip-file", "", "CSV file of networks and their country, latitude and longitude, for location based login checks")
+	flag.IntVar(&cfg.anomalies.accountsPerIP, "login-alert-accounts-per-ip", 5, "Number of accounts logging in from one IP address within -login-alert-accounts-window which is suspicious (0 disables)")
+	flag.DurationVar(&cfg.anomalies.accountsWindow, "login-alert-accounts-window", time.Hour, "Window the accounts logging in from one IP address are counted over")
+	flag.Float64Var(&cfg.anomalies.maxSpeed, "login-alert-max-speed", 1000, "Speed in km/h between consecutive login locations which is suspicious (0 disables)")
+	flag.BoolVar(&cfg.anomalies.newDevices, "new-device-alerts", true, "Email users a link to sign out sessions started from devices they haven't logged in with before")
+	flag.DurationVar(&cfg.readingSessions.timeout, "reading-session-timeout", 4*time.Hour, "How long a reading session can stay open before it's closed automatically (0 disables)")
+	flag.DurationVar(&cfg.digests.interval, "digest-interval", time.Hour, "Interval between checks for digests which are due (0 disables digests)")
+	flag.StringVar(&cfg.analytics.dir, "analytics-dir", "", "Directory anonymized usage exports are written to for the analytics team (exports are off if not set)")
+	flag.StringVar(&cfg.analytics.key, "analytics-key", os.Getenv("BOOK_ANALYTICS_KEY"), "Secret user IDs are hashed with in analytics exports; keep it the same so exports can be joined")
+	flag.DurationVar(&cfg.analytics.interval, "analytics-interval", time.Hour, "Interval between checks for analytics exports which are due")
+	flag.IntVar(&cfg.retention.policy.AuditLogMonths, "retention-audit-log-months", 24, "Months security events are kept for (0 keeps them forever)")
+	flag.IntVar(&cfg.retention.policy.EmailLogMonths, "retention-email-log-months", 12, "Months the recipients of campaign emails are kept for (0 keeps them forever)")
+	flag.IntVar(&cfg.retention.policy.SearchLogMonths, "retention-search-log-months", 12, "Months logged searches are kept for (0 keeps them forever)")
+	flag.IntVar(&cfg.retention.policy.DeadLetterDays, "retention-dead-letter-days", 30, "Days emails which couldn't be sent are kept for (0 keeps them forever)")
+	flag.IntVar(&cfg.retention.policy.InactiveAccountYears, "retention-inactive-account-years", 0, "Years an account can go unused before it's anonymized (0 never anonymizes accounts)")
+	flag.DurationVar(&cfg.retention.interval, "retention-interval", 24*time.Hour, "Interval between runs of the data retention rules (0 disables them)")
+	flag.BoolVar(&cfg.retention.dryRun, "retention-dry-run", false, "Only report what the scheduled data retention runs would delete or anonymize")
+	flag.DurationVar(&cfg.escalation.interval, "escalation-interval", time.Hour, "Interval between runs of the overdue loan escalation steps (0 disables escalation)")
+	flag.StringVar(&cfg.escalation.stepList, "escalation-steps", data.DefaultEscalationSteps, "Comma separated name=days escalation steps taken relative to a loan's due date (reminder, overdue, block and invoice)")
+	flag.DurationVar(&cfg.home.refresh, "home-refresh", 5*time.Minute, "Interval between rebuilds of the cached home page payload (0 disables caching)")
+
+	flag.BoolVar(&cfg.warmup.enabled, "warmup", false, "Warm caches and prepared statements at startup before /readyz reports ready")
+	flag.DurationVar(&cfg.warmup.timeout, "warmup-timeout", 30*time.Second, "Longest the warm-up can take before the server is reported ready anyway")
+	flag.IntVar(&cfg.warmup.conns, "warmup-conns", 4, "Number of database connections the warm-up prepares statements on")
+
+	flag.IntVar(&cfg.jobs.workers, "job-workers", 4, "Number of queued jobs this instance runs at once (0 leaves them to other instances)")
+	flag.DurationVar(&cfg.jobs.pollInterval, "job-poll-interval", time.Second, "Interval between checks of the job queue for jobs which are due")
+	flag.StringVar(&cfg.jobs.concurrencyList, "job-concurrency", "", "Comma separated kind=n limits on how many jobs of a kind this instance runs at once, overriding the defaults")
+	flag.DurationVar(&cfg.jobs.retention, "job-retention", 7*24*time.Hour, "Time finished jobs and their results are kept for (0 keeps them forever)")
+
+	flag.IntVar(&cfg.expand.parallelism, "expand-parallelism", 4, "Maximum number of ?expand= queries run concurrently for a request")
 
 	flag.Parse()
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	if cfg.logFile.path != "" {
+		if cfg.logFile.maxSize < 0 || cfg.logFile.maxAge < 0 || cfg.logFile.maxBackups < 0 {
+			logger.PrintFatal(errors.New("-log-file-max-size, -log-file-max-age and -log-file-backups must be at least 0"), nil)
+		}
+		logFile, err := jsonlog.OpenRotatingFile(cfg.logFile.path, int64(cfg.logFile.maxSize)<<20, cfg.logFile.maxAge, cfg.logFile.maxBackups)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		var out io.Writer = logFile
+		if cfg.logFile.stdout {
+			out = io.MultiWriter(os.Stdout, logFile)
+		}
+		logger = jsonlog.New(out, jsonlog.LevelInfo)
+	}
+	setDefaultLogger(logger)
+	logLevel, err := jsonlog.ParseLevel(cfg.logLevel)
+	if err != nil {
+		logger.PrintFatal(errors.New("-log-level must be debug, info, warn or error"), nil)
+	}
+	logger.SetMinLevel(logLevel)
+
+	if cfg.sandbox && cfg.env == "production" {
+		logger.PrintFatal(errors.New("sandbox mode can't be used in production"), nil)
+	}
+
+	cfg.abuse.honeypots, err = parseHoneypotPaths(cfg.abuse.honeypotList)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	cfg.abuse.allowlist, err = parseAllowlist(cfg.abuse.allowlistList)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// The provider has to be chosen, so that a server never ends up quietly logging
+	// emails, tokens and all, instead of sending them. The log and file providers
+	// write the emails out in full, so they're only for development. Sandbox mode
+	// keeps emails in its own inbox and doesn't need one.
+	if cfg.mail.provider == "" && !cfg.sandbox {
+		logger.PrintFatal(fmt.Errorf("-mail-provider must be set to one of %s", strings.Join(mailer.Providers, ", ")), nil)
+	}
+	if (cfg.mail.provider == "log" || cfg.mail.provider == "file") && cfg.env != "development" {
+		logger.PrintFatal(fmt.Errorf("-mail-provider %s can only be used in development", cfg.mail.provider), nil)
+	}
+	cfg.mail.settings.Log = logger.PrintInfo
+	cfg.mail.settings.Host = cfg.smtp.host
+	cfg.mail.settings.Port = cfg.smtp.port
+	cfg.mail.settings.Username = cfg.smtp.username
+	cfg.mail.settings.Password = cfg.smtp.password
+	if cfg.mail.dkimDomain != "" || cfg.mail.dkimSelector != "" || cfg.mail.dkimKeyFile != "" {
+		if cfg.mail.provider != "smtp" {
+			logger.PrintFatal(errors.New("DKIM signing only applies to -mail-provider smtp; other providers sign with the keys set up in the service"), nil)
+		}
+		if cfg.mail.dkimKeyFile == "" {
+			logger.PrintFatal(errors.New("-dkim-key-file is needed for DKIM signing"), nil)
+		}
+		key, err := os.ReadFile(cfg.mail.dkimKeyFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		cfg.mail.settings.DKIM, err = mailer.NewDKIM(cfg.mail.dkimDomain, cfg.mail.dkimSelector, key)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	mailProvider, err := mailer.NewProvider(cfg.mail.provider, cfg.mail.settings)
+	if err != nil && !cfg.sandbox {
+		logger.PrintFatal(err, nil)
+	}
+	if cfg.smtp.retry.Attempts < 1 {
+		logger.PrintFatal(errors.New("-smtp-attempts must be at least 1"), nil)
+	}
+	if cfg.mail.quota.PerMinute < 0 || cfg.mail.quota.PerHour < 0 {
+		logger.PrintFatal(errors.New("-mail-rate-minute and -mail-rate-hour must be at least 0"), nil)
+	}
+	if cfg.mail.quota.BulkPercent < 1 || cfg.mail.quota.BulkPercent > 100 {
+		logger.PrintFatal(errors.New("-mail-bulk-percent must be between 1 and 100"), nil)
+	}
+	// A read-only server is usually pointed at a standby, so it connects to any server
+	// unless told otherwise, and can't be told to insist on the primary.
+	if cfg.readOnly {
+		attrsSet := false
+		flag.Visit(func(f *flag.Flag) {
+			attrsSet = attrsSet || f.Name == "db-target-session-attrs"
+		})
+		switch {
+		case !attrsSet:
+			cfg.db.targetSessionAttrs = "any"
+		case cfg.needsPrimary():
+			logger.PrintFatal(fmt.Errorf("-db-target-session-attrs %s can't be used with -read-only, which is meant for standbys; use any, read-only, standby or prefer-standby", cfg.db.targetSessionAttrs), nil)
+		}
+	}
+	if cfg.jsonCase != caseSnake && cfg.jsonCase != caseCamel {
+		logger.PrintFatal(errors.New("-json-case must be snake_case or camelCase"), nil)
+	}
+	if !validator.PermittedValue(cfg.ids.strategy, data.IDStrategies...) {
+		logger.PrintFatal(fmt.Errorf("-id-strategy must be one of %s", strings.Join(data.IDStrategies, ", ")), nil)
+	}
+	if cfg.ids.node < 0 || cfg.ids.node > data.MaxSnowflakeNode {
+		logger.PrintFatal(fmt.Errorf("-snowflake-node must be between 0 and %d", data.MaxSnowflakeNode), nil)
+	}
+	if cfg.campaigns.rate <= 0 {
+		logger.PrintFatal(errors.New("-campaign-rate must be positive"), nil)
+	}
+	if cfg.expand.parallelism < 1 {
+		logger.PrintFatal(errors.New("-expand-parallelism must be at least 1"), nil)
+	}
+	if cfg.warmup.enabled && (cfg.warmup.conns < 1 || cfg.warmup.timeout <= 0) {
+		logger.PrintFatal(errors.New("-warmup-conns and -warmup-timeout must be positive"), nil)
+	}
+	if cfg.schema.mismatch != "refuse" && cfg.schema.mismatch != "degraded" && cfg.schema.mismatch != "ignore" {
+		logger.PrintFatal(errors.New("-schema-mismatch must be refuse, degraded or ignore"), nil)
+	}
+	if cfg.abuse.action != data.BanTarpit && cfg.abuse.action != data.BanShadow {
+		logger.PrintFatal(errors.New("-abuse-action must be tarpit or shadow_ban"), nil)
+	}
+	if cfg.abuse.maxTarpitted < 0 {
+		logger.PrintFatal(errors.New("-tarpit-max can't be negative"), nil)
+	}
+
+	if cfg.bootstrap.tokenFile != "" {
+		token, err := os.ReadFile(cfg.bootstrap.tokenFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		cfg.bootstrap.token = strings.TrimSpace(string(token))
+	}
+	if cfg.bootstrap.token != "" && len(cfg.bootstrap.token) < 16 {
+		logger.PrintFatal(errors.New("the bootstrap token must be at least 16 characters"), nil)
+	}
+
+	if cfg.robots.file != "" {
+		text, err := os.ReadFile(cfg.robots.file)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		cfg.robots.text = string(text)
+	}
+
+	cfg.escalation.steps, err = data.ParseEscalationSteps(cfg.escalation.stepList)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	cfg.jobs.concurrency, err = parseJobConcurrency(cfg.jobs.concurrencyList)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if cfg.jobs.pollInterval <= 0 {
+		logger.PrintFatal(errors.New("-job-poll-interval must be positive"), nil)
+	}
+
+	if cfg.passwordHashing.argon2Threads > 255 {
+		logger.PrintFatal(errors.New("-argon2-threads must be at most 255"), nil)
+	}
+	err = data.SetPasswordHashing(data.PasswordHashing{
+		Algorithm:     cfg.passwordHashing.algorithm,
+		BcryptCost:    cfg.passwordHashing.bcryptCost,
+		Argon2Time:    uint32(cfg.passwordHashing.argon2Time),
+		Argon2Memory:  uint32(cfg.passwordHashing.argon2Memory),
+		Argon2Threads: uint8(cfg.passwordHashing.argon2Threads),
+	})
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.passwordDenylist != "" {
+		f, err := os.Open(cfg.passwordDenylist)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		n, err := data.LoadCommonPasswords(f)
+		f.Close()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("password deny-list loaded", map[string]string{"passwords": strconv.Itoa(n)})
+	}
 
 	db, err := openDB(cfg)
 	if err != nil {
@@ -80,11 +702,252 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	var replica *pgxpool.Pool
+	if cfg.db.replicaDSN != "" {
+		replicaCfg := cfg
+		replicaCfg.db.dsn = cfg.db.replicaDSN
+		replicaCfg.db.targetSessionAttrs = "any"
+		replica, err = openDB(replicaCfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer replica.Close()
+
+		logger.PrintInfo("database replica connection pool established", nil)
+	}
+
+	// Check that migrations have brought the database to a schema this code can use,
+	// as running against the wrong one fails confusingly on the first query which
+	// touches whatever changed.
+	version, dirty, err := data.SchemaModel{DB: db}.Version()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	schema := data.CheckSchema(version, dirty, cfg.schema.maxAhead)
+	if !schema.Compatible {
+		properties := map[string]string{"version": strconv.FormatInt(version, 10), "expected": schema.Expected}
+		switch cfg.schema.mismatch {
+		case "refuse":
+			logger.PrintFatal(errors.New(schema.Problem), properties)
+		case "degraded":
+			properties["mode"] = "read-only"
+			cfg.readOnly = true
+		}
+		logger.PrintError(errors.New(schema.Problem), properties)
+	}
+
+	// A read-only server leaves the writing to the main servers: background jobs
+	// and the bookkeeping done on each request are all turned off.
+	if cfg.readOnly {
+		cfg.integrity.autoRepair = false
+		cfg.campaigns.interval = 0
+		cfg.tokens.cleanupInterval = 0
+		cfg.tokens.usageInterval = 0
+		cfg.readingSessions.timeout = 0
+		cfg.digests.interval = 0
+		cfg.escalation.interval = 0
+		cfg.retention.interval = 0
+		cfg.activity.lastSeenInterval = 0
+		cfg.anomalies.enabled = false
+		cfg.anomalies.newDevices = false
+		cfg.jobs.workers = 0
+		cfg.jobs.retention = 0
+	}
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		models: data.NewModels(db, replica),
+		mailer: mailer.NewWithProvider(mailProvider, cfg.smtp.sender),
+		done:   make(chan struct{}),
+		schema: schema,
+	}
+	app.queue = newJobQueue(cfg.jobs.workers, cfg.jobs.concurrency)
+	app.tokenCache = newTokenCache(cfg.tokens.cacheSize, cfg.tokens.cacheTTL)
+	app.tokenUsage = newTokenUsage()
+	app.permissionCache = newPermissionCache(cfg.tokens.permissionCacheSize, cfg.tokens.permissionCacheTTL)
+	app.abuse = newAbuseGuard(cfg.abuse.maxTarpitted)
+	app.loadClientBans()
+
+	// The database generates external IDs, so it's told the configured strategy. Every
+	// server sharing the database should be configured the same.
+	if !cfg.readOnly {
+		err = app.models.IDGeneration.Set(cfg.ids.strategy, cfg.ids.node)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.jwt.keys != "" {
+		app.jwtKeys, err = jwt.ParseKeys(cfg.jwt.keys)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	} else if cfg.jwt.enabled {
+		logger.PrintFatal(errors.New("-jwt-enabled needs -jwt-keys"), nil)
+	}
+
+	if cfg.anomalies.geoipFile != "" {
+		f, err := os.Open(cfg.anomalies.geoipFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		app.geoip, err = geoip.Read(f)
+		f.Close()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.locationsFile != "" {
+		f, err := os.Open(cfg.locationsFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		app.locations, err = data.ReadLocationTaxonomy(f)
+		f.Close()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.analytics.dir != "" {
+		if cfg.analytics.key == "" {
+			logger.PrintFatal(errors.New("-analytics-dir needs -analytics-key"), nil)
+		}
+		app.exports = storage.Dir{Root: cfg.analytics.dir}
+	}
+
+	if cfg.totp.key != "" {
+		app.totp, err = totp.NewCipher(cfg.totp.key)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.webauthn.rpID != "" {
+		var origins []string
+		for _, origin := range strings.Split(cfg.webauthn.originList, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+		app.webauthn, err = webauthn.New(cfg.webauthn.rpID, webauthnRPName, origins)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	app.oauthProviders = make(map[string]*oauth.Provider)
+	if cfg.oauth.google.clientID != "" {
+		app.oauthProviders["google"] = oauth.Google(cfg.oauth.google.clientID, cfg.oauth.google.clientSecret)
+	}
+	if cfg.oauth.github.clientID != "" {
+		app.oauthProviders["github"] = oauth.GitHub(cfg.oauth.github.clientID, cfg.oauth.github.clientSecret)
+	}
+
+	if cfg.recorder.size > 0 {
+		app.recorder = newRequestRecorder(cfg.recorder.size)
+	}
+
+	if cfg.sandbox {
+		app.inbox = mailer.NewInbox(100)
+		app.mailer = mailer.NewSandbox(cfg.smtp.sender, app.inbox)
+		logger.PrintInfo("sandbox mode enabled, emails will not be sent", nil)
+	}
+	app.mailer = app.mailer.WithRetries(cfg.smtp.retry, app.deadLetterMail).WithObserver(app.observeMail)
+	// The quota is kept in the database so that it's shared by every instance, and
+	// transactional mail over it is queued as a job rather than waiting in memory.
+	if cfg.mail.quota.Enabled() && !cfg.readOnly {
+		app.mailer = app.mailer.WithQuota(mailQuota{app}, app.deferMail)
+	}
+	if cfg.mail.templateDir != "" {
+		app.mailer, err = app.mailer.WithTemplateDir(cfg.mail.templateDir)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("email templates overridden", map[string]string{"dir": cfg.mail.templateDir})
+	}
+
+	if cfg.integrity.interval > 0 {
+		app.periodic(cfg.integrity.interval, func() {
+			_, err := app.runIntegrityCheck(context.Background(), cfg.integrity.autoRepair, nil)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	app.watchPrimary(db)
+
+	if cfg.jobs.workers > 0 {
+		app.runJobQueue()
+	}
+
+	if cfg.jobs.retention > 0 {
+		app.periodic(time.Hour, app.deleteFinishedJobs)
+	}
+
+	if cfg.campaigns.interval > 0 {
+		app.periodic(cfg.campaigns.interval, app.dispatchCampaigns)
+	}
+
+	if cfg.tokens.cleanupInterval > 0 {
+		app.periodic(cfg.tokens.cleanupInterval, app.deleteExpiredTokens)
+	}
+
+	app.periodic(time.Minute, app.loadClientBans)
+	app.loadLogLevel()
+	app.periodic(logLevelRefresh, app.loadLogLevel)
+
+	if cfg.tokens.usageInterval > 0 {
+		app.runTokenUsageFlusher(cfg.tokens.usageInterval)
+	}
+
+	if cfg.readingSessions.timeout > 0 {
+		app.periodic(5*time.Minute, app.closeForgottenSessions)
+	}
+
+	if cfg.digests.interval > 0 {
+		app.periodic(cfg.digests.interval, app.sendDigests)
+	}
+
+	if cfg.escalation.interval > 0 && len(cfg.escalation.steps) > 0 {
+		app.periodic(cfg.escalation.interval, app.runEscalations)
+	}
+
+	if cfg.retention.interval > 0 {
+		app.periodic(cfg.retention.interval, func() {
+			_, err := app.runRetention(context.Background(), cfg.retention.dryRun, nil)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	if app.exports != nil && cfg.analytics.interval > 0 {
+		app.periodic(cfg.analytics.interval, app.exportAnalytics)
+	}
+
+	if replica != nil {
+		app.periodic(time.Minute, func() {
+			app.writers.prune(cfg.db.replicaStickiness)
+		})
+	}
+
+	if cfg.home.refresh > 0 {
+		app.periodic(cfg.home.refresh, func() {
+			_, err := app.refreshHome()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	if cfg.warmup.enabled {
+		app.background(app.warmUp)
+	} else {
+		app.ready.Store(true)
 	}
 
 	err = app.serve()
@@ -94,19 +957,35 @@ func main() {
 }
 
 func openDB(cfg config) (*pgxpool.Pool, error) {
-	var err error
-	db, err := pgxpool.New(context.Background(), cfg.db.dsn)
+	// The pool settings have to be applied to the config before the pool is created,
+	// as Config() on an existing pool only returns a copy.
+	poolConfig, err := pgxpool.ParseConfig(cfg.db.dsn)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to connect to database:", err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	db.Config().MaxConns = int32(cfg.db.maxOpenConns)
+	poolConfig.MaxConns = int32(cfg.db.maxOpenConns)
 	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
 	if err != nil {
 		return nil, err
 	}
-	db.Config().MaxConnIdleTime = duration
+	poolConfig.MaxConnIdleTime = duration
+
+	err = configureFailover(cfg, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the duration of each query for the Server-Timing header.
+	if cfg.debug.serverTiming {
+		poolConfig.ConnConfig.Tracer = timing.QueryTracer{}
+	}
+
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to database:", err)
+		os.Exit(1)
+	}
 	// Create a context with a 5-second timeout deadline.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/jwt"
 	"books.reading.kz/internal/validator"
 	"errors"
 	"fmt"
@@ -38,6 +39,23 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// rejectWrites refuses every request which could change something when the server is
+// running with -read-only. Logging in counts, as it issues tokens.
+func (app *application) rejectWrites(next http.Handler) http.Handler {
+	if !app.config.readOnly {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions,
+			strings.HasPrefix(r.URL.Path, "/v1/auth/"):
+			app.readOnlyResponse(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
 func (app *application) rateLimit(next http.Handler) http.Handler {
 
 	type client struct {
@@ -90,6 +108,10 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
+				threshold := app.config.abuse.threshold
+				if n := app.abuse.strike(ip, app.config.abuse.window); threshold > 0 && n >= threshold {
+					app.banClient(ip, fmt.Sprintf("rate limited %d times", n))
+				}
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
@@ -123,12 +145,24 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
+		if len(headerParts) == 2 && headerParts[0] == "Device" {
+			app.authenticateDevice(w, r, headerParts[1], next)
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
+		if app.jwtKeys != nil && jwt.IsToken(token) {
+			app.authenticateJWT(w, r, token, next)
+			return
+		}
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
@@ -141,16 +175,37 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Retrieve the details of the user associated with the authentication token,
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
-		if err != nil {
-			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
-			default:
-				app.serverErrorResponse(w, r, err)
+		// ScopeAuthentication as the first parameter here. Recently used tokens are
+		// answered from the token cache instead.
+		user := app.tokenCache.get(token)
+		if user == nil {
+			var err error
+			user, err = app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
 			}
-			return
+			app.tokenCache.add(token, user)
+		}
+		if app.config.tokens.usageInterval > 0 {
+			app.tokenUsage.record(token, clientIP(r), r.UserAgent())
+		}
+		// Any request other than a read might change the user, so drop their cached
+		// tokens once it's done rather than trying to work out which requests do.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			defer app.tokenCache.invalidateUser(user.ID)
+		}
+		// Requests made with an impersonation token are the admin's, not the user's,
+		// so they're flagged instead of counting as the user being seen.
+		if user.ImpersonatorID != 0 {
+			app.flagImpersonatedRequest(r, user)
+		} else {
+			app.recordSeen(r, user)
 		}
 		// Call the contextSetUser() helper to add the user information to the request
 		// context.
@@ -160,6 +215,24 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// recordSeen updates when the user was last seen, but only once the previous time is
+// older than -last-seen-interval, so that active users don't cause a write on every
+// request. Failures are logged rather than failing the request.
+func (app *application) recordSeen(r *http.Request, user *data.User) {
+	interval := app.config.activity.lastSeenInterval
+	if interval <= 0 || (user.LastSeenAt != nil && time.Since(*user.LastSeenAt) < interval) {
+		return
+	}
+	err := app.models.Users.RecordSeen(user.ID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+	// The cached user still has the old time, which would make every request until
+	// the entry expires update it again.
+	app.tokenCache.invalidateUser(user.ID)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -187,12 +260,211 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireUnscopedUser guards the routes which manage the account itself, such as its
+// profile, settings and tokens. No permission covers them, so API keys and scoped
+// tokens, which only grant the permissions in their scopes, are refused.
+func (app *application) requireUnscopedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil || app.contextGetUser(r).TokenScopes != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requireRecentLogin checks that an activated user logged in within the
+// -reauth-window with a token or JWT of their own, so that one which has been stolen
+// can't be used to take over the account by changing how it's logged in to. API keys,
+// impersonation and scoped tokens are refused outright.
+func (app *application) requireRecentLogin(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if app.contextGetAPIKey(r) != nil || user.ImpersonatorID != 0 || user.TokenScopes != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		if user.AuthenticatedAt.IsZero() || time.Since(user.AuthenticatedAt) > app.config.tokens.reauthWindow {
+			app.reauthenticationRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireActivatedUser(fn)
+}
+
+// authenticateAPIKey is the part of authenticate() which handles an
+// "Authorization: ApiKey <key>" header.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	// A read-only server can't record that the key was used.
+	useKey := app.models.APIKeys.Use
+	if app.config.readOnly {
+		useKey = app.models.APIKeys.GetForKey
+	}
+	key, err := useKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// API keys aren't revoked by a legal hold, so that they work again once it's
+	// released, but they can't be used while it lasts.
+	if user.FrozenAt != nil {
+		app.accountFrozenResponse(w, r)
+		return
+	}
+
+	app.recordSeen(r, user)
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateDevice is the part of authenticate() which handles an
+// "Authorization: Device <key>" header sent by a kiosk. Kiosks don't act as a user, so
+// the request is otherwise anonymous and only the kiosk endpoints will accept it.
+func (app *application) authenticateDevice(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateDeviceKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	useDevice := app.models.Devices.Use
+	if app.config.readOnly {
+		useDevice = app.models.Devices.GetForKey
+	}
+	device, err := useDevice(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, data.AnonymousUser)
+	r = app.contextSetDevice(r, device)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateJWT is the part of authenticate() which handles JWT access tokens. The
+// token itself is checked without touching the database, and the permissions are
+// taken from its claims, but the user is still loaded so that handlers see the
+// complete record (and deleted users are turned away).
+func (app *application) authenticateJWT(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	claims, err := app.jwtKeys.Verify(token, time.Now())
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(claims.Subject, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Changing the password bumps the user's token version, logging out every JWT
+	// issued before then.
+	if claims.Version != user.TokenVersion {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	// JWTs are only issued at login, so that's when it was.
+	user.AuthenticatedAt = time.Unix(claims.IssuedAt, 0)
+	if claims.Scoped {
+		user.TokenScopes = claims.Permissions
+	}
+
+	app.recordSeen(r, user)
+	r = app.contextSetUser(r, user)
+	r = app.contextSetClaims(r, claims)
+	next.ServeHTTP(w, r)
+}
+
+// permissionsFor returns the permissions the user has for this request. When the
+// request was authenticated with a JWT they come from its claims, and with an API key
+// they're limited to the key's scopes.
+func (app *application) permissionsFor(r *http.Request, user *data.User) (data.Permissions, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+
+	permissions, ok := app.permissionCache.get(user.ID)
+	if !ok {
+		var err error
+		permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		app.permissionCache.add(user.ID, permissions)
+	}
+	if key := app.contextGetAPIKey(r); key != nil {
+		permissions = permissions.Restrict(key.Scopes)
+	}
+	if user.TokenScopes != nil {
+		permissions = permissions.Restrict(user.TokenScopes)
+	}
+	return permissions, nil
+}
+
+// requireDevice only lets kiosks through.
+func (app *application) requireDevice(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetDevice(r) == nil {
+			app.deviceRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireCatalogRead guards the endpoints which read the catalog. They need the
+// books:read permission, unless -public-catalog is set, in which case anyone can use
+// them (still subject to the rate limiter).
+func (app *application) requireCatalogRead(next http.HandlerFunc) http.HandlerFunc {
+	if app.config.publicCatalog {
+		return next
+	}
+	return app.requirePermission("books:read", next)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permissions granted by the user's roles.
+		permissions, err := app.permissionsFor(r, user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// checkNewDevice emails the user if the session was started from a device they
+// haven't logged in with before, which is told apart by its user agent's browser and
+// operating system, with a link to sign it straight back out. The first login to an account isn't from a new
+// device, as there's nothing to compare it with.
+func (app *application) checkNewDevice(user *data.User, login *data.SecurityEvent, session *data.Token) {
+	history, err := app.models.SecurityEvents.LoginHistory(user.ID, login.ID, login.IP, login.Country, login.UserAgent)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+		return
+	}
+	if history.Logins == 0 || history.SeenDevice {
+		return
+	}
+
+	token, err := app.models.Tokens.NewSessionRevoke(session)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+		return
+	}
+
+	err = app.models.SecurityEvents.Insert(&data.SecurityEvent{
+		UserID:    &user.ID,
+		Email:     user.Email,
+		Event:     data.EventNewDevice,
+		Outcome:   data.OutcomeSuccess,
+		Detail:    fmt.Sprintf("token %d", session.ID),
+		IP:        login.IP,
+		UserAgent: login.UserAgent,
+		Country:   login.Country,
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+	}
+
+	where := login.IP
+	if login.Country != "" {
+		where = fmt.Sprintf("%s (%s)", login.IP, login.Country)
+	}
+	tmplData := map[string]any{
+		"name":       user.Name,
+		"loggedInAt": login.CreatedAt.UTC().Format("2 January 2006 at 15:04 UTC"),
+		"where":      where,
+		"userAgent":  login.UserAgent,
+		"revokeURL":  app.config.baseURL + "/v1/tokens/revoke/" + token.Plaintext,
+	}
+	err = app.mailer.SendLocalized(user.Email, app.userLanguage(user.ID), "new_device.tmpl", tmplData)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// showRevokeSessionPageHandler is where the link in a new device email opens. It
+// only asks the user to confirm, which posts to revokeSessionLinkHandler, so a mail
+// scanner following the link doesn't sign the session out.
+func (app *application) showRevokeSessionPageHandler(w http.ResponseWriter, r *http.Request) {
+	app.writePage(w, r, http.StatusOK, page{
+		Title:   "Sign out the new device",
+		Message: "If you didn't log in from this device, sign it out, then change your password straight away.",
+		Button:  "Sign it out",
+	})
+}
+
+// revokeSessionLinkHandler signs out the session a new device email was about, without
+// the user having to log in, when they confirm on its page. The link stops working
+// once the session has ended.
+func (app *application) revokeSessionLinkHandler(w http.ResponseWriter, r *http.Request) {
+	plaintext := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	var user *data.User
+	err := data.ErrRecordNotFound
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, plaintext); v.Valid() {
+		user, err = app.models.Users.GetForToken(data.ScopeSessionRevoke, plaintext)
+	}
+	var id int64
+	if err == nil {
+		id, err = app.models.Tokens.RevokeSession(plaintext)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && wantsHTML(r):
+			app.writePage(w, r, http.StatusUnprocessableEntity, page{
+				Title:   "Sign out the new device",
+				Message: "This link is invalid or has expired, the session may already have ended. You can sign out your other sessions in your account settings.",
+			})
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired link, the session may already have ended")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventTokenRevoked, data.OutcomeSuccess, fmt.Sprintf("token %d from new device email", id))
+
+	if wantsHTML(r) {
+		app.writePage(w, r, http.StatusOK, page{
+			Title:   "Signed out",
+			Message: "The session has been signed out. If it wasn't you, please change your password.",
+		})
+		return
+	}
+	env := envelope{"message": "the session has been signed out, if it wasn't you please change your password"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
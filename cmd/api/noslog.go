@@ -0,0 +1,8 @@
+//go:build !go1.21
+
+package main
+
+import "books.reading.kz/internal/jsonlog"
+
+// setDefaultLogger does nothing before Go 1.21, which has no log/slog.
+func setDefaultLogger(logger *jsonlog.Logger) {}
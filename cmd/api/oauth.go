@@ -0,0 +1,298 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/oauth"
+	"books.reading.kz/internal/validator"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oauthStateCookie holds the random state sent to the provider, so that the callback
+// can check it was started by this browser.
+const oauthStateCookie = "oauth_state"
+
+// oauthStateTTL is how long the user has to get through the provider's consent page.
+const oauthStateTTL = 10 * time.Minute
+
+// oauthProvider returns the configured provider named in the URL, or sends a 404
+// response and returns nil.
+func (app *application) oauthProvider(w http.ResponseWriter, r *http.Request) *oauth.Provider {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	provider, ok := app.oauthProviders[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return provider
+}
+
+func (app *application) oauthRedirectURI(provider *oauth.Provider) string {
+	return app.config.baseURL + "/v1/auth/" + provider.Name + "/callback"
+}
+
+// oauthLoginHandler redirects the user to the provider's consent page.
+func (app *application) oauthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.oauthProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	app.setOAuthState(w, provider, state)
+	http.Redirect(w, r, provider.AuthCodeURL(state, app.oauthRedirectURI(provider)), http.StatusFound)
+}
+
+// setOAuthState sets the cookie the callback checks the state against.
+func (app *application) setOAuthState(w http.ResponseWriter, provider *oauth.Provider, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/v1/auth/" + provider.Name,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oauthCallbackHandler completes the login. The provider's account is matched to a
+// local user by a previous link, then by verified email address, and otherwise a new
+// user is created. The response is the same authentication token as a password login.
+// If the state is a link token, the account is instead linked to the user who started
+// linking it, and the response is their login methods.
+func (app *application) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.oauthProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	qs := r.URL.Query()
+	if qs.Get("error") != "" {
+		app.errorResponse(w, r, http.StatusUnauthorized, "login was cancelled or refused by the provider")
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(qs.Get("state"))) != 1 {
+		app.badRequestResponse(w, r, errors.New("invalid or missing oauth state"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/v1/auth/" + provider.Name, MaxAge: -1})
+
+	code := qs.Get("code")
+	if code == "" {
+		app.badRequestResponse(w, r, errors.New("missing authorization code"))
+		return
+	}
+
+	linking, err := app.models.Users.GetForToken(data.ScopeOAuthLink, qs.Get("state"))
+	switch {
+	case err == nil:
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeOAuthLink, linking.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		linking = nil
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), code, app.oauthRedirectURI(provider))
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrExchangeFailed):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if linking != nil {
+		app.linkOAuthIdentity(w, r, linking, identity)
+		return
+	}
+
+	user, err := app.userForIdentity(r, identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrNoVerifiedEmail):
+			app.errorResponse(w, r, http.StatusForbidden, "your account with this provider has no verified email address")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tf, err := app.twoFactorEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf != nil {
+		challenge, err := app.models.Tokens.New(user.ID, twoFactorChallengeTTL, data.ScopeTwoFactorChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.recordSecurityEvent(r, user, "", data.EventLogin, data.OutcomeFailure, "two-factor code required")
+		app.twoFactorChallengeResponse(w, r, challenge.Plaintext)
+		return
+	}
+
+	if !app.checkFrozen(w, r, user) {
+		return
+	}
+	login := app.recordLogin(r, user, provider.Name)
+	app.issueAuthenticationToken(w, r, user, login, nil)
+}
+
+// userForIdentity finds or creates the local user for the provider's identity. The
+// provider has verified the email address, so users matched or created by it are
+// activated. Accounts without a verified email are refused, as we'd have no way to
+// check the address belongs to them.
+func (app *application) userForIdentity(r *http.Request, identity *oauth.Identity) (*data.User, error) {
+	userID, err := app.models.Identities.GetUserID(identity.Provider, identity.Subject)
+	if err == nil {
+		return app.models.Users.Get(userID, r)
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, oauth.ErrNoVerifiedEmail
+	}
+
+	user, err := app.models.Users.GetByEmail(identity.Email, r)
+	switch {
+	case err == nil:
+		if !user.Activated {
+			return app.claimUnactivatedUser(r, user, identity)
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createOAuthUser(r, identity)
+		if err != nil {
+			return nil, err
+		}
+		err = app.models.Identities.Link(user.ID, identity.Provider, identity.Subject)
+		if err != nil {
+			return nil, err
+		}
+		// They don't know the random password, so it mustn't count as a way of
+		// logging in that would let them unlink their only identity.
+		return user, app.models.Identities.DisablePassword(user.ID)
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(user.ID, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// claimUnactivatedUser hands an account which was registered with the identity's
+// email address, but never activated, to the identity. Nothing shows that whoever
+// registered it owns the address; it may have been someone setting a trap for the
+// address's real owner. So everything they could have set up is undone before the
+// account is activated: their password stops working, every token issued for the
+// account is revoked, and two-factor enrollment and any pending email change are
+// dropped.
+func (app *application) claimUnactivatedUser(r *http.Request, user *data.User, identity *oauth.Identity) (*data.User, error) {
+	user.Activated = true
+	user.PendingEmail = ""
+	err := app.models.Users.Update(user, r)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Identities.Link(user.ID, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Identities.DisablePassword(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeActivation, data.ScopeEmailChange} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = app.models.TwoFactor.Delete(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventIdentityLinked, data.OutcomeSuccess,
+		identity.Provider+": unactivated account claimed, password and tokens revoked")
+	return app.models.Users.Get(user.ID, r)
+}
+
+// createOAuthUser registers a new activated user for the identity. They're given a
+// random password they don't know, so they can only log in through the provider.
+func (app *application) createOAuthUser(r *http.Request, identity *oauth.Identity) (*data.User, error) {
+	name := identity.Name
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if len(name) > 500 {
+		name = name[:500]
+	}
+
+	// The random password is only there because every user has one; nobody knows
+	// it, and the user can't log in with it until they set their own.
+	user := &data.User{
+		Name:      name,
+		Email:     identity.Email,
+		Activated: true,
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, errors.New("invalid user from oauth provider " + identity.Provider)
+	}
+
+	err = app.models.Users.Insert(user, r)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Roles.AddForUser(user.ID, data.DefaultRole)
+	if err != nil {
+		return nil, err
+	}
+	_, err = app.setSignupLanguage(r, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
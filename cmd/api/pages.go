@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// page is a minimal HTML page for the links in emails, which are opened in a browser
+// rather than by an API client. Following a link mustn't change anything, as mail
+// scanners and link previews follow them too, so a page with a Button asks the user
+// to confirm, by posting an empty form back to the same URL.
+type page struct {
+	Title   string
+	Message string
+	Button  string
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!doctype html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width" />
+<meta charset="utf-8" />
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Button}}<form method="post"><button type="submit">{{.Button}}</button></form>
+{{end}}</body>
+</html>
+`))
+
+// writePage renders p with the given status code. Pages mustn't be framed, so a
+// confirmation button can't be clicked through another site.
+func (app *application) writePage(w http.ResponseWriter, r *http.Request, status int, p page) {
+	var buf bytes.Buffer
+	err := pageTemplate.Execute(&buf, p)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// wantsHTML reports whether the request came from a browser, such as the form on a
+// confirmation page, rather than an API client or a mail client unsubscribing.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
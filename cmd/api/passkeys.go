@@ -0,0 +1,397 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"books.reading.kz/internal/webauthn"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webauthnRPName is the name authenticators show the user for the site.
+const webauthnRPName = "Book-Inspire"
+
+// passkeyChallengeTTL is how long the user has to answer their browser's passkey
+// prompt.
+const passkeyChallengeTTL = 5 * time.Minute
+
+// credentialJSON is a PublicKeyCredential as the browser's toJSON() encodes it, with
+// the binary values in base64url. The response fields are those of the attestation
+// for registration, and of the assertion for login.
+type credentialJSON struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+// decodeCredential decodes the credential's binary fields which are in fields, with
+// the ID and the client data always, adding an error to v for each which isn't valid
+// base64url. The fields are named as in the JSON.
+func decodeCredential(v *validator.Validator, credential *credentialJSON, fields ...string) map[string][]byte {
+	values := map[string]string{
+		"id":                credential.ID,
+		"clientDataJSON":    credential.Response.ClientDataJSON,
+		"attestationObject": credential.Response.AttestationObject,
+		"authenticatorData": credential.Response.AuthenticatorData,
+		"signature":         credential.Response.Signature,
+		"userHandle":        credential.Response.UserHandle,
+	}
+	v.Check(credential.Type == "public-key", "credential", "must be a public-key credential")
+
+	decoded := make(map[string][]byte)
+	for _, field := range append([]string{"id", "clientDataJSON"}, fields...) {
+		b, err := webauthn.Encoding.DecodeString(values[field])
+		v.Check(err == nil && len(b) > 0, "credential", fmt.Sprintf("must have %s in base64url", field))
+		decoded[field] = b
+	}
+	return decoded
+}
+
+// credentialDescriptors lists the passkeys for the browser, so it can tell whether
+// an authenticator already has one of them.
+func credentialDescriptors(passkeys []*data.Passkey) []map[string]any {
+	descriptors := make([]map[string]any, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		descriptor := map[string]any{
+			"type": "public-key",
+			"id":   webauthn.Encoding.EncodeToString(passkey.CredentialID),
+		}
+		if len(passkey.Transports) > 0 {
+			descriptor["transports"] = passkey.Transports
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors
+}
+
+// createPasskeyChallengeHandler starts registering a passkey. The response is the
+// options to pass to navigator.credentials.create(), which are camelCased as the
+// WebAuthn specification has them, so that they can be handed to
+// PublicKeyCredential.parseCreationOptionsFromJSON() as they are. The credential must
+// be discoverable, as logging in doesn't say which passkeys an email address has,
+// and the authenticator must verify the user.
+func (app *application) createPasskeyChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	existing, err := app.models.Passkeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Passkeys.NewChallenge(challenge, data.CeremonyRegister, user.ID, passkeyChallengeTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	params := make([]map[string]any, 0, len(webauthn.Algorithms))
+	for _, alg := range webauthn.Algorithms {
+		params = append(params, map[string]any{"type": "public-key", "alg": alg})
+	}
+	options := map[string]any{
+		"challenge": webauthn.Encoding.EncodeToString(challenge),
+		"rp":        map[string]any{"id": app.webauthn.ID, "name": app.webauthn.Name},
+		// The user handle is the external ID, which says nothing about the user to
+		// anyone who reads it off the authenticator.
+		"user": map[string]any{
+			"id":          webauthn.Encoding.EncodeToString([]byte(user.ExternalID)),
+			"name":        user.Email,
+			"displayName": user.Name,
+		},
+		"pubKeyCredParams":   params,
+		"timeout":            passkeyChallengeTTL.Milliseconds(),
+		"excludeCredentials": credentialDescriptors(existing),
+		"authenticatorSelection": map[string]any{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+		"attestation": "none",
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"public_key": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// registerPasskeyHandler finishes registering a passkey with the credential the
+// browser created for the challenge.
+func (app *application) registerPasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string         `json:"name"`
+		Credential credentialJSON `json:"credential"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	decoded := decodeCredential(v, &input.Credential, "attestationObject")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	challenge, err := webauthn.Challenge(decoded["clientDataJSON"])
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	userID, err := app.models.Passkeys.UseChallenge(challenge, data.CeremonyRegister)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if userID != user.ID {
+		v.AddError("credential", "must answer a challenge issued to you within the last 5 minutes")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	credential, err := app.webauthn.Register(challenge, decoded["clientDataJSON"], decoded["attestationObject"])
+	if err != nil {
+		switch {
+		case errors.Is(err, webauthn.ErrInvalidResponse):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !credential.UserVerified {
+		app.badRequestResponse(w, r, webauthn.ErrNotVerified)
+		return
+	}
+	if !bytes.Equal(credential.ID, decoded["id"]) {
+		app.badRequestResponse(w, r, errors.New("the credential's id doesn't match its attestation"))
+		return
+	}
+
+	passkey := &data.Passkey{
+		UserID:       user.ID,
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+		SignCount:    int64(credential.SignCount),
+		Name:         input.Name,
+		Transports:   []string{},
+	}
+	// Transports are only a hint, so ones from newer browsers than we know of are
+	// dropped rather than refused.
+	for _, transport := range input.Credential.Response.Transports {
+		if validator.PermittedValue(transport, data.PasskeyTransports...) && !validator.PermittedValue(transport, passkey.Transports...) {
+			passkey.Transports = append(passkey.Transports, transport)
+		}
+	}
+	if passkey.Name == "" {
+		passkey.Name = "Passkey"
+	}
+	if data.ValidatePasskey(v, passkey); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Passkeys.Insert(passkey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePasskey):
+			app.stateConflictResponse(w, r, "this passkey is already registered")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventIdentityLinked, data.OutcomeSuccess, fmt.Sprintf("passkey %d", passkey.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"passkey": passkey}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPasskeysHandler lists the user's passkeys.
+func (app *application) listPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := app.models.Passkeys.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"passkeys": passkeys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deletePasskeyHandler removes one of the user's passkeys, unless it's their only
+// way of logging in.
+func (app *application) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Passkeys.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastLoginMethod):
+			app.stateConflictResponse(w, r, "you can't remove your only way of logging in, link another one first")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventIdentityUnlinked, data.OutcomeSuccess, fmt.Sprintf("passkey %d", id))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "passkey successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasskeyLoginChallengeHandler starts logging in with a passkey. The response
+// is the options to pass to navigator.credentials.get(), camelCased like those for
+// registration. It's the same for everyone: the browser offers the user's
+// discoverable credentials, rather than being told which passkeys an email address
+// has, which would say who has an account and which authenticators they use.
+func (app *application) createPasskeyLoginChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Passkeys.NewChallenge(challenge, data.CeremonyLogin, 0, passkeyChallengeTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	options := map[string]any{
+		"challenge":        webauthn.Encoding.EncodeToString(challenge),
+		"rpId":             app.webauthn.ID,
+		"timeout":          passkeyChallengeTTL.Milliseconds(),
+		"allowCredentials": []map[string]any{},
+		"userVerification": "required",
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"public_key": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasskeyTokenHandler logs in with the passkey the browser signed the challenge
+// with. The passkey stands in for both the password and a two-factor code, as it's
+// something the user has which is unlocked by something they know or are. The
+// response is the same authentication token as a password login.
+func (app *application) createPasskeyTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Credential credentialJSON `json:"credential"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	decoded := decodeCredential(v, &input.Credential, "authenticatorData", "signature")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	challenge, err := webauthn.Challenge(decoded["clientDataJSON"])
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	_, err = app.models.Passkeys.UseChallenge(challenge, data.CeremonyLogin)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordSecurityEvent(r, nil, "", data.EventLogin, data.OutcomeFailure, "expired passkey challenge")
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	passkey, err := app.models.Passkeys.GetByCredentialID(decoded["id"])
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordSecurityEvent(r, nil, "", data.EventLogin, data.OutcomeFailure, "unknown passkey")
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.models.Users.Get(passkey.UserID, r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if handle := input.Credential.Response.UserHandle; handle != "" && handle != webauthn.Encoding.EncodeToString([]byte(user.ExternalID)) {
+		app.loginFailedResponse(w, r, user, "passkey user handle doesn't match")
+		return
+	}
+	if !app.checkLockout(w, r, user) {
+		return
+	}
+
+	signCount, err := app.webauthn.Login(challenge, passkey.PublicKey, uint32(passkey.SignCount),
+		decoded["clientDataJSON"], decoded["authenticatorData"], decoded["signature"])
+	if err == nil {
+		err = app.models.Passkeys.RecordUse(passkey.ID, int64(signCount))
+		if errors.Is(err, data.ErrEditConflict) {
+			err = webauthn.ErrCloned
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, webauthn.ErrInvalidResponse), errors.Is(err, webauthn.ErrInvalidSignature):
+			app.loginFailedResponse(w, r, user, "invalid passkey response")
+		case errors.Is(err, webauthn.ErrNotVerified):
+			app.loginFailedResponse(w, r, user, "passkey user not verified")
+		case errors.Is(err, webauthn.ErrCloned):
+			app.loginFailedResponse(w, r, user, fmt.Sprintf("passkey %d may have been cloned", passkey.ID))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkFrozen(w, r, user) {
+		return
+	}
+	err = app.loginSucceeded(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	login := app.recordLogin(r, user, "passkey")
+	app.issueAuthenticationToken(w, r, user, login, nil)
+}
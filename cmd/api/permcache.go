@@ -0,0 +1,103 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// permissionCacheMetrics counts permission cache lookups, published at /debug/vars.
+var permissionCacheMetrics = expvar.NewMap("permission_cache")
+
+func init() {
+	permissionCacheMetrics.Set("hit_rate", expvar.Func(func() any {
+		hits, _ := permissionCacheMetrics.Get("hits").(*expvar.Int)
+		misses, _ := permissionCacheMetrics.Get("misses").(*expvar.Int)
+		if hits == nil || misses == nil || hits.Value()+misses.Value() == 0 {
+			return 0.0
+		}
+		return float64(hits.Value()) / float64(hits.Value()+misses.Value())
+	}))
+}
+
+// permissionCache remembers each user's permissions for a short TTL, so protected
+// requests don't each cost a query. Grants and revocations made through this instance
+// invalidate the user's entry straight away; those made by other instances are
+// picked up once it expires.
+//
+// A nil *permissionCache is valid and caches nothing.
+type permissionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[int64]permissionCacheEntry
+}
+
+type permissionCacheEntry struct {
+	permissions data.Permissions
+	expires     time.Time
+}
+
+// newPermissionCache returns a cache holding up to size users, or nil if ttl isn't
+// positive.
+func newPermissionCache(size int, ttl time.Duration) *permissionCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &permissionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[int64]permissionCacheEntry),
+	}
+}
+
+// get returns the user's cached permissions, and false if they aren't cached. The
+// slice is shared, so callers mustn't change it.
+func (c *permissionCache) get(userID int64) (data.Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if !ok || time.Now().After(entry.expires) {
+		permissionCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+	permissionCacheMetrics.Add("hits", 1)
+	return entry.permissions, true
+}
+
+func (c *permissionCache) add(userID int64, permissions data.Permissions) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		// Make room by dropping expired entries, or everything if none have expired
+		// yet; this only happens with more active users than the cache holds.
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= c.size {
+			c.entries = make(map[int64]permissionCacheEntry)
+		}
+	}
+	c.entries[userID] = permissionCacheEntry{permissions: permissions, expires: now.Add(c.ttl)}
+}
+
+// invalidate forgets the user's permissions. It's called whenever their roles or
+// grants change.
+func (c *permissionCache) invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"net/http"
+	"time"
+)
+
+func (app *application) showBranchHoursHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	hours, err := app.models.Branches.GetHours(branch.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"timezone": branch.Timezone, "hours": hours}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateBranchHoursHandler replaces a branch's opening hours. Days which aren't listed
+// are days the branch is closed.
+func (app *application) updateBranchHoursHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	var input struct {
+		Hours []data.OpeningHours `json:"hours"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateOpeningHours(v, input.Hours); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Branches.SetHours(branch.ID, input.Hours)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	hours, err := app.models.Branches.GetHours(branch.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"timezone": branch.Timezone, "hours": hours}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// branchPickupSlots returns the branch's pickup slots on the day, in the branch's
+// timezone, which haven't started yet.
+func (app *application) branchPickupSlots(branch *data.LibraryBranch, year int, month time.Month, day int) ([]time.Time, error) {
+	hours, err := app.models.Branches.GetHours(branch.ID)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := data.PickupSlots(branch, hours, year, month, day)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	upcoming := slots[:0]
+	for _, slot := range slots {
+		if slot.After(now) {
+			upcoming = append(upcoming, slot)
+		}
+	}
+	return upcoming, nil
+}
+
+// listPickupSlotsHandler lists the branch's pickup slots on ?date= (today by default)
+// with the number of places left in each.
+func (app *application) listPickupSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+
+	loc, err := time.LoadLocation(branch.Timezone)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	date := time.Now().In(loc)
+	if s := app.readString(r.URL.Query(), "date", ""); s != "" {
+		date, err = time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			v := validator.New()
+			v.AddError("date", "must be a date in the format YYYY-MM-DD")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	slots, err := app.branchPickupSlots(branch, date.Year(), date.Month(), date.Day())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	length := time.Duration(branch.PickupSlotMinutes) * time.Minute
+	result := []data.PickupSlot{}
+	if len(slots) > 0 && branch.PickupCapacity > 0 {
+		booked, err := app.models.Pickups.CountBooked(branch.ID, slots[0], slots[len(slots)-1].Add(length))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, slot := range slots {
+			result = append(result, data.PickupSlot{
+				Start:     slot,
+				End:       slot.Add(length),
+				Remaining: int(branch.PickupCapacity) - booked[slot.Unix()],
+			})
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"pickup_slots": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// bookPickupHandler books a pickup slot at the branch for the user, and emails them a
+// confirmation.
+func (app *application) bookPickupHandler(w http.ResponseWriter, r *http.Request) {
+	branch := app.readBranchParam(w, r)
+	if branch == nil {
+		return
+	}
+	if branch.PickupCapacity == 0 {
+		app.stateConflictResponse(w, r, "this branch doesn't take pickup bookings")
+		return
+	}
+
+	var input struct {
+		Slot time.Time `json:"slot"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	loc, err := time.LoadLocation(branch.Timezone)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	local := input.Slot.In(loc)
+	slots, err := app.branchPickupSlots(branch, local.Year(), local.Month(), local.Day())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	valid := false
+	for _, slot := range slots {
+		if slot.Equal(input.Slot) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		v := validator.New()
+		v.AddError("slot", "must be the start of an upcoming pickup slot at this branch")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if !app.checkNotBlocked(w, r, user.ID) {
+		return
+	}
+
+	pickup := &data.Pickup{
+		BranchID:   branch.ID,
+		BranchName: branch.Name,
+		UserID:     user.ID,
+		Slot:       local,
+	}
+
+	err = app.models.Pickups.Book(pickup)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrSlotFull):
+			app.stateConflictResponse(w, r, "this pickup slot is full, please choose another")
+		case errors.Is(err, data.ErrDuplicatePickup):
+			app.stateConflictResponse(w, r, "you have already booked this pickup slot")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":    user.Name,
+			"branch":  branch.Name,
+			"address": branch.Address,
+			"slot":    local.Format("Monday 2 January 2006, 15:04"),
+		}
+		err := app.sendNotification(user, data.EmailPickups, "pickup_confirmation.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"pickup": pickup}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPickupsHandler lists the user's upcoming pickups.
+func (app *application) listPickupsHandler(w http.ResponseWriter, r *http.Request) {
+	pickups, err := app.models.Pickups.GetUpcomingForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"pickups": pickups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelPickupHandler cancels one of the user's pickups, freeing the place for someone
+// else.
+func (app *application) cancelPickupHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Pickups.Delete(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "pickup successfully cancelled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"net/http"
+)
+
+// sendNotification emails the user a notification of the given category, unless
+// they've opted out of that kind of email. Every optional email should go through
+// here rather than calling the mailer directly.
+func (app *application) sendNotification(user *data.User, category, templateFile string, tmplData any) error {
+	prefs, err := app.models.Preferences.Get(user.ID)
+	if err != nil {
+		return err
+	}
+	if !prefs.WantsEmail(category) {
+		return nil
+	}
+	return app.mailer.SendLocalized(user.Email, prefs.Language, templateFile, tmplData)
+}
+
+func (app *application) showPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.models.Preferences.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePreferencesHandler partially updates the user's preferences. email_opt_ins
+// replaces the whole list when it's sent.
+func (app *application) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		EmailOptIns     []string `json:"email_opt_ins"`
+		DigestFrequency *string  `json:"digest_frequency"`
+		Language        *string  `json:"language"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Preferences.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.EmailOptIns != nil {
+		prefs.EmailOptIns = input.EmailOptIns
+	}
+	if input.DigestFrequency != nil {
+		prefs.DigestFrequency = *input.DigestFrequency
+	}
+	if input.Language != nil {
+		prefs.Language = *input.Language
+	}
+
+	v := validator.New()
+	if data.ValidatePreferences(v, prefs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Preferences.Update(user.ID, prefs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs are run by a pool of workers on each instance, which claim them from the queue
+// in the jobs table. A worker sends a heartbeat for its jobs every
+// jobHeartbeatInterval, and any instance puts the jobs of a worker which has been
+// silent for jobStaleAfter back in the queue.
+const (
+	jobHeartbeatInterval = 30 * time.Second
+	jobStaleAfter        = 2 * time.Minute
+)
+
+// jobKind says how the jobs of a kind are run. priority and attempts are what they're
+// queued with unless the admin creating one says otherwise, and concurrency is the
+// most which run at once on each instance, unless -job-concurrency says otherwise.
+// mutates is set for kinds which change data, which aren't run again by themselves
+// once they've started, even when shutdown interrupts them. discard is set for kinds
+// whose payloads shouldn't be kept, such as emails, which are deleted once they've
+// finished rather than after -job-retention.
+type jobKind struct {
+	run         func(app *application, ctx context.Context, job *data.Job) (envelope, error)
+	priority    int
+	attempts    int
+	concurrency int
+	mutates     bool
+	discard     bool
+}
+
+// jobDeferred is returned by a job which can't run yet, such as an email over the
+// mail quota. It's queued again after the delay without using up an attempt.
+type jobDeferred struct {
+	after time.Duration
+	err   error
+}
+
+func (e *jobDeferred) Error() string {
+	return e.err.Error()
+}
+
+// jobKinds are the kinds of asynchronous request. Someone is waiting for those, so
+// they come before backfills, and deferred emails come before them. The ones which
+// change data aren't retried, leaving it to the user to decide whether to try again.
+var jobKinds = map[string]jobKind{
+	"analytics_export":    {run: (*application).runAnalyticsExport, priority: 10, attempts: 3, concurrency: 1},
+	"catalog_fingerprint": {run: (*application).runCatalogFingerprint, priority: 10, attempts: 3, concurrency: 2},
+	"catalog_diff":        {run: (*application).runCatalogDiff, priority: 10, attempts: 3, concurrency: 2},
+	"dead_letter_resend":  {run: (*application).runDeadLetterResend, priority: 10, attempts: 1, concurrency: 1},
+	"index_advisor":       {run: (*application).runIndexAdvisor, priority: 10, attempts: 3, concurrency: 1},
+	"integrity_report":    {run: (*application).runIntegrityReport, priority: 10, attempts: 3, concurrency: 1},
+	"integrity_repair":    {run: (*application).runIntegrityRepair, priority: 10, attempts: 1, concurrency: 1, mutates: true},
+	"mail_send":           {run: (*application).runMailSend, priority: 20, attempts: 3, concurrency: 4, discard: true},
+	"retention_report":    {run: (*application).runRetentionReport, priority: 10, attempts: 3, concurrency: 1},
+	"retention_run":       {run: (*application).runRetentionRun, priority: 10, attempts: 1, concurrency: 1, mutates: true},
+}
+
+// backfillKind is the kind of every backfill. They pick up from their cursor when
+// they're retried.
+var backfillKind = jobKind{run: (*application).runBackfillJob, priority: 0, attempts: 3, concurrency: 1}
+
+// lookupJobKind returns the kind of job with the given name.
+func lookupJobKind(name string) (jobKind, bool) {
+	kind, ok := jobKinds[name]
+	if ok {
+		return kind, true
+	}
+	if _, ok := data.LookupBackfill(name); ok {
+		return backfillKind, true
+	}
+	return jobKind{}, false
+}
+
+// jobKindNames returns the names of every kind of job.
+func jobKindNames() []string {
+	names := make([]string, 0, len(jobKinds)+len(data.Backfills))
+	for name := range jobKinds {
+		names = append(names, name)
+	}
+	for _, backfill := range data.Backfills {
+		names = append(names, backfill.Name)
+	}
+	return names
+}
+
+// parseJobConcurrency parses the comma separated kind=n -job-concurrency flag.
+func parseJobConcurrency(list string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, n, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("job concurrency: %q is not kind=n", field)
+		}
+		if _, ok := lookupJobKind(name); !ok {
+			return nil, fmt.Errorf("job concurrency: unknown job kind %q", name)
+		}
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("job concurrency: %q must have a whole number of at least 0", field)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// jobQueue counts the jobs this instance's workers are running, so it only claims
+// jobs it has room for.
+type jobQueue struct {
+	mu      sync.Mutex
+	running map[string]int
+	total   int
+	workers int
+	limits  map[string]int
+	// worker is what the jobs this instance claims are locked by.
+	worker string
+	// wake is signalled when a job is queued or a worker becomes free, so the queue
+	// is checked without waiting for the next poll.
+	wake chan struct{}
+}
+
+func newJobQueue(workers int, limits map[string]int) *jobQueue {
+	host, _ := os.Hostname()
+	return &jobQueue{
+		running: make(map[string]int),
+		workers: workers,
+		limits:  limits,
+		worker:  host + ":" + strconv.Itoa(os.Getpid()),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// free returns the kinds of job there's room to run another of, if any.
+func (q *jobQueue) free() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.total >= q.workers {
+		return nil
+	}
+	var kinds []string
+	for _, name := range jobKindNames() {
+		kind, _ := lookupJobKind(name)
+		limit, ok := q.limits[name]
+		if !ok {
+			limit = kind.concurrency
+		}
+		if q.running[name] < limit {
+			kinds = append(kinds, name)
+		}
+	}
+	return kinds
+}
+
+func (q *jobQueue) take(kind string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[kind]++
+	q.total++
+}
+
+func (q *jobQueue) release(kind string) {
+	q.mu.Lock()
+	q.running[kind]--
+	q.total--
+	q.mu.Unlock()
+	q.notify()
+}
+
+// enqueueJob adds a job to the queue with its kind's priority and attempts, unless
+// they're already set.
+func (app *application) enqueueJob(job *data.Job) error {
+	kind, ok := lookupJobKind(job.Kind)
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if job.Priority == 0 {
+		job.Priority = kind.priority
+	}
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = kind.attempts
+	}
+	job.Status = data.JobStatusQueued
+	err := app.models.Jobs.Insert(job)
+	if err != nil {
+		return err
+	}
+	app.queue.notify()
+	return nil
+}
+
+// runJobQueue starts the workers' loop, which claims jobs as long as there are
+// workers free and sends their heartbeats, until the server shuts down.
+func (app *application) runJobQueue() {
+	app.background(func() {
+		poll := time.NewTicker(app.config.jobs.pollInterval)
+		defer poll.Stop()
+		heartbeat := time.NewTicker(jobHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			app.claimJobs()
+			select {
+			case <-poll.C:
+			case <-app.queue.wake:
+			case <-heartbeat.C:
+				app.sendJobHeartbeat()
+			case <-app.done:
+				return
+			}
+		}
+	})
+}
+
+// claimJobs takes jobs from the queue until the workers are busy or there's nothing
+// more they can run.
+func (app *application) claimJobs() {
+	for {
+		kinds := app.queue.free()
+		if len(kinds) == 0 {
+			return
+		}
+		job, err := app.models.Jobs.Claim(kinds, app.queue.worker)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+		app.logger.PrintDebug("job claimed", map[string]string{"job_id": strconv.FormatInt(job.ID, 10), "kind": job.Kind})
+		kind, _ := lookupJobKind(job.Kind)
+		app.queue.take(job.Kind)
+		app.executeJob(job, kind)
+	}
+}
+
+// sendJobHeartbeat reports the jobs this instance is running as alive, stops those
+// which have been cancelled elsewhere or taken over, and requeues the jobs of any
+// instance which has gone quiet.
+func (app *application) sendJobHeartbeat() {
+	ids := app.jobs.ids()
+	if len(ids) > 0 {
+		cancelled, lost, err := app.models.Jobs.Heartbeat(ids)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		for _, id := range cancelled {
+			app.jobs.cancel(id)
+		}
+		for _, id := range lost {
+			app.jobs.abandon(id)
+		}
+	}
+
+	n, err := app.models.Jobs.RequeueStale(jobStaleAfter)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if n > 0 {
+		app.logger.PrintInfo("abandoned jobs requeued", map[string]string{"jobs": strconv.FormatInt(n, 10)})
+	}
+}
+
+// deleteFinishedJobs deletes the jobs which finished longer than -job-retention ago,
+// so their payloads and results, which can be large, aren't kept forever.
+func (app *application) deleteFinishedJobs() {
+	n, err := app.models.Jobs.DeleteFinished(app.config.jobs.retention)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if n > 0 {
+		app.logger.PrintInfo("finished jobs deleted", map[string]string{"jobs": strconv.FormatInt(n, 10)})
+	}
+}
+
+// jobBackoff returns how long to wait before retrying a job which has failed the
+// given number of times: 10 seconds, doubling up to 10 minutes.
+func jobBackoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < 10*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+	return d
+}
+
+// executeJob runs a claimed job in a background goroutine and records how it went.
+// A job which fails is queued again after a backoff while it has attempts left, and
+// one interrupted by shutdown is queued again straight away for the next instance,
+// without counting the attempt, unless its kind mutates data. That fails instead, as
+// it may have changed some already, and it's left to the user to retry it. A job
+// which is deferred is queued again after its delay, without counting the attempt.
+func (app *application) executeJob(job *data.Job, kind jobKind) {
+	ctx, cancel := context.WithCancel(context.Background())
+	app.jobs.add(job.ID, cancel)
+
+	properties := map[string]string{"job_id": fmt.Sprint(job.ID), "kind": job.Kind}
+	save := func() {
+		err := app.models.Jobs.Update(job)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	}
+	requeue := func(delay time.Duration) {
+		err := app.models.Jobs.Requeue(job, delay)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	}
+
+	app.background(func() {
+		defer func() {
+			app.jobs.remove(job.ID)
+			cancel()
+			app.queue.release(job.Kind)
+		}()
+		if kind.discard {
+			defer func() {
+				if job.Status != data.JobStatusCompleted && job.Status != data.JobStatusFailed || app.jobs.lost(job.ID) {
+					return
+				}
+				err := app.models.Jobs.Delete(job.ID)
+				if err != nil {
+					app.logger.PrintError(err, properties)
+				}
+			}()
+		}
+		go func() {
+			select {
+			case <-app.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		env, err := kind.run(app, ctx, job)
+		var deferred *jobDeferred
+		switch {
+		case app.jobs.lost(job.ID):
+			// Another instance has the job now, so it's left alone.
+			return
+		case ctx.Err() != nil:
+			select {
+			case <-app.done:
+				job.Error = "interrupted by server shutdown"
+				if kind.mutates {
+					job.Status = data.JobStatusFailed
+					save()
+					return
+				}
+				job.Attempts--
+				requeue(0)
+			default:
+				job.Status = data.JobStatusCancelled
+				save()
+			}
+			return
+		case errors.As(err, &deferred):
+			job.Attempts--
+			job.Error = err.Error()
+			requeue(deferred.after)
+			return
+		case err != nil:
+			job.Error = err.Error()
+			app.logger.PrintError(err, properties)
+			if job.Attempts < job.MaxAttempts {
+				requeue(jobBackoff(job.Attempts))
+				return
+			}
+			job.Status = data.JobStatusFailed
+			save()
+			return
+		}
+
+		if env == nil {
+			job.Status = data.JobStatusCompleted
+			job.Error = ""
+			save()
+		} else {
+			result, err := json.Marshal(env)
+			if err == nil {
+				err = app.models.Jobs.Complete(job, result)
+			}
+			if err != nil {
+				job.Status = data.JobStatusFailed
+				job.Error = err.Error()
+				save()
+				app.logger.PrintError(err, properties)
+				return
+			}
+		}
+		app.logger.PrintInfo("job completed", properties)
+	})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"books.reading.kz/internal/jsoncase"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecordedBody is the largest request or response body kept in a recording. Longer
+// bodies are truncated.
+const maxRecordedBody = 64 * 1024
+
+// sensitiveFields are JSON keys and query string parameters whose values are never
+// recorded. They're snake_case; camelCase keys are converted before they're looked up.
+var sensitiveFields = map[string]bool{
+	"password":             true,
+	"current_password":     true,
+	"new_password":         true,
+	"token":                true,
+	"authentication_token": true,
+	"plaintext":            true,
+	"key":                  true,
+	"otp":                  true,
+	"code":                 true,
+	"secret":               true,
+	"otpauth_url":          true,
+	"two_factor_token":     true,
+	"recovery_codes":       true,
+}
+
+// tokenPaths are the routes ending in a :token parameter, which is as good as a
+// password for whoever holds it. The token is never recorded.
+var tokenPaths = []string{
+	"/v1/tokens/revoke/",
+	"/v1/users/digest/unsubscribe/",
+	"/v1/campaigns/opens/",
+}
+
+// sensitiveHeaders are never recorded.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":     true,
+	"Cookie":            true,
+	"Set-Cookie":        true,
+	"X-Bootstrap-Token": true,
+}
+
+type recording struct {
+	ID              int64       `json:"id"`
+	Time            time.Time   `json:"time"`
+	Duration        string      `json:"duration"`
+	UserID          int64       `json:"user_id,omitempty"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     any         `json:"request_body,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    any         `json:"response_body,omitempty"`
+}
+
+// recordingFilter selects which requests are recorded. A request must match every
+// field which is set, and nothing is recorded while the filter is disabled.
+type recordingFilter struct {
+	Enabled    bool   `json:"enabled"`
+	UserID     int64  `json:"user_id,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+}
+
+// requestRecorder keeps the most recent recordings in a fixed size ring buffer.
+type requestRecorder struct {
+	mu         sync.Mutex
+	filter     recordingFilter
+	recordings []recording
+	size       int
+	nextID     int64
+}
+
+func newRequestRecorder(size int) *requestRecorder {
+	return &requestRecorder{size: size}
+}
+
+func (rr *requestRecorder) setFilter(filter recordingFilter) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.filter = filter
+}
+
+func (rr *requestRecorder) getFilter() recordingFilter {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.filter
+}
+
+func (rr *requestRecorder) matches(userID int64, path string) bool {
+	filter := rr.getFilter()
+	if !filter.Enabled {
+		return false
+	}
+	if filter.UserID != 0 && filter.UserID != userID {
+		return false
+	}
+	return strings.HasPrefix(path, filter.PathPrefix)
+}
+
+func (rr *requestRecorder) add(rec recording) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.nextID++
+	rec.ID = rr.nextID
+	rr.recordings = append(rr.recordings, rec)
+	if len(rr.recordings) > rr.size {
+		rr.recordings = rr.recordings[len(rr.recordings)-rr.size:]
+	}
+}
+
+// list returns the recordings, newest first.
+func (rr *requestRecorder) list() []recording {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	recordings := make([]recording, 0, len(rr.recordings))
+	for i := len(rr.recordings) - 1; i >= 0; i-- {
+		recordings = append(recordings, rr.recordings[i])
+	}
+	return recordings
+}
+
+func (rr *requestRecorder) clear() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.recordings = nil
+}
+
+// recordingResponseWriter captures the status code and body written by a handler.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if room := maxRecordedBody - rw.body.Len(); room > 0 {
+		if len(b) > room {
+			rw.body.Write(b[:room])
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recordRequests saves sanitized copies of requests and responses which match the
+// recorder's filter. It must run after authenticate() so that the user is known.
+func (app *application) recordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.recorder == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+		if !app.recorder.matches(user.ID, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Read the start of the request body, then put it back in front of whatever
+		// remains so the handler sees the complete body.
+		requestBody, err := io.ReadAll(io.LimitReader(r.Body, maxRecordedBody))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+
+		app.recorder.add(recording{
+			Time:            start,
+			Duration:        time.Since(start).String(),
+			UserID:          user.ID,
+			Method:          r.Method,
+			URL:             sanitizeURL(r),
+			RequestHeaders:  sanitizeHeaders(r.Header),
+			RequestBody:     sanitizeBody(requestBody),
+			Status:          rw.status,
+			ResponseHeaders: sanitizeHeaders(w.Header()),
+			ResponseBody:    sanitizeBody(rw.body.Bytes()),
+		})
+	})
+}
+
+// isSensitive reports whether a JSON key or query string parameter is one of the
+// sensitiveFields, in either snake_case or camelCase.
+func isSensitive(key string) bool {
+	return sensitiveFields[jsoncase.SnakeKey(key)]
+}
+
+func sanitizeURL(r *http.Request) string {
+	u := *r.URL
+	for _, prefix := range tokenPaths {
+		if strings.HasPrefix(u.Path, prefix) {
+			// RawPath keeps the brackets from being escaped.
+			u.Path = prefix + "[REDACTED]"
+			u.RawPath = u.Path
+			break
+		}
+	}
+	qs := u.Query()
+	for key := range qs {
+		if isSensitive(key) {
+			qs.Set(key, "[REDACTED]")
+		}
+	}
+	u.RawQuery = qs.Encode()
+	return u.String()
+}
+
+func sanitizeHeaders(headers http.Header) http.Header {
+	sanitized := headers.Clone()
+	for key := range sanitized {
+		if sensitiveHeaders[http.CanonicalHeaderKey(key)] {
+			sanitized.Set(key, "[REDACTED]")
+		}
+	}
+	return sanitized
+}
+
+// sanitizeBody decodes a JSON body and redacts any sensitive fields in it. Bodies which
+// aren't valid JSON (including truncated ones) are kept as a string.
+func sanitizeBody(body []byte) any {
+	if len(body) == 0 {
+		return nil
+	}
+	var value any
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return string(body)
+	}
+	return redact(value)
+}
+
+func redact(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if isSensitive(key) {
+				v[key] = "[REDACTED]"
+				continue
+			}
+			v[key] = redact(field)
+		}
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return value
+}
+
+func (app *application) listRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"filter":     app.recorder.getFilter(),
+		"recordings": app.recorder.list(),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateRecordingFilterHandler turns recording on or off and chooses which user and
+// routes are recorded.
+func (app *application) updateRecordingFilterHandler(w http.ResponseWriter, r *http.Request) {
+	var input recordingFilter
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.recorder.setFilter(input)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"filter": input}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) clearRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	app.recorder.clear()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "recordings cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// runRetention applies the data retention policy, or only reports what it would do if
+// dryRun is set, and logs a summary of the rules which matched anything.
+func (app *application) runRetention(ctx context.Context, dryRun bool, progress data.ProgressFunc) (*data.RetentionReport, error) {
+	report, err := app.models.Retention.Run(ctx, app.config.retention.policy, dryRun, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	for _, result := range report.Results {
+		if result.Count > 0 {
+			properties[result.Rule] = strconv.Itoa(result.Count)
+		}
+	}
+
+	if len(properties) > 0 {
+		properties["dry_run"] = strconv.FormatBool(dryRun)
+		app.logger.PrintInfo("data retention rules applied", properties)
+	}
+
+	return report, nil
+}
+
+// showRetentionReportHandler reports what the data retention policy would delete or
+// anonymize now, without changing anything.
+func (app *application) showRetentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "retention_report", nil)
+}
+
+func (app *application) runRetentionReport(ctx context.Context, job *data.Job) (envelope, error) {
+	report, err := app.runRetention(ctx, true, app.jobProgress(job))
+	return envelope{"retention": report}, err
+}
+
+// runRetentionHandler applies the data retention policy straight away, rather than
+// waiting for the next scheduled run.
+func (app *application) runRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondAsyncable(w, r, "retention_run", nil)
+}
+
+func (app *application) runRetentionRun(ctx context.Context, job *data.Job) (envelope, error) {
+	report, err := app.runRetention(ctx, false, app.jobProgress(job))
+	return envelope{"retention": report}, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// crawlerRule says whether search engines may crawl the paths starting with Path,
+// and how many seconds they should leave between requests to them. Paths can use the
+// * wildcard understood by the major search engines.
+type crawlerRule struct {
+	Path       string `json:"path"`
+	Allow      bool   `json:"allow"`
+	CrawlDelay int    `json:"crawl_delay,omitempty"`
+}
+
+// crawlDelay is the number of seconds crawlers are asked to leave between requests.
+// Unless -crawl-delay is set it's enough to stay within the rate limiter.
+func (app *application) crawlDelay() int {
+	if app.config.robots.crawlDelay > 0 {
+		return int(math.Ceil(app.config.robots.crawlDelay.Seconds()))
+	}
+	if app.config.limiter.enabled && app.config.limiter.rps > 0 {
+		return int(math.Ceil(1 / app.config.limiter.rps))
+	}
+	return 1
+}
+
+// crawlerRules is the crawler policy, most specific paths first. Only the public
+// catalog pages are worth indexing; everything else needs authentication or is too
+// expensive to crawl. Search result listings get a longer delay than single books.
+// The honeypot paths are disallowed by name, so that only crawlers which ignore
+// robots.txt get banned for requesting them.
+func (app *application) crawlerRules() []crawlerRule {
+	delay := app.crawlDelay()
+	rules := []crawlerRule{}
+	honeypots := make([]string, 0, len(app.config.abuse.honeypots))
+	for path := range app.config.abuse.honeypots {
+		honeypots = append(honeypots, path)
+	}
+	sort.Strings(honeypots)
+	for _, path := range honeypots {
+		rules = append(rules, crawlerRule{Path: path, Allow: false})
+	}
+	if app.config.publicCatalog {
+		rules = append(rules,
+			crawlerRule{Path: "/v1/books/*/copies", Allow: false},
+			crawlerRule{Path: "/v1/books/*/sessions", Allow: false},
+			crawlerRule{Path: "/v1/books/slug/", Allow: true, CrawlDelay: delay},
+			crawlerRule{Path: "/v1/books/", Allow: true, CrawlDelay: delay},
+			crawlerRule{Path: "/v1/books?", Allow: true, CrawlDelay: 5 * delay},
+			crawlerRule{Path: "/v1/books$", Allow: true, CrawlDelay: 5 * delay},
+		)
+	}
+	return append(rules, crawlerRule{Path: "/", Allow: false})
+}
+
+// robotsHandler serves robots.txt: the file given with -robots-file if there is one,
+// or else one generated from the crawler policy.
+func (app *application) robotsHandler(w http.ResponseWriter, r *http.Request) {
+	text := app.config.robots.text
+	if text == "" {
+		var b strings.Builder
+		b.WriteString("User-agent: *\n")
+		for _, rule := range app.crawlerRules() {
+			if rule.Allow {
+				fmt.Fprintf(&b, "Allow: %s\n", rule.Path)
+			} else {
+				fmt.Fprintf(&b, "Disallow: %s\n", rule.Path)
+			}
+		}
+		fmt.Fprintf(&b, "Crawl-delay: %d\n", app.crawlDelay())
+		text = b.String()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(time.Hour.Seconds())))
+	w.Write([]byte(text))
+}
+
+// showCrawlerPolicyHandler gives the crawler policy with per-path delays, which
+// robots.txt can only express for the whole site.
+func (app *application) showCrawlerPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"crawler_policy": app.crawlerRules()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
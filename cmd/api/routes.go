@@ -1,27 +1,243 @@
 package main
 
 import (
-	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"strings"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
-
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	var routes []route
+	router := app.newRouteTable(&routes)
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/readyz", app.readinessHandler)
+	router.HandlerFunc(http.MethodGet, "/robots.txt", app.robotsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/crawler-policy", app.showCrawlerPolicyHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/home", app.requirePermission("books:read", app.showHomeHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/books", app.requirePermission("books:read", app.listBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books", app.requireCatalogRead(app.listBookHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/books", app.requirePermission("books:write", app.createBookHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.requirePermission("books:read", app.showBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.requireCatalogRead(app.showBookHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.requirePermission("books:write", app.updateBookHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.requirePermission("books:write", app.deleteBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/copies", app.requirePermission("books:read", app.listBookCopiesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/copies", app.requirePermission("books:write", app.createCopyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/copies", app.requirePermission("books:read", app.findCopiesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/copies/:id", app.requirePermission("books:read", app.showCopyHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/copies/:id", app.requirePermission("books:write", app.updateCopyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/copies/:id", app.requirePermission("books:write", app.deleteCopyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/locations", app.requirePermission("books:read", app.showLocationsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches", app.requirePermission("books:read", app.listBranchesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/branches", app.requirePermission("admin", app.createBranchHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches/:id", app.requirePermission("books:read", app.showBranchHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/branches/:id", app.requirePermission("admin", app.updateBranchHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/branches/:id", app.requirePermission("admin", app.deleteBranchHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches/:id/copies", app.requirePermission("books:read", app.listBranchCopiesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches/:id/hours", app.requirePermission("books:read", app.showBranchHoursHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/branches/:id/hours", app.requirePermission("admin", app.updateBranchHoursHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/branches/:id/pickup-slots", app.requirePermission("books:read", app.listPickupSlotsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/branches/:id/pickups", app.requirePermission("books:read", app.bookPickupHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/sessions", app.requirePermission("books:read", app.startReadingSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/reading-sessions/:id/stop", app.requirePermission("books:read", app.stopReadingSessionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/lists", app.requirePermission("books:read", app.listListsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/lists", app.requirePermission("books:read", app.createListHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/lists/:id", app.requirePermission("books:read", app.showListHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/lists/:id", app.requirePermission("books:read", app.updateListHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/lists/:id", app.requirePermission("books:read", app.deleteListHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/lists/:id/items", app.requirePermission("books:read", app.addListItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/lists/:id/items/:bookID", app.requirePermission("books:read", app.removeListItemHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/lists/:id/items/:bookID/position", app.requirePermission("books:read", app.moveListItemHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/list-templates", app.requirePermission("books:read", app.listListTemplatesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/list-templates/:id", app.requirePermission("books:read", app.showListTemplateHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/list-templates/:id/clone", app.requirePermission("books:read", app.cloneListTemplateHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/suggestions", app.requirePermission("books:read", app.listSuggestionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/suggestions", app.requirePermission("books:read", app.createSuggestionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/suggestions/:id", app.requirePermission("books:read", app.showSuggestionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/suggestions/:id", app.requirePermission("books:read", app.withdrawSuggestionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/librarian/suggestions", app.requirePermission("suggestions:triage", app.listAllSuggestionsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/librarian/suggestions/:id", app.requirePermission("suggestions:triage", app.triageSuggestionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/interlibrary-loans", app.requirePermission("books:read", app.listInterlibraryLoansHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/librarian/interlibrary-loans", app.requirePermission("loans:manage", app.listAllInterlibraryLoansHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/librarian/interlibrary-loans", app.requirePermission("loans:manage", app.createInterlibraryLoanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/librarian/interlibrary-loans/:id", app.requirePermission("loans:manage", app.showInterlibraryLoanHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/librarian/interlibrary-loans/:id", app.requirePermission("loans:manage", app.updateInterlibraryLoanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/librarian/loans/:id/escalations", app.requirePermission("loans:manage", app.showLoanEscalationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/librarian/loans/:id/forgive", app.requirePermission("loans:manage", app.forgiveLoanHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/librarian/loans/:id/due-date", app.requirePermission("loans:manage", app.updateLoanDueDateHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/librarian/users/:id/card", app.requirePermission("loans:manage", app.setLibraryCardHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/loans/:id/receipt", app.requireActivatedUser(app.showLoanReceiptHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/loans/:id/receipt", app.requireActivatedUser(app.emailLoanReceiptHandler))
 
+	router.HandlerFunc(http.MethodPost, "/v1/kiosk/checkout", app.requireDevice(app.kioskCheckoutHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/kiosk/return", app.requireDevice(app.kioskReturnHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/kiosk/heartbeat", app.requireDevice(app.kioskHeartbeatHandler))
+
+	// httprouter doesn't allow the static "slug" segment to share a position with the
+	// :id wildcard above, so slug lookups are registered on a separate router which is
+	// dispatched to by path prefix below.
+	slugRouter := app.newRouteTable(&routes)
+	slugRouter.HandlerFunc(http.MethodGet, "/v1/books/slug/:slug", app.requireCatalogRead(app.showBookBySlugHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/bootstrap", app.bootstrapHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.requireUnscopedUser(app.updateUserEmailHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/confirmed", app.confirmUserEmailHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/digest/unsubscribed", app.unsubscribeDigestHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/digest/unsubscribe/:token", app.showUnsubscribeDigestPageHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/digest/unsubscribe/:token", app.unsubscribeDigestLinkHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id", app.showUserProfileHandler)
+
+	// Like the slug lookups, GET /v1/users/me would clash with the :id wildcard, so the
+	// current user's routes get their own router too.
+	meRouter := app.newRouteTable(&routes)
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	meRouter.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUnscopedUser(app.updateCurrentUserProfileHandler))
+	meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireUnscopedUser(app.deleteCurrentUserHandler))
+	meRouter.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireAuthenticatedUser(app.changePasswordHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/tokens", app.requireAuthenticatedUser(app.listTokensHandler))
+	meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me/tokens/:id", app.requireUnscopedUser(app.revokeTokenHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/security-events", app.requireAuthenticatedUser(app.listSecurityEventsHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/identities", app.requireAuthenticatedUser(app.listIdentitiesHandler))
+	meRouter.HandlerFunc(http.MethodPost, "/v1/users/me/identities/:provider", app.requireRecentLogin(app.linkIdentityHandler))
+	meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me/identities/:provider", app.requireRecentLogin(app.unlinkIdentityHandler))
+	if app.totp != nil {
+		meRouter.HandlerFunc(http.MethodPost, "/v1/users/me/2fa", app.requireUnscopedUser(app.enrollTwoFactorHandler))
+		meRouter.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/verify", app.requireUnscopedUser(app.verifyTwoFactorHandler))
+		meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa", app.requireUnscopedUser(app.disableTwoFactorHandler))
+	}
+	if app.webauthn != nil {
+		meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/passkeys", app.requireAuthenticatedUser(app.listPasskeysHandler))
+		meRouter.HandlerFunc(http.MethodPost, "/v1/users/me/passkeys/challenge", app.requireRecentLogin(app.createPasskeyChallengeHandler))
+		meRouter.HandlerFunc(http.MethodPost, "/v1/users/me/passkeys", app.requireRecentLogin(app.registerPasskeyHandler))
+		meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me/passkeys/:id", app.requireRecentLogin(app.deletePasskeyHandler))
+	}
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/preferences", app.requireAuthenticatedUser(app.showPreferencesHandler))
+	meRouter.HandlerFunc(http.MethodPatch, "/v1/users/me/preferences", app.requireUnscopedUser(app.updatePreferencesHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/pickups", app.requireActivatedUser(app.listPickupsHandler))
+	meRouter.HandlerFunc(http.MethodDelete, "/v1/users/me/pickups/:id", app.requireActivatedUser(app.cancelPickupHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/stats", app.requireActivatedUser(app.showReadingStatsHandler))
+	meRouter.HandlerFunc(http.MethodGet, "/v1/users/me/notifications", app.requireAuthenticatedUser(app.showNotificationPreferencesHandler))
+	meRouter.HandlerFunc(http.MethodPatch, "/v1/users/me/notifications", app.requireUnscopedUser(app.updateNotificationPreferencesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/revoke/:token", app.showRevokeSessionPageHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/revoke/:token", app.revokeSessionLinkHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/two-factor", app.completeTwoFactorLoginHandler)
+	if app.webauthn != nil {
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/passkey/challenge", app.createPasskeyLoginChallengeHandler)
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/passkey", app.createPasskeyTokenHandler)
+	}
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/introspect", app.requirePermission("tokens:introspect", app.introspectTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/auth/:provider/login", app.oauthLoginHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/auth/:provider/callback", app.oauthCallbackHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireActivatedUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireActivatedUser(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireActivatedUser(app.requireUnscopedUser(app.revokeAPIKeyHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("admin", app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("admin", app.addUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("admin", app.removeUserRoleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/impersonate", app.requirePermission("users:impersonate", app.createImpersonationTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("admin", app.listUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions", app.requirePermission("admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("admin", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/legal-holds", app.requirePermission("admin", app.listUserLegalHoldsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/legal-hold", app.requirePermission("admin", app.placeLegalHoldHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/legal-hold", app.requirePermission("admin", app.releaseLegalHoldHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/legal-holds", app.requirePermission("admin", app.listLegalHoldsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions/:code/users", app.requirePermission("admin", app.listPermissionUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/devices", app.requirePermission("admin", app.listDevicesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/devices", app.requirePermission("admin", app.createDeviceHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/devices/:id", app.requirePermission("admin", app.deleteDeviceHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/security-events", app.requirePermission("admin", app.listAllSecurityEventsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/client-bans", app.requirePermission("admin", app.listClientBansHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/client-bans/:id", app.requirePermission("admin", app.liftClientBanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/log-level", app.requirePermission("admin", app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", app.requirePermission("admin", app.updateLogLevelHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/mail/dead-letters", app.requirePermission("admin", app.listDeadLettersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/mail/dead-letters/:id/resend", app.requirePermission("admin", app.resendDeadLetterHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/campaigns", app.requirePermission("admin", app.listCampaignsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/campaigns", app.requirePermission("admin", app.createCampaignHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/campaigns/:id", app.requirePermission("admin", app.showCampaignHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/campaigns/:id/cancel", app.requirePermission("admin", app.cancelCampaignHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/campaigns/:id/bounces", app.requirePermission("admin", app.recordCampaignBouncesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/campaigns/opens/:token", app.campaignOpenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/integrity", app.requirePermission("admin", app.showIntegrityReportHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/integrity/repair", app.requirePermission("admin", app.repairIntegrityHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/analytics/exports", app.requirePermission("admin", app.exportAnalyticsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/catalog/fingerprint", app.requirePermission("admin", app.showCatalogFingerprintHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/catalog/diff", app.requirePermission("admin", app.diffCatalogHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/retention", app.requirePermission("admin", app.showRetentionReportHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/retention/run", app.requirePermission("admin", app.runRetentionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/index-advisor", app.requirePermission("admin", app.showIndexAdvisorHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/jobs", app.requirePermission("admin", app.listJobsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/jobs", app.requirePermission("admin", app.createJobHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/jobs/:id", app.requirePermission("admin", app.showJobHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/jobs/:id/cancel", app.requirePermission("admin", app.cancelJobHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/jobs/:id/retry", app.requirePermission("admin", app.retryJobHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/jobs/:id/resume", app.requirePermission("admin", app.retryJobHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/jobs/:id", app.requireActivatedUser(app.showAsyncJobHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/jobs/:id/result", app.requireActivatedUser(app.showAsyncJobResultHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/jobs/:id/cancel", app.requireActivatedUser(app.cancelAsyncJobHandler))
+
+	if app.recorder != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/admin/recordings", app.requirePermission("admin", app.listRecordingsHandler))
+		router.HandlerFunc(http.MethodPut, "/v1/admin/recordings", app.requirePermission("admin", app.updateRecordingFilterHandler))
+		router.HandlerFunc(http.MethodDelete, "/v1/admin/recordings", app.requirePermission("admin", app.clearRecordingsHandler))
+	}
+
+	if app.config.sandbox {
+		router.HandlerFunc(http.MethodGet, "/v1/dev/emails", app.listSandboxEmailsHandler)
+		router.HandlerFunc(http.MethodDelete, "/v1/dev/emails", app.clearSandboxEmailsHandler)
+	}
+
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("admin", app.metricsHandler))
+
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/books/slug/"):
+			slugRouter.ServeHTTP(w, r)
+		case r.URL.Path == "/v1/users/me" || strings.HasPrefix(r.URL.Path, "/v1/users/me/"):
+			meRouter.ServeHTTP(w, r)
+		default:
+			router.ServeHTTP(w, r)
+		}
+	})
+
+	// The middleware chain, outermost first. Each one is timed when Server-Timing
+	// debugging is enabled.
+	middleware := []struct {
+		name string
+		fn   func(http.Handler) http.Handler
+	}{
+		{"rate-limit", app.rateLimit},
+		{"read-only", app.rejectWrites},
+		{"authenticate", app.authenticate},
+		{"abuse", app.guardAbuse},
+		{"frozen", app.rejectFrozenWrites},
+		{"api-version", app.pinAPIVersion},
+		{"consistency", app.readYourWrites},
+		{"record", app.recordRequests},
+	}
+
+	var handler http.Handler = mux
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = app.timed(middleware[i].name, middleware[i].fn)(handler)
+	}
+
+	return app.recoverPanic(app.serverTiming(app.jsonCasing(handler)))
 
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type route struct {
+	method string
+	path   string
+}
+
+// routeTable wraps httprouter.Router and keeps a record of every route registered on
+// it. httprouter doesn't let us list its routes, and we need them to suggest near
+// misses when a client requests a URL which doesn't exist.
+type routeTable struct {
+	*httprouter.Router
+	routes *[]route
+}
+
+// newRouteTable returns a routeTable which records its routes in the routes slice.
+// Several route tables can share the same slice so that suggestions cover all of them.
+func (app *application) newRouteTable(routes *[]route) *routeTable {
+	rt := &routeTable{
+		Router: httprouter.New(),
+		routes: routes,
+	}
+	rt.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.routeNotFoundResponse(w, r, suggestRoutes(*routes, r.URL.Path))
+	})
+	rt.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	return rt
+}
+
+// Handler registers a route, applying any deprecation metadata there is for it.
+func (rt *routeTable) Handler(method, path string, handler http.Handler) {
+	r := route{method: method, path: path}
+	if d, ok := deprecations[r]; ok {
+		handler = d.middleware(handler)
+	}
+	rt.Router.Handler(method, path, handler)
+	*rt.routes = append(*rt.routes, r)
+}
+
+func (rt *routeTable) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
+}
+
+// maxSuggestionDistance is the largest number of single character edits between a
+// requested path and a route for the route to be suggested.
+const maxSuggestionDistance = 2
+
+// suggestRoutes returns up to three concrete paths from routes which are a near miss
+// for path, closest first. Wildcard segments in a route match any value and are
+// filled in from the requested path, so "/v1/book/1" gives "/v1/books/1".
+func suggestRoutes(routes []route, path string) []string {
+	type candidate struct {
+		path     string
+		distance int
+	}
+
+	requested := strings.Split(strings.Trim(path, "/"), "/")
+	seen := make(map[string]bool)
+	var candidates []candidate
+
+	for _, rt := range routes {
+		pattern := strings.Split(strings.Trim(rt.path, "/"), "/")
+		if len(pattern) != len(requested) {
+			continue
+		}
+
+		distance := 0
+		segments := make([]string, len(pattern))
+		for i, segment := range pattern {
+			if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+				segments[i] = requested[i]
+				continue
+			}
+			segments[i] = segment
+			distance += levenshtein(strings.ToLower(requested[i]), segment)
+		}
+
+		suggestion := "/" + strings.Join(segments, "/")
+		if distance == 0 || distance > maxSuggestionDistance || seen[suggestion] {
+			continue
+		}
+		seen[suggestion] = true
+		candidates = append(candidates, candidate{path: suggestion, distance: distance})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].path)
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
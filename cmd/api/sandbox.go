@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+// listSandboxEmailsHandler shows the emails captured in sandbox mode. They can be
+// filtered by recipient with the ?to= query string parameter.
+func (app *application) listSandboxEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	to := app.readString(r.URL.Query(), "to", "")
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"emails": app.inbox.Messages(to)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) clearSandboxEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	app.inbox.Clear()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "sandbox inbox cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"net/http"
+	"net/url"
+)
+
+// securityEventSortSafelist are the sort values accepted when listing security events.
+var securityEventSortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+// recordSecurityEvent adds an entry to the security audit trail for the request and
+// returns it. user can be nil for failed logins to an unknown email address. Failing
+// to record the event is logged but doesn't fail the request, and nil is returned.
+func (app *application) recordSecurityEvent(r *http.Request, user *data.User, email, event, outcome, detail string) *data.SecurityEvent {
+	e := &data.SecurityEvent{
+		Email:     email,
+		Event:     event,
+		Outcome:   outcome,
+		Detail:    detail,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if location, ok := app.geoip.Lookup(e.IP); ok {
+		e.Country = location.Country
+	}
+	if user != nil && !user.IsAnonymous() {
+		e.UserID = &user.ID
+		e.Email = user.Email
+	}
+
+	err := app.models.SecurityEvents.Insert(e)
+	if err != nil {
+		app.logError(r, err)
+		return nil
+	}
+	return e
+}
+
+// readSecurityEventFilters reads the ?event= and ?outcome= filters and the paging and
+// sorting parameters shared by the security event lists. If they're invalid a response
+// is sent and false is returned.
+func (app *application) readSecurityEventFilters(w http.ResponseWriter, r *http.Request, qs url.Values, v *validator.Validator) (string, string, data.Filters, bool) {
+	event := app.readString(qs, "event", "")
+	if event != "" {
+		v.Check(validator.PermittedValue(event, data.SecurityEvents...), "event", "invalid event")
+	}
+	outcome := app.readString(qs, "outcome", "")
+	if outcome != "" {
+		v.Check(validator.PermittedValue(outcome, data.OutcomeSuccess, data.OutcomeFailure), "outcome", "invalid outcome")
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: securityEventSortSafelist,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return "", "", filters, false
+	}
+	return event, outcome, filters, true
+}
+
+// listSecurityEventsHandler shows the user their own security audit trail, so they can
+// spot logins they don't recognise.
+func (app *application) listSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	event, outcome, filters, ok := app.readSecurityEventFilters(w, r, r.URL.Query(), validator.New())
+	if !ok {
+		return
+	}
+
+	events, metadata, err := app.models.SecurityEvents.GetAll(app.contextGetUser(r).ID, event, outcome, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"security_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAllSecurityEventsHandler is the admin view of the audit trail. It can be limited
+// to one user with ?user_id=.
+func (app *application) listAllSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	userID := app.readInt(qs, "user_id", 0, v)
+	v.Check(userID >= 0, "user_id", "must be a positive integer")
+
+	event, outcome, filters, ok := app.readSecurityEventFilters(w, r, qs, v)
+	if !ok {
+		return
+	}
+
+	events, metadata, err := app.models.SecurityEvents.GetAll(int64(userID), event, outcome, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"security_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
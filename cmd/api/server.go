@@ -35,6 +35,9 @@ func (app *application) serve() error {
 		if err != nil {
 			shutdownError <- err
 		}
+		// Tell any periodic background jobs to stop so that they don't block the
+		// WaitGroup below.
+		close(app.done)
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// closeForgottenSessions times out reading sessions which were never stopped.
+func (app *application) closeForgottenSessions() {
+	closed, err := app.models.ReadingSessions.CloseForgotten(app.config.readingSessions.timeout)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if closed > 0 {
+		app.logger.PrintInfo("forgotten reading sessions closed", map[string]string{"count": fmt.Sprint(closed)})
+	}
+}
+
+// startReadingSessionHandler starts the timer on a book. Starting a book which is
+// already being read returns the open session with a 200 response.
+func (app *application) startReadingSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveBookIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	book, err := app.models.Book.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	session, created, err := app.models.ReadingSessions.Start(user.ID, book.ID, app.config.readingSessions.timeout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"reading_session": session}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// stopReadingSessionHandler stops the timer. A session stopped after
+// -reading-session-timeout is capped at that length and marked timed out, as if it
+// had been closed as forgotten. It's safe to retry: stopping a session which has
+// already ended returns it unchanged.
+func (app *application) stopReadingSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveSessionIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	session, err := app.models.ReadingSessions.Stop(id, app.contextGetUser(r).ID, app.config.readingSessions.timeout)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reading_session": session}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showReadingStatsHandler returns the minutes the user read on each of the last ?days=
+// days (30 by default) and their reading streak, split into days in their timezone.
+func (app *application) showReadingStatsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	days := app.readInt(r.URL.Query(), "days", 30, v)
+	v.Check(days > 0, "days", "must be greater than zero")
+	v.Check(days <= 366, "days", "must be a maximum of 366")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	readings, err := app.models.ReadingSessions.GetMinutesPerDay(user.ID, days, user.Timezone)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	streak, err := app.models.ReadingSessions.GetStreak(user.ID, user.Timezone)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var total int64
+	for _, reading := range readings {
+		total += reading.Minutes
+	}
+
+	stats := envelope{
+		"minutes_per_day": readings,
+		"total_minutes":   total,
+		"timezone":        user.Timezone,
+		"streak":          streak,
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build go1.21
+
+package main
+
+import (
+	"books.reading.kz/internal/jsonlog"
+	"log/slog"
+)
+
+// setDefaultLogger makes logger slog's default, so that libraries which log through
+// log/slog, or the standard log package, write to the same JSON log as the API.
+func setDefaultLogger(logger *jsonlog.Logger) {
+	slog.SetDefault(slog.New(jsonlog.NewHandler(logger)))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// suggestionSortSafelist are the sort values accepted when listing suggestions.
+var suggestionSortSafelist = []string{"id", "title", "status", "created_at", "updated_at", "-id", "-title", "-status", "-created_at", "-updated_at"}
+
+// readSuggestionFilters reads the ?status= filter and the paging and sorting parameters
+// shared by the suggestion lists. If they're invalid a response is sent and false is
+// returned.
+func (app *application) readSuggestionFilters(w http.ResponseWriter, r *http.Request, qs url.Values) (string, data.Filters, bool) {
+	v := validator.New()
+
+	status := app.readString(qs, "status", "")
+	if status != "" {
+		v.Check(validator.PermittedValue(status, data.SuggestionPending, data.SuggestionOrdered, data.SuggestionDeclined, data.SuggestionAdded), "status", "invalid status")
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: suggestionSortSafelist,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return "", filters, false
+	}
+	return status, filters, true
+}
+
+// readSuggestionParam fetches the suggestion named by the :id parameter. If it can't be
+// fetched an error response is sent and nil is returned.
+func (app *application) readSuggestionParam(w http.ResponseWriter, r *http.Request) *data.Suggestion {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	suggestion, err := app.models.Suggestions.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return suggestion
+}
+
+// createSuggestionHandler lets a member ask for a book the library doesn't have.
+func (app *application) createSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string `json:"title"`
+		ISBN   string `json:"isbn"`
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	suggestion := &data.Suggestion{
+		UserID: app.contextGetUser(r).ID,
+		Title:  input.Title,
+		ISBN:   data.NormalizeISBN(input.ISBN),
+		Reason: input.Reason,
+	}
+
+	v := validator.New()
+	if data.ValidateSuggestion(v, suggestion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	exists, err := app.models.Suggestions.InCatalog(suggestion.Title)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if exists {
+		v.AddError("title", "a book with this title is already in the catalog")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Suggestions.Insert(suggestion)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/suggestions/%d", suggestion.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"suggestion": suggestion}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSuggestionsHandler lists the member's own suggestions.
+func (app *application) listSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	status, filters, ok := app.readSuggestionFilters(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	suggestions, metadata, err := app.models.Suggestions.GetAll(app.contextGetUser(r).ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showSuggestionHandler shows a suggestion to the member who made it, or to librarians.
+func (app *application) showSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	suggestion := app.readSuggestionParam(w, r)
+	if suggestion == nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if suggestion.UserID != user.ID {
+		permissions, err := app.permissionsFor(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include("suggestions:triage") {
+			app.notFoundResponse(w, r)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"suggestion": suggestion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// withdrawSuggestionHandler deletes one of the member's suggestions, as long as a
+// librarian hasn't acted on it yet.
+func (app *application) withdrawSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	suggestion := app.readSuggestionParam(w, r)
+	if suggestion == nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if suggestion.UserID != user.ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Suggestions.Delete(suggestion.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.stateConflictResponse(w, r, "only pending suggestions can be withdrawn")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "suggestion successfully withdrawn"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAllSuggestionsHandler is the librarians' triage queue. It lists every member's
+// suggestions, and is usually filtered with ?status=pending.
+func (app *application) listAllSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	status, filters, ok := app.readSuggestionFilters(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	suggestions, metadata, err := app.models.Suggestions.GetAll(0, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// triageSuggestionHandler lets a librarian change a suggestion's status, reply with a
+// note and, once it's been added, link the book in the catalog. The member is emailed
+// when the status changes.
+func (app *application) triageSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	suggestion := app.readSuggestionParam(w, r)
+	if suggestion == nil {
+		return
+	}
+
+	var input struct {
+		Status *string `json:"status"`
+		Note   *string `json:"note"`
+		BookID *int64  `json:"book_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	previous := suggestion.Status
+
+	if input.Status != nil && *input.Status != suggestion.Status {
+		if !validator.PermittedValue(*input.Status, data.SuggestionTransitions[suggestion.Status]...) {
+			app.stateConflictResponse(w, r, fmt.Sprintf("a suggestion can't be moved from %s to %s", suggestion.Status, *input.Status))
+			return
+		}
+		suggestion.Status = *input.Status
+	}
+	if input.Note != nil {
+		suggestion.Note = *input.Note
+	}
+	if input.BookID != nil {
+		v.Check(suggestion.Status == data.SuggestionAdded, "book_id", "can only be set once the book has been added")
+		suggestion.BookID = input.BookID
+	}
+
+	if data.ValidateSuggestion(v, suggestion); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.BookID != nil {
+		_, err = app.models.Book.Get(*input.BookID, r)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("book_id", "book does not exist")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.models.Suggestions.Update(suggestion)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if suggestion.Status != previous {
+		app.notifySuggestionStatus(r, suggestion)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestion": suggestion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// notifySuggestionStatus emails the member who made the suggestion about its new
+// status in the background.
+func (app *application) notifySuggestionStatus(r *http.Request, suggestion *data.Suggestion) {
+	user, err := app.models.Users.Get(suggestion.UserID, r)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":   user.Name,
+			"title":  suggestion.Title,
+			"status": suggestion.Status,
+			"note":   suggestion.Note,
+		}
+		err := app.sendNotification(user, data.EmailSuggestions, "suggestion_status.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
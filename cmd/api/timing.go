@@ -0,0 +1,88 @@
+package main
+
+import (
+	"books.reading.kz/internal/timing"
+	"context"
+	"net/http"
+	"time"
+)
+
+// timingWriter adds the Server-Timing header just before the response headers are
+// written, by which point the middleware, database and encoding timings are known.
+type timingWriter struct {
+	http.ResponseWriter
+	recorder    *timing.Recorder
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.Header().Set("Server-Timing", tw.recorder.Header())
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// serverTiming adds a timing.Recorder to the request context and reports what it
+// collected in a Server-Timing header. It does nothing unless enabled with the
+// -debug-server-timing flag.
+func (app *application) serverTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.debug.serverTiming {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := timing.New()
+		r = r.WithContext(timing.NewContext(r.Context(), recorder))
+		next.ServeHTTP(&timingWriter{ResponseWriter: w, recorder: recorder}, r)
+	})
+}
+
+// timed wraps a middleware so that the time it spends before calling the next handler
+// is recorded as a Server-Timing metric.
+func (app *application) timed(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		type startKey struct{}
+
+		inner := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if start, ok := r.Context().Value(startKey{}).(time.Time); ok {
+				timing.FromContext(r.Context()).Add("mw-"+name, "", time.Since(start))
+			}
+			next.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if timing.FromContext(r.Context()) != nil {
+				r = r.WithContext(context.WithValue(r.Context(), startKey{}, time.Now()))
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recordTiming adds a metric to the Server-Timing header for the response written to
+// w. It's for code which has the response writer but not the request.
+func recordTiming(w http.ResponseWriter, name string, d time.Duration) {
+	for {
+		switch rw := w.(type) {
+		case *timingWriter:
+			rw.recorder.Add(name, "", d)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
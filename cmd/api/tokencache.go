@@ -0,0 +1,129 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// tokenCache remembers which user each recently used authentication token belongs
+// to, so that a client making a burst of requests doesn't cost a database lookup for
+// each one. It's a fixed size LRU, and entries also expire after a short TTL so that
+// changes made elsewhere, such as by another instance, are picked up quickly.
+// Entries are keyed by the token's hash, so plaintext tokens aren't kept in memory,
+// and also indexed by user so that invalidating a user doesn't walk the whole cache.
+//
+// A nil *tokenCache is valid and caches nothing.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+	byUser  map[int64]map[*list.Element]struct{}
+}
+
+type tokenCacheEntry struct {
+	hash    [sha256.Size]byte
+	user    *data.User
+	expires time.Time
+}
+
+// newTokenCache returns a cache holding up to size tokens, or nil if size or ttl
+// isn't positive.
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		byUser:  make(map[int64]map[*list.Element]struct{}),
+	}
+}
+
+// get returns a copy of the user the token belongs to, or nil if it isn't cached.
+// Handlers change the user they're given, so the cached one is never handed out.
+func (c *tokenCache) get(token string) *data.User {
+	if c == nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[hash]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	user := *entry.user
+	return &user
+}
+
+func (c *tokenCache) add(token string, user *data.User) {
+	if c == nil {
+		return
+	}
+	hash := sha256.Sum256([]byte(token))
+	cached := *user
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[hash]; ok {
+		c.remove(el)
+	}
+	el := c.order.PushFront(&tokenCacheEntry{hash: hash, user: &cached, expires: time.Now().Add(c.ttl)})
+	c.entries[hash] = el
+	if c.byUser[cached.ID] == nil {
+		c.byUser[cached.ID] = make(map[*list.Element]struct{})
+	}
+	c.byUser[cached.ID][el] = struct{}{}
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidateUser forgets every token belonging to the user. It's called whenever
+// their tokens are revoked or their account changes.
+func (c *tokenCache) invalidateUser(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := range c.byUser[userID] {
+		c.remove(el)
+	}
+}
+
+// clear forgets every cached token, for when tokens have been deleted in bulk.
+func (c *tokenCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	c.byUser = make(map[int64]map[*list.Element]struct{})
+}
+
+func (c *tokenCache) remove(el *list.Element) {
+	entry := el.Value.(*tokenCacheEntry)
+	c.order.Remove(el)
+	delete(c.entries, entry.hash)
+	delete(c.byUser[entry.user.ID], el)
+	if len(c.byUser[entry.user.ID]) == 0 {
+		delete(c.byUser, entry.user.ID)
+	}
+}
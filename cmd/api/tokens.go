@@ -2,16 +2,53 @@ package main
 
 import (
 	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/jwt"
 	"books.reading.kz/internal/validator"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// deleteExpiredTokens purges tokens which have expired, so the tokens table doesn't
+// grow forever, along with authentication tokens which have been idle for longer
+// than -token-idle-timeout.
+func (app *application) deleteExpiredTokens() {
+	deleted, err := app.models.Tokens.DeleteExpired()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.logger.PrintInfo("expired tokens deleted", map[string]string{"count": fmt.Sprint(deleted)})
+
+	// Idle times are only known while usage is being tracked; without it every token
+	// would look unused since it was issued.
+	if app.config.tokens.idleTimeout <= 0 || app.config.tokens.usageInterval <= 0 {
+		return
+	}
+	deleted, err = app.models.Tokens.DeleteIdle(data.ScopeAuthentication, app.config.tokens.idleTimeout)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if deleted > 0 {
+		app.tokenCache.clear()
+		app.logger.PrintInfo("idle tokens deleted", map[string]string{"count": fmt.Sprint(deleted)})
+	}
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// OTP is the code from the user's authenticator app, or a recovery code. It's
+		// only needed if they've enabled two-factor authentication.
+		OTP string `json:"otp"`
+		// Scopes optionally limits the token to some of the user's permissions, such
+		// as ["books:read"], for handing to scripts and other less trusted clients.
+		Scopes []string `json:"scopes"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -21,7 +58,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Validate the email and password provided by the client.
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordInput(v, input.Password)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -33,31 +70,130 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordSecurityEvent(r, nil, input.Email, data.EventLogin, data.OutcomeFailure, "unknown email")
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	// Refuse to even check the password while the account is locked for this client.
+	if !app.checkLockout(w, r, user) {
+		return
+	}
+	// A user who has turned password login off, or never had it, is answered as if
+	// the password were wrong, so that it doesn't tell anyone how they log in.
+	if !user.PasswordLogin {
+		app.loginFailedResponse(w, r, user, "password login disabled")
+		return
+	}
 	// Check if the provided password matches the actual password for the user.
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
-	// helper again and return.
+	// If the passwords don't match, then we record the failure and send either an
+	// invalid credentials or an account locked response.
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.loginFailedResponse(w, r, user, "wrong password")
+		return
+	}
+	app.rehashPassword(user, input.Password)
+	tf, err := app.twoFactorEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf != nil {
+		if input.OTP == "" {
+			app.recordSecurityEvent(r, user, "", data.EventLogin, data.OutcomeFailure, "two-factor code required")
+			app.twoFactorRequiredResponse(w, r)
+			return
+		}
+		ok, err := app.checkSecondFactor(tf, input.OTP)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.loginFailedResponse(w, r, user, "wrong two-factor code")
+			return
+		}
+	}
+	// Scopes can only be checked against the user's permissions once we know who
+	// they are.
+	if input.Scopes != nil {
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if data.ValidateTokenScopes(v, input.Scopes, permissions); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+	if !app.checkFrozen(w, r, user) {
+		return
+	}
+	err = app.loginSucceeded(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	login := app.recordLogin(r, user, "password")
+	app.issueAuthenticationToken(w, r, user, login, input.Scopes)
+}
+
+// rehashPassword hashes the user's password again in the background if it was
+// hashed with other settings than the current ones, which is how stored hashes move
+// to stronger settings. password must have been checked against the user's hash.
+func (app *application) rehashPassword(user *data.User, password string) {
+	if !user.Password.NeedsRehash() {
+		return
+	}
+	// Copy the user, as the handler goes on to change it.
+	u := *user
+	app.background(func() {
+		err := app.models.Users.RehashPassword(&u, password)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"user_id": strconv.FormatInt(u.ID, 10)})
+		}
+	})
+}
+
+// issueAuthenticationToken sends the user a new authentication token in a 201 Created
+// response. It's used by every way of logging in, with the login event recordLogin
+// returned. If scopes isn't nil the token only carries those of the user's
+// permissions, which the caller must have checked.
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User, login *data.SecurityEvent, scopes []string) {
+	err := app.models.Users.RecordLogin(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// In stateless mode the client gets a short-lived JWT carrying the user's
+	// permissions, and nothing is stored.
+	if app.config.jwt.enabled {
+		app.issueJWT(w, r, user, scopes)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Otherwise we generate a new token with a 24-hour expiry time and the scope
+	// 'authentication', noting the client so the user can recognise the session later.
+	token, err := app.models.Tokens.NewForClient(user.ID, 24*time.Hour, data.ScopeAuthentication, r.UserAgent(), clientIP(r), scopes)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.recordSecurityEvent(r, user, "", data.EventTokenIssued, data.OutcomeSuccess, "authentication token")
+	// JWTs can't be revoked, so only sessions with a token are checked for new devices.
+	if login != nil && app.config.anomalies.newDevices {
+		u := *user
+		app.background(func() {
+			app.checkNewDevice(&u, login, token)
+		})
+	}
 	// Encode the token to JSON and send it in the response along with a 201 Created
 	// status code.
 	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
@@ -65,3 +201,270 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) issueJWT(w http.ResponseWriter, r *http.Request, user *data.User, scopes []string) {
+	token, expiry, err := app.signJWT(user, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventTokenIssued, data.OutcomeSuccess, "jwt")
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": jwtResponse(token, expiry)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// signJWT returns a JWT for the user carrying their permissions, limited to scopes
+// unless it's nil, and when it expires. user.TokenVersion must be current.
+func (app *application) signJWT(user *data.User, scopes []string) (string, time.Time, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if scopes != nil {
+		permissions = permissions.Restrict(scopes)
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.ttl)
+	token, err := app.jwtKeys.Sign(jwt.Claims{
+		Subject:     user.ID,
+		Permissions: permissions,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+		Scoped:      scopes != nil,
+		Version:     user.TokenVersion,
+	})
+	return token, expiry, err
+}
+
+// jwtResponse is how a JWT is sent to the client.
+func jwtResponse(token string, expiry time.Time) map[string]any {
+	return map[string]any{
+		"token":  token,
+		"type":   "jwt",
+		"expiry": expiry.UTC().Truncate(time.Second),
+	}
+}
+
+// createActivationTokenHandler sends a new activation token to a user who hasn't
+// activated their account yet, for example because the first email went astray. Older
+// activation tokens stop working, and emails to the same account are rate limited.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	retryAt, err := app.models.Users.ClaimActivationResend(user.ID, app.config.activation.resendInterval)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !retryAt.IsZero() {
+		app.activationRateLimitedResponse(w, r, retryAt)
+		return
+	}
+
+	// Replace the user's earlier tokens, so the links in emails we've already sent
+	// them stop working.
+	token, err := app.models.Tokens.Replace(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventTokenIssued, data.OutcomeSuccess, "activation token")
+
+	app.background(func() {
+		data := map[string]any{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		}
+		err := app.mailer.SendLocalized(user.Email, app.userLanguage(user.ID), "user_welcome.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listTokensHandler lists the user's active tokens, so they can see where they're
+// logged in. JWTs aren't stored, so they don't appear here.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var current string
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		current = strings.TrimPrefix(header, "Bearer ")
+	}
+	tokens, err := app.models.Tokens.GetAllForUser(app.contextGetUser(r).ID, current)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tokens": tokens}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeTokenHandler deletes one of the user's tokens, logging that session out.
+func (app *application) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Tokens.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventTokenRevoked, data.OutcomeSuccess, fmt.Sprintf("token %d", id))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// introspectTokenHandler tells services which have been handed a token, such as
+// sidecars in front of other APIs, whether it's active and who it belongs to. It
+// needs the tokens:introspect permission, which services get through an API key
+// with that scope. Unknown, expired and malformed tokens are all just inactive, as
+// are tokens which can't be used to authenticate, such as unsubscribe links.
+func (app *application) introspectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Token != "", "token", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.introspectToken(r, input.Token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// introspectToken describes a database token or JWT, including the permissions it
+// grants as of now. Only tokens the API would accept for a request are active, so
+// JWTs are checked against the user as authenticateJWT does: they must still exist,
+// be activated and not frozen, and not have changed their password since.
+func (app *application) introspectToken(r *http.Request, plaintext string) (*data.TokenIntrospection, error) {
+	inactive := &data.TokenIntrospection{Active: false}
+
+	if jwt.IsToken(plaintext) {
+		if app.jwtKeys == nil {
+			return inactive, nil
+		}
+		claims, err := app.jwtKeys.Verify(plaintext, time.Now())
+		if err != nil {
+			return inactive, nil
+		}
+		user, err := app.models.Users.Get(claims.Subject, r)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return inactive, nil
+			default:
+				return nil, err
+			}
+		}
+		if claims.Version != user.TokenVersion || !user.Activated || user.FrozenAt != nil {
+			return inactive, nil
+		}
+		issuedAt, expiry := time.Unix(claims.IssuedAt, 0), time.Unix(claims.Expiry, 0)
+		return &data.TokenIntrospection{
+			Active:      true,
+			Type:        "jwt",
+			Scope:       data.ScopeAuthentication,
+			UserID:      claims.Subject,
+			Permissions: claims.Permissions,
+			IssuedAt:    &issuedAt,
+			Expiry:      &expiry,
+		}, nil
+	}
+
+	token, err := app.models.Tokens.Introspect(plaintext, app.config.tokens.idleTimeout)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return inactive, nil
+		default:
+			return nil, err
+		}
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if token.Scopes != nil {
+		permissions = permissions.Restrict(token.Scopes)
+	}
+	token.Permissions = permissions
+	return token, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenUsage collects the most recent use of each authentication token in memory, so
+// that last-used times can be written in one batch every -token-usage-interval rather
+// than on every request.
+type tokenUsage struct {
+	mu   sync.Mutex
+	uses map[[sha256.Size]byte]data.TokenUse
+}
+
+func newTokenUsage() *tokenUsage {
+	return &tokenUsage{uses: make(map[[sha256.Size]byte]data.TokenUse)}
+}
+
+// record notes that the token was used just now. Only the latest use of each token
+// is kept until the next flush.
+func (u *tokenUsage) record(token, ip, userAgent string) {
+	hash := sha256.Sum256([]byte(token))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uses[hash] = data.TokenUse{Hash: hash[:], At: time.Now(), IP: ip, UserAgent: userAgent}
+}
+
+// take returns the uses recorded since it was last called, and forgets them.
+func (u *tokenUsage) take() []data.TokenUse {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.uses) == 0 {
+		return nil
+	}
+	uses := make([]data.TokenUse, 0, len(u.uses))
+	for _, use := range u.uses {
+		uses = append(uses, use)
+	}
+	u.uses = make(map[[sha256.Size]byte]data.TokenUse)
+	return uses
+}
+
+// flushTokenUsage writes the recorded token uses to the database. A failed batch is
+// logged and dropped; the next request made with each token records it again.
+func (app *application) flushTokenUsage() {
+	uses := app.tokenUsage.take()
+	if len(uses) == 0 {
+		return
+	}
+	err := app.models.Tokens.RecordUsage(uses)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"tokens": fmt.Sprint(len(uses))})
+	}
+}
+
+// runTokenUsageFlusher flushes token usage every interval, and once more during
+// graceful shutdown so that the last uses before a deploy aren't lost.
+func (app *application) runTokenUsageFlusher(interval time.Duration) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				app.flushTokenUsage()
+			case <-app.done:
+				app.flushTokenUsage()
+				return
+			}
+		}
+	})
+}
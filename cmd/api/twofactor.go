@@ -0,0 +1,316 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/internal/totp"
+	"books.reading.kz/internal/validator"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// totpIssuer is the name shown next to the account in authenticator apps.
+const totpIssuer = "Book-Inspire"
+
+var errTOTPNotConfigured = errors.New("a user has two-factor authentication enabled but -totp-key is not set")
+
+// twoFactorChallengeTTL is how long the user has to enter their code after a social
+// login.
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// checkSecondFactor checks a TOTP code, or one of the user's recovery codes, against
+// their enrollment. Codes are only accepted once.
+func (app *application) checkSecondFactor(tf *data.TwoFactor, code string) (bool, error) {
+	if app.totp == nil {
+		return false, errTOTPNotConfigured
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return app.models.TwoFactor.UseRecoveryCode(tf.UserID, code)
+	}
+
+	secret, err := app.totp.Open(tf.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.models.TwoFactor.UseStep(tf.UserID, step)
+}
+
+// twoFactorEnabled returns the user's enrollment if two-factor authentication is
+// turned on for them, or nil if it isn't.
+func (app *application) twoFactorEnabled(userID int64) (*data.TwoFactor, error) {
+	tf, err := app.models.TwoFactor.Get(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !tf.Enabled {
+		return nil, nil
+	}
+	return tf, nil
+}
+
+// confirmPassword checks the password sent to a sensitive endpoint, sending an error
+// response and returning false if it's missing or wrong.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	v := validator.New()
+	if data.ValidatePasswordInput(v, password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// enrollTwoFactorHandler starts TOTP enrollment. The secret and recovery codes are
+// only ever shown in this response. Nothing changes at login until the user verifies a
+// code from their app.
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	sealed, err := app.totp.Seal(secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enroll(user.ID, sealed, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.stateConflictResponse(w, r, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"two_factor": map[string]any{
+			"secret":         totp.EncodeSecret(secret),
+			"otpauth_url":    totp.URL(totpIssuer, user.Email, secret),
+			"recovery_codes": codes,
+		},
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyTwoFactorHandler finishes enrollment by checking a code from the user's app.
+func (app *application) verifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Code) == 6, "code", "must be the 6 digit code from your authenticator app")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.stateConflictResponse(w, r, "two-factor enrollment has not been started")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if tf.Enabled {
+		app.stateConflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	ok, err := app.checkSecondFactor(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "is incorrect or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TwoFactor.Enable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventTwoFactor, data.OutcomeSuccess, "enabled")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication enabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler turns two-factor authentication off. It needs both the
+// password and a current code (or recovery code).
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	tf, err := app.twoFactorEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf != nil {
+		ok, err := app.checkSecondFactor(tf, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	err = app.models.TwoFactor.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, user, "", data.EventTwoFactor, data.OutcomeSuccess, "disabled")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// completeTwoFactorLoginHandler finishes a social login to an account with two-factor
+// authentication, swapping the challenge token the callback gave out and a code for
+// an authentication token. Wrong codes count towards the account's lockout, as at a
+// password login.
+func (app *application) completeTwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"two_factor_token"`
+		OTP   string `json:"otp"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.Token)
+	v.Check(input.OTP != "", "otp", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactorChallenge, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.checkLockout(w, r, user) {
+		return
+	}
+
+	tf, err := app.twoFactorEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf != nil {
+		ok, err := app.checkSecondFactor(tf, input.OTP)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.loginFailedResponse(w, r, user, "wrong two-factor code")
+			return
+		}
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTwoFactorChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !app.checkFrozen(w, r, user) {
+		return
+	}
+	err = app.loginSucceeded(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	login := app.recordLogin(r, user, "social login with two-factor code")
+	app.issueAuthenticationToken(w, r, user, login, nil)
+}
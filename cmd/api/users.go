@@ -4,7 +4,9 @@ import (
 	"books.reading.kz/internal/data"
 	"books.reading.kz/internal/validator"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,9 +28,10 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	// Activated field will have the zero-value of false by default. But setting this
 	// explicitly helps to make our intentions clear to anyone reading the code.
 	user := &data.User{
-		Name:      input.Name,
-		Email:     input.Email,
-		Activated: false,
+		Name:          input.Name,
+		Email:         input.Email,
+		PasswordLogin: true,
+		Activated:     false,
 	}
 	// Use the Password.Set() method to generate and store the hashed and plaintext
 	// passwords.
@@ -56,7 +59,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	err = app.models.Permissions.AddForUser(user.ID, "books:read")
+	err = app.models.Roles.AddForUser(user.ID, data.DefaultRole)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	language, err := app.setSignupLanguage(r, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -77,7 +85,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			"userID":          user.ID,
 		}
 		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err = app.mailer.SendLocalized(user.Email, language, "user_welcome.tmpl", data)
 		if err != nil {
 			app.logger.PrintError(err, nil)
 		}
@@ -104,10 +112,13 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Retrieve the details of the user associated with the token using the
-	// GetForToken() method (which we will create in a minute). If no matching record
-	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	// Activate the user, consuming the token and any others they were sent in the
+	// same transaction so that none of them can be replayed. A link clicked twice gets
+	// the same response both times, as the token can be used again for a few minutes
+	// without changing anything. If the token doesn't match, has expired or was used
+	// longer ago than that we let the client know that the token they provided is not
+	// valid.
+	user, err := app.models.Users.Activate(input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -118,13 +129,280 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	// Update the user's activation status.
+	// The user may already be logged in, so their cached tokens still say they
+	// aren't activated.
+	app.tokenCache.invalidateUser(user.ID)
+	// Send the updated user details to the client in a JSON response.
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// changePasswordHandler changes the user's password after checking their current one,
+// which counts towards the same lockout as logging in. Every other authentication
+// token and every JWT they have is revoked, so anyone who had got hold of one is
+// logged out, and the user is emailed in case it wasn't them. Admins impersonating a
+// user can't change their password.
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	if app.contextGetAPIKey(r) != nil || user.ImpersonatorID != 0 || user.TokenScopes != nil {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordForUser(v, input.Password, user)
+	v.Check(input.Password != input.CurrentPassword, "password", "must be different from the current password")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkLockoutFor(w, r, user, data.EventPasswordChanged) {
+		return
+	}
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.failedResponseFor(w, r, user, data.EventPasswordChanged, "wrong password")
+		return
+	}
+	err = app.loginSucceeded(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Set hashes the new password with the current cost, however old the hash
+	// being replaced is.
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Users.Update(user, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Keep the token this request was made with, so the user stays logged in here.
+	var current string
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		current = strings.TrimPrefix(header, "Bearer ")
+	}
+	revoked, err := app.models.Tokens.DeleteOthersForUser(data.ScopeAuthentication, user.ID, current)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+	// JWTs can't be deleted, so every one issued so far is revoked by bumping the
+	// token version. If this request used one, a new one is sent back instead.
+	user.TokenVersion, err = app.models.Users.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"message": "your password has been changed", "sessions_revoked": revoked}
+	if app.contextGetClaims(r) != nil {
+		token, expiry, err := app.signJWT(user, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["authentication_token"] = jwtResponse(token, expiry)
+	}
+	app.recordSecurityEvent(r, user, "", data.EventPasswordChanged, data.OutcomeSuccess, fmt.Sprintf("%d other sessions logged out", revoked))
+
+	ip := clientIP(r)
+	app.background(func() {
+		tmplData := map[string]any{
+			"name":      user.Name,
+			"changedAt": time.Now().UTC().Format("2 January 2006 at 15:04 UTC"),
+			"ip":        ip,
+		}
+		err := app.mailer.SendLocalized(user.Email, app.userLanguage(user.ID), "password_changed.tmpl", tmplData)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserEmailHandler starts an email address change. The new address isn't used
+// until the user confirms it with the token we send there, and the account is
+// deactivated until then.
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordInput(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// The current password is required, so that someone who gets hold of an
+	// authentication token can't take over the account by changing its email.
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from the current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(input.Email, r)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.PendingEmail = input.Email
+	user.Activated = false
+	err = app.models.Users.Update(user, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+
+	// Only the most recent request can be confirmed.
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"emailChangeToken": token.Plaintext,
+		}
+		err := app.mailer.SendLocalized(input.Email, app.userLanguage(user.ID), "email_change.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "a confirmation email has been sent to the new address, the change will take effect and your account will be reactivated once it is confirmed"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmUserEmailHandler completes an email address change using the token that was
+// sent to the new address, and reactivates the account.
+func (app *application) confirmUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.PendingEmail == "" {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// A frozen account mustn't be changed or reactivated until the hold is released.
+	// The token is left alone so that it still works afterwards, if it hasn't expired.
+	if user.FrozenAt != nil {
+		app.recordSecurityEvent(r, user, "", data.EventEmailChanged, data.OutcomeFailure, "account frozen")
+		app.accountFrozenResponse(w, r)
+		return
+	}
+
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
 	user.Activated = true
-	// Save the updated user record in our database, checking for any edit conflicts in
-	// the same way that we did for our movie records.
 	err = app.models.Users.Update(user, r)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -132,16 +410,182 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	// If everything went successfully, then we delete all activation tokens for the
-	// user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Send the updated user details to the client in a JSON response.
+	app.tokenCache.invalidateUser(user.ID)
+	app.recordSecurityEvent(r, user, "", data.EventEmailChanged, data.OutcomeSuccess, "")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler permanently deletes the authenticated user's account. The
+// user must confirm their password.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordInput(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// The preferences go with the account, so the language has to be looked up first.
+	language := app.userLanguage(user.ID)
+
+	err = app.models.Users.Delete(user.ID, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokenCache.invalidateUser(user.ID)
+
+	app.background(func() {
+		data := map[string]any{
+			"name": user.Name,
+		}
+		err := app.mailer.SendLocalized(user.Email, language, "account_deleted.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account has been deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler returns the authenticated user's own account, including the
+// private fields which aren't part of their public profile.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserProfileHandler partially updates the authenticated user's profile.
+func (app *application) updateCurrentUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name          *string `json:"name"`
+		DisplayName   *string `json:"display_name"`
+		Bio           *string `json:"bio"`
+		AvatarURL     *string `json:"avatar_url"`
+		ProfilePublic *bool   `json:"profile_public"`
+		Timezone      *string `json:"timezone"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.DisplayName != nil {
+		user.DisplayName = *input.DisplayName
+	}
+	if input.Bio != nil {
+		user.Bio = *input.Bio
+	}
+	if input.AvatarURL != nil {
+		user.AvatarURL = *input.AvatarURL
+	}
+	if input.ProfilePublic != nil {
+		user.ProfilePublic = *input.ProfilePublic
+	}
+	if input.Timezone != nil {
+		user.Timezone = *input.Timezone
+	}
+
+	v := validator.New()
+	data.ValidateUser(v, user)
+	if data.ValidateProfile(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// showUserProfileHandler returns another user's public profile. Private profiles, and
+// those of users who haven't activated their account, are reported as not found so
+// that their existence isn't revealed. Users can always see their own profile.
+func (app *application) showUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.resolveUserIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(id, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.ID != app.contextGetUser(r).ID && !(user.ProfilePublic && user.Activated) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"profile": user.Profile()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"books.reading.kz/internal/data"
+	"context"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// warmUp primes what the first requests after a deploy would otherwise wait for: the
+// home page cache, with its genre counts and new arrivals, and the busiest queries'
+// prepared statements. pgx prepares a query the first time each connection runs it,
+// so the queries are run in parallel to leave them prepared on several connections.
+// /readyz reports ready once it's done, even if it failed, as a cold server is better
+// than none.
+func (app *application) warmUp() {
+	defer app.ready.Store(true)
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.warmup.timeout)
+	defer cancel()
+
+	_, err := app.refreshHome()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"phase": "warm-up"})
+		return
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < app.config.warmup.conns; i++ {
+		g.Go(func() error {
+			return app.warmQueries(ctx)
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"phase": "warm-up"})
+		return
+	}
+
+	app.logger.PrintInfo("warm-up complete", map[string]string{
+		"conns":       strconv.Itoa(app.config.warmup.conns),
+		"duration_ms": strconv.FormatInt(time.Since(start).Milliseconds(), 10),
+	})
+}
+
+// warmQueries runs the queries behind the home page and the default book listing.
+func (app *application) warmQueries(ctx context.Context) error {
+	_, err := app.models.Book.GetNewArrivals(ctx, 10)
+	if err != nil {
+		return err
+	}
+	_, err = app.models.Book.GetGenreCounts(ctx, 10)
+	if err != nil {
+		return err
+	}
+
+	// The models route reads by request, so the listing is made as if for one.
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/v1/books", nil)
+	if err != nil {
+		return err
+	}
+	filters := data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}}
+	_, _, err = app.models.Book.GetAll("", "", nil, 0, "", filters, r)
+	return err
+}
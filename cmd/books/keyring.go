@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// keyringService is the name tokens are stored under in the OS keyring.
+const keyringService = "books.reading.kz"
+
+var (
+	errNoToken   = errors.New("not logged in; run: books login")
+	errNoKeyring = errors.New("no OS keyring found; run books login -file to keep the token in a file instead")
+)
+
+// tokenStore keeps the authentication token for each API URL. Tokens go in the OS
+// keyring, through the security tool on macOS and secret-tool (libsecret) on Linux
+// and the BSDs. Where neither is available, such as on Windows, they're only kept
+// in a plaintext file in the user's config directory if allowFile is set, as anyone
+// who can read the file as the user can use the token.
+type tokenStore struct {
+	dir       string
+	allowFile bool
+}
+
+func newTokenStore() (*tokenStore, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	return &tokenStore{dir: filepath.Join(dir, "books")}, nil
+}
+
+// keyringCommand returns the tool used to reach the OS keyring, or "" if there isn't
+// one.
+func keyringCommand() string {
+	var name string
+	switch runtime.GOOS {
+	case "darwin":
+		name = "security"
+	case "windows":
+		return ""
+	default:
+		name = "secret-tool"
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+func (s *tokenStore) get(api string) (string, error) {
+	var out []byte
+	var err error
+	switch keyringCommand() {
+	case "security":
+		out, err = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", api, "-w").Output()
+	case "secret-tool":
+		out, err = exec.Command("secret-tool", "lookup", "service", keyringService, "account", api).Output()
+	default:
+		out, err = os.ReadFile(s.file(api))
+	}
+	token := strings.TrimSpace(string(out))
+	if err != nil || token == "" {
+		return "", errNoToken
+	}
+	return token, nil
+}
+
+func (s *tokenStore) set(api, token string) error {
+	switch keyringCommand() {
+	case "security":
+		// security only takes the secret as an argument, so the command is given
+		// on stdin in interactive mode to keep the token out of the process list.
+		cmd := exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			strconv.Quote(keyringService), strconv.Quote(api), strconv.Quote(token)))
+		return cmd.Run()
+	case "secret-tool":
+		cmd := exec.Command("secret-tool", "store", "--label", "Books API token for "+api, "service", keyringService, "account", api)
+		cmd.Stdin = bytes.NewBufferString(token)
+		return cmd.Run()
+	default:
+		if !s.allowFile {
+			return errNoKeyring
+		}
+		fmt.Fprintf(os.Stderr, "warning: no OS keyring found, so the token is stored unencrypted in %s\n", s.file(api))
+		err := os.MkdirAll(s.dir, 0o700)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(s.file(api), []byte(token+"\n"), 0o600)
+	}
+}
+
+func (s *tokenStore) remove(api string) error {
+	var err error
+	switch keyringCommand() {
+	case "security":
+		err = exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", api).Run()
+	case "secret-tool":
+		err = exec.Command("secret-tool", "clear", "service", keyringService, "account", api).Run()
+	default:
+		err = os.Remove(s.file(api))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	return err
+}
+
+// file is where the token for api is kept when there's no keyring. The URL is
+// flattened into the name so each server gets its own file.
+func (s *tokenStore) file(api string) string {
+	name := strings.NewReplacer("://", "_", "/", "_", ":", "_").Replace(api)
+	return filepath.Join(s.dir, "token_"+name)
+}
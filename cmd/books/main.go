@@ -0,0 +1,442 @@
+// Command books is a terminal client for the Book-Inspire API: search the catalog,
+// look up books, keep reading lists and time reading sessions.
+//
+//	books login
+//	books search -genre fantasy dragons
+//	books show the-hobbit
+//	books shelves
+//	books shelf add 3 42
+//	books read start 42
+//	books read stop
+//	books stats
+//
+// The API is chosen with -api or the BOOKS_API_URL environment variable, and the
+// token from books login is kept in the OS keyring.
+package main
+
+import (
+	"books.reading.kz/pkg/client"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: books [-api URL] <command> [arguments]
+
+Commands:
+  login [-file]                   log in and store the token in the OS keyring, or
+                                  a plaintext file with -file if there isn't one
+  logout                          revoke and forget the stored token
+  whoami                          show the logged in user
+  search [-genre G] [-all] WORDS  search the catalog
+  show ID|SLUG                    show a book
+  shelves [-archived]             list your reading lists
+  shelf show LIST                 show a reading list
+  shelf create NAME [DESC]        create a reading list
+  shelf add LIST BOOK             add a book to a reading list
+  shelf remove LIST BOOK          remove a book from a reading list
+  shelf delete LIST               delete a reading list
+  read start BOOK                 start timing a reading session
+  read stop [SESSION]             stop a reading session, the last started by default
+  stats [-days N]                 show your reading stats and streak
+`
+
+// cli holds what every command needs.
+type cli struct {
+	api    string
+	client *client.Client
+	tokens *tokenStore
+	state  *state
+	out    *tabwriter.Writer
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "books:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("books", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	api := os.Getenv("BOOKS_API_URL")
+	if api == "" {
+		api = "http://localhost:4000"
+	}
+	fs.StringVar(&api, "api", api, "Base URL of the API")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+
+	tokens, err := newTokenStore()
+	if err != nil {
+		return err
+	}
+	c := &cli{
+		api:    strings.TrimRight(api, "/"),
+		tokens: tokens,
+		state:  loadState(tokens.dir),
+		out:    tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0),
+	}
+	defer c.out.Flush()
+	c.client = client.New(c.api)
+	c.client.UserAgent = "books-cli/" + runtime.GOOS
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	commands := map[string]func(context.Context, []string) error{
+		"login":   c.login,
+		"logout":  c.logout,
+		"whoami":  c.whoami,
+		"search":  c.search,
+		"show":    c.show,
+		"shelves": c.shelves,
+		"shelf":   c.shelf,
+		"read":    c.read,
+		"stats":   c.stats,
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if args[0] != "login" {
+		c.client.Token, err = c.tokens.get(c.api)
+		if err != nil {
+			return err
+		}
+	}
+	err = cmd(ctx, args[1:])
+	if errors.Is(err, client.ErrUnauthorized) && args[0] != "login" {
+		return errors.New("your session has expired; run: books login")
+	}
+	return err
+}
+
+func (c *cli) login(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	fs.BoolVar(&c.tokens.allowFile, "file", false, "Store the token in a plaintext file if there's no OS keyring")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	// Check before logging in, so that a token isn't issued with nowhere to keep it.
+	if keyringCommand() == "" && !c.tokens.allowFile {
+		return errNoKeyring
+	}
+	in := bufio.NewReader(os.Stdin)
+	fmt.Print("Email: ")
+	email, err := in.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(in, "Password: ")
+	if err != nil {
+		return err
+	}
+
+	token, err := c.client.CreateToken(ctx, strings.TrimSpace(email), password, "", nil)
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 401 && strings.Contains(apiErr.Message, "two-factor") {
+		fmt.Print("Two-factor code: ")
+		otp, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		token, err = c.client.CreateToken(ctx, strings.TrimSpace(email), password, strings.TrimSpace(otp), nil)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	err = c.tokens.set(c.api, token.Token)
+	if err != nil {
+		return fmt.Errorf("storing the token: %w", err)
+	}
+	fmt.Printf("Logged in until %s.\n", token.Expiry.Local().Format(time.RFC1123))
+	return nil
+}
+
+// readPassword prompts for a password, turning off echo with stty where it's
+// available.
+func readPassword(in *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	if runtime.GOOS != "windows" {
+		echoOff := exec.Command("stty", "-echo")
+		echoOff.Stdin = os.Stdin
+		if echoOff.Run() == nil {
+			defer func() {
+				echoOn := exec.Command("stty", "echo")
+				echoOn.Stdin = os.Stdin
+				echoOn.Run()
+				fmt.Println()
+			}()
+		}
+	}
+	password, err := in.ReadString('\n')
+	return strings.TrimRight(password, "\r\n"), err
+}
+
+func (c *cli) logout(ctx context.Context, args []string) error {
+	sessions, err := c.client.Sessions(ctx)
+	if err == nil {
+		for _, session := range sessions {
+			if session.Current {
+				err = c.client.RevokeSession(ctx, session.ID)
+				break
+			}
+		}
+	}
+	// The token is forgotten even if it couldn't be revoked, as it has most likely
+	// expired already.
+	if err != nil && !errors.Is(err, client.ErrUnauthorized) {
+		fmt.Fprintln(os.Stderr, "books: couldn't revoke the token:", err)
+	}
+	return c.tokens.remove(c.api)
+}
+
+func (c *cli) whoami(ctx context.Context, args []string) error {
+	user, err := c.client.CurrentUser(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "ID\t%d\nName\t%s\nEmail\t%s\nActivated\t%t\nTimezone\t%s\n", user.ID, user.Name, user.Email, user.Activated, user.Timezone)
+	return nil
+}
+
+func (c *cli) search(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	genre := fs.String("genre", "", "Comma separated genres the books must all have")
+	all := fs.Bool("all", false, "Page through every result instead of the first page")
+	pageSize := fs.Int("n", 20, "Results per page")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filter := client.BookFilter{Search: strings.Join(fs.Args(), " "), Page: client.Page{PageSize: *pageSize}}
+	if *genre != "" {
+		filter.Genres = strings.Split(*genre, ",")
+	}
+
+	fmt.Fprintln(c.out, "ID\tTITLE\tYEAR\tPAGES\tGENRES")
+	if *all {
+		books := c.client.Books(ctx, filter)
+		for books.Next() {
+			printBookRow(c.out, books.Value())
+		}
+		return books.Err()
+	}
+	books, metadata, err := c.client.ListBooks(ctx, filter)
+	if err != nil {
+		return err
+	}
+	for _, book := range books {
+		printBookRow(c.out, book)
+	}
+	if metadata.LastPage > 1 {
+		c.out.Flush()
+		fmt.Printf("\n%d of %d books; use -all to see the rest.\n", len(books), metadata.TotalRecords)
+	}
+	return nil
+}
+
+func printBookRow(out *tabwriter.Writer, book *client.Book) {
+	fmt.Fprintf(out, "%d\t%s\t%d\t%d\t%s\n", book.ID, book.Title, book.Year, book.Pages, strings.Join(book.Genres, ", "))
+}
+
+func (c *cli) show(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: books show ID|SLUG")
+	}
+	var book *client.Book
+	var err error
+	if id, perr := strconv.ParseInt(args[0], 10, 64); perr == nil {
+		book, err = c.client.GetBook(ctx, id)
+	} else {
+		book, err = c.client.GetBookBySlug(ctx, args[0])
+	}
+	if errors.Is(err, client.ErrRecordNotFound) {
+		return fmt.Errorf("no book %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "ID\t%d\nTitle\t%s\nSlug\t%s\nYear\t%d\nPages\t%d\nGenres\t%s\n", book.ID, book.Title, book.Slug, book.Year, book.Pages, strings.Join(book.Genres, ", "))
+	c.out.Flush()
+	if book.Content != "" {
+		fmt.Printf("\n%s\n", book.Content)
+	}
+	return nil
+}
+
+func (c *cli) shelves(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("shelves", flag.ContinueOnError)
+	archived := fs.Bool("archived", false, "List archived reading lists instead")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	lists, err := c.client.Lists(ctx, *archived)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "ID\tNAME\tDESCRIPTION")
+	for _, list := range lists {
+		fmt.Fprintf(c.out, "%d\t%s\t%s\n", list.ID, list.Name, list.Description)
+	}
+	return nil
+}
+
+func (c *cli) shelf(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: books shelf show|create|add|remove|delete ...")
+	}
+	if args[0] == "create" {
+		name := args[1]
+		var description *string
+		if len(args) > 2 {
+			description = &args[2]
+		}
+		list, err := c.client.CreateList(ctx, client.ListInput{Name: &name, Description: description})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created reading list %d.\n", list.ID)
+		return nil
+	}
+
+	listID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid list ID %q", args[1])
+	}
+	var list *client.List
+	switch args[0] {
+	case "show":
+		list, err = c.client.GetList(ctx, listID)
+	case "add", "remove":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: books shelf %s LIST BOOK", args[0])
+		}
+		bookID, perr := strconv.ParseInt(args[2], 10, 64)
+		if perr != nil {
+			return fmt.Errorf("invalid book ID %q", args[2])
+		}
+		if args[0] == "add" {
+			list, err = c.client.AddListItem(ctx, listID, bookID)
+		} else {
+			list, err = c.client.RemoveListItem(ctx, listID, bookID)
+		}
+	case "delete":
+		err = c.client.DeleteList(ctx, listID)
+		if err == nil {
+			fmt.Printf("Deleted reading list %d.\n", listID)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown shelf command %q", args[0])
+	}
+	if errors.Is(err, client.ErrRecordNotFound) {
+		return errors.New("no such reading list or book")
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "%s\t%s\n\n", list.Name, list.Description)
+	fmt.Fprintln(c.out, "#\tBOOK\tTITLE")
+	for _, item := range list.Items {
+		fmt.Fprintf(c.out, "%d\t%d\t%s\n", item.Position, item.BookID, item.Title)
+	}
+	return nil
+}
+
+func (c *cli) read(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: books read start BOOK | books read stop [SESSION]")
+	}
+	switch args[0] {
+	case "start":
+		if len(args) != 2 {
+			return errors.New("usage: books read start BOOK")
+		}
+		bookID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid book ID %q", args[1])
+		}
+		session, err := c.client.StartReading(ctx, bookID)
+		if err != nil {
+			return err
+		}
+		c.state.LastSession = session.ID
+		err = c.state.save()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reading session %d started at %s.\n", session.ID, session.StartedAt.Local().Format(time.Kitchen))
+		return nil
+	case "stop":
+		id := c.state.LastSession
+		if len(args) > 1 {
+			var err error
+			id, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid session ID %q", args[1])
+			}
+		}
+		if id == 0 {
+			return errors.New("no reading session to stop")
+		}
+		session, err := c.client.StopReading(ctx, id)
+		if err != nil {
+			return err
+		}
+		if id == c.state.LastSession {
+			c.state.LastSession = 0
+			c.state.save()
+		}
+		fmt.Printf("Read for %s.\n", time.Duration(session.Duration)*time.Second)
+		return nil
+	}
+	return fmt.Errorf("unknown read command %q", args[0])
+}
+
+func (c *cli) stats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	days := fs.Int("days", 7, "Number of days to show")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	stats, err := c.client.ReadingStats(ctx, *days)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "DATE\tMINUTES")
+	for _, day := range stats.MinutesPerDay {
+		fmt.Fprintf(c.out, "%s\t%d\n", day.Date, day.Minutes)
+	}
+	fmt.Fprintf(c.out, "\nTotal\t%d minutes\nStreak\t%d days (longest %d)\n", stats.TotalMinutes, stats.Streak.Current, stats.Streak.Longest)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// state is what the CLI remembers between runs, other than the token.
+type state struct {
+	// LastSession is the reading session books read start last started, so that
+	// books read stop doesn't need to be told it.
+	LastSession int64 `json:"last_session,omitempty"`
+
+	path string
+}
+
+// loadState reads the state saved in dir. A missing or unreadable file gives an
+// empty state, as nothing in it is worth failing over.
+func loadState(dir string) *state {
+	s := &state{path: filepath.Join(dir, "state.json")}
+	b, err := os.ReadFile(s.path)
+	if err == nil {
+		json.Unmarshal(b, s)
+	}
+	return s
+}
+
+func (s *state) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, b, 0o600)
+}
@@ -3,15 +3,19 @@ module books.reading.kz
 go 1.19
 
 require (
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
+	github.com/go-mail/mail/v2 v2.3.0
+	github.com/jackc/pgx/v5 v5.3.0
+	github.com/julienschmidt/httprouter v1.3.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/sync v0.1.0
+	golang.org/x/time v0.3.0
+)
+
+require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/jackc/pgx/v5 v5.3.0 // indirect
 	github.com/jackc/puddle/v2 v2.2.0 // indirect
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// HotQuery is one of the queries run on every request to a busy endpoint. The index
+// advisor EXPLAINs it with representative Args against the current table statistics.
+type HotQuery struct {
+	Name  string
+	Query string
+	Args  []any
+}
+
+// HotQueries mirrors the WHERE clauses of the queries behind our busiest endpoints.
+var HotQueries = []HotQuery{
+	{
+		Name:  "book_by_id",
+		Query: `SELECT * FROM books WHERE id = $1`,
+		Args:  []any{1},
+	},
+	{
+		Name:  "book_by_slug",
+		Query: `SELECT * FROM books WHERE slug = $1 OR id = (SELECT book_id FROM book_slugs WHERE slug = $1)`,
+		Args:  []any{"example-2000"},
+	},
+	{
+		Name:  "books_by_title",
+		Query: `SELECT * FROM books WHERE to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) ORDER BY id LIMIT 20`,
+		Args:  []any{"example"},
+	},
+	{
+		Name:  "books_full_text_search",
+		Query: `SELECT * FROM books WHERE to_tsvector('simple', title || ' ' || content) @@ plainto_tsquery('simple', $1) ORDER BY id LIMIT 20`,
+		Args:  []any{"example"},
+	},
+	{
+		Name: "books_by_genre",
+		Query: `
+			SELECT book_genres.book_id FROM book_genres
+			INNER JOIN genres ON genres.id = book_genres.genre_id
+			WHERE genres.name = ANY($1)`,
+		Args: []any{[]string{"fiction"}},
+	},
+	{
+		Name: "user_for_token",
+		Query: `
+			SELECT users.* FROM users
+			INNER JOIN tokens ON users.id = tokens.user_id
+			WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3`,
+		Args: []any{[]byte{0}, ScopeAuthentication, time.Now()},
+	},
+	{
+		Name:  "user_by_email",
+		Query: `SELECT * FROM users WHERE email = $1`,
+		Args:  []any{"user@example.com"},
+	},
+}
+
+// Thresholds used to decide whether a finding is worth reporting. Tables smaller than
+// minAdvisorRows are cheap to scan and not worth an index.
+const (
+	minAdvisorRows    = 1000
+	maxDeadTupleRatio = 0.2
+)
+
+// AdvisorHint is a single tuning suggestion.
+type AdvisorHint struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Query  string `json:"query,omitempty"`
+	Index  string `json:"index,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// AdvisorReport is the outcome of a run of the index advisor.
+type AdvisorReport struct {
+	CheckedAt time.Time     `json:"checked_at"`
+	Hints     []AdvisorHint `json:"hints"`
+}
+
+// planNode is the subset of an EXPLAIN (FORMAT JSON) plan node that the advisor uses.
+type planNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	PlanRows     float64    `json:"Plan Rows"`
+	Filter       string     `json:"Filter"`
+	Plans        []planNode `json:"Plans"`
+}
+
+type AdvisorModel struct {
+	DB *pgxpool.Pool
+}
+
+// Advise EXPLAINs each of the HotQueries and looks at the table and index statistics,
+// returning hints about likely missing indexes, unused indexes and bloated tables.
+// Nothing is changed in the database. Progress is reported after each query and set
+// of statistics.
+func (m AdvisorModel) Advise(ctx context.Context, progress ProgressFunc) (*AdvisorReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	report := &AdvisorReport{
+		CheckedAt: time.Now(),
+		Hints:     []AdvisorHint{},
+	}
+
+	// Row estimates for each table, used to ignore sequential scans on small tables.
+	rowCounts := make(map[string]float64)
+	rows, err := m.DB.Query(ctx, `
+		SELECT relname, reltuples FROM pg_class
+		WHERE relkind = 'r' AND relnamespace = 'public'::regnamespace`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table string
+		var count float32
+		err := rows.Scan(&table, &count)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rowCounts[table] = float64(count)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The hot queries, then bloat, then unused indexes.
+	total := int64(len(HotQueries) + 2)
+	for i, hq := range HotQueries {
+		var plan []byte
+		err := m.DB.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+hq.Query, hq.Args...).Scan(&plan)
+		if err != nil {
+			return nil, fmt.Errorf("explain %s: %w", hq.Name, err)
+		}
+
+		var explained []struct {
+			Plan planNode `json:"Plan"`
+		}
+		err = json.Unmarshal(plan, &explained)
+		if err != nil {
+			return nil, fmt.Errorf("explain %s: %w", hq.Name, err)
+		}
+
+		for _, e := range explained {
+			report.Hints = append(report.Hints, seqScanHints(hq.Name, e.Plan, rowCounts)...)
+		}
+		progress.report(int64(i+1), total)
+	}
+
+	bloat, err := m.bloatHints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Hints = append(report.Hints, bloat...)
+	progress.report(total-1, total)
+
+	unused, err := m.unusedIndexHints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Hints = append(report.Hints, unused...)
+	progress.report(total, total)
+
+	return report, nil
+}
+
+// seqScanHints walks a plan and returns a hint for every sequential scan over a table
+// large enough for an index to matter.
+func seqScanHints(query string, node planNode, rowCounts map[string]float64) []AdvisorHint {
+	var hints []AdvisorHint
+	if node.NodeType == "Seq Scan" && rowCounts[node.RelationName] >= minAdvisorRows {
+		detail := fmt.Sprintf("sequential scan over about %.0f rows", rowCounts[node.RelationName])
+		if node.Filter != "" {
+			detail += fmt.Sprintf(", consider an index covering the filter %s", node.Filter)
+		}
+		hints = append(hints, AdvisorHint{
+			Kind:   "missing_index",
+			Table:  node.RelationName,
+			Query:  query,
+			Detail: detail,
+		})
+	}
+	for _, child := range node.Plans {
+		hints = append(hints, seqScanHints(query, child, rowCounts)...)
+	}
+	return hints
+}
+
+// bloatHints reports tables with a high proportion of dead rows, which autovacuum
+// isn't keeping up with.
+func (m AdvisorModel) bloatHints(ctx context.Context) ([]AdvisorHint, error) {
+	query := `
+		SELECT relname, n_live_tup, n_dead_tup
+		FROM pg_stat_user_tables
+		WHERE n_dead_tup >= $1 AND n_dead_tup > $2 * (n_live_tup + n_dead_tup)
+		ORDER BY n_dead_tup DESC`
+
+	rows, err := m.DB.Query(ctx, query, minAdvisorRows, maxDeadTupleRatio)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hints []AdvisorHint
+	for rows.Next() {
+		var table string
+		var live, dead int64
+		err := rows.Scan(&table, &live, &dead)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, AdvisorHint{
+			Kind:   "bloat",
+			Table:  table,
+			Detail: fmt.Sprintf("%d dead rows against %d live rows, consider running VACUUM or tuning autovacuum", dead, live),
+		})
+	}
+	return hints, rows.Err()
+}
+
+// unusedIndexHints reports indexes which have never been scanned since the statistics
+// were last reset. Unique indexes are left out as they enforce constraints.
+func (m AdvisorModel) unusedIndexHints(ctx context.Context) ([]AdvisorHint, error) {
+	query := `
+		SELECT s.relname, s.indexrelname, pg_size_pretty(pg_relation_size(s.indexrelid))
+		FROM pg_stat_user_indexes s
+		INNER JOIN pg_index i ON i.indexrelid = s.indexrelid
+		WHERE s.idx_scan = 0 AND NOT i.indisunique
+		ORDER BY pg_relation_size(s.indexrelid) DESC`
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hints []AdvisorHint
+	for rows.Next() {
+		var table, index, size string
+		err := rows.Scan(&table, &index, &size)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, AdvisorHint{
+			Kind:   "unused_index",
+			Table:  table,
+			Index:  index,
+			Detail: fmt.Sprintf("index of %s has not been used since statistics were reset", size),
+		})
+	}
+	return hints, rows.Err()
+}
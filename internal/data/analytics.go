@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Anonymization is what's done to a column's values before they leave the database
+// in an analytics export.
+type Anonymization int
+
+const (
+	// Keep exports the value as it is. Only use it for values which can't identify
+	// anyone, such as book IDs.
+	Keep Anonymization = iota
+	// Pseudonymize replaces the value with a keyed hash, so the analytics team can
+	// tell rows for the same user apart from others without learning who they are.
+	Pseudonymize
+	// TruncateHour and TruncateDay coarsen timestamps so that activity can't be
+	// matched against other logs.
+	TruncateHour
+	TruncateDay
+	// Scrub lower cases free text and masks anything which looks like an email
+	// address or a number long enough to be a phone or card number.
+	Scrub
+)
+
+// AnalyticsColumn is one column of an export, in the order the dataset's query
+// selects them.
+type AnalyticsColumn struct {
+	Name string
+	Rule Anonymization
+}
+
+// AnalyticsDataset is an export of one kind of usage. Query selects the rows in the
+// window between $1 and $2.
+type AnalyticsDataset struct {
+	Name    string
+	Query   string
+	Columns []AnalyticsColumn
+}
+
+// AnalyticsDatasets are exported for the analytics team. Adding a column here means
+// deciding how it's anonymized, and nothing which identifies a member is exported
+// with Keep.
+var AnalyticsDatasets = []AnalyticsDataset{
+	{
+		Name: "searches",
+		Query: `
+			SELECT searched_at, user_id, query, results
+			FROM searches
+			WHERE searched_at >= $1 AND searched_at < $2
+			ORDER BY searched_at, id`,
+		Columns: []AnalyticsColumn{
+			{"searched_at", TruncateHour},
+			{"user", Pseudonymize},
+			{"query", Scrub},
+			{"results", Keep},
+		},
+	},
+	{
+		Name: "reads",
+		Query: `
+			SELECT reading_sessions.started_at, reading_sessions.user_id, reading_sessions.book_id, books.external_id,
+				CASE WHEN reading_sessions.ended_at IS NULL THEN NULL
+				ELSE extract(epoch FROM reading_sessions.ended_at - reading_sessions.started_at)::bigint / 60 END,
+				reading_sessions.timed_out
+			FROM reading_sessions
+			INNER JOIN books ON books.id = reading_sessions.book_id
+			WHERE reading_sessions.started_at >= $1 AND reading_sessions.started_at < $2
+			ORDER BY reading_sessions.started_at, reading_sessions.id`,
+		Columns: []AnalyticsColumn{
+			{"started_at", TruncateHour},
+			{"user", Pseudonymize},
+			{"book_id", Keep},
+			{"book_external_id", Keep},
+			{"minutes", Keep},
+			{"timed_out", Keep},
+		},
+	},
+	{
+		// A loan is exported on the day it's checked out and again on the day it's
+		// returned, with returned_on filled in. Rows with the same loan replace the
+		// earlier ones.
+		Name: "loans",
+		Query: `
+			SELECT loans.id, loans.checked_out_at, loans.due_at, loans.returned_at, loans.user_id,
+				book_copies.book_id, books.external_id, book_copies.branch, loans.device_id IS NOT NULL
+			FROM loans
+			INNER JOIN book_copies ON book_copies.id = loans.copy_id
+			INNER JOIN books ON books.id = book_copies.book_id
+			WHERE (loans.checked_out_at >= $1 AND loans.checked_out_at < $2)
+			OR (loans.returned_at >= $1 AND loans.returned_at < $2)
+			ORDER BY loans.checked_out_at, loans.id`,
+		Columns: []AnalyticsColumn{
+			{"loan", Pseudonymize},
+			{"checked_out_on", TruncateDay},
+			{"due_on", TruncateDay},
+			{"returned_on", TruncateDay},
+			{"user", Pseudonymize},
+			{"book_id", Keep},
+			{"book_external_id", Keep},
+			{"branch", Keep},
+			{"kiosk", Keep},
+		},
+	},
+}
+
+var (
+	scrubEmailRX  = regexp.MustCompile(`\S+@\S+`)
+	scrubNumberRX = regexp.MustCompile(`[0-9][0-9 -]{2,}[0-9]`)
+)
+
+// anonymize formats a value from the database for the export, applying rule.
+// NULLs are always exported as empty fields.
+func anonymize(value any, rule Anonymization, key []byte) string {
+	if value == nil {
+		return ""
+	}
+	switch rule {
+	case Pseudonymize:
+		mac := hmac.New(sha256.New, key)
+		fmt.Fprint(mac, value)
+		return hex.EncodeToString(mac.Sum(nil))[:32]
+	case TruncateHour, TruncateDay:
+		t, ok := value.(time.Time)
+		if !ok {
+			return ""
+		}
+		if rule == TruncateDay {
+			return t.UTC().Format("2006-01-02")
+		}
+		return t.UTC().Truncate(time.Hour).Format(time.RFC3339)
+	case Scrub:
+		s := strings.ToLower(fmt.Sprint(value))
+		s = scrubEmailRX.ReplaceAllString(s, "[email]")
+		return scrubNumberRX.ReplaceAllStringFunc(s, func(n string) string {
+			if len(strings.Trim(n, " -")) < 5 {
+				return n
+			}
+			return "[number]"
+		})
+	default:
+		if t, ok := value.(time.Time); ok {
+			return t.UTC().Format(time.RFC3339)
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+type AnalyticsModel struct {
+	DB *pgxpool.Pool
+}
+
+// Export writes the dataset's rows from the window between from and to as CSV, with
+// a header row, anonymizing each column by its rule. key is the secret user IDs are
+// hashed with; exports made with the same key can be joined on the user column.
+// It returns the number of rows written.
+func (m AnalyticsModel) Export(ctx context.Context, dataset AnalyticsDataset, from, to time.Time, key []byte, w io.Writer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, dataset.Query, from, to)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	record := make([]string, len(dataset.Columns))
+	for i, column := range dataset.Columns {
+		record[i] = column.Name
+	}
+	err = cw.Write(record)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return 0, err
+		}
+		if len(values) != len(dataset.Columns) {
+			return 0, fmt.Errorf("analytics %s: query returned %d columns for %d rules", dataset.Name, len(values), len(dataset.Columns))
+		}
+		for i, column := range dataset.Columns {
+			record[i] = anonymize(values[i], column.Rule, key)
+		}
+		err = cw.Write(record)
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	cw.Flush()
+	return n, cw.Error()
+}
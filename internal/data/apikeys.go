@@ -0,0 +1,206 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so that keys are easy to recognise (and to
+// search for in leaked source code).
+const apiKeyPrefix = "bk_"
+
+// APIKey is a long-lived credential for scripts and integrations. Unlike
+// authentication tokens it doesn't expire, and it only grants the permissions listed
+// in Scopes (as long as its owner still has them). Only the hash of the key is
+// stored; the plaintext is shown once when the key is created.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Plaintext  string     `json:"key,omitempty"`
+	Hash       []byte     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// APIVersion is the API version requests made with the key are pinned to, which
+	// is the first one asked for with it. It's empty until then.
+	APIVersion string `json:"api_version,omitempty"`
+}
+
+// IsAPIKey reports whether an Authorization credential looks like an API key.
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+func generateAPIKey(userID int64, name string, scopes []string) (*APIKey, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plaintext[:len(apiKeyPrefix)+6],
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		Scopes:    scopes,
+	}, nil
+}
+
+// ValidateAPIKey checks a new key's name and scopes. Keys can only be given scopes
+// which their owner currently has.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, permissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(key.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range key.Scopes {
+		v.Check(permissions.Include(scope), "scopes", "must only contain permissions you have")
+	}
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(IsAPIKey(plaintext), "key", "must be an API key")
+	v.Check(len(plaintext) == len(apiKeyPrefix)+32, "key", "must be 35 bytes long")
+}
+
+type APIKeyModel struct {
+	DB *pgxpool.Pool
+}
+
+// New generates a key and stores it.
+func (m APIKeyModel) New(userID int64, name string, scopes []string) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, key.Scopes}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	return key, err
+}
+
+// GetAllForUser returns the user's keys, newest first. The plaintext keys aren't
+// available.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, coalesce(api_version, '')
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.LastUsedAt, &key.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Use looks up the key with the given plaintext and records that it has been used.
+func (m APIKeyModel) Use(plaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		RETURNING id, user_id, name, prefix, scopes, created_at, last_used_at, coalesce(api_version, '')`
+	var key APIKey
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, hash[:]).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.LastUsedAt, &key.APIVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// GetForKey looks up the key with the given plaintext without recording that it has
+// been used, for servers which can't write to the database.
+func (m APIKeyModel) GetForKey(plaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, coalesce(api_version, '')
+		FROM api_keys
+		WHERE hash = $1`
+	var key APIKey
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, hash[:]).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.LastUsedAt, &key.APIVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// SetAPIVersion pins the key to the given API version, unless it's pinned already.
+func (m APIKeyModel) SetAPIVersion(id int64, apiVersion string) error {
+	query := `
+		UPDATE api_keys
+		SET api_version = $1
+		WHERE id = $2 AND api_version IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, apiVersion, id)
+	return err
+}
+
+// Delete revokes one of the user's keys.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -8,19 +8,102 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"html"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type Book struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Year      int32     `json:"year,omitempty"`
-	Pages     Pages     `json:"pages,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   string    `json:"version"`
+	ID int64 `json:"id"`
+	// ExternalID identifies the book as a string, for clients which can't handle
+	// 64-bit integers. Book routes accept it in place of the numeric ID.
+	ExternalID string    `json:"external_id"`
+	CreatedAt  time.Time `json:"-"`
+	Title      string    `json:"title"`
+	Slug       string    `json:"slug"`
+	// CreatedBy is the ID of the user who added the book. It's zero for books added
+	// before ownership was recorded, or whose creator has since been deleted.
+	CreatedBy int64    `json:"created_by,omitempty"`
+	Content   string   `json:"content"`
+	Year      int32    `json:"year,omitempty"`
+	Pages     Pages    `json:"pages,omitempty"`
+	Genres    []string `json:"genres,omitempty"`
+	WordCount int32    `json:"word_count,omitempty"`
+	// DigitalRights are the licence terms of the book's digital edition.
+	DigitalRights DigitalRights `json:"digital_rights"`
+	Version       string        `json:"version"`
+	// Highlights is only set on books returned by a full-text search.
+	Highlights *Highlights `json:"highlights,omitempty"`
+	// ContentWithheld is set when the content, and its highlights, were left out
+	// because the book is only for library members.
+	ContentWithheld bool `json:"content_withheld,omitempty"`
+	// The fields below are only filled in when requested with ?expand=.
+	PreviousSlugs []string              `json:"previous_slugs,omitempty"`
+	Similar       []*BookSummary        `json:"similar,omitempty"`
+	Copies        []*Copy               `json:"copies,omitempty"`
+	Availability  []*BranchAvailability `json:"availability,omitempty"`
+}
+
+// DigitalRights are the licence terms of a book's digital edition. The zero value is
+// an unrestricted book anyone can download.
+type DigitalRights struct {
+	// StreamOnly books can be read online but not downloaded.
+	StreamOnly bool `json:"stream_only"`
+	// InstitutionOnly books are only for members of the library.
+	InstitutionOnly bool `json:"institution_only"`
+}
+
+// exportableBooks is the condition on the books table for a query which lets a book's
+// content leave the site, such as a download. Stream-only books can only be read online.
+const exportableBooks = `NOT books.stream_only`
+
+// WithholdContent removes the content of an institution-only book, and any search
+// highlights of it, for someone who isn't a library member. It does nothing to other
+// books.
+func (book *Book) WithholdContent() {
+	if !book.DigitalRights.InstitutionOnly {
+		return
+	}
+	book.Content = ""
+	if book.Highlights != nil {
+		book.Highlights.Content = ""
+	}
+	book.ContentWithheld = true
+}
+
+// BookSummary is a short representation of a book used when it's embedded in another
+// resource.
+type BookSummary struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Slug  string `json:"slug"`
+	Year  int32  `json:"year"`
+}
+
+// Highlights holds snippets of a book's title and content with the words matching a
+// full-text search wrapped in <mark> tags. The rest of the text is HTML escaped, so
+// the snippets are safe to render as HTML.
+type Highlights struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// ts_headline() marks matches with characters from the Unicode private use area
+// rather than <mark> tags, which couldn't be told apart from markup in the book's
+// own text. highlight escapes the text and then swaps them for the tags.
+const (
+	headlineStart = "\ue000"
+	headlineStop  = "\ue001"
+)
+
+// headlineOptions are passed to ts_headline() when generating Highlights.
+const headlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", MaxWords=35, MinWords=15, MaxFragments=2"
+
+var headlineReplacer = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+func highlight(headline string) string {
+	return headlineReplacer.Replace(html.EscapeString(headline))
 }
 
 func ValidateBook(v *validator.Validator, book *Book) {
@@ -43,21 +126,89 @@ func ValidateBook(v *validator.Validator, book *Book) {
 	// in the v.Errors map.
 }
 
+// RawPagesBook wraps a Book so that its page count is encoded as a bare integer
+// instead of the "320 pages" string form. The Pages field here shadows the one on the
+// embedded Book when encoding to JSON.
+type RawPagesBook struct {
+	*Book
+	Pages int32 `json:"pages,omitempty"`
+}
+
+func NewRawPagesBook(book *Book) RawPagesBook {
+	return RawPagesBook{Book: book, Pages: int32(book.Pages)}
+}
+
 type BookModel struct {
 	DB *pgxpool.Pool
+	// Replica is an optional read replica. Reads which don't have to see the latest
+	// writes are sent to it.
+	Replica *pgxpool.Pool
+}
+
+// bookGenres is a select list expression which collects a book's genres from the
+// book_genres join table, in the order they were given.
+const bookGenres = `ARRAY(
+			SELECT genres.name FROM book_genres
+			INNER JOIN genres ON genres.id = book_genres.genre_id
+			WHERE book_genres.book_id = books.id
+			ORDER BY book_genres.position)`
+
+// setBookGenres replaces a book's genres, creating any genres which don't exist yet.
+func setBookGenres(ctx context.Context, tx pgx.Tx, bookID int64, genres []string) error {
+	_, err := tx.Exec(ctx, `INSERT INTO genres (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING`, genres)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM book_genres WHERE book_id = $1`, bookID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO book_genres (book_id, genre_id, position)
+		SELECT $1, genres.id, t.position
+		FROM unnest($2::text[]) WITH ORDINALITY AS t(name, position)
+		INNER JOIN genres ON genres.name = t.name`
+
+	_, err = tx.Exec(ctx, query, bookID, genres)
+	return err
 }
 
 func (b BookModel) Insert(book *Book, r *http.Request) error {
 	query := `
-		INSERT INTO books (title, year, content, pages, genres)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at, version`
+		INSERT INTO books (title, slug, year, content, pages, word_count, created_by, stream_only, institution_only)
+		VALUES ($1, $2, $3, $4, $5, book_word_count($4), nullif($6, 0), $7, $8)
+		RETURNING id, created_at, word_count, external_id, version`
 
-	args := []any{book.Title, book.Year, book.Content, book.Pages, book.Genres}
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
 
-	return b.DB.QueryRow(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	slug, err := uniqueSlug(ctx, b.DB, Slugify(book.Title, book.Year), 0)
+	if err != nil {
+		return err
+	}
+	book.Slug = slug
+
+	tx, err := b.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	args := []any{book.Title, book.Slug, book.Year, book.Content, book.Pages, book.CreatedBy,
+		book.DigitalRights.StreamOnly, book.DigitalRights.InstitutionOnly}
+	err = tx.QueryRow(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.WordCount, &book.ExternalID, &book.Version)
+	if err != nil {
+		return err
+	}
+
+	err = setBookGenres(ctx, tx, book.ID, book.Genres)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (b BookModel) Get(id int64, r *http.Request) (*Book, error) {
@@ -66,7 +217,7 @@ func (b BookModel) Get(id int64, r *http.Request) (*Book, error) {
 	}
 
 	query := `
-        SELECT id, created_at, title, content, year, pages, genres, version
+        SELECT id, created_at, coalesce(created_by, 0), title, slug, content, year, pages, ` + bookGenres + `, coalesce(word_count, 0), stream_only, institution_only, external_id, version
         FROM books
         WHERE id = $1`
 
@@ -75,14 +226,20 @@ func (b BookModel) Get(id int64, r *http.Request) (*Book, error) {
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
 
-	err := b.DB.QueryRow(ctx, query, id).Scan(
+	err := reader(ctx, b.DB, b.Replica).QueryRow(ctx, query, id).Scan(
 		&book.ID,
 		&book.CreatedAt,
+		&book.CreatedBy,
 		&book.Title,
+		&book.Slug,
 		&book.Content,
 		&book.Year,
 		&book.Pages,
 		&book.Genres,
+		&book.WordCount,
+		&book.DigitalRights.StreamOnly,
+		&book.DigitalRights.InstitutionOnly,
+		&book.ExternalID,
 		&book.Version,
 	)
 
@@ -100,26 +257,93 @@ func (b BookModel) Get(id int64, r *http.Request) (*Book, error) {
 	return &book, nil
 }
 
+// GetBySlug returns the book which currently has the given slug, or which had it before
+// its title was changed. Callers can compare the returned book's Slug field with the
+// requested slug to tell the two cases apart.
+func (b BookModel) GetBySlug(slug string, r *http.Request) (*Book, error) {
+	query := `
+        SELECT id, created_at, coalesce(created_by, 0), title, slug, content, year, pages, ` + bookGenres + `, coalesce(word_count, 0), stream_only, institution_only, external_id, version
+        FROM books
+        WHERE slug = $1 OR id = (SELECT book_id FROM book_slugs WHERE slug = $1)
+        ORDER BY slug = $1 DESC
+        LIMIT 1`
+
+	var book Book
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	err := reader(ctx, b.DB, b.Replica).QueryRow(ctx, query, slug).Scan(
+		&book.ID,
+		&book.CreatedAt,
+		&book.CreatedBy,
+		&book.Title,
+		&book.Slug,
+		&book.Content,
+		&book.Year,
+		&book.Pages,
+		&book.Genres,
+		&book.WordCount,
+		&book.DigitalRights.StreamOnly,
+		&book.DigitalRights.InstitutionOnly,
+		&book.ExternalID,
+		&book.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &book, nil
+}
+
 func (b BookModel) Update(book *Book, r *http.Request) error {
 	query := `
        UPDATE books
-       SET title = $1, content = $2, year = $3, pages = $4, genres = $5, version = uuid_generate_v4()
-       WHERE id = $6 AND version = $7
-       RETURNING version`
+       SET title = $1, slug = $2, content = $3, year = $4, pages = $5, word_count = book_word_count($3),
+           stream_only = $6, institution_only = $7, version = uuid_generate_v4()
+       WHERE id = $8 AND version = $9
+       RETURNING word_count, version`
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	// If the title or year changed, the book gets a new slug. The old one is kept in
+	// the book_slugs table so that links to it can be redirected.
+	oldSlug := book.Slug
+	base := Slugify(book.Title, book.Year)
+	if !slugMatches(oldSlug, base) {
+		slug, err := uniqueSlug(ctx, b.DB, base, book.ID)
+		if err != nil {
+			return err
+		}
+		book.Slug = slug
+	}
 
 	args := []any{
 		book.Title,
+		book.Slug,
 		book.Content,
 		book.Year,
 		book.Pages,
-		book.Genres,
+		book.DigitalRights.StreamOnly,
+		book.DigitalRights.InstitutionOnly,
 		book.ID,
 		book.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
-	defer cancel()
-	err := b.DB.QueryRow(ctx, query, args...).Scan(&book.Version)
+	tx, err := b.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&book.WordCount, &book.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -130,11 +354,30 @@ func (b BookModel) Update(book *Book, r *http.Request) error {
 			return err
 		}
 	}
-	return nil
+
+	err = setBookGenres(ctx, tx, book.ID, book.Genres)
+	if err != nil {
+		return err
+	}
+
+	if book.Slug != oldSlug {
+		_, err = tx.Exec(ctx, `DELETE FROM book_slugs WHERE slug = $1`, book.Slug)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO book_slugs (slug, book_id) VALUES ($1, $2)`, oldSlug, book.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
 
 }
 
-func (b BookModel) Delete(id int64, r *http.Request) error {
+// Delete removes a book. If version isn't empty the book is only deleted if it still
+// has that version, and ErrEditConflict is returned if it doesn't.
+func (b BookModel) Delete(id int64, version string, r *http.Request) error {
 
 	if id < 1 {
 		return ErrRecordNotFound
@@ -142,12 +385,12 @@ func (b BookModel) Delete(id int64, r *http.Request) error {
 
 	query := `
 		DELETE FROM books
-		WHERE id = $1`
+		WHERE id = $1 AND ($2 = '' OR version::text = $2)`
 
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
 
-	result, err := b.DB.Exec(ctx, query, id)
+	result, err := b.DB.Exec(ctx, query, id, version)
 
 	if err != nil {
 		return err
@@ -159,29 +402,46 @@ func (b BookModel) Delete(id int64, r *http.Request) error {
 	}
 
 	if rowsAffected == 0 {
+		if version != "" {
+			return ErrEditConflict
+		}
 		return ErrRecordNotFound
 	}
 
 	return nil
 }
 
-func (b BookModel) GetAll(title string, content string, genres []string, filters Filters, r *http.Request) ([]*Book, Metadata, error) {
+// GetAll returns a page of books. title filters on the title only, while search is a
+// full-text search over both the title and content; when it's used each book gets
+// ts_headline() snippets showing where the match occurred. If createdBy isn't zero
+// only books added by that user are returned.
+func (b BookModel) GetAll(title string, search string, genres []string, createdBy int64, branch string, filters Filters, r *http.Request) ([]*Book, Metadata, error) {
 	//  to_tsvector('simple', title) function takes a movie title and splits it into lexemes
 
 	//plainto_tsquery('simple', $1) function takes a search value and turns it into a
 	//formatted query term that PostgreSQ
 	query := fmt.Sprintf(`
-		SELECT  count(*) OVER(), id, created_at, title, content, year, pages, genres, version
+		SELECT  count(*) OVER(), id, created_at, coalesce(created_by, 0), title, slug, content, year, pages, %[4]s, coalesce(word_count, 0), stream_only, institution_only, external_id, version,
+			CASE WHEN $2 = '' THEN '' ELSE ts_headline('simple', title, plainto_tsquery('simple', $2), '%[3]s') END,
+			CASE WHEN $2 = '' THEN '' ELSE ts_headline('simple', content, plainto_tsquery('simple', $2), '%[3]s') END
 		FROM books
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		AND (to_tsvector('simple', title || ' ' || content) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND ($3::text[] = '{}' OR id IN (
+			SELECT book_genres.book_id FROM book_genres
+			INNER JOIN genres ON genres.id = book_genres.genre_id
+			WHERE genres.name = ANY($3)
+			GROUP BY book_genres.book_id
+			HAVING count(*) = cardinality($3::text[])))
+		AND (created_by = $4 OR $4 = 0)
+		AND ($5 = '' OR id IN (SELECT book_id FROM book_copies WHERE branch = $5))
+		ORDER BY %[1]s %[2]s, id ASC
+		LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection(), headlineOptions, bookGenres)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	args := []any{title, genres, filters.limit(), filters.offset()}
-	rows, err := b.DB.Query(ctx, query, args...)
+	args := []any{title, search, genres, createdBy, branch, filters.limit(), filters.offset()}
+	rows, err := reader(ctx, b.DB, b.Replica).Query(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -193,23 +453,38 @@ func (b BookModel) GetAll(title string, content string, genres []string, filters
 
 	for rows.Next() {
 		var book Book
+		var highlights Highlights
 
 		err := rows.Scan(
 			&totalRecords,
 			&book.ID,
 			&book.CreatedAt,
+			&book.CreatedBy,
 			&book.Title,
+			&book.Slug,
 			&book.Content,
 			&book.Year,
 			&book.Pages,
 			&book.Genres,
+			&book.WordCount,
+			&book.DigitalRights.StreamOnly,
+			&book.DigitalRights.InstitutionOnly,
+			&book.ExternalID,
 			&book.Version,
+			&highlights.Title,
+			&highlights.Content,
 		)
 
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
+		if search != "" {
+			highlights.Title = highlight(highlights.Title)
+			highlights.Content = highlight(highlights.Content)
+			book.Highlights = &highlights
+		}
+
 		books = append(books, &book)
 	}
 	if err = rows.Err(); err != nil {
@@ -221,3 +496,149 @@ func (b BookModel) GetAll(title string, content string, genres []string, filters
 	return books, metadata, nil
 
 }
+
+// GetPreviousSlugs returns the slugs each of the given books used to have, keyed by
+// book ID.
+func (b BookModel) GetPreviousSlugs(ctx context.Context, ids []int64) (map[int64][]string, error) {
+	query := `
+		SELECT book_id, slug
+		FROM book_slugs
+		WHERE book_id = ANY($1)
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := reader(ctx, b.DB, b.Replica).Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slugs := make(map[int64][]string)
+	for rows.Next() {
+		var id int64
+		var slug string
+		err := rows.Scan(&id, &slug)
+		if err != nil {
+			return nil, err
+		}
+		slugs[id] = append(slugs[id], slug)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return slugs, nil
+}
+
+// GetSimilar returns up to limit other books for each of the given books, ranked by
+// the number of genres they have in common, keyed by book ID.
+func (b BookModel) GetSimilar(ctx context.Context, ids []int64, limit int) (map[int64][]*BookSummary, error) {
+	query := `
+		SELECT source.id, similar.id, similar.title, similar.slug, similar.year
+		FROM books source
+		CROSS JOIN LATERAL (
+			SELECT other.id, other.title, other.slug, other.year
+			FROM book_genres source_genres
+			INNER JOIN book_genres other_genres
+				ON other_genres.genre_id = source_genres.genre_id AND other_genres.book_id <> source_genres.book_id
+			INNER JOIN books other ON other.id = other_genres.book_id
+			WHERE source_genres.book_id = source.id
+			GROUP BY other.id
+			ORDER BY count(*) DESC, other.id
+			LIMIT $2
+		) similar
+		WHERE source.id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := reader(ctx, b.DB, b.Replica).Query(ctx, query, ids, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similar := make(map[int64][]*BookSummary)
+	for rows.Next() {
+		var id int64
+		var summary BookSummary
+		err := rows.Scan(&id, &summary.ID, &summary.Title, &summary.Slug, &summary.Year)
+		if err != nil {
+			return nil, err
+		}
+		similar[id] = append(similar[id], &summary)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return similar, nil
+}
+
+// GetNewArrivals returns the most recently added books, newest first.
+func (b BookModel) GetNewArrivals(ctx context.Context, limit int) ([]*BookSummary, error) {
+	query := `
+		SELECT id, title, slug, year
+		FROM books
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := reader(ctx, b.DB, b.Replica).Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []*BookSummary{}
+	for rows.Next() {
+		var book BookSummary
+		err := rows.Scan(&book.ID, &book.Title, &book.Slug, &book.Year)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// GenreCount is the number of books in a genre.
+type GenreCount struct {
+	Genre string `json:"genre"`
+	Books int    `json:"books"`
+}
+
+// GetGenreCounts returns the genres with the most books, largest first.
+func (b BookModel) GetGenreCounts(ctx context.Context, limit int) ([]GenreCount, error) {
+	query := `
+		SELECT genres.name, count(*)
+		FROM book_genres
+		INNER JOIN genres ON genres.id = book_genres.genre_id
+		GROUP BY genres.name
+		ORDER BY count(*) DESC, genres.name
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := reader(ctx, b.DB, b.Replica).Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []GenreCount{}
+	for rows.Next() {
+		var count GenreCount
+		err := rows.Scan(&count.Genre, &count.Books)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
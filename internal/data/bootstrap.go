@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// ErrAlreadyBootstrapped is returned when the initial admin has already been created,
+// whether by an earlier bootstrap for a different email address or by hand.
+var ErrAlreadyBootstrapped = errors.New("already bootstrapped")
+
+// BootstrapPermissions are granted to the initial admin on top of the admin role, so
+// they can manage everything without further setup.
+var BootstrapPermissions = []string{"admin:*", "books:*", "loans:*", "suggestions:*", "tokens:*", "users:*"}
+
+type BootstrapModel struct {
+	DB *pgxpool.Pool
+}
+
+// Run creates the initial admin, activated, with the admin role and
+// BootstrapPermissions. It's idempotent: running it again for the same email address
+// returns the admin created the first time, with created false. Any other call after
+// the first, or once some user has the admin role, returns ErrAlreadyBootstrapped.
+func (m BootstrapModel) Run(user *User) (created bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Claiming the single bootstrap row first makes concurrent calls wait for each
+	// other, so only one of them creates a user.
+	result, err := tx.Exec(ctx, `INSERT INTO bootstrap (email) VALUES ($1) ON CONFLICT DO NOTHING`, user.Email)
+	if err != nil {
+		return false, err
+	}
+	if result.RowsAffected() == 0 {
+		return false, m.getBootstrapped(ctx, tx, user)
+	}
+
+	var admins bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM users_roles
+			INNER JOIN roles ON roles.id = users_roles.role_id
+			WHERE roles.name = 'admin')`
+	err = tx.QueryRow(ctx, query).Scan(&admins)
+	if err != nil {
+		return false, err
+	}
+	if admins {
+		return false, ErrAlreadyBootstrapped
+	}
+
+	query = `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, $2, $3, true)
+		RETURNING id, created_at, timezone, external_id, version`
+	err = tx.QueryRow(ctx, query, user.Name, user.Email, user.Password.hash).Scan(&user.ID, &user.CreatedAt, &user.Timezone, &user.ExternalID, &user.Version)
+	if err != nil {
+		if isDuplicateEmail(err) {
+			return false, ErrDuplicateEmail
+		}
+		return false, err
+	}
+	user.Activated = true
+
+	query = `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)`
+	_, err = tx.Exec(ctx, query, user.ID, []string{DefaultRole, "admin"})
+	if err != nil {
+		return false, err
+	}
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	_, err = tx.Exec(ctx, query, user.ID, BootstrapPermissions)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE bootstrap SET user_id = $1`, user.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// getBootstrapped fills in user with the admin an earlier bootstrap created, as long
+// as it was for the same email address.
+func (m BootstrapModel) getBootstrapped(ctx context.Context, tx pgx.Tx, user *User) error {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.activated, users.timezone, users.external_id, users.version
+		FROM bootstrap
+		INNER JOIN users ON users.id = bootstrap.user_id
+		WHERE bootstrap.email = $1`
+	err := tx.QueryRow(ctx, query, user.Email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Timezone,
+		&user.ExternalID,
+		&user.Version,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrAlreadyBootstrapped
+		}
+		return err
+	}
+	return nil
+}
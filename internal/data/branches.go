@@ -0,0 +1,267 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrDuplicateBranch = errors.New("duplicate branch")
+	ErrBranchInUse     = errors.New("branch has copies")
+	ErrUnknownBranch   = errors.New("unknown branch")
+)
+
+// LoanPolicy holds a branch's rules for lending its copies. Fines are in the smallest
+// unit of the currency, and charged for each day or part of a day a copy is overdue
+// up to MaxFine. A MaxFine of zero means there's no cap. ReplacementFee is what the
+// member is invoiced when a copy is so late that it's treated as lost.
+type LoanPolicy struct {
+	LoanPeriodDays int32 `json:"loan_period_days"`
+	MaxRenewals    int32 `json:"max_renewals"`
+	MaxLoans       int32 `json:"max_loans"`
+	DailyFine      int32 `json:"daily_fine"`
+	MaxFine        int32 `json:"max_fine"`
+	ReplacementFee int32 `json:"replacement_fee"`
+}
+
+// Fine returns the fine for a copy which was due at due and returned at returned.
+func (p LoanPolicy) Fine(due, returned time.Time) int64 {
+	if !returned.After(due) {
+		return 0
+	}
+	days := int64((returned.Sub(due) + 24*time.Hour - 1) / (24 * time.Hour))
+	fine := days * int64(p.DailyFine)
+	if p.MaxFine > 0 && fine > int64(p.MaxFine) {
+		fine = int64(p.MaxFine)
+	}
+	return fine
+}
+
+// LibraryBranch is one of the library's sites. Copies are shelved at a branch, which
+// they refer to by name. Members can book PickupCapacity pickups in each slot of
+// PickupSlotMinutes while the branch is open, in its timezone. A capacity of zero
+// means the branch doesn't take pickup bookings.
+type LibraryBranch struct {
+	ID                int64      `json:"id"`
+	Name              string     `json:"name"`
+	Address           string     `json:"address,omitempty"`
+	Phone             string     `json:"phone,omitempty"`
+	Timezone          string     `json:"timezone"`
+	LoanPolicy        LoanPolicy `json:"loan_policy"`
+	PickupSlotMinutes int32      `json:"pickup_slot_minutes"`
+	PickupCapacity    int32      `json:"pickup_capacity"`
+	CreatedAt         time.Time  `json:"created_at"`
+	Version           int32      `json:"version"`
+}
+
+// BranchAvailability is the number of copies of a book held at a branch, and how many
+// of them aren't out on loan.
+type BranchAvailability struct {
+	Branch    string `json:"branch"`
+	Copies    int    `json:"copies"`
+	Available int    `json:"available"`
+}
+
+func ValidateBranch(v *validator.Validator, branch *LibraryBranch) {
+	v.Check(branch.Name != "", "name", "must be provided")
+	v.Check(len(branch.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(len(branch.Address) <= 500, "address", "must not be more than 500 bytes long")
+	v.Check(len(branch.Phone) <= 50, "phone", "must not be more than 50 bytes long")
+	v.Check(ValidTimezone(branch.Timezone), "timezone", "must be a valid IANA time zone name, such as Asia/Almaty")
+	v.Check(branch.PickupSlotMinutes >= 5 && branch.PickupSlotMinutes <= 240, "pickup_slot_minutes", "must be between 5 and 240")
+	v.Check(branch.PickupCapacity >= 0 && branch.PickupCapacity <= 1000, "pickup_capacity", "must be between 0 and 1000")
+	v.Check(branch.LoanPolicy.LoanPeriodDays >= 1 && branch.LoanPolicy.LoanPeriodDays <= 365, "loan_policy", "loan period must be between 1 and 365 days")
+	v.Check(branch.LoanPolicy.MaxRenewals >= 0 && branch.LoanPolicy.MaxRenewals <= 20, "loan_policy", "max renewals must be between 0 and 20")
+	v.Check(branch.LoanPolicy.MaxLoans >= 1 && branch.LoanPolicy.MaxLoans <= 100, "loan_policy", "max loans must be between 1 and 100")
+	v.Check(branch.LoanPolicy.DailyFine >= 0 && branch.LoanPolicy.DailyFine <= 1000000, "loan_policy", "daily fine must be between 0 and 1000000")
+	v.Check(branch.LoanPolicy.MaxFine >= 0 && branch.LoanPolicy.MaxFine <= 100000000, "loan_policy", "max fine must be between 0 and 100000000")
+	v.Check(branch.LoanPolicy.ReplacementFee >= 0 && branch.LoanPolicy.ReplacementFee <= 100000000, "loan_policy", "replacement fee must be between 0 and 100000000")
+}
+
+type BranchModel struct {
+	DB *pgxpool.Pool
+}
+
+const branchColumns = `id, name, address, phone, timezone, loan_period_days, max_renewals, max_loans,
+	daily_fine, max_fine, replacement_fee, pickup_slot_minutes, pickup_capacity, created_at, version`
+
+func scanBranch(row pgx.Row) (*LibraryBranch, error) {
+	var b LibraryBranch
+	err := row.Scan(&b.ID, &b.Name, &b.Address, &b.Phone, &b.Timezone, &b.LoanPolicy.LoanPeriodDays,
+		&b.LoanPolicy.MaxRenewals, &b.LoanPolicy.MaxLoans, &b.LoanPolicy.DailyFine, &b.LoanPolicy.MaxFine,
+		&b.LoanPolicy.ReplacementFee, &b.PickupSlotMinutes, &b.PickupCapacity,
+		&b.CreatedAt, &b.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func isDuplicateBranch(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "branches_name_key"
+}
+
+func (m BranchModel) Insert(branch *LibraryBranch) error {
+	query := `
+		INSERT INTO branches (name, address, phone, timezone, loan_period_days, max_renewals, max_loans,
+			daily_fine, max_fine, replacement_fee, pickup_slot_minutes, pickup_capacity)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at, version`
+	args := []any{branch.Name, branch.Address, branch.Phone, branch.Timezone, branch.LoanPolicy.LoanPeriodDays,
+		branch.LoanPolicy.MaxRenewals, branch.LoanPolicy.MaxLoans, branch.LoanPolicy.DailyFine,
+		branch.LoanPolicy.MaxFine, branch.LoanPolicy.ReplacementFee, branch.PickupSlotMinutes, branch.PickupCapacity}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&branch.ID, &branch.CreatedAt, &branch.Version)
+	if err != nil {
+		if isDuplicateBranch(err) {
+			return ErrDuplicateBranch
+		}
+		return err
+	}
+	return nil
+}
+
+func (m BranchModel) Get(id int64) (*LibraryBranch, error) {
+	query := `SELECT ` + branchColumns + ` FROM branches WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	branch, err := scanBranch(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return branch, nil
+}
+
+// GetByName returns the branch with the name, which is how copies refer to it.
+func (m BranchModel) GetByName(name string) (*LibraryBranch, error) {
+	query := `SELECT ` + branchColumns + ` FROM branches WHERE name = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	branch, err := scanBranch(m.DB.QueryRow(ctx, query, name))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return branch, nil
+}
+
+func (m BranchModel) GetAll() ([]*LibraryBranch, error) {
+	query := `SELECT ` + branchColumns + ` FROM branches ORDER BY name`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	branches := []*LibraryBranch{}
+	for rows.Next() {
+		branch, err := scanBranch(rows)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return branches, nil
+}
+
+// Update saves the branch. Renaming a branch also renames it on its copies. It returns
+// ErrEditConflict if the branch has changed since it was read.
+func (m BranchModel) Update(branch *LibraryBranch) error {
+	query := `
+		UPDATE branches
+		SET name = $1, address = $2, phone = $3, timezone = $4, loan_period_days = $5, max_renewals = $6,
+			max_loans = $7, daily_fine = $8, max_fine = $9, replacement_fee = $10, pickup_slot_minutes = $11,
+			pickup_capacity = $12, version = version + 1
+		WHERE id = $13 AND version = $14
+		RETURNING version`
+	args := []any{branch.Name, branch.Address, branch.Phone, branch.Timezone, branch.LoanPolicy.LoanPeriodDays,
+		branch.LoanPolicy.MaxRenewals, branch.LoanPolicy.MaxLoans, branch.LoanPolicy.DailyFine,
+		branch.LoanPolicy.MaxFine, branch.LoanPolicy.ReplacementFee, branch.PickupSlotMinutes, branch.PickupCapacity,
+		branch.ID, branch.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&branch.Version)
+	if err != nil {
+		switch {
+		case isDuplicateBranch(err):
+			return ErrDuplicateBranch
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a branch. Branches which still have copies can't be deleted, and
+// ErrBranchInUse is returned.
+func (m BranchModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM branches WHERE id = $1`, id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return ErrBranchInUse
+		}
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetAvailability returns the number of copies of each of the given books at each
+// branch, keyed by book ID. Branches without a copy are left out.
+func (m BranchModel) GetAvailability(ctx context.Context, ids []int64) (map[int64][]*BranchAvailability, error) {
+	query := `
+		SELECT book_id, branch, count(*), count(*) FILTER (WHERE NOT EXISTS (
+			SELECT 1 FROM loans WHERE loans.copy_id = book_copies.id AND loans.returned_at IS NULL))
+		FROM book_copies
+		WHERE book_id = ANY($1)
+		GROUP BY book_id, branch
+		ORDER BY book_id, branch`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	availability := make(map[int64][]*BranchAvailability)
+	for rows.Next() {
+		var id int64
+		var a BranchAvailability
+		err := rows.Scan(&id, &a.Branch, &a.Copies, &a.Available)
+		if err != nil {
+			return nil, err
+		}
+		availability[id] = append(availability[id], &a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return availability, nil
+}
@@ -0,0 +1,332 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// The statuses a campaign moves through. A campaign is "scheduled" until its
+// scheduled time, "sending" while emails go out, then "sent". Scheduled and sending
+// campaigns can be cancelled.
+const (
+	CampaignScheduled = "scheduled"
+	CampaignSending   = "sending"
+	CampaignSent      = "sent"
+	CampaignCancelled = "cancelled"
+)
+
+// The statuses of a single recipient of a campaign. A recipient is "sending" once an
+// instance has claimed them to send to.
+const (
+	RecipientPending = "pending"
+	RecipientSending = "sending"
+	RecipientSent    = "sent"
+	RecipientFailed  = "failed"
+	RecipientBounced = "bounced"
+)
+
+// CampaignTemplates are the email templates which can be used for campaigns.
+var CampaignTemplates = []string{"campaign_new_arrivals.tmpl"}
+
+// CampaignAudience selects the users a campaign is sent to. Every field which is set
+// must match.
+type CampaignAudience struct {
+	Activated *bool  `json:"activated,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// CampaignStats counts a campaign's recipients by status.
+type CampaignStats struct {
+	Recipients int `json:"recipients"`
+	Pending    int `json:"pending"`
+	Sent       int `json:"sent"`
+	Failed     int `json:"failed"`
+	Bounced    int `json:"bounced"`
+	Opened     int `json:"opened"`
+}
+
+type Campaign struct {
+	ID          int64            `json:"id"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Name        string           `json:"name"`
+	Template    string           `json:"template"`
+	Audience    CampaignAudience `json:"audience"`
+	ScheduledAt time.Time        `json:"scheduled_at"`
+	Status      string           `json:"status"`
+	Stats       CampaignStats    `json:"stats"`
+}
+
+// recipientClaimTimeout is how long a claimed recipient is left to the instance which
+// claimed them before another can, in case it crashed or lost the database.
+const recipientClaimTimeout = 10 * time.Minute
+
+// CampaignRecipient is a user who is due to receive a campaign email.
+type CampaignRecipient struct {
+	UserID    int64
+	Name      string
+	Email     string
+	OpenToken string
+}
+
+func ValidateCampaign(v *validator.Validator, campaign *Campaign) {
+	v.Check(campaign.Name != "", "name", "must be provided")
+	v.Check(len(campaign.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(validator.PermittedValue(campaign.Template, CampaignTemplates...), "template", "invalid template")
+	v.Check(!campaign.ScheduledAt.IsZero(), "scheduled_at", "must be provided")
+}
+
+type CampaignModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m CampaignModel) Insert(campaign *Campaign) error {
+	query := `
+		INSERT INTO campaigns (name, template, audience, scheduled_at, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	campaign.Status = CampaignScheduled
+	args := []any{campaign.Name, campaign.Template, campaign.Audience, campaign.ScheduledAt, campaign.Status}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, args...).Scan(&campaign.ID, &campaign.CreatedAt)
+}
+
+// campaignColumns selects a campaign along with its recipient statistics.
+const campaignColumns = `
+	campaigns.id, campaigns.created_at, campaigns.name, campaigns.template, campaigns.audience,
+	campaigns.scheduled_at, campaigns.status,
+	count(campaign_recipients.user_id),
+	count(*) FILTER (WHERE campaign_recipients.status IN ('pending', 'sending')),
+	count(*) FILTER (WHERE campaign_recipients.status = 'sent'),
+	count(*) FILTER (WHERE campaign_recipients.status = 'failed'),
+	count(*) FILTER (WHERE campaign_recipients.status = 'bounced'),
+	count(campaign_recipients.opened_at)`
+
+func scanCampaign(row pgx.Row) (*Campaign, error) {
+	var c Campaign
+	err := row.Scan(
+		&c.ID,
+		&c.CreatedAt,
+		&c.Name,
+		&c.Template,
+		&c.Audience,
+		&c.ScheduledAt,
+		&c.Status,
+		&c.Stats.Recipients,
+		&c.Stats.Pending,
+		&c.Stats.Sent,
+		&c.Stats.Failed,
+		&c.Stats.Bounced,
+		&c.Stats.Opened,
+	)
+	return &c, err
+}
+
+func (m CampaignModel) Get(id int64) (*Campaign, error) {
+	query := `
+		SELECT ` + campaignColumns + `
+		FROM campaigns
+		LEFT JOIN campaign_recipients ON campaign_recipients.campaign_id = campaigns.id
+		WHERE campaigns.id = $1
+		GROUP BY campaigns.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	campaign, err := scanCampaign(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return campaign, nil
+}
+
+// GetAll returns every campaign, newest first. If due is true, only campaigns which
+// should be sending now are returned.
+func (m CampaignModel) GetAll(due bool) ([]*Campaign, error) {
+	query := `
+		SELECT ` + campaignColumns + `
+		FROM campaigns
+		LEFT JOIN campaign_recipients ON campaign_recipients.campaign_id = campaigns.id
+		WHERE NOT $1 OR (campaigns.status IN ('scheduled', 'sending') AND campaigns.scheduled_at <= NOW())
+		GROUP BY campaigns.id
+		ORDER BY campaigns.id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, due)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	campaigns := []*Campaign{}
+	for rows.Next() {
+		campaign, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+// Start works out the campaign's recipients from its audience and marks it as
+// sending. Users who join the audience later aren't added, and users who have
+// opted out of campaign emails are left out. If another instance has started the
+// campaign already, nothing is changed.
+func (m CampaignModel) Start(campaign *Campaign) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `UPDATE campaigns SET status = $1 WHERE id = $2 AND status = $3`,
+		CampaignSending, campaign.ID, CampaignScheduled)
+	if err != nil {
+		return err
+	}
+	campaign.Status = CampaignSending
+	if result.RowsAffected() == 0 {
+		return nil
+	}
+
+	query := `
+		INSERT INTO campaign_recipients (campaign_id, user_id, email)
+		SELECT $1, users.id, users.email
+		FROM users
+		WHERE ($2::boolean IS NULL OR users.activated = $2)
+		AND ($3 = '' OR EXISTS (
+			SELECT 1 FROM users_roles
+			INNER JOIN roles ON roles.id = users_roles.role_id
+			WHERE users_roles.user_id = users.id AND roles.name = $3))
+		AND NOT EXISTS (
+			SELECT 1 FROM user_preferences
+			WHERE user_preferences.user_id = users.id AND NOT 'campaigns' = ANY(user_preferences.email_opt_ins))
+		ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(ctx, query, campaign.ID, campaign.Audience.Activated, campaign.Audience.Role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// SetStatus moves a campaign to a new status, as long as it's currently in one of the
+// from statuses. It returns ErrEditConflict if it isn't.
+func (m CampaignModel) SetStatus(id int64, status string, from ...string) error {
+	query := `
+		UPDATE campaigns SET status = $1
+		WHERE id = $2 AND status = ANY($3)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, status, id, from)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// ClaimRecipients claims up to limit recipients who haven't been sent the campaign
+// yet, and returns them. Rows another instance is claiming at the same moment are
+// skipped, so no recipient is claimed twice. Recipients claimed by an instance which
+// didn't send to them within recipientClaimTimeout can be claimed again.
+func (m CampaignModel) ClaimRecipients(campaignID int64, limit int) ([]*CampaignRecipient, error) {
+	query := `
+		UPDATE campaign_recipients
+		SET status = 'sending', claimed_at = NOW()
+		FROM users
+		WHERE users.id = campaign_recipients.user_id
+		AND (campaign_recipients.campaign_id, campaign_recipients.user_id) IN (
+			SELECT campaign_id, user_id
+			FROM campaign_recipients
+			WHERE campaign_id = $1
+			AND (status = 'pending' OR (status = 'sending' AND claimed_at < NOW() - $3::interval))
+			ORDER BY user_id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING users.id, users.name, campaign_recipients.email, campaign_recipients.open_token::text`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, campaignID, limit, recipientClaimTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := []*CampaignRecipient{}
+	for rows.Next() {
+		var recipient CampaignRecipient
+		err := rows.Scan(&recipient.UserID, &recipient.Name, &recipient.Email, &recipient.OpenToken)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, &recipient)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// MarkRecipient records the outcome of sending the campaign to a user.
+func (m CampaignModel) MarkRecipient(campaignID, userID int64, status, errorMessage string) error {
+	query := `
+		UPDATE campaign_recipients
+		SET status = $1, error = $2, sent_at = CASE WHEN $1 = 'sent' THEN NOW() ELSE sent_at END, claimed_at = NULL
+		WHERE campaign_id = $3 AND user_id = $4`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, status, errorMessage, campaignID, userID)
+	return err
+}
+
+// RecordOpen records that the email with the given open token has been opened. Only
+// the first open is kept. Unknown tokens, and ones which aren't UUIDs, are ignored.
+func (m CampaignModel) RecordOpen(token string) error {
+	if !externalIDRX.MatchString(token) {
+		return nil
+	}
+	query := `
+		UPDATE campaign_recipients
+		SET opened_at = coalesce(opened_at, NOW())
+		WHERE open_token = $1::uuid`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, token)
+	return err
+}
+
+// RecordBounces marks the campaign's recipients with the given addresses as bounced,
+// returning how many were found.
+func (m CampaignModel) RecordBounces(campaignID int64, emails []string) (int64, error) {
+	query := `
+		UPDATE campaign_recipients
+		SET status = 'bounced'
+		WHERE campaign_id = $1 AND lower(email::text) = ANY($2)`
+	lowered := make([]string, len(emails))
+	for i, email := range emails {
+		lowered[i] = strings.ToLower(email)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, campaignID, lowered)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
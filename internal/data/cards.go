@@ -0,0 +1,81 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrDuplicateCard = errors.New("duplicate card number")
+)
+
+// CardNumberRX matches the numbers printed on library cards, which are scanned at
+// kiosks.
+var CardNumberRX = regexp.MustCompile(`^[A-Z0-9]{4,32}$`)
+
+func ValidateCardNumber(v *validator.Validator, number string) {
+	v.Check(number != "", "card_number", "must be provided")
+	v.Check(validator.Matches(number, CardNumberRX), "card_number", "must be 4 to 32 upper case letters and digits")
+}
+
+// CardModel links library cards to members. Each member has at most one card.
+type CardModel struct {
+	DB *pgxpool.Pool
+}
+
+// Set issues the card to the user, replacing any card they had before.
+func (m CardModel) Set(userID int64, number string) error {
+	query := `
+		INSERT INTO library_cards (number, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET number = EXCLUDED.number, issued_at = NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, number, userID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "library_cards_pkey":
+			return ErrDuplicateCard
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUserID returns the ID of the member the card was issued to.
+func (m CardModel) GetUserID(number string) (int64, error) {
+	query := `SELECT user_id FROM library_cards WHERE number = $1`
+	var userID int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, number).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
+// HasCard reports whether the user has been issued a library card, which is what
+// makes them a member of the library.
+func (m CardModel) HasCard(userID int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM library_cards WHERE user_id = $1)`
+	var exists bool
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sort"
+	"time"
+)
+
+// CatalogEntry fingerprints one book. Books are matched between environments by slug,
+// as IDs aren't kept in step. Title, Content and Genres are short hashes so that a
+// fingerprint of the whole catalog stays small. ExternalID is reported so that a sync
+// can keep a book's external ID the same everywhere, but it isn't part of the hash, as
+// each environment generates its own.
+type CatalogEntry struct {
+	Slug       string `json:"slug"`
+	ExternalID string `json:"external_id,omitempty"`
+	Title      string `json:"title"`
+	Content    string `json:"content"`
+	Year       int32  `json:"year"`
+	Pages      int32  `json:"pages"`
+	Genres     string `json:"genres"`
+}
+
+// CatalogFingerprint is a snapshot of the catalog which can be compared with one taken
+// in another environment. Hash covers every entry, so two catalogs are the same if
+// their hashes are.
+type CatalogFingerprint struct {
+	Environment string    `json:"environment"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// IDStrategy is how the environment generates external IDs. Books synced between
+	// environments with different strategies get external IDs of different forms.
+	IDStrategy string         `json:"id_strategy,omitempty"`
+	Books      int            `json:"books"`
+	Hash       string         `json:"hash"`
+	Entries    []CatalogEntry `json:"entries"`
+}
+
+// CatalogDivergence is a book which is in both catalogs but whose metadata differs.
+// Fields lists the fields which don't match.
+type CatalogDivergence struct {
+	Slug   string   `json:"slug"`
+	Fields []string `json:"fields"`
+}
+
+// CatalogDiff is the difference between the local catalog and another environment's.
+type CatalogDiff struct {
+	Identical bool `json:"identical"`
+	// OnlyLocal are the slugs of books missing from the other environment, and
+	// OnlyRemote those missing from this one.
+	OnlyLocal  []string            `json:"only_local"`
+	OnlyRemote []string            `json:"only_remote"`
+	Divergent  []CatalogDivergence `json:"divergent"`
+	// DifferentIDs are the slugs of books in both catalogs whose external IDs don't
+	// match. They don't stop the catalogs being identical.
+	DifferentIDs []string `json:"different_ids"`
+}
+
+type CatalogModel struct {
+	DB *pgxpool.Pool
+}
+
+// fingerprintProgressEvery is how many books Fingerprint reads between reports of its
+// progress.
+const fingerprintProgressEvery = 1000
+
+// Fingerprint takes a fingerprint of every book in the catalog, in slug order,
+// reporting progress every fingerprintProgressEvery books.
+func (m CatalogModel) Fingerprint(ctx context.Context, environment string, progress ProgressFunc) (*CatalogFingerprint, error) {
+	query := `
+		SELECT slug, external_id, left(md5(title), 12), left(md5(content), 12), year, pages,
+			left(md5(coalesce((
+				SELECT string_agg(genres.name, ',' ORDER BY book_genres.position)
+				FROM book_genres
+				INNER JOIN genres ON genres.id = book_genres.genre_id
+				WHERE book_genres.book_id = books.id
+			), '')), 12)
+		FROM books
+		ORDER BY slug`
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	fp := &CatalogFingerprint{Environment: environment, GeneratedAt: time.Now(), Entries: []CatalogEntry{}}
+	var total int64
+	err := m.DB.QueryRow(ctx, `SELECT strategy, (SELECT count(*) FROM books) FROM id_generation`).Scan(&fp.IDStrategy, &total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hash := sha256.New()
+	for rows.Next() {
+		var e CatalogEntry
+		err := rows.Scan(&e.Slug, &e.ExternalID, &e.Title, &e.Content, &e.Year, &e.Pages, &e.Genres)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%d\x00%d\x00%s\n", e.Slug, e.Title, e.Content, e.Year, e.Pages, e.Genres)
+		fp.Entries = append(fp.Entries, e)
+		if len(fp.Entries)%fingerprintProgressEvery == 0 {
+			progress.report(int64(len(fp.Entries)), total)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	fp.Books = len(fp.Entries)
+	progress.report(int64(fp.Books), int64(fp.Books))
+	fp.Hash = hex.EncodeToString(hash.Sum(nil))
+	return fp, nil
+}
+
+// DiffCatalogs compares the local catalog's fingerprint with a remote one. The slices
+// in the result are sorted by slug.
+func DiffCatalogs(local, remote *CatalogFingerprint) *CatalogDiff {
+	diff := &CatalogDiff{OnlyLocal: []string{}, OnlyRemote: []string{}, Divergent: []CatalogDivergence{}, DifferentIDs: []string{}}
+
+	remoteEntries := make(map[string]CatalogEntry, len(remote.Entries))
+	for _, e := range remote.Entries {
+		remoteEntries[e.Slug] = e
+	}
+
+	for _, l := range local.Entries {
+		r, ok := remoteEntries[l.Slug]
+		if !ok {
+			diff.OnlyLocal = append(diff.OnlyLocal, l.Slug)
+			continue
+		}
+		delete(remoteEntries, l.Slug)
+
+		// Fingerprints from before external IDs were reported don't have them.
+		if l.ExternalID != "" && r.ExternalID != "" && l.ExternalID != r.ExternalID {
+			diff.DifferentIDs = append(diff.DifferentIDs, l.Slug)
+		}
+
+		var fields []string
+		if l.Title != r.Title {
+			fields = append(fields, "title")
+		}
+		if l.Content != r.Content {
+			fields = append(fields, "content")
+		}
+		if l.Year != r.Year {
+			fields = append(fields, "year")
+		}
+		if l.Pages != r.Pages {
+			fields = append(fields, "pages")
+		}
+		if l.Genres != r.Genres {
+			fields = append(fields, "genres")
+		}
+		if len(fields) > 0 {
+			diff.Divergent = append(diff.Divergent, CatalogDivergence{Slug: l.Slug, Fields: fields})
+		}
+	}
+	for slug := range remoteEntries {
+		diff.OnlyRemote = append(diff.OnlyRemote, slug)
+	}
+
+	sort.Strings(diff.OnlyLocal)
+	sort.Strings(diff.OnlyRemote)
+	sort.Strings(diff.DifferentIDs)
+	sort.Slice(diff.Divergent, func(i, j int) bool {
+		return diff.Divergent[i].Slug < diff.Divergent[j].Slug
+	})
+	diff.Identical = len(diff.OnlyLocal) == 0 && len(diff.OnlyRemote) == 0 && len(diff.Divergent) == 0
+	return diff
+}
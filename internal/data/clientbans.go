@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// What's done to requests from a banned client. Tarpitted clients have every response
+// delayed; shadow banned clients are also delayed, then get an empty response instead
+// of the real one, so scrapers don't notice they've been caught.
+const (
+	BanTarpit = "tarpit"
+	BanShadow = "shadow_ban"
+)
+
+// ClientBan is a decision to tarpit or shadow ban an IP address, made automatically
+// when a client hits a honeypot endpoint or keeps exceeding the rate limit. Bans are
+// kept after they expire or are lifted, as a log of the decisions made.
+type ClientBan struct {
+	ID        int64      `json:"id"`
+	IP        string     `json:"ip"`
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy  *int64     `json:"lifted_by,omitempty"`
+}
+
+// Active reports whether the ban still applies.
+func (b *ClientBan) Active() bool {
+	return b.LiftedAt == nil && time.Now().Before(b.ExpiresAt)
+}
+
+type ClientBanModel struct {
+	DB *pgxpool.Pool
+}
+
+const clientBanColumns = `id, ip, action, reason, created_at, expires_at, lifted_at, lifted_by`
+
+func scanClientBan(row pgx.Row) (*ClientBan, error) {
+	var ban ClientBan
+	err := row.Scan(&ban.ID, &ban.IP, &ban.Action, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt, &ban.LiftedAt, &ban.LiftedBy)
+	if err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+// Insert saves the ban, unless the IP address is already banned, in which case the
+// ID, creation and expiry time of the ban already in force are filled in instead. So
+// instances banning the same client at about the same time don't pile up bans which
+// each have to be lifted.
+func (m ClientBanModel) Insert(ban *ClientBan) error {
+	query := `
+		WITH existing AS (
+			SELECT id, created_at, expires_at
+			FROM client_bans
+			WHERE ip = $1 AND lifted_at IS NULL AND expires_at > NOW()
+			ORDER BY id
+			LIMIT 1
+		), inserted AS (
+			INSERT INTO client_bans (ip, action, reason, expires_at)
+			SELECT $1, $2, $3, $4
+			WHERE NOT EXISTS (SELECT 1 FROM existing)
+			RETURNING id, created_at, expires_at
+		)
+		SELECT id, created_at, expires_at FROM inserted
+		UNION ALL
+		SELECT id, created_at, expires_at FROM existing`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, ban.IP, ban.Action, ban.Reason, ban.ExpiresAt).Scan(&ban.ID, &ban.CreatedAt, &ban.ExpiresAt)
+}
+
+// GetAll returns bans newest first. If active is set, only those which still apply
+// are returned.
+func (m ClientBanModel) GetAll(active bool, filters Filters) ([]*ClientBan, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), ` + clientBanColumns + `
+		FROM client_bans
+		WHERE NOT $1 OR (lifted_at IS NULL AND expires_at > NOW())
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, active, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	bans := []*ClientBan{}
+	for rows.Next() {
+		var ban ClientBan
+		err := rows.Scan(&totalRecords, &ban.ID, &ban.IP, &ban.Action, &ban.Reason, &ban.CreatedAt, &ban.ExpiresAt, &ban.LiftedAt, &ban.LiftedBy)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		bans = append(bans, &ban)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return bans, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// GetActive returns every ban which still applies, for loading into memory.
+func (m ClientBanModel) GetActive() ([]*ClientBan, error) {
+	query := `
+		SELECT ` + clientBanColumns + `
+		FROM client_bans
+		WHERE lifted_at IS NULL AND expires_at > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []*ClientBan{}
+	for rows.Next() {
+		ban, err := scanClientBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// Lift ends the ban early, recording which admin did so. Any other bans still in
+// force on the same IP address are lifted along with it, so they don't take over when
+// the bans are next loaded. It returns ErrRecordNotFound if there's no such ban or it
+// no longer applies.
+func (m ClientBanModel) Lift(id, adminID int64) (*ClientBan, error) {
+	query := `
+		UPDATE client_bans
+		SET lifted_at = NOW(), lifted_by = $2
+		WHERE ip = (SELECT ip FROM client_bans WHERE id = $1 AND lifted_at IS NULL AND expires_at > NOW())
+		AND lifted_at IS NULL AND expires_at > NOW()
+		RETURNING ` + clientBanColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, id, adminID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lifted *ClientBan
+	for rows.Next() {
+		ban, err := scanClientBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if ban.ID == id {
+			lifted = ban
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if lifted == nil {
+		return nil, ErrRecordNotFound
+	}
+	return lifted, nil
+}
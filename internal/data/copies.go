@@ -0,0 +1,261 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateBarcode = errors.New("duplicate barcode")
+)
+
+// Copy is a physical copy of a book and where it's shelved. Location is a readable
+// form of the branch, room and shelf, such as "Main Library, Shelf B4".
+type Copy struct {
+	ID         int64     `json:"id"`
+	ExternalID string    `json:"external_id"`
+	BookID     int64     `json:"book_id"`
+	Barcode    string    `json:"barcode"`
+	Branch     string    `json:"branch"`
+	Room       string    `json:"room,omitempty"`
+	Shelf      string    `json:"shelf,omitempty"`
+	CallNumber string    `json:"call_number,omitempty"`
+	Location   string    `json:"location"`
+	CreatedAt  time.Time `json:"created_at"`
+	Version    int32     `json:"version"`
+	// Book is only set on copies returned by a location or barcode lookup.
+	Book *BookSummary `json:"book,omitempty"`
+}
+
+// describeLocation sets c.Location from the branch, room and shelf.
+func (c *Copy) describeLocation() {
+	parts := []string{c.Branch}
+	if c.Room != "" {
+		parts = append(parts, c.Room)
+	}
+	if c.Shelf != "" {
+		parts = append(parts, "Shelf "+c.Shelf)
+	}
+	c.Location = strings.Join(parts, ", ")
+}
+
+func ValidateCopy(v *validator.Validator, c *Copy, taxonomy *LocationTaxonomy) {
+	v.Check(c.Barcode != "", "barcode", "must be provided")
+	v.Check(len(c.Barcode) <= 100, "barcode", "must not be more than 100 bytes long")
+	ValidateLocation(v, c, taxonomy)
+}
+
+// CopyLookup holds the filters for finding copies by location. Empty fields match
+// everything, and CallNumber matches call numbers starting with it.
+type CopyLookup struct {
+	Branch     string
+	Room       string
+	Shelf      string
+	CallNumber string
+}
+
+type CopyModel struct {
+	DB *pgxpool.Pool
+}
+
+const copyColumns = `book_copies.id, book_copies.external_id, book_copies.book_id, book_copies.barcode, book_copies.branch,
+	book_copies.room, book_copies.shelf, book_copies.call_number, book_copies.created_at, book_copies.version`
+
+func scanCopy(row pgx.Row, extra ...any) (*Copy, error) {
+	var c Copy
+	dest := append([]any{&c.ID, &c.ExternalID, &c.BookID, &c.Barcode, &c.Branch, &c.Room, &c.Shelf, &c.CallNumber,
+		&c.CreatedAt, &c.Version}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	c.describeLocation()
+	return &c, nil
+}
+
+func isDuplicateBarcode(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "book_copies_barcode_key"
+}
+
+func isUnknownBranch(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "book_copies_branch_fkey"
+}
+
+func (m CopyModel) Insert(c *Copy) error {
+	query := `
+		INSERT INTO book_copies (book_id, barcode, branch, room, shelf, call_number)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, external_id, created_at, version`
+	args := []any{c.BookID, c.Barcode, c.Branch, c.Room, c.Shelf, c.CallNumber}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&c.ID, &c.ExternalID, &c.CreatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case isDuplicateBarcode(err):
+			return ErrDuplicateBarcode
+		case isUnknownBranch(err):
+			return ErrUnknownBranch
+		default:
+			return err
+		}
+	}
+	c.describeLocation()
+	return nil
+}
+
+func (m CopyModel) Get(id int64) (*Copy, error) {
+	query := `SELECT ` + copyColumns + ` FROM book_copies WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := scanCopy(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// GetByBarcode returns the copy with the barcode, along with a summary of its book.
+func (m CopyModel) GetByBarcode(barcode string) (*Copy, error) {
+	query := `
+		SELECT ` + copyColumns + `, books.id, books.title, books.slug, books.year
+		FROM book_copies
+		INNER JOIN books ON books.id = book_copies.book_id
+		WHERE book_copies.barcode = $1`
+	var book BookSummary
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c, err := scanCopy(m.DB.QueryRow(ctx, query, barcode), &book.ID, &book.Title, &book.Slug, &book.Year)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	c.Book = &book
+	return c, nil
+}
+
+// GetForBooks returns the copies of each of the given books, keyed by book ID.
+func (m CopyModel) GetForBooks(ctx context.Context, ids []int64) (map[int64][]*Copy, error) {
+	query := `
+		SELECT ` + copyColumns + `
+		FROM book_copies
+		WHERE book_id = ANY($1)
+		ORDER BY branch, room, shelf, id`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	copies := make(map[int64][]*Copy)
+	for rows.Next() {
+		c, err := scanCopy(rows)
+		if err != nil {
+			return nil, err
+		}
+		copies[c.BookID] = append(copies[c.BookID], c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+// Find returns the copies matching the lookup, with the book each is a copy of.
+func (m CopyModel) Find(lookup CopyLookup, filters Filters) ([]*Copy, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT `+copyColumns+`, books.title, books.slug, books.year, count(*) OVER()
+		FROM book_copies
+		INNER JOIN books ON books.id = book_copies.book_id
+		WHERE ($1 = '' OR book_copies.branch = $1)
+		AND ($2 = '' OR book_copies.room = $2)
+		AND ($3 = '' OR book_copies.shelf = $3)
+		AND ($4 = '' OR book_copies.call_number LIKE $4 || '%%')
+		ORDER BY book_copies.%s %s, book_copies.id ASC
+		LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+	args := []any{lookup.Branch, lookup.Room, lookup.Shelf, escapeLike(lookup.CallNumber), filters.limit(), filters.offset()}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	copies := []*Copy{}
+	for rows.Next() {
+		book := &BookSummary{}
+		c, err := scanCopy(rows, &book.Title, &book.Slug, &book.Year, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		book.ID = c.BookID
+		c.Book = book
+		copies = append(copies, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return copies, metadata, nil
+}
+
+// Update saves the copy's barcode and location. It returns ErrEditConflict if the copy
+// has changed since it was read.
+func (m CopyModel) Update(c *Copy) error {
+	query := `
+		UPDATE book_copies
+		SET barcode = $1, branch = $2, room = $3, shelf = $4, call_number = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version`
+	args := []any{c.Barcode, c.Branch, c.Room, c.Shelf, c.CallNumber, c.ID, c.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&c.Version)
+	if err != nil {
+		switch {
+		case isDuplicateBarcode(err):
+			return ErrDuplicateBarcode
+		case isUnknownBranch(err):
+			return ErrUnknownBranch
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	c.describeLocation()
+	return nil
+}
+
+func (m CopyModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM book_copies WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
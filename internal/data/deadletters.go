@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// DeadLetter is an email which couldn't be sent after every retry. It's kept
+// rendered, so resending it doesn't depend on the data it was made from. Emails with
+// a one-time link in them are Redacted: their bodies aren't kept, so they can't be
+// resent.
+type DeadLetter struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Recipient string     `json:"recipient"`
+	Sender    string     `json:"sender"`
+	Template  string     `json:"template"`
+	Subject   string     `json:"subject"`
+	PlainBody string     `json:"-"`
+	HTMLBody  string     `json:"-"`
+	Attempts  int        `json:"attempts"`
+	Error     string     `json:"error"`
+	Redacted  bool       `json:"redacted"`
+	ResentAt  *time.Time `json:"resent_at,omitempty"`
+}
+
+type DeadLetterModel struct {
+	DB *pgxpool.Pool
+}
+
+const deadLetterColumns = `id, created_at, recipient, sender, template, subject, plain_body, html_body, attempts, error, redacted, resent_at`
+
+func scanDeadLetter(row pgx.Row, extra ...any) (*DeadLetter, error) {
+	var letter DeadLetter
+	dest := append(extra, &letter.ID, &letter.CreatedAt, &letter.Recipient, &letter.Sender, &letter.Template, &letter.Subject,
+		&letter.PlainBody, &letter.HTMLBody, &letter.Attempts, &letter.Error, &letter.Redacted, &letter.ResentAt)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (m DeadLetterModel) Insert(letter *DeadLetter) error {
+	query := `
+		INSERT INTO mail_dead_letters (recipient, sender, template, subject, plain_body, html_body, attempts, error, redacted)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at`
+	args := []any{letter.Recipient, letter.Sender, letter.Template, letter.Subject, letter.PlainBody, letter.HTMLBody, letter.Attempts, letter.Error, letter.Redacted}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, args...).Scan(&letter.ID, &letter.CreatedAt)
+}
+
+func (m DeadLetterModel) Get(id int64) (*DeadLetter, error) {
+	query := `SELECT ` + deadLetterColumns + ` FROM mail_dead_letters WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	letter, err := scanDeadLetter(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return letter, nil
+}
+
+// GetAll returns dead letters newest first. If pending is set, only those which
+// haven't been resent are returned.
+func (m DeadLetterModel) GetAll(pending bool, filters Filters) ([]*DeadLetter, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), ` + deadLetterColumns + `
+		FROM mail_dead_letters
+		WHERE NOT $1 OR resent_at IS NULL
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, pending, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	letters := []*DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		letters = append(letters, letter)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return letters, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Claim marks the dead letter as resent before it's sent, so that two admins
+// resending it at once can't both deliver it. It returns ErrRecordNotFound if there's
+// no such dead letter, it was already resent or it's redacted. If sending fails the
+// claim is undone with Release.
+func (m DeadLetterModel) Claim(id int64) (*DeadLetter, error) {
+	query := `
+		UPDATE mail_dead_letters
+		SET resent_at = NOW()
+		WHERE id = $1 AND resent_at IS NULL AND NOT redacted
+		RETURNING ` + deadLetterColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	letter, err := scanDeadLetter(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return letter, nil
+}
+
+// Release undoes a Claim after the dead letter couldn't be sent, so it's pending
+// again.
+func (m DeadLetterModel) Release(id int64) error {
+	query := `
+		UPDATE mail_dead_letters
+		SET resent_at = NULL
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, id)
+	return err
+}
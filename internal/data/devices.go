@@ -0,0 +1,219 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// deviceKeyPrefix starts every device key, so they can't be mistaken for a member's
+// API key.
+const deviceKeyPrefix = "bkd_"
+
+// Device is a self-checkout kiosk at a branch. It authenticates with its own key
+// instead of acting as a user, and can only use the kiosk endpoints. Status and
+// SoftwareVersion are whatever the device reported in its last heartbeat. Only the
+// hash of the key is stored; the plaintext is shown once when the device is created.
+type Device struct {
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	BranchID        int64      `json:"branch_id"`
+	Branch          string     `json:"branch"`
+	Prefix          string     `json:"prefix"`
+	Plaintext       string     `json:"key,omitempty"`
+	Hash            []byte     `json:"-"`
+	Status          string     `json:"status"`
+	SoftwareVersion string     `json:"software_version"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastSeenAt      *time.Time `json:"last_seen_at"`
+	Online          bool       `json:"online"`
+}
+
+// IsDeviceKey reports whether an Authorization credential looks like a device key.
+func IsDeviceKey(credential string) bool {
+	return strings.HasPrefix(credential, deviceKeyPrefix)
+}
+
+func ValidateDevice(v *validator.Validator, device *Device) {
+	v.Check(device.Name != "", "name", "must be provided")
+	v.Check(len(device.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(device.BranchID > 0, "branch_id", "must be provided")
+}
+
+func ValidateDeviceKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(IsDeviceKey(plaintext), "key", "must be a device key")
+	v.Check(len(plaintext) == len(deviceKeyPrefix)+32, "key", "must be 36 bytes long")
+}
+
+// ValidateHeartbeat checks what a device reports about itself.
+func ValidateHeartbeat(v *validator.Validator, status, softwareVersion string) {
+	v.Check(len(status) <= 200, "status", "must not be more than 200 bytes long")
+	v.Check(len(softwareVersion) <= 50, "software_version", "must not be more than 50 bytes long")
+}
+
+type DeviceModel struct {
+	DB *pgxpool.Pool
+}
+
+const deviceColumns = `devices.id, devices.name, devices.branch_id, branches.name, devices.prefix,
+	devices.status, devices.software_version, devices.created_at, devices.last_seen_at`
+
+func scanDevice(row pgx.Row) (*Device, error) {
+	var d Device
+	err := row.Scan(&d.ID, &d.Name, &d.BranchID, &d.Branch, &d.Prefix, &d.Status, &d.SoftwareVersion,
+		&d.CreatedAt, &d.LastSeenAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// New generates a key for the device and stores it. It returns ErrUnknownBranch if
+// the branch doesn't exist.
+func (m DeviceModel) New(device *Device) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	device.Plaintext = deviceKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	device.Prefix = device.Plaintext[:len(deviceKeyPrefix)+6]
+	hash := sha256.Sum256([]byte(device.Plaintext))
+	device.Hash = hash[:]
+
+	query := `
+		INSERT INTO devices (name, branch_id, prefix, hash)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, (SELECT name FROM branches WHERE id = $2), created_at`
+	args := []any{device.Name, device.BranchID, device.Prefix, device.Hash}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&device.ID, &device.Branch, &device.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &pgErr) && pgErr.Code == "23503":
+			return ErrUnknownBranch
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAll returns every device, grouped by branch. The plaintext keys aren't available.
+func (m DeviceModel) GetAll() ([]*Device, error) {
+	query := `
+		SELECT ` + deviceColumns + `
+		FROM devices
+		INNER JOIN branches ON branches.id = devices.branch_id
+		ORDER BY branches.name, devices.name, devices.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []*Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Use looks up the device with the given key and records that it has been seen.
+func (m DeviceModel) Use(plaintext string) (*Device, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		UPDATE devices
+		SET last_seen_at = NOW()
+		FROM branches
+		WHERE devices.hash = $1 AND branches.id = devices.branch_id
+		RETURNING ` + deviceColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	device, err := scanDevice(m.DB.QueryRow(ctx, query, hash[:]))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return device, nil
+}
+
+// GetForKey looks up the device with the given key without recording that it has
+// been seen, for servers which can't write to the database.
+func (m DeviceModel) GetForKey(plaintext string) (*Device, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		SELECT ` + deviceColumns + `
+		FROM devices
+		INNER JOIN branches ON branches.id = devices.branch_id
+		WHERE devices.hash = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	device, err := scanDevice(m.DB.QueryRow(ctx, query, hash[:]))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return device, nil
+}
+
+// Heartbeat records the status and software version the device reported.
+func (m DeviceModel) Heartbeat(device *Device) error {
+	query := `
+		UPDATE devices
+		SET status = $1, software_version = $2, last_seen_at = NOW()
+		WHERE id = $3
+		RETURNING last_seen_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, device.Status, device.SoftwareVersion, device.ID).Scan(&device.LastSeenAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the device, which stops its key working.
+func (m DeviceModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM devices WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// NotificationPreferences are the emails a user has opted in to. WeeklyDigest predates
+// the digest frequency in Preferences, and is true when any digest is being sent.
+type NotificationPreferences struct {
+	WeeklyDigest   bool     `json:"weekly_digest"`
+	FollowedGenres []string `json:"followed_genres"`
+}
+
+// DigestRecipient is a user who is due their digest. Since is when the previous digest
+// was sent, or one digest period ago if there wasn't one.
+type DigestRecipient struct {
+	UserID   int64
+	Name     string
+	Email    string
+	Timezone string
+	Since    time.Time
+}
+
+// DigestProgress is the reading a user did in a digest period: the minutes spent in
+// closed reading sessions, and the titles of the books they were reading, the most
+// read first.
+type DigestProgress struct {
+	Minutes  int64
+	Sessions int
+	Books    []string
+}
+
+func ValidateNotificationPreferences(v *validator.Validator, prefs *NotificationPreferences) {
+	v.Check(len(prefs.FollowedGenres) <= 20, "followed_genres", "must not contain more than 20 genres")
+	v.Check(validator.Unique(prefs.FollowedGenres), "followed_genres", "must not contain duplicate values")
+	for _, genre := range prefs.FollowedGenres {
+		v.Check(genre != "", "followed_genres", "must not contain empty values")
+	}
+}
+
+type DigestModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m DigestModel) GetPreferences(userID int64) (*NotificationPreferences, error) {
+	query := `
+		SELECT coalesce((
+			SELECT digest_frequency <> 'never' FROM user_preferences
+			WHERE user_preferences.user_id = users.id), false), ARRAY(
+			SELECT genres.name FROM users_followed_genres
+			INNER JOIN genres ON genres.id = users_followed_genres.genre_id
+			WHERE users_followed_genres.user_id = users.id
+			ORDER BY genres.name)
+		FROM users
+		WHERE users.id = $1`
+	var prefs NotificationPreferences
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&prefs.WeeklyDigest, &prefs.FollowedGenres)
+	if err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+// UpdatePreferences replaces the user's notification preferences. Genres which no
+// book belongs to yet can still be followed.
+func (m DigestModel) UpdatePreferences(userID int64, prefs *NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Turning the digest on keeps whatever frequency the user already picked.
+	query := `
+		INSERT INTO user_preferences (user_id, digest_frequency)
+		VALUES ($1, CASE WHEN $2 THEN 'weekly' ELSE 'never' END)
+		ON CONFLICT (user_id) DO UPDATE
+		SET digest_frequency = CASE
+			WHEN NOT $2 THEN 'never'
+			WHEN user_preferences.digest_frequency = 'never' THEN 'weekly'
+			ELSE user_preferences.digest_frequency END,
+			updated_at = NOW()`
+	_, err = tx.Exec(ctx, query, userID, prefs.WeeklyDigest)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO genres (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING`, prefs.FollowedGenres)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM users_followed_genres WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO users_followed_genres (user_id, genre_id)
+		SELECT $1, genres.id FROM genres WHERE genres.name = ANY($2)`
+	_, err = tx.Exec(ctx, query, userID, prefs.FollowedGenres)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetDue returns up to limit activated users who have opted in to the digest and
+// haven't had one within the frequency they chose.
+func (m DigestModel) GetDue(limit int) ([]*DigestRecipient, error) {
+	query := `
+		WITH periods AS (
+			SELECT user_id, CASE digest_frequency
+				WHEN 'daily' THEN interval '1 day'
+				WHEN 'weekly' THEN interval '7 days'
+				WHEN 'monthly' THEN interval '1 month' END AS period
+			FROM user_preferences
+			WHERE digest_frequency <> 'never')
+		SELECT users.id, users.name, users.email, users.timezone, coalesce(users.last_digest_at, NOW() - periods.period)
+		FROM users
+		INNER JOIN periods ON periods.user_id = users.id
+		WHERE users.activated
+		AND (users.last_digest_at IS NULL OR users.last_digest_at <= NOW() - periods.period)
+		ORDER BY users.id
+		LIMIT $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := []*DigestRecipient{}
+	for rows.Next() {
+		var recipient DigestRecipient
+		err := rows.Scan(&recipient.UserID, &recipient.Name, &recipient.Email, &recipient.Timezone, &recipient.Since)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, &recipient)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// GetNewBooks returns up to limit books in the user's followed genres which were added
+// after since, newest first.
+func (m DigestModel) GetNewBooks(userID int64, since time.Time, limit int) ([]*BookSummary, error) {
+	query := `
+		SELECT DISTINCT books.id, books.title, books.slug, books.year, books.created_at
+		FROM books
+		INNER JOIN book_genres ON book_genres.book_id = books.id
+		INNER JOIN users_followed_genres ON users_followed_genres.genre_id = book_genres.genre_id
+		WHERE users_followed_genres.user_id = $1 AND books.created_at > $2
+		ORDER BY books.created_at DESC, books.id DESC
+		LIMIT $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := []*BookSummary{}
+	for rows.Next() {
+		var book BookSummary
+		var createdAt time.Time
+		err := rows.Scan(&book.ID, &book.Title, &book.Slug, &book.Year, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// GetProgress returns the reading the user did in sessions started after since.
+func (m DigestModel) GetProgress(userID int64, since time.Time) (*DigestProgress, error) {
+	query := `
+		WITH sessions AS (
+			SELECT book_id, extract(epoch FROM ended_at - started_at)::bigint AS seconds
+			FROM reading_sessions
+			WHERE user_id = $1 AND ended_at IS NOT NULL AND started_at > $2)
+		SELECT coalesce(sum(seconds), 0) / 60, count(*), ARRAY(
+			SELECT books.title
+			FROM sessions
+			INNER JOIN books ON books.id = sessions.book_id
+			GROUP BY books.id, books.title
+			ORDER BY sum(sessions.seconds) DESC, books.title
+			LIMIT 5)
+		FROM sessions`
+	var progress DigestProgress
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID, since).Scan(&progress.Minutes, &progress.Sessions, &progress.Books)
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// Unsubscribe turns the user's digest off, keeping their followed genres for if they
+// turn it on again.
+func (m DigestModel) Unsubscribe(userID int64) error {
+	query := `
+		UPDATE user_preferences
+		SET digest_frequency = 'never', updated_at = NOW()
+		WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// MarkSent records that the user's digest covering everything up to at was handled.
+func (m DigestModel) MarkSent(userID int64, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, `UPDATE users SET last_digest_at = $1 WHERE id = $2`, at, userID)
+	return err
+}
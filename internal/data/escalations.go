@@ -0,0 +1,333 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of step an overdue loan can be escalated through. Reminders and overdue
+// notices only email the member; a block also stops them borrowing until the copy is
+// back or the loan is forgiven, and an invoice charges them the branch's replacement
+// fee.
+const (
+	EscalationReminder = "reminder"
+	EscalationOverdue  = "overdue"
+	EscalationBlock    = "block"
+	EscalationInvoice  = "invoice"
+)
+
+// DefaultEscalationSteps is a reminder two days before a loan is due, an overdue
+// notice the day after, a block after two weeks and an invoice after sixty days.
+const DefaultEscalationSteps = "reminder=-2,overdue=1,block=14,invoice=60"
+
+var escalationTemplates = map[string]string{
+	EscalationReminder: "loan_reminder.tmpl",
+	EscalationOverdue:  "loan_overdue.tmpl",
+	EscalationBlock:    "account_blocked.tmpl",
+	EscalationInvoice:  "replacement_invoice.tmpl",
+}
+
+// EscalationStep is taken Days days after a loan's due date, or before it if Days is
+// negative.
+type EscalationStep struct {
+	Name string
+	Days int
+}
+
+// Template is the email sent to the member when the step is taken.
+func (s EscalationStep) Template() string {
+	return escalationTemplates[s.Name]
+}
+
+// NotifyOnly reports whether the step does nothing but email the member, so it isn't
+// worth taking once the step after it is due.
+func (s EscalationStep) NotifyOnly() bool {
+	return s.Name == EscalationReminder || s.Name == EscalationOverdue
+}
+
+// At returns when the step is due for a loan due at due.
+func (s EscalationStep) At(due time.Time) time.Time {
+	return due.AddDate(0, 0, s.Days)
+}
+
+// ParseEscalationSteps parses a comma separated list of name=days steps, such as
+// DefaultEscalationSteps, and returns them in the order they're taken. Steps can be
+// left out, and an empty list turns escalation off.
+func ParseEscalationSteps(s string) ([]EscalationStep, error) {
+	var steps []EscalationStep
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, days, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("escalation steps: %q is not name=days", field)
+		}
+		if _, ok := escalationTemplates[name]; !ok {
+			return nil, fmt.Errorf("escalation steps: unknown step %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("escalation steps: duplicate step %q", name)
+		}
+		seen[name] = true
+		n, err := strconv.Atoi(days)
+		if err != nil || n < -365 || n > 365 {
+			return nil, fmt.Errorf("escalation steps: %q must have a whole number of days between -365 and 365", field)
+		}
+		steps = append(steps, EscalationStep{Name: name, Days: n})
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Days < steps[j].Days
+	})
+	return steps, nil
+}
+
+// Escalation is a step which has been taken for a loan. Amount is the invoiced
+// replacement fee for invoice steps. NotifiedAt is nil until the member has been
+// emailed about the step.
+type Escalation struct {
+	Step       string     `json:"step"`
+	Amount     int64      `json:"amount,omitempty"`
+	ExecutedAt time.Time  `json:"executed_at"`
+	NotifiedAt *time.Time `json:"notified_at"`
+}
+
+// escalationRetryDelay is how long a step which was taken but whose email wasn't sent,
+// because sending failed or the instance sending it stopped, waits before the email
+// is tried again.
+const escalationRetryDelay = 10 * time.Minute
+
+// EscalationNotice is an open loan which a step is due for, with what's needed to
+// email the member about it.
+type EscalationNotice struct {
+	LoanID         int64
+	UserID         int64
+	Name           string
+	Email          string
+	Title          string
+	Branch         string
+	Timezone       string
+	ReplacementFee int32
+	DueAt          time.Time
+}
+
+type EscalationModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetDue returns up to limit open loans which step is due for and hasn't been taken
+// for yet, or was taken without the member being emailed and is due a retry. Loans
+// which have been forgiven are skipped. If next is not nil, loans which next is
+// already due for are skipped too.
+func (m EscalationModel) GetDue(step EscalationStep, next *EscalationStep, limit int) ([]*EscalationNotice, error) {
+	query := `
+		SELECT loans.id, users.id, users.name, users.email, books.title, branches.name, branches.timezone,
+			branches.replacement_fee, loans.due_at
+		FROM loans
+		INNER JOIN users ON users.id = loans.user_id
+		INNER JOIN book_copies ON book_copies.id = loans.copy_id
+		INNER JOIN books ON books.id = book_copies.book_id
+		INNER JOIN branches ON branches.name = book_copies.branch
+		WHERE loans.returned_at IS NULL AND loans.forgiven_at IS NULL
+		AND loans.due_at + make_interval(days => $1) <= NOW()
+		AND ($2::integer IS NULL OR loans.due_at + make_interval(days => $2::integer) > NOW())
+		AND NOT EXISTS (
+			SELECT 1 FROM loan_escalations
+			WHERE loan_escalations.loan_id = loans.id AND loan_escalations.step = $3
+			AND (loan_escalations.notified_at IS NOT NULL OR loan_escalations.attempted_at > NOW() - $5::interval)
+		)
+		ORDER BY loans.due_at, loans.id
+		LIMIT $4`
+	var nextDays *int
+	if next != nil {
+		nextDays = &next.Days
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, step.Days, nextDays, step.Name, limit, escalationRetryDelay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notices := []*EscalationNotice{}
+	for rows.Next() {
+		var n EscalationNotice
+		err := rows.Scan(&n.LoanID, &n.UserID, &n.Name, &n.Email, &n.Title, &n.Branch, &n.Timezone,
+			&n.ReplacementFee, &n.DueAt)
+		if err != nil {
+			return nil, err
+		}
+		notices = append(notices, &n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return notices, nil
+}
+
+// Claim records that step has been taken for the loan, and that this instance is
+// emailing the member about it. A step which was taken before but whose email wasn't
+// sent is claimed again once escalationRetryDelay has passed, keeping the time it was
+// first taken, so a block or invoice stays in force while the email is retried. It
+// returns false if another instance has the claim, or the email has been sent.
+func (m EscalationModel) Claim(loanID int64, step string, amount int64) (bool, error) {
+	query := `
+		INSERT INTO loan_escalations (loan_id, step, amount)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (loan_id, step) DO UPDATE SET attempted_at = NOW()
+		WHERE loan_escalations.notified_at IS NULL
+		AND loan_escalations.attempted_at <= NOW() - $4::interval`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, loanID, step, amount, escalationRetryDelay)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// MarkNotified records that the member has been emailed about the step.
+func (m EscalationModel) MarkNotified(loanID int64, step string) error {
+	query := `
+		UPDATE loan_escalations
+		SET notified_at = NOW()
+		WHERE loan_id = $1 AND step = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, loanID, step)
+	return err
+}
+
+// GetForLoan returns the steps which have been taken for the loan, oldest first.
+func (m EscalationModel) GetForLoan(loanID int64) ([]*Escalation, error) {
+	query := `
+		SELECT step, amount, executed_at, notified_at
+		FROM loan_escalations
+		WHERE loan_id = $1
+		ORDER BY executed_at, step`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, loanID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	escalations := []*Escalation{}
+	for rows.Next() {
+		var e Escalation
+		err := rows.Scan(&e.Step, &e.Amount, &e.ExecutedAt, &e.NotifiedAt)
+		if err != nil {
+			return nil, err
+		}
+		escalations = append(escalations, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return escalations, nil
+}
+
+// blockedLoanExists is true when the member $1 has a copy out which they've been
+// blocked for. The block lasts until the copy is returned or the loan is forgiven,
+// whether or not the email telling them about it has been sent yet.
+const blockedLoanExists = `EXISTS (
+	SELECT 1
+	FROM loan_escalations
+	INNER JOIN loans ON loans.id = loan_escalations.loan_id
+	WHERE loans.user_id = $1 AND loan_escalations.step = '` + EscalationBlock + `'
+	AND loans.returned_at IS NULL AND loans.forgiven_at IS NULL
+)`
+
+// IsBlocked reports whether the member is blocked from borrowing because of a long
+// overdue loan.
+func (m EscalationModel) IsBlocked(userID int64) (bool, error) {
+	query := `SELECT ` + blockedLoanExists
+	var blocked bool
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&blocked)
+	if err != nil {
+		return false, err
+	}
+	return blocked, nil
+}
+
+// Reschedule moves the loan's due date, and forgets the steps which aren't due any
+// more under the new one so that they're taken again if the copy still isn't back.
+// It returns ErrNotOnLoan if the copy has been returned or the loan forgiven.
+func (m EscalationModel) Reschedule(loan *Loan, dueAt time.Time, steps []EscalationStep) error {
+	var undo []string
+	for _, step := range steps {
+		if step.At(dueAt).After(time.Now()) {
+			undo = append(undo, step.Name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE loans
+		SET due_at = $1
+		WHERE id = $2 AND returned_at IS NULL AND forgiven_at IS NULL`
+	result, err := tx.Exec(ctx, query, dueAt, loan.ID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotOnLoan
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM loan_escalations WHERE loan_id = $1 AND step = ANY($2)`, loan.ID, undo)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	loan.DueAt = dueAt
+	return nil
+}
+
+// Forgive stops escalating the loan, which lifts any block and voids any invoice for
+// it. It returns ErrNotOnLoan if the copy has been returned or the loan was already
+// forgiven.
+func (m EscalationModel) Forgive(loan *Loan, staffID int64, note string) error {
+	query := `
+		UPDATE loans
+		SET forgiven_at = NOW(), forgiven_by = $1, forgive_note = $2
+		WHERE id = $3 AND returned_at IS NULL AND forgiven_at IS NULL
+		RETURNING forgiven_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, staffID, note, loan.ID).Scan(&loan.ForgivenAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrNotOnLoan
+		default:
+			return err
+		}
+	}
+	loan.ForgiveNote = note
+	return nil
+}
@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The ways the external IDs of new records can be generated. UUIDv4s are
+// random; UUIDv7s and Snowflake IDs start with a timestamp, so they sort in the order
+// records were made, and Snowflake IDs also carry a node ID for when the data is
+// sharded. Serial external IDs are the record's numeric ID.
+const (
+	IDUUIDv4    = "uuidv4"
+	IDUUIDv7    = "uuidv7"
+	IDSerial    = "serial"
+	IDSnowflake = "snowflake"
+)
+
+// IDStrategies lists the strategies IDGenerationModel.Set accepts.
+var IDStrategies = []string{IDUUIDv4, IDUUIDv7, IDSerial, IDSnowflake}
+
+// MaxSnowflakeNode is the largest node ID which fits in a Snowflake ID.
+const MaxSnowflakeNode = 1023
+
+// minSnowflakeID is below every Snowflake ID made more than a few minutes after their
+// 2024 epoch, and far above any numeric ID, so numbers from it up are taken to be
+// Snowflake external IDs.
+const minSnowflakeID = 1 << 40
+
+// externalIDRX matches UUID external IDs, which records get unless their deployment
+// generates them some other way.
+var externalIDRX = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsExternalID reports whether s has the form of an external ID, as opposed to a
+// numeric ID or a slug. Serial external IDs are numeric IDs, so they aren't told apart.
+func IsExternalID(s string) bool {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n >= minSnowflakeID
+	}
+	return externalIDRX.MatchString(s)
+}
+
+// resolveExternalID returns the numeric ID of the row in table with the given
+// external ID. table is always one of ours, never user input.
+func resolveExternalID(db *pgxpool.Pool, table, externalID string) (int64, error) {
+	if !IsExternalID(externalID) {
+		return 0, ErrRecordNotFound
+	}
+	query := `SELECT id FROM ` + table + ` WHERE external_id = lower($1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var id int64
+	err := db.QueryRow(ctx, query, externalID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+// ResolveExternalID returns the numeric ID of the book with the given external ID.
+func (b BookModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(b.DB, "books", externalID)
+}
+
+// ResolveExternalID returns the numeric ID of the user with the given external ID.
+func (m UserModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(m.DB, "users", externalID)
+}
+
+// ResolveExternalID returns the numeric ID of the copy with the given external ID.
+func (m CopyModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(m.DB, "book_copies", externalID)
+}
+
+// ResolveExternalID returns the numeric ID of the reading list with the given
+// external ID.
+func (m ReadingListModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(m.DB, "reading_lists", externalID)
+}
+
+// ResolveExternalID returns the numeric ID of the reading session with the given
+// external ID.
+func (m ReadingSessionModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(m.DB, "reading_sessions", externalID)
+}
+
+// ResolveExternalID returns the numeric ID of the loan with the given external ID.
+func (m LoanModel) ResolveExternalID(externalID string) (int64, error) {
+	return resolveExternalID(m.DB, "loans", externalID)
+}
+
+// IDGenerationModel stores how the database generates external IDs for new records,
+// which a trigger on each table with external IDs reads when a record is inserted.
+type IDGenerationModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the current strategy and Snowflake node ID.
+func (m IDGenerationModel) Get() (string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var strategy string
+	var nodeID int
+	err := m.DB.QueryRow(ctx, `SELECT strategy, node_id FROM id_generation`).Scan(&strategy, &nodeID)
+	return strategy, nodeID, err
+}
+
+// Set changes how external IDs are generated from now on. Existing records keep
+// theirs, so a deployment may have external IDs of several forms.
+func (m IDGenerationModel) Set(strategy string, nodeID int) error {
+	query := `
+		INSERT INTO id_generation (strategy, node_id) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET strategy = EXCLUDED.strategy, node_id = EXCLUDED.node_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, strategy, nodeID)
+	return err
+}
@@ -66,3 +66,13 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// likeEscaper escapes the characters LIKE and ILIKE treat specially, with the default
+// backslash escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike returns s for use in a LIKE pattern, so that a search for "50%" or
+// "a_b" matches just that text rather than acting as a wildcard.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
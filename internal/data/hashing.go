@@ -0,0 +1,162 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// PasswordHashing configures how new password hashes are made. Hashes made with
+// other settings, including by the other algorithm, still match, and are replaced
+// the next time their user logs in.
+type PasswordHashing struct {
+	Algorithm  string
+	BcryptCost int
+	// Argon2Time is the number of passes over the memory, Argon2Memory is in KiB,
+	// and Argon2Threads is the degree of parallelism.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// DefaultPasswordHashing is what passwords are hashed with unless
+// SetPasswordHashing is called. The Argon2id settings are the ones recommended by
+// RFC 9106 for memory constrained environments.
+var DefaultPasswordHashing = PasswordHashing{
+	Algorithm:     HashBcrypt,
+	BcryptCost:    12,
+	Argon2Time:    3,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+var passwordHashing = DefaultPasswordHashing
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// SetPasswordHashing changes how new password hashes are made. It should be called
+// once at startup, before any passwords are hashed.
+func SetPasswordHashing(h PasswordHashing) error {
+	switch h.Algorithm {
+	case HashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if h.Argon2Time < 1 || h.Argon2Memory < 8*uint32(h.Argon2Threads) || h.Argon2Threads < 1 {
+			return errors.New("argon2id needs at least 1 pass, 1 thread and 8 KiB of memory per thread")
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", h.Algorithm)
+	}
+	passwordHashing = h
+	return nil
+}
+
+// hashPassword hashes plaintextPassword with the current settings. Argon2id hashes
+// are encoded in the PHC string format, like $argon2id$v=19$m=65536,t=3,p=4$salt$key,
+// so that they can be told apart from bcrypt hashes and carry their own parameters.
+func hashPassword(plaintextPassword string) ([]byte, error) {
+	h := passwordHashing
+	if h.Algorithm == HashBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.BcryptCost)
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(plaintextPassword), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// argon2Hash is a decoded Argon2id hash.
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+var errInvalidArgon2Hash = errors.New("invalid argon2id hash")
+
+func decodeArgon2Hash(hash []byte) (*argon2Hash, error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 || string(parts[1]) != HashArgon2id {
+		return nil, errInvalidArgon2Hash
+	}
+	var version int
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errInvalidArgon2Hash
+	}
+	var h argon2Hash
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return nil, errInvalidArgon2Hash
+	}
+	h.salt, err = base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return nil, errInvalidArgon2Hash
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil || len(h.key) == 0 {
+		return nil, errInvalidArgon2Hash
+	}
+	return &h, nil
+}
+
+// comparePassword reports whether plaintextPassword matches hash, whichever
+// algorithm made it. An empty hash never matches.
+func comparePassword(hash []byte, plaintextPassword string) (bool, error) {
+	if len(hash) == 0 {
+		return false, nil
+	}
+	if !bytes.HasPrefix(hash, []byte("$"+HashArgon2id+"$")) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	h, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(plaintextPassword), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// passwordNeedsRehash reports whether hash was made with settings other than the
+// current ones.
+func passwordNeedsRehash(hash []byte) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	want := passwordHashing
+	if bytes.HasPrefix(hash, []byte("$"+HashArgon2id+"$")) {
+		h, err := decodeArgon2Hash(hash)
+		return err != nil || want.Algorithm != HashArgon2id ||
+			h.time != want.Argon2Time || h.memory != want.Argon2Memory || h.threads != want.Argon2Threads
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || want.Algorithm != HashBcrypt || cost != want.BcryptCost
+}
@@ -0,0 +1,266 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// ErrLastLoginMethod is returned when removing a way of logging in would leave the
+// user with none.
+var ErrLastLoginMethod = errors.New("the user would be left with no way to log in")
+
+// Identity is an account at a social login provider which the user can log in with.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	CreatedAt time.Time `json:"linked_at"`
+}
+
+// LoginMethods are the ways a user can log in: with their email address and password,
+// with each of their linked identities and with any of their passkeys.
+type LoginMethods struct {
+	Password   bool       `json:"password"`
+	Identities []Identity `json:"identities"`
+	Passkeys   int        `json:"passkeys"`
+}
+
+// IdentityModel links users to their accounts at social login providers.
+type IdentityModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetUserID returns the ID of the user linked to the provider's subject, or
+// ErrRecordNotFound if the account hasn't been linked yet.
+func (m IdentityModel) GetUserID(provider, subject string) (int64, error) {
+	query := `SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`
+	var userID int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, provider, subject).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
+// Link records that the provider's subject belongs to the user.
+func (m IdentityModel) Link(userID int64, provider, subject string) error {
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (provider, subject) DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, provider, subject, userID)
+	return err
+}
+
+// GetAllForUser returns the ways the user can log in, or ErrRecordNotFound if there's
+// no such user.
+func (m IdentityModel) GetAllForUser(userID int64) (*LoginMethods, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	methods := LoginMethods{Identities: []Identity{}}
+	query := `
+		SELECT password_login, (SELECT count(*) FROM webauthn_credentials WHERE user_id = users.id)
+		FROM users
+		WHERE id = $1`
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&methods.Password, &methods.Passkeys)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `
+		SELECT provider, created_at FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at`
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(&identity.Provider, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		methods.Identities = append(methods.Identities, identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &methods, nil
+}
+
+// lockLoginMethods locks the user's row, so their login methods can't change under
+// the transaction, and reports whether they can log in with their password and how
+// many other ways they have: their passkeys, and their identities which aren't the
+// given provider's.
+func lockLoginMethods(ctx context.Context, tx pgx.Tx, userID int64, provider string) (password bool, others int, err error) {
+	query := `
+		SELECT password_login,
+			(SELECT count(*) FROM user_identities WHERE user_id = users.id AND provider <> $2) +
+			(SELECT count(*) FROM webauthn_credentials WHERE user_id = users.id)
+		FROM users
+		WHERE id = $1
+		FOR UPDATE`
+	err = tx.QueryRow(ctx, query, userID, provider).Scan(&password, &others)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = ErrRecordNotFound
+	}
+	return password, others, err
+}
+
+// EnablePassword saves the password the user has been given and lets them log in
+// with it.
+func (m IdentityModel) EnablePassword(user *User) error {
+	query := `
+		UPDATE users
+		SET password_hash = $1, password_login = true, version = uuid_generate_v4()
+		WHERE id = $2
+		RETURNING version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, user.Password.hash, user.ID).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	user.PasswordLogin = true
+	return nil
+}
+
+// DisablePassword stops the user logging in with their password, by clearing its
+// hash, as long as they have an identity to log in with instead. Otherwise it returns
+// ErrLastLoginMethod.
+func (m IdentityModel) DisablePassword(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, others, err := lockLoginMethods(ctx, tx, userID, "")
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastLoginMethod
+	}
+
+	query := `
+		UPDATE users
+		SET password_hash = '', password_login = false, version = uuid_generate_v4()
+		WHERE id = $1`
+	_, err = tx.Exec(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Unlink removes the user's identities at the provider, as long as they're left with
+// another way to log in. Otherwise it returns ErrLastLoginMethod. It returns
+// ErrRecordNotFound if they have no identity at the provider.
+func (m IdentityModel) Unlink(userID int64, provider string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	password, others, err := lockLoginMethods(ctx, tx, userID, provider)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, `DELETE FROM user_identities WHERE user_id = $1 AND provider = $2`, userID, provider)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	if !password && others == 0 {
+		return ErrLastLoginMethod
+	}
+	return tx.Commit(ctx)
+}
+
+// Move links the provider's subject to the user, taking it from the user it's linked
+// to now, such as an account they registered twice with. That user must be left with
+// another way to log in, or ErrLastLoginMethod is returned. It returns the ID of the
+// user the subject was taken from, or 0 if it wasn't linked to anyone else.
+func (m IdentityModel) Move(userID int64, provider, subject string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID int64
+	query := `SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, provider, subject).Scan(&ownerID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		_, err = tx.Exec(ctx, `INSERT INTO user_identities (provider, subject, user_id) VALUES ($1, $2, $3)`, provider, subject, userID)
+		if err != nil {
+			return 0, err
+		}
+		return 0, tx.Commit(ctx)
+	case err != nil:
+		return 0, err
+	case ownerID == userID:
+		return 0, nil
+	}
+
+	// The subject itself is being moved, so the owner's other identities at the
+	// same provider still count.
+	password, passkeysAndIdentities, err := lockLoginMethods(ctx, tx, ownerID, provider)
+	if err != nil {
+		return 0, err
+	}
+	var others int
+	query = `SELECT count(*) FROM user_identities WHERE user_id = $1 AND provider = $2 AND subject <> $3`
+	err = tx.QueryRow(ctx, query, ownerID, provider, subject).Scan(&others)
+	if err != nil {
+		return 0, err
+	}
+	if !password && passkeysAndIdentities+others == 0 {
+		return 0, ErrLastLoginMethod
+	}
+
+	query = `UPDATE user_identities SET user_id = $1, created_at = NOW() WHERE provider = $2 AND subject = $3`
+	_, err = tx.Exec(ctx, query, userID, provider, subject)
+	if err != nil {
+		return 0, err
+	}
+	return ownerID, tx.Commit(ctx)
+}
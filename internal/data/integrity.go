@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// IntegrityCheck describes a single consistency rule. CountQuery must return the
+// number of offending rows. RepairQuery is optional and is only set for checks where
+// fixing the problem can't lose any meaningful data (e.g. deleting expired tokens).
+type IntegrityCheck struct {
+	Name        string
+	Description string
+	CountQuery  string
+	RepairQuery string
+}
+
+// IntegrityFinding holds the result of running a single IntegrityCheck.
+type IntegrityFinding struct {
+	Check       string `json:"check"`
+	Description string `json:"description"`
+	Count       int    `json:"count"`
+	Repairable  bool   `json:"repairable"`
+	Repaired    int64  `json:"repaired,omitempty"`
+}
+
+// IntegrityReport is the outcome of a full run of the consistency checker.
+type IntegrityReport struct {
+	CheckedAt time.Time          `json:"checked_at"`
+	Findings  []IntegrityFinding `json:"findings"`
+}
+
+// IntegrityChecks is the list of rules run by the consistency checker.
+var IntegrityChecks = []IntegrityCheck{
+	{
+		Name:        "expired_tokens",
+		Description: "tokens which have passed their expiry time",
+		CountQuery:  `SELECT count(*) FROM tokens WHERE expiry < NOW()`,
+		RepairQuery: `DELETE FROM tokens WHERE expiry < NOW()`,
+	},
+	{
+		Name:        "stale_activation_tokens",
+		Description: "activation tokens for users who are already activated",
+		CountQuery: `
+			SELECT count(*) FROM tokens
+			INNER JOIN users ON users.id = tokens.user_id
+			WHERE tokens.scope = 'activation' AND users.activated`,
+		RepairQuery: `
+			DELETE FROM tokens
+			USING users
+			WHERE users.id = tokens.user_id AND tokens.scope = 'activation' AND users.activated`,
+	},
+	{
+		Name:        "stale_login_failures",
+		Description: "failed login counts with no activity or lock in the last day",
+		CountQuery: `
+			SELECT count(*) FROM login_failures
+			WHERE updated_at < NOW() - interval '1 day' AND (locked_until IS NULL OR locked_until < NOW())`,
+		RepairQuery: `
+			DELETE FROM login_failures
+			WHERE updated_at < NOW() - interval '1 day' AND (locked_until IS NULL OR locked_until < NOW())`,
+	},
+	{
+		Name:        "users_without_roles",
+		Description: "users who have not been assigned any roles",
+		CountQuery: `
+			SELECT count(*) FROM users
+			WHERE NOT EXISTS (SELECT 1 FROM users_roles WHERE users_roles.user_id = users.id)`,
+	},
+	{
+		Name:        "invalid_books",
+		Description: "books with a non-positive page count or no genres",
+		CountQuery: `
+			SELECT count(*) FROM books
+			WHERE pages <= 0 OR NOT EXISTS (SELECT 1 FROM book_genres WHERE book_genres.book_id = books.id)`,
+	},
+	{
+		Name:        "unused_genres",
+		Description: "genres which no book belongs to and no user follows",
+		CountQuery: `
+			SELECT count(*) FROM genres
+			WHERE NOT EXISTS (SELECT 1 FROM book_genres WHERE book_genres.genre_id = genres.id)
+			AND NOT EXISTS (SELECT 1 FROM users_followed_genres WHERE users_followed_genres.genre_id = genres.id)`,
+		RepairQuery: `
+			DELETE FROM genres
+			WHERE NOT EXISTS (SELECT 1 FROM book_genres WHERE book_genres.genre_id = genres.id)
+			AND NOT EXISTS (SELECT 1 FROM users_followed_genres WHERE users_followed_genres.genre_id = genres.id)`,
+	},
+}
+
+type IntegrityModel struct {
+	DB *pgxpool.Pool
+}
+
+// Check runs every integrity check and returns a report of the findings, reporting
+// progress after each check. If repair is true, checks which have a RepairQuery and
+// at least one finding are also fixed. If ctx is cancelled it stops before the next
+// check, and a repair in progress is rolled back.
+func (m IntegrityModel) Check(ctx context.Context, repair bool, progress ProgressFunc) (*IntegrityReport, error) {
+	report := &IntegrityReport{
+		CheckedAt: time.Now(),
+		Findings:  []IntegrityFinding{},
+	}
+
+	for i, check := range IntegrityChecks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		finding := IntegrityFinding{
+			Check:       check.Name,
+			Description: check.Description,
+			Repairable:  check.RepairQuery != "",
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := m.DB.QueryRow(ctx, check.CountQuery).Scan(&finding.Count)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		if repair && finding.Repairable && finding.Count > 0 {
+			result, err := m.DB.Exec(ctx, check.RepairQuery)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			finding.Repaired = result.RowsAffected()
+		}
+		cancel()
+
+		report.Findings = append(report.Findings, finding)
+		progress.report(int64(i+1), int64(len(IntegrityChecks)))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// The statuses of an inter-library loan. A loan starts "requested" when we ask the
+// partner library for the item, is "shipped" once they've sent it, "received" while
+// it's in our possession and "returned" when we've sent it back. A request can be
+// "cancelled" until it's shipped.
+const (
+	InterlibraryRequested = "requested"
+	InterlibraryShipped   = "shipped"
+	InterlibraryReceived  = "received"
+	InterlibraryReturned  = "returned"
+	InterlibraryCancelled = "cancelled"
+)
+
+// InterlibraryTransitions lists the statuses a loan can move to from each status.
+var InterlibraryTransitions = map[string][]string{
+	InterlibraryRequested: {InterlibraryShipped, InterlibraryCancelled},
+	InterlibraryShipped:   {InterlibraryReceived},
+	InterlibraryReceived:  {InterlibraryReturned},
+}
+
+// InterlibraryLoan is an item borrowed from a partner library on behalf of a member.
+// DueDate is when the partner wants it back, and the timestamps record when it moved
+// through each status.
+type InterlibraryLoan struct {
+	ID             int64      `json:"id"`
+	UserID         int64      `json:"user_id"`
+	Title          string     `json:"title"`
+	ISBN           string     `json:"isbn,omitempty"`
+	PartnerLibrary string     `json:"partner_library"`
+	PartnerContact string     `json:"partner_contact,omitempty"`
+	Status         string     `json:"status"`
+	Note           string     `json:"note,omitempty"`
+	DueDate        *time.Time `json:"due_date,omitempty"`
+	ShippedAt      *time.Time `json:"shipped_at,omitempty"`
+	ReceivedAt     *time.Time `json:"received_at,omitempty"`
+	ReturnedAt     *time.Time `json:"returned_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	Version        int32      `json:"version"`
+}
+
+func ValidateInterlibraryLoan(v *validator.Validator, loan *InterlibraryLoan) {
+	v.Check(loan.Title != "", "title", "must be provided")
+	v.Check(len(loan.Title) <= 500, "title", "must not be more than 500 bytes long")
+	if loan.ISBN != "" {
+		v.Check(ValidISBN(loan.ISBN), "isbn", "must be a valid ISBN-10 or ISBN-13")
+	}
+	v.Check(loan.PartnerLibrary != "", "partner_library", "must be provided")
+	v.Check(len(loan.PartnerLibrary) <= 500, "partner_library", "must not be more than 500 bytes long")
+	v.Check(len(loan.PartnerContact) <= 500, "partner_contact", "must not be more than 500 bytes long")
+	v.Check(len(loan.Note) <= 2000, "note", "must not be more than 2000 bytes long")
+}
+
+type InterlibraryLoanModel struct {
+	DB *pgxpool.Pool
+}
+
+const interlibraryLoanColumns = `id, user_id, title, isbn, partner_library, partner_contact, status, note,
+	due_date, shipped_at, received_at, returned_at, created_at, updated_at, version`
+
+func scanInterlibraryLoan(row pgx.Row, extra ...any) (*InterlibraryLoan, error) {
+	var l InterlibraryLoan
+	dest := append(extra, &l.ID, &l.UserID, &l.Title, &l.ISBN, &l.PartnerLibrary, &l.PartnerContact,
+		&l.Status, &l.Note, &l.DueDate, &l.ShippedAt, &l.ReceivedAt, &l.ReturnedAt,
+		&l.CreatedAt, &l.UpdatedAt, &l.Version)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (m InterlibraryLoanModel) Insert(loan *InterlibraryLoan) error {
+	query := `
+		INSERT INTO interlibrary_loans (user_id, title, isbn, partner_library, partner_contact, note, due_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + interlibraryLoanColumns
+	args := []any{loan.UserID, loan.Title, loan.ISBN, loan.PartnerLibrary, loan.PartnerContact, loan.Note, loan.DueDate}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	inserted, err := scanInterlibraryLoan(m.DB.QueryRow(ctx, query, args...))
+	if err != nil {
+		return err
+	}
+	*loan = *inserted
+	return nil
+}
+
+func (m InterlibraryLoanModel) Get(id int64) (*InterlibraryLoan, error) {
+	query := `SELECT ` + interlibraryLoanColumns + ` FROM interlibrary_loans WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	loan, err := scanInterlibraryLoan(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return loan, nil
+}
+
+// GetAll returns inter-library loans, newest first by default. userID limits them to
+// a single member's loans when it isn't zero, and status to a single status when it
+// isn't empty.
+func (m InterlibraryLoanModel) GetAll(userID int64, status string, filters Filters) ([]*InterlibraryLoan, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+interlibraryLoanColumns+`
+		FROM interlibrary_loans
+		WHERE ($1::bigint = 0 OR user_id = $1)
+		AND ($2 = '' OR status = $2)
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	loans := []*InterlibraryLoan{}
+	for rows.Next() {
+		loan, err := scanInterlibraryLoan(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		loans = append(loans, loan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return loans, metadata, nil
+}
+
+// Update saves the loan. It returns ErrEditConflict if the loan has changed since it
+// was read.
+func (m InterlibraryLoanModel) Update(loan *InterlibraryLoan) error {
+	query := `
+		UPDATE interlibrary_loans
+		SET partner_library = $1, partner_contact = $2, status = $3, note = $4, due_date = $5,
+			shipped_at = $6, received_at = $7, returned_at = $8, updated_at = NOW(), version = version + 1
+		WHERE id = $9 AND version = $10
+		RETURNING updated_at, version`
+	args := []any{loan.PartnerLibrary, loan.PartnerContact, loan.Status, loan.Note, loan.DueDate,
+		loan.ShippedAt, loan.ReceivedAt, loan.ReturnedAt, loan.ID, loan.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&loan.UpdatedAt, &loan.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,526 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// Define constants for the job statuses. A job is "queued" until a worker claims it,
+// and "running" while the worker is processing it. "cancelled" and "failed" jobs can
+// be queued again, and backfills then resume from the last saved cursor.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCancelled = "cancelled"
+	JobStatusFailed    = "failed"
+	JobStatusCompleted = "completed"
+)
+
+// Backfill describes a long-running data migration that is processed in batches.
+// CountQuery must return the number of rows the backfill will touch. BatchQuery is
+// called with the cursor (the last processed id) as $1 and the batch size as $2, and
+// must return the ids of the rows it processed.
+type Backfill struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CountQuery  string `json:"-"`
+	BatchQuery  string `json:"-"`
+}
+
+// Backfills is the list of backfills which can be started as jobs.
+var Backfills = []Backfill{
+	{
+		Name:        "word_count",
+		Description: "compute the word count of every book",
+		CountQuery:  `SELECT count(*) FROM books`,
+		BatchQuery: `
+			UPDATE books
+			SET word_count = book_word_count(content)
+			WHERE id IN (SELECT id FROM books WHERE id > $1 ORDER BY id LIMIT $2)
+			RETURNING id`,
+	},
+}
+
+// LookupBackfill returns the backfill with the given name.
+func LookupBackfill(name string) (Backfill, bool) {
+	for _, backfill := range Backfills {
+		if backfill.Name == name {
+			return backfill, true
+		}
+	}
+	return Backfill{}, false
+}
+
+// Job is either a backfill, or a long-running request which is being answered
+// asynchronously. The latter have a UserID, the user who made the request, and a
+// result once they've completed, which ResultURL links to.
+//
+// Jobs wait in a queue until RunAt, and are then claimed by the highest Priority
+// first. A failed job is queued again, after a backoff, until it has been attempted
+// MaxAttempts times. LockedBy names the instance running the job.
+type Job struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Kind      string    `json:"kind"`
+	Status    string    `json:"status"`
+	Processed int64     `json:"processed"`
+	Total     int64     `json:"total"`
+	Cursor    int64     `json:"-"`
+	BatchSize int       `json:"batch_size"`
+	Error     string    `json:"error,omitempty"`
+	UserID    int64     `json:"user_id,omitempty"`
+	HasResult bool      `json:"-"`
+	ResultURL string    `json:"result_url,omitempty"`
+
+	Priority        int       `json:"priority"`
+	Attempts        int       `json:"attempts"`
+	MaxAttempts     int       `json:"max_attempts"`
+	RunAt           time.Time `json:"run_at"`
+	LockedBy        string    `json:"locked_by,omitempty"`
+	CancelRequested bool      `json:"cancel_requested,omitempty"`
+	// Payload is the JSON the job needs to run, such as an asynchronous request's
+	// input. It's only read when the job is claimed.
+	Payload []byte `json:"-"`
+}
+
+// Progress returns the percentage of the job which has been processed.
+func (j *Job) Progress() float64 {
+	if j.Total == 0 {
+		if j.Status == JobStatusCompleted {
+			return 100
+		}
+		return 0
+	}
+	return float64(j.Processed) / float64(j.Total) * 100
+}
+
+// MarshalJSON adds the computed progress percentage to the JSON representation.
+func (j Job) MarshalJSON() ([]byte, error) {
+	type alias Job
+	return json.Marshal(struct {
+		alias
+		Progress float64 `json:"progress"`
+	}{alias(j), j.Progress()})
+}
+
+// ProgressFunc is told how much of a long-running operation is done, out of its
+// total, as it goes. A nil ProgressFunc ignores it.
+type ProgressFunc func(done, total int64)
+
+func (p ProgressFunc) report(done, total int64) {
+	if p != nil {
+		p(done, total)
+	}
+}
+
+// Resumable reports whether the job was stopped before it completed.
+func (j *Job) Resumable() bool {
+	return j.Status == JobStatusCancelled || j.Status == JobStatusFailed
+}
+
+func ValidateJob(v *validator.Validator, job *Job) {
+	_, ok := LookupBackfill(job.Kind)
+	v.Check(job.Kind != "", "kind", "must be provided")
+	v.Check(ok, "kind", "unknown job kind")
+	v.Check(job.BatchSize > 0, "batch_size", "must be greater than zero")
+	v.Check(job.BatchSize <= 10_000, "batch_size", "must be a maximum of 10000")
+	v.Check(job.Priority >= -100 && job.Priority <= 100, "priority", "must be between -100 and 100")
+	v.Check(job.MaxAttempts >= 1, "max_attempts", "must be at least 1")
+	v.Check(job.MaxAttempts <= 10, "max_attempts", "must be a maximum of 10")
+}
+
+type JobModel struct {
+	DB *pgxpool.Pool
+}
+
+const jobColumns = `id, created_at, updated_at, kind, status, processed, total, cursor, batch_size, error,
+	coalesce(user_id, 0), result IS NOT NULL, priority, attempts, max_attempts, run_at, coalesce(locked_by, ''),
+	cancel_requested`
+
+func scanJob(row pgx.Row, extra ...any) (*Job, error) {
+	var job Job
+	dest := append(extra, &job.ID, &job.CreatedAt, &job.UpdatedAt, &job.Kind, &job.Status, &job.Processed,
+		&job.Total, &job.Cursor, &job.BatchSize, &job.Error, &job.UserID, &job.HasResult, &job.Priority,
+		&job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LockedBy, &job.CancelRequested)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Insert adds a job. Queued jobs are run by the next free worker from RunAt, or
+// straight away if it isn't set; a job is only inserted with another status by code
+// which runs it itself.
+func (m JobModel) Insert(job *Job) error {
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = 1
+	}
+	var runAt *time.Time
+	if !job.RunAt.IsZero() {
+		runAt = &job.RunAt
+	}
+	query := `
+		INSERT INTO jobs (kind, status, total, batch_size, user_id, priority, max_attempts, payload, run_at)
+		VALUES ($1, $2, $3, $4, nullif($5, 0), $6, $7, $8, coalesce($9::timestamptz, NOW()))
+		RETURNING id, created_at, updated_at, run_at`
+	args := []any{job.Kind, job.Status, job.Total, job.BatchSize, job.UserID, job.Priority, job.MaxAttempts, job.Payload, runAt}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, args...).Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt, &job.RunAt)
+}
+
+func (m JobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	job, err := scanJob(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// GetAll returns the latest 100 jobs, or only those with the given status if it
+// isn't empty.
+func (m JobModel) GetAll(status string) ([]*Job, error) {
+	query := `
+		SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY id DESC
+		LIMIT 100`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Update saves the progress and status of a job.
+func (m JobModel) Update(job *Job) error {
+	query := `
+		UPDATE jobs
+		SET status = $1, processed = $2, total = $3, cursor = $4, error = $5, updated_at = NOW()
+		WHERE id = $6
+		RETURNING updated_at`
+	args := []any{job.Status, job.Processed, job.Total, job.Cursor, job.Error, job.ID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&job.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Complete marks an asynchronous request's job as completed with result, the JSON
+// response body.
+func (m JobModel) Complete(job *Job, result []byte) error {
+	query := `
+		UPDATE jobs
+		SET status = $1, processed = $2, total = $3, result = $4, error = '', updated_at = NOW()
+		WHERE id = $5
+		RETURNING updated_at`
+	args := []any{JobStatusCompleted, job.Processed, job.Total, result, job.ID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&job.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	job.Status = JobStatusCompleted
+	job.Error = ""
+	job.HasResult = true
+	return nil
+}
+
+// Claim takes the next queued job of one of the given kinds which is due, highest
+// priority first, and marks it as running on worker. Claims made at the same time by
+// other instances skip the rows locked by this one rather than waiting for them. It
+// returns ErrRecordNotFound if there's nothing to run.
+func (m JobModel) Claim(kinds []string, worker string) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, locked_by = $2, updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = 'queued' AND run_at <= NOW() AND kind = ANY($1)
+			ORDER BY priority DESC, run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING payload, ` + jobColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var payload []byte
+	job, err := scanJob(m.DB.QueryRow(ctx, query, kinds, worker), &payload)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	job.Payload = payload
+	return job, nil
+}
+
+// Requeue puts a job back in the queue to run after delay, keeping its progress so
+// a backfill carries on from its cursor. It saves the job's attempts and error, so
+// a retry can be counted or the count reset.
+func (m JobModel) Requeue(job *Job, delay time.Duration) error {
+	query := `
+		UPDATE jobs
+		SET status = 'queued', run_at = NOW() + $1::interval, attempts = $2, error = $3, processed = $4,
+			cursor = $5, locked_by = NULL, cancel_requested = false, updated_at = NOW()
+		WHERE id = $6
+		RETURNING updated_at, run_at`
+	args := []any{delay, job.Attempts, job.Error, job.Processed, job.Cursor, job.ID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&job.UpdatedAt, &job.RunAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	job.Status = JobStatusQueued
+	job.LockedBy = ""
+	job.CancelRequested = false
+	return nil
+}
+
+// Retry puts a cancelled or failed job back in the queue with its attempts reset,
+// as does one left running without a worker by an instance from before the queue.
+// The check and the update are one statement, so two retries can't both queue it. It
+// returns ErrEditConflict if the job is in any other state.
+func (m JobModel) Retry(id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'queued', run_at = NOW(), attempts = 0, error = '', locked_by = NULL,
+			cancel_requested = false, updated_at = NOW()
+		WHERE id = $1 AND (status IN ('cancelled', 'failed') OR (status = 'running' AND locked_by IS NULL))
+		RETURNING ` + jobColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	job, err := scanJob(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// Heartbeat tells the other instances that the jobs with the given ids are still
+// being worked on. It returns those of them whose cancellation has been requested,
+// and those which are lost: no longer running, such as because they were taken to be
+// abandoned and queued again.
+func (m JobModel) Heartbeat(ids []int64) (cancelled, lost []int64, err error) {
+	query := `
+		UPDATE jobs
+		SET updated_at = NOW()
+		WHERE id = ANY($1) AND status = 'running'
+		RETURNING id, cancel_requested`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	running := make(map[int64]bool, len(ids))
+	for rows.Next() {
+		var id int64
+		var cancelRequested bool
+		err := rows.Scan(&id, &cancelRequested)
+		if err != nil {
+			return nil, nil, err
+		}
+		running[id] = true
+		if cancelRequested {
+			cancelled = append(cancelled, id)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		if !running[id] {
+			lost = append(lost, id)
+		}
+	}
+	return cancelled, lost, nil
+}
+
+// RequeueStale returns to the queue the jobs whose workers haven't sent a heartbeat
+// for longer than age, because their instance crashed or lost the database. Jobs
+// out of attempts fail instead, so one which crashes its worker can't go round for
+// ever, and those whose cancellation was requested are cancelled.
+func (m JobModel) RequeueStale(age time.Duration) (int64, error) {
+	query := `
+		UPDATE jobs
+		SET status = CASE
+				WHEN cancel_requested THEN 'cancelled'
+				WHEN attempts >= max_attempts THEN 'failed'
+				ELSE 'queued'
+			END,
+			error = 'abandoned by ' || locked_by, run_at = NOW(), locked_by = NULL, updated_at = NOW()
+		WHERE status = 'running' AND locked_by IS NOT NULL AND updated_at < NOW() - $1::interval`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, age)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// DeleteFinished deletes the completed, cancelled and failed jobs which haven't
+// changed for longer than age, along with their payloads and results. It returns the
+// number deleted.
+func (m JobModel) DeleteFinished(age time.Duration) (int64, error) {
+	query := `
+		DELETE FROM jobs
+		WHERE status IN ('completed', 'cancelled', 'failed') AND updated_at < NOW() - $1::interval`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, age)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// Delete deletes a job, such as one whose payload isn't worth keeping once it has
+// finished.
+func (m JobModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, `DELETE FROM jobs WHERE id = $1`, id)
+	return err
+}
+
+// Cancel cancels a queued job straight away, and asks the worker running a running
+// one to stop, which it notices at its next heartbeat. It returns ErrRecordNotFound
+// if the job is neither.
+func (m JobModel) Cancel(id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = CASE WHEN status = 'queued' THEN 'cancelled' ELSE status END,
+			cancel_requested = status = 'running', updated_at = NOW()
+		WHERE id = $1 AND status IN ('queued', 'running')
+		RETURNING ` + jobColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	job, err := scanJob(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// GetResult returns the result of a completed asynchronous request's job, or
+// ErrRecordNotFound if it hasn't got one.
+func (m JobModel) GetResult(id int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var result []byte
+	err := m.DB.QueryRow(ctx, `SELECT result FROM jobs WHERE id = $1 AND result IS NOT NULL`, id).Scan(&result)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CountBackfill returns the number of rows the backfill will process.
+func (m JobModel) CountBackfill(backfill Backfill) (int64, error) {
+	var total int64
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, backfill.CountQuery).Scan(&total)
+	return total, err
+}
+
+// RunBackfillBatch processes the next batch of rows after cursor. It returns the new
+// cursor and the number of rows processed; a count of zero means the backfill is done.
+func (m JobModel) RunBackfillBatch(ctx context.Context, backfill Backfill, cursor int64, batchSize int) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, backfill.BatchQuery, cursor, batchSize)
+	if err != nil {
+		return cursor, 0, err
+	}
+	defer rows.Close()
+	var processed int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return cursor, 0, err
+		}
+		if id > cursor {
+			cursor = id
+		}
+		processed++
+	}
+	if err = rows.Err(); err != nil {
+		return cursor, 0, err
+	}
+	return cursor, processed, nil
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// ErrAccountFrozen is returned when an account is, or already is, under a legal hold.
+var ErrAccountFrozen = errors.New("account is frozen")
+
+// LegalHold freezes an account for an investigation: the user can't log in or change
+// anything, and nothing of theirs is deleted or anonymized, until it's released.
+// ReleasedAt is nil while the hold is active.
+type LegalHold struct {
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"user_id"`
+	Reason        string     `json:"reason"`
+	PlacedBy      *int64     `json:"placed_by"`
+	PlacedAt      time.Time  `json:"placed_at"`
+	ReleasedBy    *int64     `json:"released_by,omitempty"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+	ReleaseReason string     `json:"release_reason,omitempty"`
+}
+
+// ValidateLegalHoldReason checks the reason given for placing or releasing a hold,
+// which is always needed for the record.
+func ValidateLegalHoldReason(v *validator.Validator, reason string) {
+	v.Check(reason != "", "reason", "must be provided")
+	v.Check(len(reason) <= 1000, "reason", "must not be more than 1000 bytes long")
+}
+
+func isDuplicateLegalHold(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "legal_holds_active_idx"
+}
+
+type LegalHoldModel struct {
+	DB *pgxpool.Pool
+}
+
+// Place puts the user's account under a legal hold. It returns ErrAccountFrozen if
+// it already is, and ErrRecordNotFound if there's no such user.
+func (m LegalHoldModel) Place(hold *LegalHold) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO legal_holds (user_id, reason, placed_by)
+		VALUES ($1, $2, $3)
+		RETURNING id, placed_at`
+	err = tx.QueryRow(ctx, query, hold.UserID, hold.Reason, hold.PlacedBy).Scan(&hold.ID, &hold.PlacedAt)
+	if err != nil {
+		switch {
+		case isDuplicateLegalHold(err):
+			return ErrAccountFrozen
+		default:
+			return err
+		}
+	}
+
+	result, err := tx.Exec(ctx, `UPDATE users SET frozen_at = $2, version = uuid_generate_v4() WHERE id = $1`, hold.UserID, hold.PlacedAt)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return tx.Commit(ctx)
+}
+
+// Release lifts the active legal hold on the user's account and returns it. It
+// returns ErrRecordNotFound if the account isn't under one.
+func (m LegalHoldModel) Release(userID, releasedBy int64, reason string) (*LegalHold, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE legal_holds
+		SET released_by = $2, released_at = NOW(), release_reason = $3
+		WHERE user_id = $1 AND released_at IS NULL
+		RETURNING ` + legalHoldColumns
+	hold, err := scanLegalHold(tx.QueryRow(ctx, query, userID, releasedBy, reason))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET frozen_at = NULL, version = uuid_generate_v4() WHERE id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return hold, tx.Commit(ctx)
+}
+
+const legalHoldColumns = `id, user_id, reason, placed_by, placed_at, released_by, released_at, release_reason`
+
+func scanLegalHold(row pgx.Row) (*LegalHold, error) {
+	var hold LegalHold
+	err := row.Scan(
+		&hold.ID,
+		&hold.UserID,
+		&hold.Reason,
+		&hold.PlacedBy,
+		&hold.PlacedAt,
+		&hold.ReleasedBy,
+		&hold.ReleasedAt,
+		&hold.ReleaseReason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+// GetAll returns legal holds, newest first. userID limits them to a single user's
+// holds, active and released, when it isn't zero; otherwise only active holds are
+// returned.
+func (m LegalHoldModel) GetAll(userID int64) ([]*LegalHold, error) {
+	query := `
+		SELECT ` + legalHoldColumns + `
+		FROM legal_holds
+		WHERE CASE WHEN $1::bigint = 0 THEN released_at IS NULL ELSE user_id = $1 END
+		ORDER BY id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	holds := []*LegalHold{}
+	for rows.Next() {
+		hold, err := scanLegalHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
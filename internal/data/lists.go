@@ -0,0 +1,400 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrDuplicateListItem = errors.New("book is already in the list")
+)
+
+// ReadingList is a user's ordered shelf of books. Archived lists are kept but left out
+// of the user's lists by default. Template lists are published for other users to
+// clone, and CloneCount is how many times that has happened.
+type ReadingList struct {
+	ID          int64       `json:"id"`
+	ExternalID  string      `json:"external_id"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Archived    bool        `json:"archived"`
+	Template    bool        `json:"template"`
+	CloneCount  int         `json:"clone_count"`
+	ClonedFrom  *int64      `json:"cloned_from,omitempty"`
+	Version     int32       `json:"version"`
+	Items       []*ListItem `json:"items,omitempty"`
+}
+
+const readingListColumns = `id, external_id, user_id, name, description, created_at, archived_at IS NOT NULL, is_template, clone_count, cloned_from, version`
+
+func scanReadingList(row pgx.Row, extra ...any) (*ReadingList, error) {
+	var list ReadingList
+	dest := append(extra, &list.ID, &list.ExternalID, &list.UserID, &list.Name, &list.Description, &list.CreatedAt,
+		&list.Archived, &list.Template, &list.CloneCount, &list.ClonedFrom, &list.Version)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ListItem is a book on a reading list. Position is 1-based.
+type ListItem struct {
+	BookID   int64     `json:"book_id"`
+	Title    string    `json:"title"`
+	Slug     string    `json:"slug"`
+	Position int       `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+func ValidateReadingList(v *validator.Validator, list *ReadingList) {
+	v.Check(list.Name != "", "name", "must be provided")
+	v.Check(len(list.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(len(list.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+}
+
+type ReadingListModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m ReadingListModel) Insert(list *ReadingList) error {
+	query := `
+		INSERT INTO reading_lists (user_id, name, description, is_template)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, external_id, created_at, version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, list.UserID, list.Name, list.Description, list.Template).Scan(&list.ID, &list.ExternalID, &list.CreatedAt, &list.Version)
+}
+
+// Get returns the list with its items in order.
+func (m ReadingListModel) Get(id int64) (*ReadingList, error) {
+	query := `
+		SELECT ` + readingListColumns + `
+		FROM reading_lists
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	list, err := scanReadingList(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	list.Items, err = m.getItems(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (m ReadingListModel) getItems(ctx context.Context, listID int64) ([]*ListItem, error) {
+	query := `
+		SELECT books.id, books.title, books.slug, reading_list_items.position, reading_list_items.added_at
+		FROM reading_list_items
+		INNER JOIN books ON books.id = reading_list_items.book_id
+		WHERE reading_list_items.list_id = $1
+		ORDER BY reading_list_items.position`
+	rows, err := m.DB.Query(ctx, query, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*ListItem{}
+	for rows.Next() {
+		var item ListItem
+		err := rows.Scan(&item.BookID, &item.Title, &item.Slug, &item.Position, &item.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetAllForUser returns the user's lists, without their items. Only archived lists are
+// returned if archived is true, and only the others if it's false.
+func (m ReadingListModel) GetAllForUser(userID int64, archived bool) ([]*ReadingList, error) {
+	query := `
+		SELECT ` + readingListColumns + `
+		FROM reading_lists
+		WHERE user_id = $1 AND (archived_at IS NOT NULL) = $2
+		ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, archived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := []*ReadingList{}
+	for rows.Next() {
+		list, err := scanReadingList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// GetTemplates returns the published templates, without their items. Archived lists
+// aren't offered as templates.
+func (m ReadingListModel) GetTemplates(name string, filters Filters) ([]*ReadingList, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+readingListColumns+`
+		FROM reading_lists
+		WHERE is_template AND archived_at IS NULL
+		AND (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, escapeLike(name), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	lists := []*ReadingList{}
+	for rows.Next() {
+		list, err := scanReadingList(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		lists = append(lists, list)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return lists, metadata, nil
+}
+
+// Clone copies the template, with its books in the same order, into a new list owned by
+// the user, and counts the clone against the template. It returns ErrRecordNotFound if
+// the list doesn't exist or isn't a published template.
+func (m ReadingListModel) Clone(templateID, userID int64) (*ReadingList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE reading_lists SET clone_count = clone_count + 1
+		WHERE id = $1 AND is_template AND archived_at IS NULL`
+	result, err := tx.Exec(ctx, query, templateID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	query = `
+		INSERT INTO reading_lists (user_id, name, description, cloned_from)
+		SELECT $2, name, description, id FROM reading_lists WHERE id = $1
+		RETURNING ` + readingListColumns
+	list, err := scanReadingList(tx.QueryRow(ctx, query, templateID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO reading_list_items (list_id, book_id, position)
+		SELECT $2, book_id, row_number() OVER (ORDER BY position, added_at)
+		FROM reading_list_items
+		WHERE list_id = $1`
+	_, err = tx.Exec(ctx, query, templateID, list.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (m ReadingListModel) Update(list *ReadingList) error {
+	query := `
+		UPDATE reading_lists
+		SET name = $1, description = $2, is_template = $3,
+			archived_at = CASE WHEN $4 THEN coalesce(archived_at, NOW()) END,
+			version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []any{list.Name, list.Description, list.Template, list.Archived, list.ID, list.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ReadingListModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM reading_lists WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// AddItem puts the book at the end of the list.
+func (m ReadingListModel) AddItem(listID, bookID int64) error {
+	return m.inOrder(listID, func(ctx context.Context, tx pgx.Tx) error {
+		query := `
+			INSERT INTO reading_list_items (list_id, book_id, position)
+			SELECT $1, $2, coalesce(max(position), 0) + 1
+			FROM reading_list_items
+			WHERE list_id = $1`
+		_, err := tx.Exec(ctx, query, listID, bookID)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDuplicateListItem
+		}
+		return err
+	})
+}
+
+// RemoveItem takes the book off the list and closes the gap it leaves.
+func (m ReadingListModel) RemoveItem(listID, bookID int64) error {
+	return m.inOrder(listID, func(ctx context.Context, tx pgx.Tx) error {
+		var position int
+		query := `DELETE FROM reading_list_items WHERE list_id = $1 AND book_id = $2 RETURNING position`
+		err := tx.QueryRow(ctx, query, listID, bookID).Scan(&position)
+		if err != nil {
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		_, err = tx.Exec(ctx, `UPDATE reading_list_items SET position = position - 1 WHERE list_id = $1 AND position > $2`, listID, position)
+		return err
+	})
+}
+
+// MoveItem moves the book to position, shifting the books in between up or down by one.
+// Positions past the end of the list move the book to the end.
+func (m ReadingListModel) MoveItem(listID, bookID int64, position int) error {
+	return m.inOrder(listID, func(ctx context.Context, tx pgx.Tx) error {
+		var from, count int
+		query := `
+			SELECT position, (SELECT count(*) FROM reading_list_items WHERE list_id = $1)
+			FROM reading_list_items
+			WHERE list_id = $1 AND book_id = $2`
+		err := tx.QueryRow(ctx, query, listID, bookID).Scan(&from, &count)
+		if err != nil {
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		if position > count {
+			position = count
+		}
+		switch {
+		case position < from:
+			_, err = tx.Exec(ctx, `
+				UPDATE reading_list_items SET position = position + 1
+				WHERE list_id = $1 AND position >= $2 AND position < $3`, listID, position, from)
+		case position > from:
+			_, err = tx.Exec(ctx, `
+				UPDATE reading_list_items SET position = position - 1
+				WHERE list_id = $1 AND position > $2 AND position <= $3`, listID, from, position)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE reading_list_items SET position = $3 WHERE list_id = $1 AND book_id = $2`, listID, bookID, position)
+		return err
+	})
+}
+
+// inOrder runs fn in a transaction holding a lock on the list, after renumbering its
+// items 1..n. Positions can have gaps when a book is deleted from the catalog, and this
+// way every change starts from a contiguous order and concurrent reorders of the same
+// list are applied one after the other. The list's version is bumped so clients
+// holding a stale copy notice.
+func (m ReadingListModel) inOrder(listID int64, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `UPDATE reading_lists SET version = version + 1 WHERE id = $1`, listID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE reading_list_items
+		SET position = ordered.position
+		FROM (
+			SELECT book_id, row_number() OVER (ORDER BY position, added_at) AS position
+			FROM reading_list_items
+			WHERE list_id = $1
+		) AS ordered
+		WHERE reading_list_items.list_id = $1 AND reading_list_items.book_id = ordered.book_id
+		AND reading_list_items.position <> ordered.position`
+	_, err = tx.Exec(ctx, query, listID)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
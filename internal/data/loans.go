@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrCopyOnLoan = errors.New("copy is already on loan")
+	ErrNotOnLoan  = errors.New("copy is not on loan")
+	ErrLoanLimit  = errors.New("loan limit reached")
+	// ErrBorrowingBlocked is returned when the member has been blocked from borrowing
+	// because of a long overdue loan.
+	ErrBorrowingBlocked = errors.New("member is blocked from borrowing")
+)
+
+// Loan is a copy lent to a member. ReturnedAt is nil while the copy is still out.
+// DeviceID is set when the copy was checked out at a kiosk. ForgivenAt is set when
+// staff have stopped the loan being escalated.
+type Loan struct {
+	ID           int64        `json:"id"`
+	ExternalID   string       `json:"external_id"`
+	CopyID       int64        `json:"copy_id"`
+	Barcode      string       `json:"barcode,omitempty"`
+	Book         *BookSummary `json:"book,omitempty"`
+	Branch       string       `json:"branch,omitempty"`
+	UserID       int64        `json:"-"`
+	DeviceID     *int64       `json:"-"`
+	CheckedOutAt time.Time    `json:"checked_out_at"`
+	DueAt        time.Time    `json:"due_at"`
+	ReturnedAt   *time.Time   `json:"returned_at"`
+	ForgivenAt   *time.Time   `json:"forgiven_at,omitempty"`
+	ForgiveNote  string       `json:"forgive_note,omitempty"`
+}
+
+type LoanModel struct {
+	DB *pgxpool.Pool
+}
+
+// Checkout lends the copy to the member, as long as they have fewer than maxLoans
+// copies out. It returns ErrCopyOnLoan if the copy hasn't been returned from an
+// earlier loan, ErrLoanLimit if the member can't borrow any more, and
+// ErrBorrowingBlocked if they've been blocked for a long overdue loan.
+func (m LoanModel) Checkout(loan *Loan, maxLoans int32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the member so two kiosks can't both lend them their last allowed copy.
+	_, err = tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, loan.UserID)
+	if err != nil {
+		return err
+	}
+
+	var open int32
+	var blocked bool
+	query := `SELECT count(*), ` + blockedLoanExists + ` FROM loans WHERE user_id = $1 AND returned_at IS NULL`
+	err = tx.QueryRow(ctx, query, loan.UserID).Scan(&open, &blocked)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBorrowingBlocked
+	}
+	if open >= maxLoans {
+		return ErrLoanLimit
+	}
+
+	query = `
+		INSERT INTO loans (copy_id, user_id, device_id, due_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, external_id, checked_out_at`
+	args := []any{loan.CopyID, loan.UserID, loan.DeviceID, loan.DueAt}
+	err = tx.QueryRow(ctx, query, args...).Scan(&loan.ID, &loan.ExternalID, &loan.CheckedOutAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "loans_open_copy_idx":
+			return ErrCopyOnLoan
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Get returns the loan with the copy's barcode and branch and its book.
+func (m LoanModel) Get(id int64) (*Loan, error) {
+	query := `
+		SELECT loans.id, loans.external_id, loans.copy_id, loans.user_id, loans.device_id, loans.checked_out_at, loans.due_at,
+			loans.returned_at, loans.forgiven_at, loans.forgive_note, book_copies.barcode, book_copies.branch, books.id, books.title, books.slug, books.year
+		FROM loans
+		INNER JOIN book_copies ON book_copies.id = loans.copy_id
+		INNER JOIN books ON books.id = book_copies.book_id
+		WHERE loans.id = $1`
+	var loan Loan
+	var book BookSummary
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, id).Scan(&loan.ID, &loan.ExternalID, &loan.CopyID, &loan.UserID, &loan.DeviceID,
+		&loan.CheckedOutAt, &loan.DueAt, &loan.ReturnedAt, &loan.ForgivenAt, &loan.ForgiveNote, &loan.Barcode,
+		&loan.Branch, &book.ID, &book.Title, &book.Slug, &book.Year)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	loan.Book = &book
+	return &loan, nil
+}
+
+// Return records that the copy has come back, and returns the loan it was out on.
+// It returns ErrNotOnLoan if the copy wasn't out.
+func (m LoanModel) Return(copyID int64) (*Loan, error) {
+	query := `
+		UPDATE loans
+		SET returned_at = NOW()
+		WHERE copy_id = $1 AND returned_at IS NULL
+		RETURNING id, external_id, copy_id, user_id, device_id, checked_out_at, due_at, returned_at`
+	var loan Loan
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, copyID).Scan(&loan.ID, &loan.ExternalID, &loan.CopyID, &loan.UserID, &loan.DeviceID,
+		&loan.CheckedOutAt, &loan.DueAt, &loan.ReturnedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrNotOnLoan
+		default:
+			return nil, err
+		}
+	}
+	return &loan, nil
+}
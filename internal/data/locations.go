@@ -0,0 +1,94 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// CallNumberRX matches call numbers in the usual classification schemes, such as
+// "823.914 ROW" or "PR6068.O93 H3".
+var CallNumberRX = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 .:/\-]*$`)
+
+// BranchLocations lists the rooms and shelves copies at a branch can be placed on.
+// Empty lists aren't checked, so a branch can list its shelves without naming its
+// rooms.
+type BranchLocations struct {
+	Name    string   `json:"name"`
+	Rooms   []string `json:"rooms,omitempty"`
+	Shelves []string `json:"shelves,omitempty"`
+}
+
+// LocationTaxonomy is the set of places a copy can be shelved.
+type LocationTaxonomy struct {
+	Branches []BranchLocations `json:"branches"`
+}
+
+// ReadLocationTaxonomy reads a taxonomy in JSON, such as:
+//
+//	{"branches": [{"name": "Main Library", "rooms": ["Reading Room"], "shelves": ["A1", "B4"]}]}
+func ReadLocationTaxonomy(r io.Reader) (*LocationTaxonomy, error) {
+	var taxonomy LocationTaxonomy
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&taxonomy)
+	if err != nil {
+		return nil, fmt.Errorf("location taxonomy: %w", err)
+	}
+	if len(taxonomy.Branches) == 0 {
+		return nil, errors.New("location taxonomy: no branches")
+	}
+	seen := make(map[string]bool)
+	for _, branch := range taxonomy.Branches {
+		if branch.Name == "" || seen[branch.Name] {
+			return nil, fmt.Errorf("location taxonomy: missing or duplicate branch name %q", branch.Name)
+		}
+		seen[branch.Name] = true
+	}
+	return &taxonomy, nil
+}
+
+func (t *LocationTaxonomy) branch(name string) *BranchLocations {
+	for i := range t.Branches {
+		if t.Branches[i].Name == name {
+			return &t.Branches[i]
+		}
+	}
+	return nil
+}
+
+// ValidateLocation checks a copy's location. If taxonomy is nil any branch, room and
+// shelf are accepted.
+func ValidateLocation(v *validator.Validator, c *Copy, taxonomy *LocationTaxonomy) {
+	v.Check(c.Branch != "", "branch", "must be provided")
+	v.Check(len(c.Branch) <= 200, "branch", "must not be more than 200 bytes long")
+	v.Check(len(c.Room) <= 200, "room", "must not be more than 200 bytes long")
+	v.Check(len(c.Shelf) <= 200, "shelf", "must not be more than 200 bytes long")
+	v.Check(len(c.CallNumber) <= 100, "call_number", "must not be more than 100 bytes long")
+	if c.CallNumber != "" {
+		v.Check(validator.Matches(c.CallNumber, CallNumberRX), "call_number", "must only contain letters, digits, spaces and . : / -")
+	}
+
+	if taxonomy == nil || c.Branch == "" {
+		return
+	}
+	branch := taxonomy.branch(c.Branch)
+	if branch == nil {
+		names := make([]string, len(taxonomy.Branches))
+		for i, b := range taxonomy.Branches {
+			names[i] = b.Name
+		}
+		v.AddError("branch", "must be one of: "+strings.Join(names, ", "))
+		return
+	}
+	if c.Room != "" && len(branch.Rooms) > 0 {
+		v.Check(validator.PermittedValue(c.Room, branch.Rooms...), "room", "must be one of: "+strings.Join(branch.Rooms, ", "))
+	}
+	if c.Shelf != "" && len(branch.Shelves) > 0 {
+		v.Check(validator.PermittedValue(c.Shelf, branch.Shelves...), "shelf", "must be one of: "+strings.Join(branch.Shelves, ", "))
+	}
+}
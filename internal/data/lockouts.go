@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// LockoutPolicy controls when repeated failed logins lock an account. After Threshold
+// failures in a row the account is locked for Duration, and each further lockout
+// without a successful login in between doubles that, up to Max.
+type LockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Max       time.Duration
+}
+
+// delay returns how long the lockouts'th lockout (counting from zero) lasts.
+func (p LockoutPolicy) delay(lockouts int) time.Duration {
+	delay := p.Duration
+	for i := 0; i < lockouts && delay < p.Max; i++ {
+		delay *= 2
+	}
+	if delay > p.Max {
+		delay = p.Max
+	}
+	return delay
+}
+
+// LockoutModel tracks failed logins. Failures are counted per user and IP address, so
+// someone guessing passwords from one address can't lock the real user out everywhere.
+type LockoutModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetLockedUntil returns when the lock on the user's logins from ip expires, or the
+// zero time if they aren't locked.
+func (m LockoutModel) GetLockedUntil(userID int64, ip string) (time.Time, error) {
+	query := `
+		SELECT locked_until FROM login_failures
+		WHERE user_id = $1 AND ip = $2 AND locked_until > NOW()`
+	var lockedUntil time.Time
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID, ip).Scan(&lockedUntil)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+// RecordFailure counts a failed login. If it takes the user over the policy's threshold
+// they're locked out, and the time the lock expires is returned. Otherwise the zero time
+// is returned.
+func (m LockoutModel) RecordFailure(userID int64, ip string, policy LockoutPolicy) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO login_failures (user_id, ip, failures)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (user_id, ip) DO UPDATE
+		SET failures = login_failures.failures + 1, updated_at = NOW()
+		RETURNING failures, lockouts`
+	var failures, lockouts int
+	err = tx.QueryRow(ctx, query, userID, ip).Scan(&failures, &lockouts)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var lockedUntil time.Time
+	if failures >= policy.Threshold {
+		query = `
+			UPDATE login_failures
+			SET failures = 0, lockouts = lockouts + 1, locked_until = NOW() + $3::interval
+			WHERE user_id = $1 AND ip = $2
+			RETURNING locked_until`
+		err = tx.QueryRow(ctx, query, userID, ip, policy.delay(lockouts)).Scan(&lockedUntil)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+// Reset forgets the failures for the user and IP after a successful login.
+func (m LockoutModel) Reset(userID int64, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, `DELETE FROM login_failures WHERE user_id = $1 AND ip = $2`, userID, ip)
+	return err
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// LogLevel is the minimum severity every instance logs, set by an admin while the
+// servers are running. It's kept in the database so that each instance picks it up,
+// including ones started after it was set.
+type LogLevel struct {
+	Level     string    `json:"level"`
+	ChangedBy string    `json:"changed_by"`
+	ChangedOn string    `json:"changed_on"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type LogLevelModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the log level set by an admin, or ErrRecordNotFound if it's never been
+// set and each instance logs at its -log-level.
+func (m LogLevelModel) Get() (*LogLevel, error) {
+	query := `SELECT level, changed_by, changed_on, updated_at FROM log_level`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var level LogLevel
+	err := m.DB.QueryRow(ctx, query).Scan(&level.Level, &level.ChangedBy, &level.ChangedOn, &level.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &level, nil
+}
+
+// Set replaces the log level.
+func (m LogLevelModel) Set(level *LogLevel) error {
+	query := `
+		INSERT INTO log_level (level, changed_by, changed_on) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE
+		SET level = EXCLUDED.level, changed_by = EXCLUDED.changed_by, changed_on = EXCLUDED.changed_on, updated_at = NOW()
+		RETURNING updated_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, level.Level, level.ChangedBy, level.ChangedOn).Scan(&level.UpdatedAt)
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// MailQuota caps how many emails are sent by every instance together, so that they
+// stay inside the provider's quotas. Each limit counts the emails sent in a fixed
+// minute or hour, and zero leaves that window unlimited. Bulk mail, such as campaigns
+// and digests, can only use BulkPercent of each limit, which keeps the rest for
+// transactional mail.
+type MailQuota struct {
+	PerMinute   int
+	PerHour     int
+	BulkPercent int
+}
+
+// Enabled reports whether the quota limits anything.
+func (q MailQuota) Enabled() bool {
+	return q.PerMinute > 0 || q.PerHour > 0
+}
+
+type MailQuotaModel struct {
+	DB *pgxpool.Pool
+}
+
+// Take counts another email against the quota if there's room for it in every window,
+// and returns zero. Otherwise it counts nothing and returns how long until the window
+// which is full ends.
+func (m MailQuotaModel) Take(quota MailQuota, bulk bool) (time.Duration, error) {
+	windows := []struct {
+		period string
+		length time.Duration
+		limit  int
+	}{
+		{"minute", time.Minute, quota.PerMinute},
+		{"hour", time.Hour, quota.PerHour},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	var wait time.Duration
+	for _, w := range windows {
+		if w.limit <= 0 {
+			continue
+		}
+		start := now.Truncate(w.length)
+		// The no-op update locks the window's row, so instances taking from it at the
+		// same time wait for each other.
+		query := `
+			INSERT INTO mail_quota (period, window_start) VALUES ($1, $2)
+			ON CONFLICT (period, window_start) DO UPDATE SET sent = mail_quota.sent
+			RETURNING sent, bulk`
+		var sent, bulkSent int
+		err := tx.QueryRow(ctx, query, w.period, start).Scan(&sent, &bulkSent)
+		if err != nil {
+			return 0, err
+		}
+		full := sent >= w.limit || (bulk && bulkSent >= w.limit*quota.BulkPercent/100)
+		if d := start.Add(w.length).Sub(now); full && d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	query := `
+		UPDATE mail_quota
+		SET sent = sent + 1, bulk = bulk + $3
+		WHERE (period = 'minute' AND window_start = $1) OR (period = 'hour' AND window_start = $2)`
+	var b int
+	if bulk {
+		b = 1
+	}
+	_, err = tx.Exec(ctx, query, now.Truncate(time.Minute), now.Truncate(time.Hour), b)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM mail_quota WHERE window_start < $1`, now.Add(-2*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit(ctx)
+}
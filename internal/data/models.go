@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"errors"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"io"
 	"net/http"
 	"time"
 )
@@ -13,38 +15,383 @@ var (
 )
 
 type Models struct {
+	Advisor interface {
+		Advise(ctx context.Context, progress ProgressFunc) (*AdvisorReport, error)
+	}
+
+	Analytics interface {
+		Export(ctx context.Context, dataset AnalyticsDataset, from, to time.Time, key []byte, w io.Writer) (int, error)
+	}
+
+	APIKeys interface {
+		New(userID int64, name string, scopes []string) (*APIKey, error)
+		GetAllForUser(userID int64) ([]*APIKey, error)
+		Use(plaintext string) (*APIKey, error)
+		GetForKey(plaintext string) (*APIKey, error)
+		SetAPIVersion(id int64, apiVersion string) error
+		Delete(id, userID int64) error
+	}
+
 	Book interface {
 		Insert(book *Book, r *http.Request) error
 		Get(id int64, r *http.Request) (*Book, error)
+		GetBySlug(slug string, r *http.Request) (*Book, error)
+		ResolveExternalID(externalID string) (int64, error)
 		Update(book *Book, r *http.Request) error
-		Delete(id int64, r *http.Request) error
-		GetAll(title string, content string, genres []string, filters Filters, r *http.Request) ([]*Book, Metadata, error)
+		Delete(id int64, version string, r *http.Request) error
+		GetAll(title string, search string, genres []string, createdBy int64, branch string, filters Filters, r *http.Request) ([]*Book, Metadata, error)
+		GetPreviousSlugs(ctx context.Context, ids []int64) (map[int64][]string, error)
+		GetSimilar(ctx context.Context, ids []int64, limit int) (map[int64][]*BookSummary, error)
+		GetNewArrivals(ctx context.Context, limit int) ([]*BookSummary, error)
+		GetGenreCounts(ctx context.Context, limit int) ([]GenreCount, error)
+	}
+
+	Bootstrap interface {
+		Run(user *User) (bool, error)
+	}
+
+	Branches interface {
+		Insert(branch *LibraryBranch) error
+		Get(id int64) (*LibraryBranch, error)
+		GetByName(name string) (*LibraryBranch, error)
+		GetAll() ([]*LibraryBranch, error)
+		Update(branch *LibraryBranch) error
+		Delete(id int64) error
+		GetAvailability(ctx context.Context, ids []int64) (map[int64][]*BranchAvailability, error)
+		GetHours(branchID int64) ([]OpeningHours, error)
+		SetHours(branchID int64, hours []OpeningHours) error
+	}
+
+	Campaigns interface {
+		Insert(campaign *Campaign) error
+		Get(id int64) (*Campaign, error)
+		GetAll(due bool) ([]*Campaign, error)
+		Start(campaign *Campaign) error
+		SetStatus(id int64, status string, from ...string) error
+		ClaimRecipients(campaignID int64, limit int) ([]*CampaignRecipient, error)
+		MarkRecipient(campaignID, userID int64, status, errorMessage string) error
+		RecordOpen(token string) error
+		RecordBounces(campaignID int64, emails []string) (int64, error)
+	}
+
+	Cards interface {
+		Set(userID int64, number string) error
+		GetUserID(number string) (int64, error)
+		HasCard(userID int64) (bool, error)
+	}
+
+	Catalog interface {
+		Fingerprint(ctx context.Context, environment string, progress ProgressFunc) (*CatalogFingerprint, error)
+	}
+
+	ClientBans interface {
+		Insert(ban *ClientBan) error
+		GetAll(active bool, filters Filters) ([]*ClientBan, Metadata, error)
+		GetActive() ([]*ClientBan, error)
+		Lift(id, adminID int64) (*ClientBan, error)
+	}
+
+	Copies interface {
+		Insert(c *Copy) error
+		Get(id int64) (*Copy, error)
+		ResolveExternalID(externalID string) (int64, error)
+		GetByBarcode(barcode string) (*Copy, error)
+		GetForBooks(ctx context.Context, ids []int64) (map[int64][]*Copy, error)
+		Find(lookup CopyLookup, filters Filters) ([]*Copy, Metadata, error)
+		Update(c *Copy) error
+		Delete(id int64) error
+	}
+
+	DeadLetters interface {
+		Insert(letter *DeadLetter) error
+		Get(id int64) (*DeadLetter, error)
+		GetAll(pending bool, filters Filters) ([]*DeadLetter, Metadata, error)
+		Claim(id int64) (*DeadLetter, error)
+		Release(id int64) error
+	}
+
+	Devices interface {
+		New(device *Device) error
+		GetAll() ([]*Device, error)
+		Use(plaintext string) (*Device, error)
+		GetForKey(plaintext string) (*Device, error)
+		Heartbeat(device *Device) error
+		Delete(id int64) error
+	}
+
+	Digests interface {
+		GetPreferences(userID int64) (*NotificationPreferences, error)
+		UpdatePreferences(userID int64, prefs *NotificationPreferences) error
+		GetDue(limit int) ([]*DigestRecipient, error)
+		GetNewBooks(userID int64, since time.Time, limit int) ([]*BookSummary, error)
+		GetProgress(userID int64, since time.Time) (*DigestProgress, error)
+		MarkSent(userID int64, at time.Time) error
+		Unsubscribe(userID int64) error
+	}
+
+	Escalations interface {
+		GetDue(step EscalationStep, next *EscalationStep, limit int) ([]*EscalationNotice, error)
+		Claim(loanID int64, step string, amount int64) (bool, error)
+		MarkNotified(loanID int64, step string) error
+		GetForLoan(loanID int64) ([]*Escalation, error)
+		IsBlocked(userID int64) (bool, error)
+		Reschedule(loan *Loan, dueAt time.Time, steps []EscalationStep) error
+		Forgive(loan *Loan, staffID int64, note string) error
+	}
+
+	IDGeneration interface {
+		Get() (string, int, error)
+		Set(strategy string, nodeID int) error
+	}
+
+	Identities interface {
+		GetUserID(provider, subject string) (int64, error)
+		Link(userID int64, provider, subject string) error
+		GetAllForUser(userID int64) (*LoginMethods, error)
+		Move(userID int64, provider, subject string) (int64, error)
+		Unlink(userID int64, provider string) error
+		EnablePassword(user *User) error
+		DisablePassword(userID int64) error
+	}
+
+	Integrity interface {
+		Check(ctx context.Context, repair bool, progress ProgressFunc) (*IntegrityReport, error)
+	}
+
+	InterlibraryLoans interface {
+		Insert(loan *InterlibraryLoan) error
+		Get(id int64) (*InterlibraryLoan, error)
+		GetAll(userID int64, status string, filters Filters) ([]*InterlibraryLoan, Metadata, error)
+		Update(loan *InterlibraryLoan) error
+	}
+
+	Jobs interface {
+		Insert(job *Job) error
+		Get(id int64) (*Job, error)
+		GetAll(status string) ([]*Job, error)
+		Update(job *Job) error
+		Complete(job *Job, result []byte) error
+		Claim(kinds []string, worker string) (*Job, error)
+		Requeue(job *Job, delay time.Duration) error
+		Retry(id int64) (*Job, error)
+		Heartbeat(ids []int64) (cancelled, lost []int64, err error)
+		RequeueStale(age time.Duration) (int64, error)
+		DeleteFinished(age time.Duration) (int64, error)
+		Delete(id int64) error
+		Cancel(id int64) (*Job, error)
+		GetResult(id int64) ([]byte, error)
+		CountBackfill(backfill Backfill) (int64, error)
+		RunBackfillBatch(ctx context.Context, backfill Backfill, cursor int64, batchSize int) (int64, int64, error)
+	}
+
+	LegalHolds interface {
+		Place(hold *LegalHold) error
+		Release(userID, releasedBy int64, reason string) (*LegalHold, error)
+		GetAll(userID int64) ([]*LegalHold, error)
+	}
+
+	Loans interface {
+		Checkout(loan *Loan, maxLoans int32) error
+		Get(id int64) (*Loan, error)
+		ResolveExternalID(externalID string) (int64, error)
+		Return(copyID int64) (*Loan, error)
+	}
+
+	Lockouts interface {
+		GetLockedUntil(userID int64, ip string) (time.Time, error)
+		RecordFailure(userID int64, ip string, policy LockoutPolicy) (time.Time, error)
+		Reset(userID int64, ip string) error
+	}
+
+	LogLevel interface {
+		Get() (*LogLevel, error)
+		Set(level *LogLevel) error
+	}
+
+	MailQuota interface {
+		Take(quota MailQuota, bulk bool) (time.Duration, error)
 	}
 
 	Permissions interface {
-		AddForUser(userID int64, codes ...string) error
 		GetAllForUser(userID int64) (Permissions, error)
+		GetAll() (Permissions, error)
+		GetGrantedForUser(userID int64) (Permissions, error)
+		AddForUser(userID int64, codes ...string) error
+		RemoveForUser(userID int64, codes ...string) error
+		GetUsers(code string, filters Filters) ([]*User, Metadata, error)
+	}
+
+	Passkeys interface {
+		NewChallenge(challenge []byte, ceremony string, userID int64, ttl time.Duration) error
+		UseChallenge(challenge []byte, ceremony string) (int64, error)
+		Insert(passkey *Passkey) error
+		GetAllForUser(userID int64) ([]*Passkey, error)
+		GetByCredentialID(credentialID []byte) (*Passkey, error)
+		RecordUse(id, signCount int64) error
+		Delete(id, userID int64) error
+	}
+
+	Pickups interface {
+		Book(pickup *Pickup) error
+		CountBooked(branchID int64, from, to time.Time) (map[int64]int, error)
+		GetUpcomingForUser(userID int64) ([]*Pickup, error)
+		Delete(id, userID int64) error
+	}
+
+	Preferences interface {
+		Get(userID int64) (*Preferences, error)
+		Update(userID int64, prefs *Preferences) error
+	}
+
+	ReadingLists interface {
+		Insert(list *ReadingList) error
+		Get(id int64) (*ReadingList, error)
+		ResolveExternalID(externalID string) (int64, error)
+		GetAllForUser(userID int64, archived bool) ([]*ReadingList, error)
+		GetTemplates(name string, filters Filters) ([]*ReadingList, Metadata, error)
+		Clone(templateID, userID int64) (*ReadingList, error)
+		Update(list *ReadingList) error
+		Delete(id int64) error
+		AddItem(listID, bookID int64) error
+		RemoveItem(listID, bookID int64) error
+		MoveItem(listID, bookID int64, position int) error
+	}
+
+	ReadingSessions interface {
+		Start(userID, bookID int64, timeout time.Duration) (*ReadingSession, bool, error)
+		Stop(id, userID int64, timeout time.Duration) (*ReadingSession, error)
+		ResolveExternalID(externalID string) (int64, error)
+		CloseForgotten(timeout time.Duration) (int64, error)
+		GetMinutesPerDay(userID int64, days int, timezone string) ([]DailyReading, error)
+		GetStreak(userID int64, timezone string) (*Streak, error)
+	}
+
+	Retention interface {
+		Run(ctx context.Context, policy RetentionPolicy, dryRun bool, progress ProgressFunc) (*RetentionReport, error)
+	}
+
+	Roles interface {
+		GetAll() ([]*Role, error)
+		GetAllForUser(userID int64) ([]string, error)
+		AddForUser(userID int64, names ...string) error
+		RemoveForUser(userID int64, name string) error
+	}
+
+	Schema interface {
+		Version() (int64, bool, error)
+	}
+
+	Searches interface {
+		Record(userID int64, search string, results int) error
+	}
+
+	SecurityEvents interface {
+		Insert(event *SecurityEvent) error
+		GetAll(userID int64, event, outcome string, filters Filters) ([]*SecurityEvent, Metadata, error)
+		LoginHistory(userID, beforeID int64, ip, country, userAgent string) (*LoginHistory, error)
+		CountUsersFromIP(ip string, since time.Time) (int, error)
+	}
+
+	Suggestions interface {
+		InCatalog(title string) (bool, error)
+		Insert(suggestion *Suggestion) error
+		Get(id int64) (*Suggestion, error)
+		GetAll(userID int64, status string, filters Filters) ([]*Suggestion, Metadata, error)
+		Update(suggestion *Suggestion) error
+		Delete(id, userID int64) error
 	}
 
 	Tokens interface {
 		New(userID int64, ttl time.Duration, scope string) (*Token, error)
+		Replace(userID int64, ttl time.Duration, scope string) (*Token, error)
+		NewForClient(userID int64, ttl time.Duration, scope, userAgent, ip string, scopes []string) (*Token, error)
+		NewImpersonation(userID, impersonatorID int64, ttl time.Duration, userAgent, ip string) (*Token, error)
+		NewSessionRevoke(session *Token) (*Token, error)
+		RevokeSession(plaintext string) (int64, error)
 		Insert(token *Token) error
+		GetAllForUser(userID int64, currentPlaintext string) ([]*TokenInfo, error)
+		Delete(id, userID int64) error
 		DeleteAllForUser(scope string, userID int64) error
+		DeleteEveryForUser(userID int64) (int64, error)
+		DeleteOthersForUser(scope string, userID int64, keepPlaintext string) (int64, error)
+		DeleteIdle(scope string, idle time.Duration) (int64, error)
+		RecordUsage(uses []TokenUse) error
+		Introspect(plaintext string, idle time.Duration) (*TokenIntrospection, error)
+		DeleteExpired() (int64, error)
+	}
+
+	TwoFactor interface {
+		Get(userID int64) (*TwoFactor, error)
+		Enroll(userID int64, secret []byte, recoveryHashes [][]byte) error
+		Enable(userID int64) error
+		UseStep(userID, step int64) (bool, error)
+		UseRecoveryCode(userID int64, code string) (bool, error)
+		Delete(userID int64) error
 	}
 
 	Users interface {
 		Insert(user *User, r *http.Request) error
 		GetByEmail(email string, r *http.Request) (*User, error)
+		Get(id int64, r *http.Request) (*User, error)
+		ResolveExternalID(externalID string) (int64, error)
+		GetAll(email string, activated *bool, inactiveSince *time.Time, filters Filters, r *http.Request) ([]*User, Metadata, error)
+		Search(q string, activated *bool, inactiveSince *time.Time, filters Filters, r *http.Request) ([]*User, Metadata, error)
 		Update(user *User, r *http.Request) error
 		GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+		Activate(tokenPlaintext string) (*User, error)
+		RehashPassword(user *User, plaintextPassword string) error
+		RecordLogin(userID int64) error
+		RecordSeen(userID int64) error
+		SetAPIVersion(userID int64, apiVersion string) error
+		RevokeJWTs(userID int64) (int32, error)
+		ClaimActivationResend(userID int64, interval time.Duration) (time.Time, error)
+		Delete(userID int64, r *http.Request) error
 	}
 }
 
-func NewModels(db *pgxpool.Pool) Models {
+// NewModels returns the models backed by db. replica is an optional read replica, and
+// can be nil.
+func NewModels(db, replica *pgxpool.Pool) Models {
 	return Models{
-		Book:        BookModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Advisor:           AdvisorModel{DB: db},
+		Analytics:         AnalyticsModel{DB: db},
+		APIKeys:           APIKeyModel{DB: db},
+		Book:              BookModel{DB: db, Replica: replica},
+		Bootstrap:         BootstrapModel{DB: db},
+		Branches:          BranchModel{DB: db},
+		Campaigns:         CampaignModel{DB: db},
+		Cards:             CardModel{DB: db},
+		Catalog:           CatalogModel{DB: db},
+		ClientBans:        ClientBanModel{DB: db},
+		Copies:            CopyModel{DB: db},
+		DeadLetters:       DeadLetterModel{DB: db},
+		Devices:           DeviceModel{DB: db},
+		Digests:           DigestModel{DB: db},
+		Escalations:       EscalationModel{DB: db},
+		IDGeneration:      IDGenerationModel{DB: db},
+		Identities:        IdentityModel{DB: db},
+		Integrity:         IntegrityModel{DB: db},
+		InterlibraryLoans: InterlibraryLoanModel{DB: db},
+		Jobs:              JobModel{DB: db},
+		LegalHolds:        LegalHoldModel{DB: db},
+		Loans:             LoanModel{DB: db},
+		Lockouts:          LockoutModel{DB: db},
+		LogLevel:          LogLevelModel{DB: db},
+		MailQuota:         MailQuotaModel{DB: db},
+		Passkeys:          PasskeyModel{DB: db},
+		Permissions:       PermissionModel{DB: db},
+		Pickups:           PickupModel{DB: db},
+		Preferences:       PreferenceModel{DB: db},
+		ReadingLists:      ReadingListModel{DB: db},
+		ReadingSessions:   ReadingSessionModel{DB: db},
+		Retention:         RetentionModel{DB: db},
+		Roles:             RoleModel{DB: db},
+		Schema:            SchemaModel{DB: db},
+		Searches:          SearchModel{DB: db},
+		SecurityEvents:    SecurityEventModel{DB: db},
+		Suggestions:       SuggestionModel{DB: db},
+		Tokens:            TokenModel{DB: db},
+		TwoFactor:         TwoFactorModel{DB: db},
+		Users:             UserModel{DB: db},
 	}
 }
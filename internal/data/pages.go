@@ -18,7 +18,16 @@ func (r Pages) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJSONValue), nil
 }
 
+// UnmarshalJSON accepts both the "<count> pages" string form and a bare integer.
 func (r *Pages) UnmarshalJSON(jsonValue []byte) error {
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+		i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+		if err != nil {
+			return ErrInvalidPageFormat
+		}
+		*r = Pages(i)
+		return nil
+	}
 
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
@@ -0,0 +1,225 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// The ceremonies passkey challenges are issued for.
+const (
+	CeremonyRegister = "register"
+	CeremonyLogin    = "login"
+)
+
+// ErrDuplicatePasskey is returned when a passkey has already been registered.
+var ErrDuplicatePasskey = errors.New("duplicate passkey")
+
+// PasskeyTransports are the ways browsers can reach an authenticator, which they
+// report at registration so that logins can offer the right ones.
+var PasskeyTransports = []string{"ble", "hybrid", "internal", "nfc", "smart-card", "usb"}
+
+// Passkey is a WebAuthn credential a user can log in with instead of a password.
+type Passkey struct {
+	ID           int64      `json:"id"`
+	UserID       int64      `json:"-"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    int64      `json:"-"`
+	Name         string     `json:"name"`
+	Transports   []string   `json:"transports"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+func ValidatePasskey(v *validator.Validator, passkey *Passkey) {
+	v.Check(len(passkey.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Unique(passkey.Transports), "transports", "must not contain duplicate values")
+	for _, transport := range passkey.Transports {
+		v.Check(validator.PermittedValue(transport, PasskeyTransports...), "transports", "must only contain known transports")
+	}
+}
+
+func isDuplicatePasskey(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "webauthn_credentials_credential_id_key"
+}
+
+type PasskeyModel struct {
+	DB *pgxpool.Pool
+}
+
+// NewChallenge stores a challenge for the ceremony, for the user if it's a
+// registration, which can be answered once within ttl. Only its hash is stored.
+// Expired challenges are cleared out at the same time.
+func (m PasskeyModel) NewChallenge(challenge []byte, ceremony string, userID int64, ttl time.Duration) error {
+	hash := sha256.Sum256(challenge)
+	query := `
+		WITH expired AS (DELETE FROM webauthn_challenges WHERE expiry < NOW())
+		INSERT INTO webauthn_challenges (hash, ceremony, user_id, expiry)
+		VALUES ($1, $2, nullif($3, 0), $4)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, hash[:], ceremony, userID, time.Now().Add(ttl))
+	return err
+}
+
+// UseChallenge uses up a challenge issued for the ceremony and returns the user it
+// was issued for, which is 0 for logins. It returns ErrRecordNotFound if there's no
+// such challenge, or it has expired or been used already.
+func (m PasskeyModel) UseChallenge(challenge []byte, ceremony string) (int64, error) {
+	hash := sha256.Sum256(challenge)
+	query := `
+		DELETE FROM webauthn_challenges
+		WHERE hash = $1 AND ceremony = $2 AND expiry > NOW()
+		RETURNING coalesce(user_id, 0)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var userID int64
+	err := m.DB.QueryRow(ctx, query, hash[:], ceremony).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
+// Insert stores a newly registered passkey.
+func (m PasskeyModel) Insert(passkey *Passkey) error {
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name, transports)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+	args := []any{passkey.UserID, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Name, passkey.Transports}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&passkey.ID, &passkey.CreatedAt)
+	if isDuplicatePasskey(err) {
+		return ErrDuplicatePasskey
+	}
+	return err
+}
+
+const passkeyColumns = `id, user_id, credential_id, public_key, sign_count, name, transports, created_at, last_used_at`
+
+func scanPasskey(row pgx.Row) (*Passkey, error) {
+	var passkey Passkey
+	err := row.Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&passkey.SignCount,
+		&passkey.Name,
+		&passkey.Transports,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+// GetAllForUser returns the user's passkeys, oldest first.
+func (m PasskeyModel) GetAllForUser(userID int64) ([]*Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM webauthn_credentials WHERE user_id = $1 ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+// GetByCredentialID returns the passkey with the credential ID the authenticator
+// gave it, or ErrRecordNotFound.
+func (m PasskeyModel) GetByCredentialID(credentialID []byte) (*Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM webauthn_credentials WHERE credential_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	passkey, err := scanPasskey(m.DB.QueryRow(ctx, query, credentialID))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return passkey, nil
+}
+
+// RecordUse saves the signature counter the passkey logged in with. A login with
+// the same passkey which has since saved a higher counter returns ErrEditConflict,
+// as one of the two must have come from a copy of it.
+func (m PasskeyModel) RecordUse(id, signCount int64) error {
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $2, last_used_at = NOW()
+		WHERE id = $1 AND ($2 = 0 OR sign_count < $2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, id, signCount)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Delete removes one of the user's passkeys, as long as they're left with another
+// way to log in. Otherwise it returns ErrLastLoginMethod. It returns
+// ErrRecordNotFound if the user has no such passkey.
+func (m PasskeyModel) Delete(id, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	password, others, err := lockLoginMethods(ctx, tx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	// others counted the passkey being deleted.
+	if !password && others <= 1 {
+		return ErrLastLoginMethod
+	}
+	return tx.Commit(ctx)
+}
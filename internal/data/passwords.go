@@ -0,0 +1,146 @@
+package data
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// MinPasswordEntropy is the estimated strength, in bits, a new password needs. Eight
+// random lower case letters are just above it.
+const MinPasswordEntropy = 36
+
+//go:embed "common_passwords.txt"
+var defaultCommonPasswords string
+
+// commonPasswords is the deny-list of leaked and common passwords, in the normalized
+// form produced by normalizePassword(). It's filled in at startup and only read after
+// that, so it doesn't need a lock.
+var commonPasswords = make(map[string]bool)
+
+func init() {
+	_, err := LoadCommonPasswords(strings.NewReader(defaultCommonPasswords))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// LoadCommonPasswords adds the passwords read from r, one per line, to the deny-list.
+// Blank lines and lines starting with # are skipped. It returns the number of
+// passwords read, and must only be called during startup.
+func LoadCommonPasswords(r io.Reader) (int, error) {
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commonPasswords[normalizePassword(line)] = true
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// leetReplacer undoes the letter substitutions people use to dress up a common
+// password.
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i",
+)
+
+// normalizePassword lower cases the password and undoes letter substitutions, so that
+// "P@ssw0rd" and "password" are the same entry.
+func normalizePassword(password string) string {
+	return leetReplacer.Replace(strings.ToLower(password))
+}
+
+// IsCommonPassword reports whether the password, or the password with the digits and
+// symbols people tack on the end removed ("summer2024!"), is on the deny-list.
+func IsCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] || commonPasswords[normalizePassword(lower)] {
+		return true
+	}
+	base := strings.TrimRightFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(base) >= 4 && base != lower {
+		return commonPasswords[base] || commonPasswords[normalizePassword(base)]
+	}
+	return false
+}
+
+// PasswordEntropy estimates the strength of the password in bits, in the spirit of
+// zxcvbn but much simpler. Each character is worth log2 of the size of the alphabet it
+// draws from, except characters which repeat or continue a sequence ("aaa", "abc",
+// "321") from the one before, which are only worth one bit.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := math.Log2(float64(pool))
+	var entropy float64
+	var prev rune = -1
+	for _, r := range password {
+		d := unicode.ToLower(r) - unicode.ToLower(prev)
+		if prev != -1 && (d >= -1 && d <= 1) {
+			entropy++
+		} else {
+			entropy += bits
+		}
+		prev = r
+	}
+	return entropy
+}
+
+// passwordContains reports whether the password contains the user's name, any word of
+// it, or the local part of their email address. Parts shorter than four letters are
+// ignored, as they'd turn away too many good passwords.
+func passwordContains(password, name, email string) bool {
+	password = strings.ToLower(password)
+	local, _, _ := strings.Cut(email, "@")
+	parts := append(strings.Fields(name), name, local)
+	for _, part := range parts {
+		part = strings.ToLower(part)
+		if len(part) >= 4 && strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,28 @@ package data
 
 import (
 	"context"
+	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
 	"time"
 )
 
 type Permissions []string
 
-// Add a helper method to check whether the Permissions slice contains a specific
-// permission code.
+// Add a helper method to check whether the Permissions slice grants a specific
+// permission code, either by containing it or through a wildcard such as books:*.
 func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if matchPermission(p[i], code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the slice contains code itself, without resolving
+// wildcards.
+func (p Permissions) Contains(code string) bool {
 	for i := range p {
 		if code == p[i] {
 			return true
@@ -19,30 +32,99 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// Covers reports whether every permission in other is granted by p, either directly
+// or through a wildcard.
+func (p Permissions) Covers(other Permissions) bool {
+	for _, code := range other {
+		if !p.Include(code) {
+			return false
+		}
+	}
+	return true
+}
+
+// Restrict returns the permissions which are also granted by scopes. A wildcard
+// on either side is narrowed to the other, so books:* restricted to books:read is
+// books:read.
+func (p Permissions) Restrict(scopes []string) Permissions {
+	var restricted Permissions
+	for _, code := range p {
+		if Permissions(scopes).Include(code) {
+			restricted = append(restricted, code)
+		}
+	}
+	for _, scope := range scopes {
+		if p.Include(scope) && !restricted.Contains(scope) {
+			restricted = append(restricted, scope)
+		}
+	}
+	return restricted
+}
+
+// matchPermission reports whether the granted permission covers code. A code
+// ending in :* covers its prefix and everything under it, so admin:* covers admin
+// and books:* covers books:read.
+func matchPermission(granted, code string) bool {
+	if granted == code {
+		return true
+	}
+	if !strings.HasSuffix(granted, ":*") {
+		return false
+	}
+	prefix := strings.TrimSuffix(granted, "*")
+	return code == strings.TrimSuffix(prefix, ":") || strings.HasPrefix(code, prefix)
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
 	DB *pgxpool.Pool
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
+// Permissions slice. Most permissions are granted by the roles the user has, so the
+// codes are resolved through users_roles and roles_permissions, but admins can also
+// grant a permission to a user directly.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 SELECT permissions.code
 FROM permissions
+INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+WHERE users_roles.user_id = $1
+UNION
+SELECT permissions.code
+FROM permissions
+INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+WHERE users_permissions.user_id = $1`
+	return m.queryCodes(query, userID)
+}
+
+// GetAll returns every permission code, in alphabetical order.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	return m.queryCodes(`SELECT DISTINCT code FROM permissions ORDER BY code`)
+}
+
+// GetGrantedForUser returns the permissions granted to the user directly, leaving
+// out those which only come from their roles.
+func (m PermissionModel) GetGrantedForUser(userID int64) (Permissions, error) {
+	query := `
+SELECT permissions.code
+FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-INNER JOIN users ON users_permissions.user_id = users.id
-WHERE users.id = $1`
+WHERE users_permissions.user_id = $1
+ORDER BY permissions.code`
+	return m.queryCodes(query, userID)
+}
+
+func (m PermissionModel) queryCodes(query string, args ...any) (Permissions, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	rows, err := m.DB.Query(ctx, query, userID)
+	rows, err := m.DB.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -57,12 +139,105 @@ WHERE users.id = $1`
 	return permissions, nil
 }
 
+// AddForUser grants permissions to a user directly. Permissions the user has
+// already been granted are left alone.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 INSERT INTO users_permissions
-SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.Exec(ctx, query, userID, codes)
 	return err
 }
+
+// RemoveForUser revokes permissions granted to a user directly. It returns
+// ErrRecordNotFound if none of them had been granted. Permissions which come from the
+// user's roles can only be taken away by removing the role.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+DELETE FROM users_permissions
+USING permissions
+WHERE users_permissions.permission_id = permissions.id AND users_permissions.user_id = $1
+AND permissions.code = ANY($2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, userID, codes)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// matchesPermission is matchPermission in SQL, matching the permissions which cover
+// the code in $1.
+const matchesPermission = `(permissions.code = $1 OR (permissions.code LIKE '%:*' AND
+		($1 = left(permissions.code, -2) OR starts_with($1, left(permissions.code, -1)))))`
+
+// GetUsers returns the users holding the permission, through a role or a direct
+// grant, including those granted it by a wildcard.
+func (m PermissionModel) GetUsers(code string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, email, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version
+FROM users
+WHERE id IN (
+	SELECT users_roles.user_id
+	FROM users_roles
+	INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+	INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+	WHERE %[3]s
+	UNION
+	SELECT users_permissions.user_id
+	FROM users_permissions
+	INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+	WHERE %[3]s
+)
+ORDER BY %[1]s %[2]s, id ASC
+LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection(), matchesPermission)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, code, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.APIVersion,
+			&user.PendingEmail,
+			&user.DisplayName,
+			&user.Bio,
+			&user.AvatarURL,
+			&user.ProfilePublic,
+			&user.Timezone,
+			&user.LastLoginAt,
+			&user.LastSeenAt,
+			&user.FrozenAt,
+			&user.ExternalID,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
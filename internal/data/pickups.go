@@ -0,0 +1,277 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrSlotFull        = errors.New("pickup slot is full")
+	ErrDuplicatePickup = errors.New("duplicate pickup")
+)
+
+// ClockRX matches times of day in 24 hour HH:MM form.
+var ClockRX = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// OpeningHours are a branch's hours on one day of the week. Weekday counts from Sunday
+// as 0, like time.Weekday, and Opens and Closes are HH:MM in the branch's timezone.
+type OpeningHours struct {
+	Weekday int    `json:"weekday"`
+	Opens   string `json:"opens"`
+	Closes  string `json:"closes"`
+}
+
+// minutes returns the number of minutes after midnight of an HH:MM time.
+func minutes(clock string) int {
+	var h, m int
+	fmt.Sscanf(clock, "%d:%d", &h, &m)
+	return h*60 + m
+}
+
+func ValidateOpeningHours(v *validator.Validator, hours []OpeningHours) {
+	seen := make(map[int]bool)
+	for _, h := range hours {
+		v.Check(h.Weekday >= 0 && h.Weekday <= 6, "hours", "weekday must be between 0 (Sunday) and 6 (Saturday)")
+		v.Check(!seen[h.Weekday], "hours", "must not list a weekday more than once")
+		seen[h.Weekday] = true
+		if !validator.Matches(h.Opens, ClockRX) || !validator.Matches(h.Closes, ClockRX) {
+			v.AddError("hours", "opens and closes must be times in the format HH:MM")
+			continue
+		}
+		v.Check(minutes(h.Opens) < minutes(h.Closes), "hours", "a branch must close after it opens")
+	}
+}
+
+// PickupSlot is a period members can book to collect items from a branch. Remaining is
+// how many more pickups can be booked in it.
+type PickupSlot struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Remaining int       `json:"remaining"`
+}
+
+// PickupSlots returns the start of each of the branch's pickup slots on the given date,
+// in the branch's timezone. The slots fill the opening hours for that day, leaving out
+// a final slot which would run past closing time.
+func PickupSlots(branch *LibraryBranch, hours []OpeningHours, year int, month time.Month, day int) ([]time.Time, error) {
+	loc, err := time.LoadLocation(branch.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if branch.PickupSlotMinutes <= 0 {
+		return nil, nil
+	}
+
+	weekday := int(time.Date(year, month, day, 0, 0, 0, 0, loc).Weekday())
+	var slots []time.Time
+	for _, h := range hours {
+		if h.Weekday != weekday {
+			continue
+		}
+		closes := minutes(h.Closes)
+		for m := minutes(h.Opens); m+int(branch.PickupSlotMinutes) <= closes; m += int(branch.PickupSlotMinutes) {
+			slots = append(slots, time.Date(year, month, day, 0, m, 0, 0, loc))
+		}
+	}
+	return slots, nil
+}
+
+// Pickup is a member's booking of a slot to collect items from a branch.
+type Pickup struct {
+	ID         int64     `json:"id"`
+	BranchID   int64     `json:"branch_id"`
+	BranchName string    `json:"branch"`
+	UserID     int64     `json:"-"`
+	Slot       time.Time `json:"slot"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type PickupModel struct {
+	DB *pgxpool.Pool
+}
+
+// Book saves the pickup, as long as fewer pickups are booked in the slot already than
+// the branch's capacity. Otherwise it returns ErrSlotFull. The branch is locked while
+// its capacity is read and the slot counted, so that two members can't take the last
+// place at once and a capacity lowered meanwhile is respected. It returns
+// ErrRecordNotFound if the branch has gone.
+func (m PickupModel) Book(pickup *Pickup) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var capacity int32
+	err = tx.QueryRow(ctx, `SELECT pickup_capacity FROM branches WHERE id = $1 FOR UPDATE`, pickup.BranchID).Scan(&capacity)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	var booked int32
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM pickups WHERE branch_id = $1 AND slot = $2`, pickup.BranchID, pickup.Slot).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked >= capacity {
+		return ErrSlotFull
+	}
+
+	query := `
+		INSERT INTO pickups (branch_id, user_id, slot)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, pickup.BranchID, pickup.UserID, pickup.Slot).Scan(&pickup.ID, &pickup.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDuplicatePickup
+		}
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// CountBooked returns the number of pickups booked in each slot at the branch between
+// from and to, keyed by the slot's Unix time.
+func (m PickupModel) CountBooked(branchID int64, from, to time.Time) (map[int64]int, error) {
+	query := `
+		SELECT slot, count(*)
+		FROM pickups
+		WHERE branch_id = $1 AND slot >= $2 AND slot < $3
+		GROUP BY slot`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, branchID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var slot time.Time
+		var count int
+		err := rows.Scan(&slot, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[slot.Unix()] = count
+	}
+	return counts, rows.Err()
+}
+
+// GetUpcomingForUser returns the user's pickups which haven't happened yet, soonest
+// first.
+func (m PickupModel) GetUpcomingForUser(userID int64) ([]*Pickup, error) {
+	query := `
+		SELECT pickups.id, pickups.branch_id, branches.name, pickups.user_id, pickups.slot, pickups.created_at
+		FROM pickups
+		INNER JOIN branches ON branches.id = pickups.branch_id
+		WHERE pickups.user_id = $1 AND pickups.slot >= NOW()
+		ORDER BY pickups.slot, pickups.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pickups := []*Pickup{}
+	for rows.Next() {
+		var p Pickup
+		err := rows.Scan(&p.ID, &p.BranchID, &p.BranchName, &p.UserID, &p.Slot, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		pickups = append(pickups, &p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return pickups, nil
+}
+
+// Delete cancels one of the user's pickups.
+func (m PickupModel) Delete(id, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM pickups WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetHours returns the branch's opening hours, from Sunday to Saturday. Days the
+// branch is closed are left out.
+func (m BranchModel) GetHours(branchID int64) ([]OpeningHours, error) {
+	query := `
+		SELECT weekday, to_char(opens, 'HH24:MI'), to_char(closes, 'HH24:MI')
+		FROM branch_hours
+		WHERE branch_id = $1
+		ORDER BY weekday`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, branchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hours := []OpeningHours{}
+	for rows.Next() {
+		var h OpeningHours
+		err := rows.Scan(&h.Weekday, &h.Opens, &h.Closes)
+		if err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hours, nil
+}
+
+// SetHours replaces the branch's opening hours.
+func (m BranchModel) SetHours(branchID int64, hours []OpeningHours) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM branch_hours WHERE branch_id = $1`, branchID)
+	if err != nil {
+		return err
+	}
+	for _, h := range hours {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO branch_hours (branch_id, weekday, opens, closes)
+			VALUES ($1, $2, $3::time, $4::time)`, branchID, h.Weekday, h.Opens, h.Closes)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// The kinds of email a user can opt out of. Emails about the account itself, such as
+// activation, email changes and lockouts, are always sent.
+const (
+	EmailCampaigns    = "campaigns"
+	EmailSuggestions  = "suggestions"
+	EmailInterlibrary = "interlibrary"
+	EmailPickups      = "pickups"
+)
+
+var EmailCategories = []string{EmailCampaigns, EmailSuggestions, EmailInterlibrary, EmailPickups}
+
+// How often the reading digest is sent.
+const (
+	DigestNever   = "never"
+	DigestDaily   = "daily"
+	DigestWeekly  = "weekly"
+	DigestMonthly = "monthly"
+)
+
+var DigestFrequencies = []string{DigestNever, DigestDaily, DigestWeekly, DigestMonthly}
+
+// Languages are the languages users can have their emails in.
+var Languages = []string{"en", "ru", "kk"}
+
+// Preferences are a user's settings for what we send them and how.
+type Preferences struct {
+	EmailOptIns     []string `json:"email_opt_ins"`
+	DigestFrequency string   `json:"digest_frequency"`
+	Language        string   `json:"language"`
+}
+
+// DefaultPreferences are the preferences of users who haven't changed any.
+func DefaultPreferences() *Preferences {
+	return &Preferences{
+		EmailOptIns:     append([]string(nil), EmailCategories...),
+		DigestFrequency: DigestNever,
+		Language:        "en",
+	}
+}
+
+// WantsEmail reports whether the user has opted in to emails of the category.
+func (p *Preferences) WantsEmail(category string) bool {
+	return validator.PermittedValue(category, p.EmailOptIns...)
+}
+
+func ValidatePreferences(v *validator.Validator, prefs *Preferences) {
+	v.Check(validator.Unique(prefs.EmailOptIns), "email_opt_ins", "must not contain duplicate values")
+	for _, category := range prefs.EmailOptIns {
+		v.Check(validator.PermittedValue(category, EmailCategories...), "email_opt_ins", "contains an unknown category")
+	}
+	v.Check(validator.PermittedValue(prefs.DigestFrequency, DigestFrequencies...), "digest_frequency", "must be never, daily, weekly or monthly")
+	v.Check(validator.PermittedValue(prefs.Language, Languages...), "language", "must be en, ru or kk")
+}
+
+type PreferenceModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the user's preferences, or the defaults if they haven't set any.
+func (m PreferenceModel) Get(userID int64) (*Preferences, error) {
+	query := `
+		SELECT email_opt_ins, digest_frequency, language
+		FROM user_preferences
+		WHERE user_id = $1`
+	var prefs Preferences
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&prefs.EmailOptIns, &prefs.DigestFrequency, &prefs.Language)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return DefaultPreferences(), nil
+		default:
+			return nil, err
+		}
+	}
+	return &prefs, nil
+}
+
+func (m PreferenceModel) Update(userID int64, prefs *Preferences) error {
+	query := `
+		INSERT INTO user_preferences (user_id, email_opt_ins, digest_frequency, language)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET email_opt_ins = EXCLUDED.email_opt_ins, digest_frequency = EXCLUDED.digest_frequency,
+			language = EXCLUDED.language, updated_at = NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID, prefs.EmailOptIns, prefs.DigestFrequency, prefs.Language)
+	return err
+}
@@ -0,0 +1,29 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type primaryContextKey struct{}
+
+// WithPrimary returns a copy of ctx which makes the models read from the primary
+// database even when a replica is configured. It's used after a user has written
+// something, so that they don't read a replica which hasn't caught up yet.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// reader returns the pool which reads for ctx should go to: the replica if there is
+// one and ctx doesn't ask for the primary.
+func reader(ctx context.Context, primary, replica *pgxpool.Pool) *pgxpool.Pool {
+	if replica == nil || usePrimary(ctx) {
+		return primary
+	}
+	return replica
+}
@@ -0,0 +1,274 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy says how long data is kept for. A period of zero keeps that data
+// forever. Nothing belonging to an account under a legal hold is ever deleted or
+// anonymized.
+type RetentionPolicy struct {
+	// AuditLogMonths is how long security events are kept.
+	AuditLogMonths int
+	// EmailLogMonths is how long the record of who each campaign email was sent to
+	// is kept.
+	EmailLogMonths int
+	// SearchLogMonths is how long logged searches are kept.
+	SearchLogMonths int
+	// DeadLetterDays is how long emails which couldn't be sent are kept, whether or
+	// not they've been resent.
+	DeadLetterDays int
+	// InactiveAccountYears is how long an account can go unused before it's
+	// anonymized.
+	InactiveAccountYears int
+}
+
+// RetentionRule deletes or anonymizes one kind of data which is older than Cutoff.
+// CountQuery and ApplyQuery both take the cutoff as $1.
+type RetentionRule struct {
+	Name        string
+	Description string
+	Cutoff      time.Time
+	CountQuery  string
+	ApplyQuery  string
+}
+
+// RetentionResult is the outcome of a single rule. Applied is how many rows were
+// deleted or anonymized, and is always zero on a dry run.
+type RetentionResult struct {
+	Rule        string    `json:"rule"`
+	Description string    `json:"description"`
+	Cutoff      time.Time `json:"cutoff"`
+	Count       int       `json:"count"`
+	Applied     int64     `json:"applied"`
+}
+
+// RetentionReport is the outcome of running every rule in a policy.
+type RetentionReport struct {
+	RanAt   time.Time         `json:"ran_at"`
+	DryRun  bool              `json:"dry_run"`
+	Results []RetentionResult `json:"results"`
+}
+
+// inactiveAccounts matches accounts which haven't been used since the cutoff and
+// haven't been anonymized yet. Members with a copy still out are left alone, as staff
+// need to be able to chase it.
+const inactiveAccounts = `
+	SELECT id, email FROM users
+	WHERE anonymized_at IS NULL AND frozen_at IS NULL AND coalesce(last_seen_at, created_at) < $1
+	AND NOT EXISTS (SELECT 1 FROM loans WHERE loans.user_id = users.id AND loans.returned_at IS NULL)`
+
+// userReference is a column which holds a user's ID, and what anonymizing the user
+// does to the rows which hold theirs. Rows are deleted unless Keep is set, when Scrub,
+// if there is one, is the SET clause which clears whatever in them could say who the
+// user is.
+type userReference struct {
+	Table  string
+	Column string
+	Keep   bool
+	Scrub  string
+}
+
+// userReferences lists every column which refers to users. Each new one must be added
+// here, deciding whether anonymizing a user deletes their rows or keeps them; the
+// tests check it against the foreign keys in the migrations. Rows are only kept when
+// the library needs them to add up, such as loans, or when they record what staff did.
+var userReferences = []userReference{
+	{Table: "api_keys", Column: "user_id"},
+	{Table: "bootstrap", Column: "user_id", Keep: true},
+	{Table: "books", Column: "created_by", Keep: true},
+	{Table: "campaign_recipients", Column: "user_id"},
+	{Table: "client_bans", Column: "lifted_by", Keep: true},
+	{Table: "interlibrary_loans", Column: "user_id", Keep: true, Scrub: "note = ''"},
+	{Table: "jobs", Column: "user_id"},
+	{Table: "legal_holds", Column: "placed_by", Keep: true},
+	{Table: "legal_holds", Column: "released_by", Keep: true},
+	{Table: "legal_holds", Column: "user_id", Keep: true},
+	{Table: "library_cards", Column: "user_id"},
+	{Table: "login_failures", Column: "user_id"},
+	{Table: "loans", Column: "forgiven_by", Keep: true},
+	{Table: "loans", Column: "user_id", Keep: true, Scrub: "forgive_note = ''"},
+	{Table: "pickups", Column: "user_id"},
+	{Table: "purchase_suggestions", Column: "user_id", Keep: true, Scrub: "reason = '', note = ''"},
+	{Table: "reading_lists", Column: "user_id"},
+	{Table: "reading_sessions", Column: "user_id"},
+	{Table: "searches", Column: "user_id"},
+	{Table: "security_events", Column: "user_id"},
+	{Table: "tokens", Column: "impersonator_id"},
+	{Table: "tokens", Column: "user_id"},
+	{Table: "totp_recovery_codes", Column: "user_id"},
+	{Table: "user_identities", Column: "user_id"},
+	{Table: "user_preferences", Column: "user_id"},
+	{Table: "user_totp", Column: "user_id"},
+	{Table: "users_followed_genres", Column: "user_id"},
+	{Table: "users_permissions", Column: "user_id"},
+	{Table: "users_roles", Column: "user_id"},
+	{Table: "webauthn_challenges", Column: "user_id"},
+	{Table: "webauthn_credentials", Column: "user_id"},
+}
+
+// anonymizeAccounts is the statement which anonymizes the accounts matched by
+// inactiveAccounts. It deletes or scrubs the rows userReferences lists, and the rows
+// which only hold the user's email address: security events for logins with it and
+// emails to it which couldn't be sent. The user's own row is kept, so their loans and
+// the books they added still add up, but everything which says who they were and
+// every way of logging in as them is cleared. The empty password hash never matches.
+func anonymizeAccounts() string {
+	var ctes []string
+	var deletes []string
+	columns := make(map[string][]string)
+	for _, ref := range userReferences {
+		condition := ref.Column + ` IN (SELECT id FROM targets)`
+		switch {
+		case !ref.Keep:
+			if len(columns[ref.Table]) == 0 {
+				deletes = append(deletes, ref.Table)
+			}
+			columns[ref.Table] = append(columns[ref.Table], condition)
+		case ref.Scrub != "":
+			ctes = append(ctes, fmt.Sprintf(`scrubbed_%s_%s AS (UPDATE %s SET %s WHERE %s)`,
+				ref.Table, ref.Column, ref.Table, ref.Scrub, condition))
+		}
+	}
+	// Failed logins with the user's email address are recorded without their ID.
+	columns["security_events"] = append(columns["security_events"], `email IN (SELECT email FROM targets)`)
+	for _, table := range deletes {
+		ctes = append(ctes, fmt.Sprintf(`deleted_%s AS (DELETE FROM %s WHERE %s)`,
+			table, table, strings.Join(columns[table], " OR ")))
+	}
+	ctes = append(ctes, `deleted_mail_dead_letters AS (DELETE FROM mail_dead_letters WHERE lower(recipient) IN (SELECT lower(email) FROM targets))`)
+
+	return `
+		WITH targets AS (` + inactiveAccounts + `),
+		` + strings.Join(ctes, ",\n\t\t") + `
+		UPDATE users
+		SET name = 'Anonymized user', email = 'anonymized-' || id || '@invalid', password_hash = '',
+			password_login = false, activated = false, pending_email = NULL, display_name = '', bio = '',
+			avatar_url = '', profile_public = false, last_login_at = NULL, anonymized_at = NOW(),
+			version = uuid_generate_v4()
+		WHERE id IN (SELECT id FROM targets)`
+}
+
+// notFrozen is a condition which leaves out the rows in table which belong to an
+// account under a legal hold, by its user_id column.
+func notFrozen(table string) string {
+	return `NOT EXISTS (SELECT 1 FROM users WHERE users.id = ` + table + `.user_id AND users.frozen_at IS NOT NULL)`
+}
+
+// Rules returns the rules for the policy's non-zero periods, with cutoffs counted
+// back from now.
+func (p RetentionPolicy) Rules(now time.Time) []RetentionRule {
+	var rules []RetentionRule
+	if p.AuditLogMonths > 0 {
+		rules = append(rules, RetentionRule{
+			Name:        "audit_logs",
+			Description: "security events older than the audit log retention period",
+			Cutoff:      now.AddDate(0, -p.AuditLogMonths, 0),
+			CountQuery:  `SELECT count(*) FROM security_events WHERE created_at < $1 AND ` + notFrozen("security_events"),
+			ApplyQuery:  `DELETE FROM security_events WHERE created_at < $1 AND ` + notFrozen("security_events"),
+		})
+	}
+	if p.EmailLogMonths > 0 {
+		rules = append(rules, RetentionRule{
+			Name:        "email_logs",
+			Description: "campaign email recipients older than the email log retention period",
+			Cutoff:      now.AddDate(0, -p.EmailLogMonths, 0),
+			CountQuery: `
+				SELECT count(*) FROM campaign_recipients
+				INNER JOIN campaigns ON campaigns.id = campaign_recipients.campaign_id
+				WHERE coalesce(campaign_recipients.sent_at, campaigns.created_at) < $1
+				AND ` + notFrozen("campaign_recipients"),
+			ApplyQuery: `
+				DELETE FROM campaign_recipients
+				USING campaigns
+				WHERE campaigns.id = campaign_recipients.campaign_id
+				AND coalesce(campaign_recipients.sent_at, campaigns.created_at) < $1
+				AND ` + notFrozen("campaign_recipients"),
+		})
+	}
+	if p.SearchLogMonths > 0 {
+		rules = append(rules, RetentionRule{
+			Name:        "search_logs",
+			Description: "logged searches older than the search log retention period",
+			Cutoff:      now.AddDate(0, -p.SearchLogMonths, 0),
+			CountQuery:  `SELECT count(*) FROM searches WHERE searched_at < $1 AND ` + notFrozen("searches"),
+			ApplyQuery:  `DELETE FROM searches WHERE searched_at < $1 AND ` + notFrozen("searches"),
+		})
+	}
+	if p.DeadLetterDays > 0 {
+		// Dead letters only have the recipient's address, so that's what's checked
+		// for a legal hold.
+		notFrozenRecipient := `NOT EXISTS (SELECT 1 FROM users WHERE lower(users.email) = lower(mail_dead_letters.recipient) AND users.frozen_at IS NOT NULL)`
+		rules = append(rules, RetentionRule{
+			Name:        "dead_letters",
+			Description: "emails which couldn't be sent, older than the dead letter retention period",
+			Cutoff:      now.AddDate(0, 0, -p.DeadLetterDays),
+			CountQuery:  `SELECT count(*) FROM mail_dead_letters WHERE created_at < $1 AND ` + notFrozenRecipient,
+			ApplyQuery:  `DELETE FROM mail_dead_letters WHERE created_at < $1 AND ` + notFrozenRecipient,
+		})
+	}
+	if p.InactiveAccountYears > 0 {
+		rules = append(rules, RetentionRule{
+			Name:        "inactive_accounts",
+			Description: "accounts unused for longer than the inactive account retention period",
+			Cutoff:      now.AddDate(-p.InactiveAccountYears, 0, 0),
+			CountQuery:  `SELECT count(*) FROM (` + inactiveAccounts + `) AS targets`,
+			ApplyQuery:  anonymizeAccounts(),
+		})
+	}
+	return rules
+}
+
+type RetentionModel struct {
+	DB *pgxpool.Pool
+}
+
+// Run counts the data each of the policy's rules applies to and, unless dryRun is
+// set, deletes or anonymizes it, reporting progress after each rule. If ctx is
+// cancelled it stops before the next rule, and the statement it's running is rolled
+// back; the rules already applied stay applied.
+func (m RetentionModel) Run(ctx context.Context, policy RetentionPolicy, dryRun bool, progress ProgressFunc) (*RetentionReport, error) {
+	report := &RetentionReport{
+		RanAt:   time.Now(),
+		DryRun:  dryRun,
+		Results: []RetentionResult{},
+	}
+
+	rules := policy.Rules(report.RanAt)
+	for i, rule := range rules {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result := RetentionResult{
+			Rule:        rule.Name,
+			Description: rule.Description,
+			Cutoff:      rule.Cutoff,
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := m.DB.QueryRow(ctx, rule.CountQuery, rule.Cutoff).Scan(&result.Count)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		if !dryRun && result.Count > 0 {
+			tag, err := m.DB.Exec(ctx, rule.ApplyQuery, rule.Cutoff)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			result.Applied = tag.RowsAffected()
+		}
+		cancel()
+
+		report.Results = append(report.Results, result)
+		progress.report(int64(i+1), int64(len(rules)))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"books.reading.kz/migrations"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var (
+	migrationTableRX      = regexp.MustCompile(`(?i)^\s*(?:CREATE TABLE(?: IF NOT EXISTS)?|ALTER TABLE(?: IF EXISTS)?)\s+(\w+)`)
+	migrationColumnRX     = regexp.MustCompile(`(?i)^\s*(?:ALTER TABLE\s+\w+\s+ADD COLUMN(?: IF NOT EXISTS)?\s+)?(\w+)\s+bigint\b.*\bREFERENCES users\b`)
+	migrationForeignKeyRX = regexp.MustCompile(`(?i)FOREIGN KEY \((\w+)\) REFERENCES users\b`)
+)
+
+// migrationUserReferences returns every table.column which the up migrations give a
+// foreign key to users.
+func migrationUserReferences(t *testing.T) map[string]bool {
+	t.Helper()
+	names, err := fs.Glob(migrations.FS, "*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+
+	refs := make(map[string]bool)
+	for _, name := range names {
+		contents, err := fs.ReadFile(migrations.FS, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var table string
+		for _, line := range strings.Split(string(contents), "\n") {
+			if m := migrationTableRX.FindStringSubmatch(line); m != nil {
+				table = m[1]
+			}
+			if m := migrationColumnRX.FindStringSubmatch(line); m != nil {
+				refs[table+"."+m[1]] = true
+			}
+			if m := migrationForeignKeyRX.FindStringSubmatch(line); m != nil {
+				refs[table+"."+m[1]] = true
+			}
+		}
+	}
+	return refs
+}
+
+func TestUserReferencesCoverForeignKeys(t *testing.T) {
+	fks := migrationUserReferences(t)
+	if len(fks) == 0 {
+		t.Fatal("found no foreign keys to users in the migrations")
+	}
+
+	listed := make(map[string]bool)
+	for _, ref := range userReferences {
+		name := ref.Table + "." + ref.Column
+		if listed[name] {
+			t.Errorf("%s is listed twice", name)
+		}
+		listed[name] = true
+		if !fks[name] {
+			t.Errorf("%s is listed but no migration gives it a foreign key to users", name)
+		}
+		if !ref.Keep && ref.Scrub != "" {
+			t.Errorf("%s is deleted, so it has nothing to scrub", name)
+		}
+	}
+	for name := range fks {
+		if !listed[name] {
+			t.Errorf("%s refers to users but isn't in userReferences, so anonymizing a user wouldn't touch it", name)
+		}
+	}
+}
+
+func TestAnonymizeAccountsTouchesEveryReference(t *testing.T) {
+	query := anonymizeAccounts()
+	for _, ref := range userReferences {
+		if ref.Keep && ref.Scrub == "" {
+			continue
+		}
+		if !strings.Contains(query, ref.Table+" ") || !strings.Contains(query, ref.Column+" IN (SELECT id FROM targets)") {
+			t.Errorf("the anonymize statement doesn't touch %s.%s", ref.Table, ref.Column)
+		}
+	}
+	for _, table := range []string{"security_events", "mail_dead_letters"} {
+		if !strings.Contains(query, "DELETE FROM "+table+" WHERE") {
+			t.Errorf("the anonymize statement doesn't delete from %s", table)
+		}
+	}
+	if strings.Count(query, "DELETE FROM tokens ") != 1 {
+		t.Error("tokens should be deleted by a single statement")
+	}
+}
@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// DefaultRole is given to every user when they register.
+const DefaultRole = "reader"
+
+// Role is a named set of permissions which can be assigned to users.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB *pgxpool.Pool
+}
+
+// GetAll returns every role along with the permissions it grants.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+SELECT roles.id, roles.name, coalesce(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+FROM roles
+LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+GROUP BY roles.id
+ORDER BY roles.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		var permissions []string
+		err := rows.Scan(&role.ID, &role.Name, &permissions)
+		if err != nil {
+			return nil, err
+		}
+		role.Permissions = permissions
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetAllForUser returns the names of the roles assigned to a user.
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+SELECT roles.name
+FROM roles
+INNER JOIN users_roles ON users_roles.role_id = roles.id
+WHERE users_roles.user_id = $1
+ORDER BY roles.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AddForUser assigns roles to a user. Roles the user already has are left alone.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+INSERT INTO users_roles
+SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID, names)
+	return err
+}
+
+// RemoveForUser takes a role away from a user. It returns ErrRecordNotFound if the
+// user didn't have the role.
+func (m RoleModel) RemoveForUser(userID int64, name string) error {
+	query := `
+DELETE FROM users_roles
+USING roles
+WHERE users_roles.role_id = roles.id AND users_roles.user_id = $1 AND roles.name = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
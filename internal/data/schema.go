@@ -0,0 +1,79 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// The range of schema versions, as numbered by the files in migrations/, which this
+// code works with. SchemaVersion is the newest migration it knows about and must be
+// bumped with every new migration. MinSchemaVersion is the oldest schema it can run
+// against; bump it to the new migration's number whenever the code starts reading or
+// writing something the migration adds. Keeping the two apart lets a blue/green
+// deploy apply backwards compatible migrations before the old code is drained.
+const (
+	SchemaVersion    = 73
+	MinSchemaVersion = 73
+)
+
+// SchemaStatus is the database's migration version compared with the code's.
+type SchemaStatus struct {
+	Version    int64  `json:"version"`
+	Dirty      bool   `json:"dirty"`
+	Expected   string `json:"expected"`
+	Compatible bool   `json:"compatible"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+// CheckSchema compares the version migrations have brought the database to with the
+// range the code works with. maxAhead is how many migrations newer than
+// SchemaVersion the database may be, which is fine as long as migrations are kept
+// backwards compatible.
+func CheckSchema(version int64, dirty bool, maxAhead int64) SchemaStatus {
+	status := SchemaStatus{
+		Version:    version,
+		Dirty:      dirty,
+		Expected:   fmt.Sprintf("%d-%d", MinSchemaVersion, SchemaVersion+maxAhead),
+		Compatible: true,
+	}
+	switch {
+	case dirty:
+		status.Problem = fmt.Sprintf("migration %d failed part way through and needs fixing by hand", version)
+	case version < MinSchemaVersion:
+		status.Problem = fmt.Sprintf("the database is at migration %d, but this code needs at least %d", version, MinSchemaVersion)
+	case version > SchemaVersion+maxAhead:
+		status.Problem = fmt.Sprintf("the database is at migration %d, which is too far ahead of this code's %d", version, SchemaVersion)
+	}
+	status.Compatible = status.Problem == ""
+	return status
+}
+
+type SchemaModel struct {
+	DB *pgxpool.Pool
+}
+
+// Version returns the migration version recorded in the schema_migrations table
+// kept by the migrate tool, and whether the last migration failed part way through.
+// A database which has never been migrated is at version 0.
+func (m SchemaModel) Version() (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var version int64
+	var dirty bool
+	err := m.DB.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.Is(err, pgx.ErrNoRows), errors.As(err, &pgErr) && pgErr.Code == "42P01":
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+	return version, dirty, nil
+}
@@ -0,0 +1,25 @@
+package data
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// SearchModel logs catalog searches so that they can be included in the analytics
+// export.
+type SearchModel struct {
+	DB *pgxpool.Pool
+}
+
+// Record logs a search and how many books it found. userID is zero for anonymous
+// searches.
+func (m SearchModel) Record(userID int64, search string, results int) error {
+	query := `
+		INSERT INTO searches (user_id, query, results)
+		VALUES (nullif($1::bigint, 0), $2, $3)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID, search, results)
+	return err
+}
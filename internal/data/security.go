@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// The kinds of security event which are recorded.
+const (
+	EventLogin           = "login"
+	EventTokenIssued     = "token_issued"
+	EventTokenRevoked    = "token_revoked"
+	EventAPIKeyCreated   = "api_key_created"
+	EventAPIKeyRevoked   = "api_key_revoked"
+	EventEmailChanged    = "email_changed"
+	EventPasswordChanged = "password_changed"
+	EventTwoFactor       = "two_factor_changed"
+	// EventIdentityLinked and EventIdentityUnlinked are recorded when a way of logging
+	// in, a social login provider or the password, is added to or removed from the
+	// user, with which in Detail.
+	EventIdentityLinked   = "identity_linked"
+	EventIdentityUnlinked = "identity_unlinked"
+	// EventImpersonation is recorded when an admin starts impersonating a user, and
+	// EventImpersonatedRequest for every request they make while doing so.
+	EventImpersonation       = "impersonation_started"
+	EventImpersonatedRequest = "impersonated_request"
+	// EventSuspiciousLogin is recorded alongside a successful login which looked
+	// unusual, with the reasons in Detail.
+	EventSuspiciousLogin = "suspicious_login"
+	// EventNewDevice is recorded alongside a successful login from a user agent the
+	// user hasn't logged in with before, when they're emailed about it.
+	EventNewDevice = "new_device"
+	// EventLegalHoldPlaced and EventLegalHoldReleased are recorded for both the admin
+	// and the user when an account is frozen or unfrozen, with the reason in Detail.
+	EventLegalHoldPlaced   = "legal_hold_placed"
+	EventLegalHoldReleased = "legal_hold_released"
+)
+
+// The outcomes of a security event.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// SecurityEvents lists the events which can be filtered on.
+var SecurityEvents = []string{EventLogin, EventTokenIssued, EventTokenRevoked, EventAPIKeyCreated, EventAPIKeyRevoked, EventEmailChanged, EventTwoFactor,
+	EventPasswordChanged, EventImpersonation, EventImpersonatedRequest, EventSuspiciousLogin, EventIdentityLinked, EventIdentityUnlinked, EventNewDevice,
+	EventLegalHoldPlaced, EventLegalHoldReleased}
+
+// SecurityEvent is an entry in the security audit trail. UserID is nil for failed
+// logins to an email address without an account, in which case Email says which
+// address was tried. Detail says what happened in a few words, such as "wrong
+// password" or "jwt". Country is where the IP address is, if it's known.
+type SecurityEvent struct {
+	ID        int64     `json:"id"`
+	UserID    *int64    `json:"user_id,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Country   string    `json:"country,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginHistory summarises a user's earlier successful logins, for spotting unusual
+// ones.
+type LoginHistory struct {
+	// Logins is how many earlier logins there were.
+	Logins int
+	// SeenIP, SeenCountry and SeenDevice are set if any of them were from the same
+	// IP address, country or kind of device, which is the user agent's browser and
+	// operating system as DeviceFamily has them, so a browser updating itself isn't a
+	// new device.
+	SeenIP      bool
+	SeenCountry bool
+	SeenDevice  bool
+	// Previous is the most recent of them, or nil if there weren't any.
+	Previous *SecurityEvent
+}
+
+type SecurityEventModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m SecurityEventModel) Insert(event *SecurityEvent) error {
+	query := `
+		INSERT INTO security_events (user_id, email, event, outcome, detail, ip, user_agent, country)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+	args := []any{event.UserID, event.Email, event.Event, event.Outcome, event.Detail, event.IP, event.UserAgent, event.Country}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAll returns security events, newest first by default. userID limits them to a
+// single user's events when it isn't zero, and event and outcome to a single kind of
+// event or outcome when they aren't empty.
+func (m SecurityEventModel) GetAll(userID int64, event, outcome string, filters Filters) ([]*SecurityEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, user_id, email, event, outcome, detail, ip, user_agent, country, created_at
+		FROM security_events
+		WHERE ($1::bigint = 0 OR user_id = $1)
+		AND ($2 = '' OR event = $2)
+		AND ($3 = '' OR outcome = $3)
+		ORDER BY %s %s, id DESC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, event, outcome, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	events := []*SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		err := rows.Scan(&totalRecords, &e.ID, &e.UserID, &e.Email, &e.Event, &e.Outcome, &e.Detail,
+			&e.IP, &e.UserAgent, &e.Country, &e.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
+
+// LoginHistory summarises the user's successful logins recorded before the event
+// with the ID beforeID. country is ignored if it's empty.
+func (m SecurityEventModel) LoginHistory(userID, beforeID int64, ip, country, userAgent string) (*LoginHistory, error) {
+	query := `
+		SELECT count(*), coalesce(bool_or(ip = $3), false), coalesce(bool_or($4 <> '' AND country = $4), false)
+		FROM security_events
+		WHERE user_id = $1 AND id < $2 AND event = $5 AND outcome = $6`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var history LoginHistory
+	err := m.DB.QueryRow(ctx, query, userID, beforeID, ip, country, EventLogin, OutcomeSuccess).
+		Scan(&history.Logins, &history.SeenIP, &history.SeenCountry)
+	if err != nil || history.Logins == 0 {
+		return &history, err
+	}
+
+	// The user agents are compared by their device family, which SQL can't work out,
+	// so the most recent different ones are checked here.
+	query = `
+		SELECT user_agent
+		FROM security_events
+		WHERE user_id = $1 AND id < $2 AND event = $3 AND outcome = $4
+		GROUP BY user_agent
+		ORDER BY max(id) DESC
+		LIMIT 100`
+	rows, err := m.DB.Query(ctx, query, userID, beforeID, EventLogin, OutcomeSuccess)
+	if err != nil {
+		return nil, err
+	}
+	device := DeviceFamily(userAgent)
+	for rows.Next() {
+		var seen string
+		if err := rows.Scan(&seen); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if DeviceFamily(seen) == device {
+			history.SeenDevice = true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT id, email, event, outcome, detail, ip, user_agent, country, created_at
+		FROM security_events
+		WHERE user_id = $1 AND id < $2 AND event = $3 AND outcome = $4
+		ORDER BY id DESC
+		LIMIT 1`
+	var e SecurityEvent
+	err = m.DB.QueryRow(ctx, query, userID, beforeID, EventLogin, OutcomeSuccess).
+		Scan(&e.ID, &e.Email, &e.Event, &e.Outcome, &e.Detail, &e.IP, &e.UserAgent, &e.Country, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.UserID = &userID
+	history.Previous = &e
+	return &history, nil
+}
+
+// CountUsersFromIP returns how many different users have logged in successfully from
+// the IP address since the given time.
+func (m SecurityEventModel) CountUsersFromIP(ip string, since time.Time) (int, error) {
+	query := `
+		SELECT count(DISTINCT user_id)
+		FROM security_events
+		WHERE ip = $1 AND created_at >= $2 AND event = $3 AND outcome = $4`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var n int
+	err := m.DB.QueryRow(ctx, query, ip, since, EventLogin, OutcomeSuccess).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,308 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// ReadingSession is a stretch of time a user spent reading a book. EndedAt is nil while
+// the session is still open. Sessions which were left open for too long are closed by a
+// background job and marked TimedOut.
+type ReadingSession struct {
+	ID         int64      `json:"id"`
+	ExternalID string     `json:"external_id"`
+	BookID     int64      `json:"book_id"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	Duration   int64      `json:"duration_seconds"`
+	TimedOut   bool       `json:"timed_out"`
+}
+
+// Streak is how many days in a row a user has read. Current counts back from today, or
+// from yesterday if they haven't read yet today, so a streak isn't lost until a whole
+// day is missed.
+type Streak struct {
+	Current    int     `json:"current"`
+	Longest    int     `json:"longest"`
+	LastReadOn *string `json:"last_read_on,omitempty"`
+}
+
+// DailyReading is the number of minutes a user read on a single day.
+type DailyReading struct {
+	Date    string `json:"date"`
+	Minutes int64  `json:"minutes"`
+}
+
+type ReadingSessionModel struct {
+	DB *pgxpool.Pool
+}
+
+const readingSessionColumns = `id, external_id, book_id, started_at, ended_at, timed_out, extract(epoch FROM coalesce(ended_at, NOW()) - started_at)::bigint`
+
+func scanReadingSession(row pgx.Row) (*ReadingSession, error) {
+	var session ReadingSession
+	err := row.Scan(&session.ID, &session.ExternalID, &session.BookID, &session.StartedAt, &session.EndedAt, &session.TimedOut, &session.Duration)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// closeSession is the SET clause which ends a session now, or timeout after it
+// started if that's earlier, so that a session which is stopped after it should have
+// timed out counts for no longer than one closed by CloseForgotten. The timeout is
+// passed as $1 by sessionTimeout.
+const closeSession = `
+	SET ended_at = LEAST(NOW(), started_at + $1::interval),
+		timed_out = coalesce(NOW() > started_at + $1::interval, false)`
+
+// sessionTimeout returns the argument closeSession takes for timeout, which is NULL,
+// so that sessions aren't capped, if timeouts are turned off.
+func sessionTimeout(timeout time.Duration) any {
+	if timeout <= 0 {
+		return nil
+	}
+	return timeout
+}
+
+// Start opens a session for the user on the book. If they already have one open for
+// the same book it's returned instead, with created set to false, unless it has been
+// open for longer than timeout. A session open on any other book is closed first, as
+// you can only read one book at a time.
+func (m ReadingSessionModel) Start(userID, bookID int64, timeout time.Duration) (*ReadingSession, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE reading_sessions `+closeSession+`
+		WHERE user_id = $2 AND ended_at IS NULL AND (book_id <> $3 OR started_at < NOW() - $1::interval)`,
+		sessionTimeout(timeout), userID, bookID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	created := true
+	session, err := scanReadingSession(tx.QueryRow(ctx, `
+		INSERT INTO reading_sessions (user_id, book_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) WHERE ended_at IS NULL DO NOTHING
+		RETURNING `+readingSessionColumns, userID, bookID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		created = false
+		session, err = scanReadingSession(tx.QueryRow(ctx, `
+			SELECT `+readingSessionColumns+`
+			FROM reading_sessions
+			WHERE user_id = $1 AND ended_at IS NULL`, userID))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return session, created, nil
+}
+
+// Stop closes one of the user's sessions, capped at timeout long. Stopping a session
+// which is already closed isn't an error, it's just returned unchanged.
+func (m ReadingSessionModel) Stop(id, userID int64, timeout time.Duration) (*ReadingSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	session, err := scanReadingSession(m.DB.QueryRow(ctx, `
+		UPDATE reading_sessions `+closeSession+`
+		WHERE id = $2 AND user_id = $3 AND ended_at IS NULL
+		RETURNING `+readingSessionColumns, sessionTimeout(timeout), id, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		session, err = scanReadingSession(m.DB.QueryRow(ctx, `
+			SELECT `+readingSessionColumns+`
+			FROM reading_sessions
+			WHERE id = $1 AND user_id = $2`, id, userID))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// CloseForgotten closes sessions which have been open for longer than timeout. They're
+// ended timeout after they started, so a forgotten timer counts for at most that long.
+func (m ReadingSessionModel) CloseForgotten(timeout time.Duration) (int64, error) {
+	query := `
+		UPDATE reading_sessions
+		SET ended_at = started_at + $1::interval, timed_out = true
+		WHERE ended_at IS NULL AND started_at < NOW() - $1::interval`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// GetMinutesPerDay returns the minutes the user read on each of the last days days,
+// oldest first and including days they didn't read at all. Days are split in the given
+// timezone, and closed sessions are counted on the day they started. The days are
+// worked out here rather than by Postgres, whose timezone database may not match ours.
+func (m ReadingSessionModel) GetMinutesPerDay(userID int64, days int, timezone string) ([]DailyReading, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	today := localDate(time.Now(), loc)
+	since := time.Date(today.Year(), today.Month(), today.Day()-days+1, 0, 0, 0, 0, loc)
+
+	// since is only a lower bound: if midnight doesn't exist on that day in loc, it may
+	// be an hour early, and sessions before the first day are skipped when bucketing.
+	query := `
+		SELECT started_at, extract(epoch FROM ended_at - started_at)::bigint
+		FROM reading_sessions
+		WHERE user_id = $1 AND ended_at IS NOT NULL AND started_at >= $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []ReadingSession{}
+	for rows.Next() {
+		var session ReadingSession
+		err := rows.Scan(&session.StartedAt, &session.Duration)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return minutesPerDay(today, days, sessions, loc), nil
+}
+
+// localDate returns the calendar day t falls on in loc, as midnight UTC. Dates are
+// compared and stepped through with AddDate in UTC, so a day which is 23 or 25 hours
+// long in loc because of daylight saving is still exactly one day.
+func localDate(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// minutesPerDay adds up the seconds read in sessions on each of the days days up to
+// and including today, counting each session on the day it started in loc.
+func minutesPerDay(today time.Time, days int, sessions []ReadingSession, loc *time.Location) []DailyReading {
+	first := today.AddDate(0, 0, -(days - 1))
+	seconds := make([]int64, days)
+	for _, session := range sessions {
+		day := localDate(session.StartedAt, loc)
+		if day.Before(first) || day.After(today) {
+			continue
+		}
+		// Every date is midnight UTC, so the difference is a whole number of days.
+		seconds[int(day.Sub(first).Hours()/24)] += session.Duration
+	}
+
+	readings := make([]DailyReading, days)
+	for i := range readings {
+		readings[i] = DailyReading{
+			Date:    first.AddDate(0, 0, i).Format("2006-01-02"),
+			Minutes: seconds[i] / 60,
+		}
+	}
+	return readings
+}
+
+// GetStreak works out the user's reading streak. Any closed session counts as reading
+// on the day it started, in the given timezone.
+func (m ReadingSessionModel) GetStreak(userID int64, timezone string) (*Streak, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT started_at
+		FROM reading_sessions
+		WHERE user_id = $1 AND ended_at IS NOT NULL
+		ORDER BY started_at DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var starts []time.Time
+	for rows.Next() {
+		var start time.Time
+		err := rows.Scan(&start)
+		if err != nil {
+			return nil, err
+		}
+		starts = append(starts, start)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return computeStreak(localDate(time.Now(), loc), readingDays(starts, loc)), nil
+}
+
+// readingDays returns the distinct days in loc that the sessions started on, newest
+// first. starts must be newest first too.
+func readingDays(starts []time.Time, loc *time.Location) []time.Time {
+	days := []time.Time{}
+	for _, start := range starts {
+		day := localDate(start, loc)
+		if len(days) == 0 || !day.Equal(days[len(days)-1]) {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// computeStreak works out the streak from the distinct days the user read on, newest
+// first. The dates are calendar days, so stepping back with AddDate is always exact.
+func computeStreak(today time.Time, days []time.Time) *Streak {
+	streak := &Streak{}
+	if len(days) == 0 {
+		return streak
+	}
+
+	last := days[0].Format("2006-01-02")
+	streak.LastReadOn = &last
+
+	run := 1
+	for i := 1; i <= len(days); i++ {
+		if i < len(days) && days[i].Equal(days[i-1].AddDate(0, 0, -1)) {
+			run++
+			continue
+		}
+		// The first run is the current streak, as long as it reaches today or
+		// yesterday.
+		if i == run && !days[0].Before(today.AddDate(0, 0, -1)) {
+			streak.Current = run
+		}
+		if run > streak.Longest {
+			streak.Longest = run
+		}
+		run = 1
+	}
+	return streak
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestLocalDate(t *testing.T) {
+	almaty := mustLoadLocation(t, "Asia/Almaty")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name string
+		t    time.Time
+		loc  *time.Location
+		want string
+	}{
+		{"before midnight", time.Date(2026, 3, 10, 23, 59, 59, 0, almaty), almaty, "2026-03-10"},
+		{"at midnight", time.Date(2026, 3, 11, 0, 0, 0, 0, almaty), almaty, "2026-03-11"},
+		{"UTC evening is next day east", time.Date(2026, 3, 10, 20, 0, 0, 0, time.UTC), almaty, "2026-03-11"},
+		{"UTC morning is previous day west", time.Date(2026, 3, 10, 3, 0, 0, 0, time.UTC), newYork, "2026-03-09"},
+		{"last hour of short day", time.Date(2026, 3, 8, 23, 30, 0, 0, newYork), newYork, "2026-03-08"},
+		{"repeated hour of long day", time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), newYork, "2026-11-01"},
+		{"last hour of long day", time.Date(2026, 11, 1, 23, 30, 0, 0, newYork), newYork, "2026-11-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := localDate(tt.t, tt.loc)
+			if got.Format("2006-01-02") != tt.want {
+				t.Errorf("got %s; want %s", got.Format("2006-01-02"), tt.want)
+			}
+			if got.Location() != time.UTC || got.Hour() != 0 {
+				t.Errorf("got %v; want midnight UTC", got)
+			}
+		})
+	}
+}
+
+func TestMinutesPerDay(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	session := func(start time.Time, minutes int64) ReadingSession {
+		return ReadingSession{StartedAt: start, Duration: minutes * 60}
+	}
+
+	t.Run("spring forward", func(t *testing.T) {
+		// 2026-03-08 is 23 hours long in New York.
+		today := time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)
+		sessions := []ReadingSession{
+			session(time.Date(2026, 3, 7, 23, 59, 0, 0, newYork), 10),
+			session(time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), 20),
+			session(time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), 5),
+			session(time.Date(2026, 3, 8, 23, 59, 0, 0, newYork), 30),
+			session(time.Date(2026, 3, 9, 0, 0, 0, 0, newYork), 40),
+		}
+		got := minutesPerDay(today, 3, sessions, newYork)
+		want := []DailyReading{{"2026-03-07", 10}, {"2026-03-08", 55}, {"2026-03-09", 40}}
+		assertReadings(t, got, want)
+	})
+
+	t.Run("fall back", func(t *testing.T) {
+		// 2026-11-01 is 25 hours long in New York, and 01:30 happens twice.
+		today := time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)
+		sessions := []ReadingSession{
+			session(time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), 15),
+			session(time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC), 15),
+			session(time.Date(2026, 11, 1, 23, 59, 0, 0, newYork), 30),
+			session(time.Date(2026, 11, 2, 4, 59, 0, 0, time.UTC), 1),
+			session(time.Date(2026, 11, 2, 5, 0, 0, 0, time.UTC), 2),
+		}
+		got := minutesPerDay(today, 2, sessions, newYork)
+		want := []DailyReading{{"2026-11-01", 61}, {"2026-11-02", 2}}
+		assertReadings(t, got, want)
+	})
+
+	t.Run("sessions outside the range", func(t *testing.T) {
+		today := time.Date(2026, 5, 10, 0, 0, 0, 0, time.UTC)
+		sessions := []ReadingSession{
+			session(time.Date(2026, 5, 8, 23, 0, 0, 0, newYork), 10),
+			session(time.Date(2026, 5, 11, 0, 30, 0, 0, newYork), 10),
+		}
+		got := minutesPerDay(today, 1, sessions, newYork)
+		want := []DailyReading{{"2026-05-10", 0}}
+		assertReadings(t, got, want)
+	})
+
+	t.Run("seconds add up across sessions", func(t *testing.T) {
+		today := time.Date(2026, 5, 10, 0, 0, 0, 0, time.UTC)
+		sessions := []ReadingSession{
+			{StartedAt: time.Date(2026, 5, 10, 9, 0, 0, 0, newYork), Duration: 90},
+			{StartedAt: time.Date(2026, 5, 10, 10, 0, 0, 0, newYork), Duration: 30},
+		}
+		got := minutesPerDay(today, 1, sessions, newYork)
+		want := []DailyReading{{"2026-05-10", 2}}
+		assertReadings(t, got, want)
+	})
+}
+
+func assertReadings(t *testing.T, got, want []DailyReading) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("day %d: got %v; want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestStreakAcrossDaylightSaving(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// Evening sessions fall on the next day in UTC, so splitting days in the wrong
+	// timezone would find four reading days instead of three.
+	starts := []time.Time{
+		time.Date(2026, 3, 9, 23, 30, 0, 0, newYork),
+		time.Date(2026, 3, 8, 23, 30, 0, 0, newYork),
+		time.Date(2026, 3, 7, 19, 30, 0, 0, newYork),
+		time.Date(2026, 3, 7, 8, 0, 0, 0, newYork),
+	}
+	days := readingDays(starts, newYork)
+	if len(days) != 3 {
+		t.Fatalf("got %d reading days; want 3", len(days))
+	}
+
+	streak := computeStreak(time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), days)
+	if streak.Current != 3 || streak.Longest != 3 {
+		t.Errorf("got current %d, longest %d; want 3, 3", streak.Current, streak.Longest)
+	}
+	if streak.LastReadOn == nil || *streak.LastReadOn != "2026-03-09" {
+		t.Errorf("got last read on %v; want 2026-03-09", streak.LastReadOn)
+	}
+
+	starts = []time.Time{
+		time.Date(2026, 11, 2, 0, 10, 0, 0, newYork),
+		time.Date(2026, 11, 1, 23, 50, 0, 0, newYork),
+		time.Date(2026, 11, 1, 1, 30, 0, 0, newYork),
+		time.Date(2026, 10, 31, 23, 59, 0, 0, newYork),
+	}
+	streak = computeStreak(time.Date(2026, 11, 3, 0, 0, 0, 0, time.UTC), readingDays(starts, newYork))
+	if streak.Current != 3 || streak.Longest != 3 {
+		t.Errorf("got current %d, longest %d; want 3, 3", streak.Current, streak.Longest)
+	}
+}
+
+func TestComputeStreak(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	dates := func(ss ...string) []time.Time {
+		var ds []time.Time
+		for _, s := range ss {
+			ds = append(ds, date(s))
+		}
+		return ds
+	}
+
+	tests := []struct {
+		name    string
+		today   string
+		days    []time.Time
+		current int
+		longest int
+	}{
+		{"no reading", "2026-03-10", nil, 0, 0},
+		{"read today", "2026-03-10", dates("2026-03-10", "2026-03-09"), 2, 2},
+		{"read yesterday", "2026-03-10", dates("2026-03-09", "2026-03-08"), 2, 2},
+		{"missed a day", "2026-03-10", dates("2026-03-08", "2026-03-07"), 0, 2},
+		{"across a month", "2026-03-01", dates("2026-03-01", "2026-02-28", "2026-02-27"), 3, 3},
+		{"longer run earlier", "2026-03-10", dates("2026-03-10", "2026-03-05", "2026-03-04", "2026-03-03"), 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streak := computeStreak(date(tt.today), tt.days)
+			if streak.Current != tt.current || streak.Longest != tt.longest {
+				t.Errorf("got current %d, longest %d; want %d, %d", streak.Current, streak.Longest, tt.current, tt.longest)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"unicode"
+)
+
+// Slugify turns a book title and year into a human friendly slug such as
+// "the-name-of-the-wind-2007". Letters from any alphabet are kept, everything else is
+// collapsed into single hyphens.
+func Slugify(title string, year int32) string {
+	var sb strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		if !hyphen && sb.Len() > 0 {
+			sb.WriteByte('-')
+			hyphen = true
+		}
+	}
+	slug := strings.TrimSuffix(sb.String(), "-")
+	if slug == "" {
+		return fmt.Sprintf("%d", year)
+	}
+	return fmt.Sprintf("%s-%d", slug, year)
+}
+
+// slugMatches reports whether slug was generated from base, either exactly or with a
+// numeric collision suffix ("base-2", "base-3" and so on).
+func slugMatches(slug, base string) bool {
+	if slug == base {
+		return true
+	}
+	if !strings.HasPrefix(slug, base+"-") {
+		return false
+	}
+	suffix := strings.TrimPrefix(slug, base+"-")
+	if suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// uniqueSlug returns base if no other book is using it (currently or historically),
+// otherwise the first free "base-N" variant. Slugs held by bookID itself don't count
+// as collisions, so a book can take back one of its old slugs.
+func uniqueSlug(ctx context.Context, db *pgxpool.Pool, base string, bookID int64) (string, error) {
+	query := `
+		SELECT slug FROM books WHERE (slug = $1 OR slug LIKE $2) AND id <> $3
+		UNION
+		SELECT slug FROM book_slugs WHERE (slug = $1 OR slug LIKE $2) AND book_id <> $3`
+
+	rows, err := db.Query(ctx, query, base, base+"-%", bookID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		err := rows.Scan(&slug)
+		if err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	slug := base
+	for i := 2; taken[slug]; i++ {
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+	return slug, nil
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"books.reading.kz/internal/validator"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// The statuses of a purchase suggestion. Suggestions start "pending", and librarians
+// move them to "ordered", "declined" or "added" (to the catalog). Declined and added
+// suggestions are final.
+const (
+	SuggestionPending  = "pending"
+	SuggestionOrdered  = "ordered"
+	SuggestionDeclined = "declined"
+	SuggestionAdded    = "added"
+)
+
+// SuggestionTransitions lists the statuses a suggestion can move to from each status.
+var SuggestionTransitions = map[string][]string{
+	SuggestionPending: {SuggestionOrdered, SuggestionDeclined, SuggestionAdded},
+	SuggestionOrdered: {SuggestionDeclined, SuggestionAdded},
+}
+
+// Suggestion is a member's request for the library to acquire a book it doesn't have.
+// Note is the librarian's reply, and BookID is set once the book is in the catalog.
+type Suggestion struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Title     string    `json:"title"`
+	ISBN      string    `json:"isbn,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Status    string    `json:"status"`
+	Note      string    `json:"note,omitempty"`
+	BookID    *int64    `json:"book_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+// NormalizeISBN strips the hyphens and spaces that ISBNs are usually printed with.
+func NormalizeISBN(isbn string) string {
+	isbn = strings.ReplaceAll(isbn, "-", "")
+	isbn = strings.ReplaceAll(isbn, " ", "")
+	return strings.ToUpper(isbn)
+}
+
+// ValidISBN reports whether a normalized ISBN-10 or ISBN-13 has a correct check digit.
+func ValidISBN(isbn string) bool {
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, c := range isbn {
+			var digit int
+			switch {
+			case c >= '0' && c <= '9':
+				digit = int(c - '0')
+			case c == 'X' && i == 9:
+				digit = 10
+			default:
+				return false
+			}
+			sum += (10 - i) * digit
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, c := range isbn {
+			if c < '0' || c > '9' {
+				return false
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(c-'0')
+		}
+		return sum%10 == 0
+	}
+	return false
+}
+
+func ValidateSuggestion(v *validator.Validator, suggestion *Suggestion) {
+	v.Check(suggestion.Title != "", "title", "must be provided")
+	v.Check(len(suggestion.Title) <= 500, "title", "must not be more than 500 bytes long")
+	if suggestion.ISBN != "" {
+		v.Check(ValidISBN(suggestion.ISBN), "isbn", "must be a valid ISBN-10 or ISBN-13")
+	}
+	v.Check(len(suggestion.Reason) <= 2000, "reason", "must not be more than 2000 bytes long")
+	v.Check(len(suggestion.Note) <= 2000, "note", "must not be more than 2000 bytes long")
+}
+
+type SuggestionModel struct {
+	DB *pgxpool.Pool
+}
+
+const suggestionColumns = `id, user_id, title, isbn, reason, status, note, book_id, created_at, updated_at, version`
+
+func scanSuggestion(row pgx.Row, extra ...any) (*Suggestion, error) {
+	var s Suggestion
+	dest := append(extra, &s.ID, &s.UserID, &s.Title, &s.ISBN, &s.Reason, &s.Status, &s.Note,
+		&s.BookID, &s.CreatedAt, &s.UpdatedAt, &s.Version)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// InCatalog reports whether a book with the same title is already in the catalog.
+func (m SuggestionModel) InCatalog(title string) (bool, error) {
+	var exists bool
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE lower(title) = lower($1))`, title).Scan(&exists)
+	return exists, err
+}
+
+func (m SuggestionModel) Insert(suggestion *Suggestion) error {
+	query := `
+		INSERT INTO purchase_suggestions (user_id, title, isbn, reason)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + suggestionColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	inserted, err := scanSuggestion(m.DB.QueryRow(ctx, query, suggestion.UserID, suggestion.Title, suggestion.ISBN, suggestion.Reason))
+	if err != nil {
+		return err
+	}
+	*suggestion = *inserted
+	return nil
+}
+
+func (m SuggestionModel) Get(id int64) (*Suggestion, error) {
+	query := `SELECT ` + suggestionColumns + ` FROM purchase_suggestions WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	suggestion, err := scanSuggestion(m.DB.QueryRow(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return suggestion, nil
+}
+
+// GetAll returns suggestions, newest first by default. userID limits them to a single
+// member's suggestions when it isn't zero, and status to a single status when it isn't
+// empty.
+func (m SuggestionModel) GetAll(userID int64, status string, filters Filters) ([]*Suggestion, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), `+suggestionColumns+`
+		FROM purchase_suggestions
+		WHERE ($1::bigint = 0 OR user_id = $1)
+		AND ($2 = '' OR status = $2)
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	suggestions := []*Suggestion{}
+	for rows.Next() {
+		suggestion, err := scanSuggestion(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return suggestions, metadata, nil
+}
+
+// Update saves the librarian's changes to the status, note and book. It returns
+// ErrEditConflict if the suggestion has changed since it was read.
+func (m SuggestionModel) Update(suggestion *Suggestion) error {
+	query := `
+		UPDATE purchase_suggestions
+		SET status = $1, note = $2, book_id = $3, updated_at = NOW(), version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version`
+	args := []any{suggestion.Status, suggestion.Note, suggestion.BookID, suggestion.ID, suggestion.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&suggestion.UpdatedAt, &suggestion.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete withdraws one of the user's suggestions. Only pending suggestions can be
+// withdrawn, otherwise ErrEditConflict is returned.
+func (m SuggestionModel) Delete(id, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `
+		DELETE FROM purchase_suggestions
+		WHERE id = $1 AND user_id = $2 AND status = 'pending'`, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
@@ -15,17 +17,90 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email-change"
+	// ScopeUnsubscribe tokens are sent in digests, and turn the digest off.
+	ScopeUnsubscribe = "unsubscribe"
+	// ScopeOAuthLink tokens are the state of a social login started to link the
+	// provider to a logged in user.
+	ScopeOAuthLink = "oauth-link"
+	// ScopeSessionRevoke tokens are sent in new device emails, and sign the session
+	// in SessionID out.
+	ScopeSessionRevoke = "session-revoke"
+	// ScopeTwoFactorChallenge tokens are given out by a social login to an account
+	// with two-factor authentication, and are swapped for an authentication token
+	// along with a code.
+	ScopeTwoFactorChallenge = "two-factor-challenge"
 )
 
+// unlistedScopes are the scopes of tokens which only work as part of a link or login
+// flow, and aren't shown to users among their tokens.
+var unlistedScopes = []string{ScopeUnsubscribe, ScopeOAuthLink, ScopeSessionRevoke, ScopeTwoFactorChallenge}
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
 // scope.
 type Token struct {
+	ID        int64 `json:"-"`
 	Plaintext string
 	Hash      []byte
 	UserID    int64
 	Expiry    time.Time
 	Scope     string
+	// UserAgent and IP describe the client the token was issued to, so users can
+	// recognise their sessions.
+	UserAgent string `json:"-"`
+	IP        string `json:"-"`
+	// ImpersonatorID is set on tokens an admin minted to act as the user.
+	ImpersonatorID *int64 `json:"-"`
+	// Scopes limits an authentication token to these of the user's permissions, like
+	// an API key. It's nil for tokens which have all of them.
+	Scopes []string `json:",omitempty"`
+	// SessionID is the authentication token a session revoke token signs out.
+	SessionID *int64 `json:"-"`
+}
+
+// TokenInfo describes an issued token without revealing it. Current is set for the
+// token which authenticated the request.
+type TokenInfo struct {
+	ID        int64     `json:"id"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+	// Impersonated is set for tokens an admin is using to act as the user.
+	Impersonated bool `json:"impersonated"`
+	// Scopes is set for tokens limited to some of the user's permissions.
+	Scopes []string `json:"scopes,omitempty"`
+	// LastUsedAt, LastUsedIP and LastUsedUserAgent describe the most recent request
+	// made with the token. They're recorded in batches, so can be a little behind.
+	LastUsedAt        *time.Time `json:"last_used_at"`
+	LastUsedIP        string     `json:"last_used_ip"`
+	LastUsedUserAgent string     `json:"last_used_user_agent"`
+}
+
+// TokenIntrospection describes a token to a service which has been handed it. Only
+// Active is set for tokens which don't exist or have expired.
+type TokenIntrospection struct {
+	Active       bool       `json:"active"`
+	Type         string     `json:"type,omitempty"`
+	Scope        string     `json:"scope,omitempty"`
+	UserID       int64      `json:"user_id,omitempty"`
+	Permissions  []string   `json:"permissions,omitempty"`
+	IssuedAt     *time.Time `json:"issued_at,omitempty"`
+	Expiry       *time.Time `json:"expiry,omitempty"`
+	Impersonated bool       `json:"impersonated,omitempty"`
+	// Scopes is only used to work out Permissions.
+	Scopes []string `json:"-"`
+}
+
+// TokenUse is a request made with a token, as recorded by RecordUsage.
+type TokenUse struct {
+	Hash      []byte
+	At        time.Time
+	IP        string
+	UserAgent string
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -65,6 +140,20 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// ValidateTokenScopes checks the scopes requested for an authentication token. nil
+// asks for an unrestricted token; otherwise tokens can only be given scopes which
+// their owner currently has.
+func ValidateTokenScopes(v *validator.Validator, scopes []string, permissions Permissions) {
+	if scopes == nil {
+		return
+	}
+	v.Check(len(scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range scopes {
+		v.Check(permissions.Include(scope), "scopes", "must only contain permissions you have")
+	}
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -86,16 +175,131 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert() adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+// Replace creates a new token like New, and deletes the user's other tokens with the
+// scope in the same transaction, so links in emails sent with the old ones stop
+// working. The user's row is locked first, so that of two Replaces at once the later
+// one deletes the earlier one's token and only one is left working. It returns
+// ErrRecordNotFound if there's no such user.
+func (m TokenModel) Replace(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, scope, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	_, err = tx.Exec(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit(ctx)
+}
+
+// NewForClient is the same as New, but also records the client the token is issued to
+// and limits it to scopes, unless they're nil.
+func (m TokenModel) NewForClient(userID int64, ttl time.Duration, scope, userAgent, ip string, scopes []string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(userAgent) > 500 {
+		userAgent = userAgent[:500]
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Scopes = scopes
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewImpersonation creates an authentication token for the user which is used by
+// impersonatorID to act as them.
+func (m TokenModel) NewImpersonation(userID, impersonatorID int64, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	if len(userAgent) > 500 {
+		userAgent = userAgent[:500]
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.ImpersonatorID = &impersonatorID
+	err = m.Insert(token)
+	return token, err
+}
+
+// Insert() adds the data for a specific token to the tokens table.
+func (m TokenModel) Insert(token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, impersonator_id, scopes, session_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.ImpersonatorID, token.Scopes, token.SessionID}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.Exec(ctx, query, args...)
-	return err
+	return m.DB.QueryRow(ctx, query, args...).Scan(&token.ID)
+}
+
+// NewSessionRevoke creates a token which signs the session out, and which lasts as
+// long as the session does.
+func (m TokenModel) NewSessionRevoke(session *Token) (*Token, error) {
+	token, err := generateToken(session.UserID, time.Until(session.Expiry), ScopeSessionRevoke)
+	if err != nil {
+		return nil, err
+	}
+	token.SessionID = &session.ID
+	err = m.Insert(token)
+	return token, err
+}
+
+// RevokeSession signs out the session the session revoke token was issued for, which
+// uses up the token too, and returns the ID of the session. It returns
+// ErrRecordNotFound if the token is invalid or expired, or the session has already
+// ended.
+func (m TokenModel) RevokeSession(plaintext string) (int64, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE id = (SELECT session_id FROM tokens WHERE hash = $1 AND scope = $2 AND expiry > $3)
+		RETURNING id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var id int64
+	err := m.DB.QueryRow(ctx, query, hash[:], ScopeSessionRevoke, time.Now()).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return id, nil
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
@@ -108,3 +312,178 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.Exec(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteEveryForUser deletes all of the user's tokens, whatever their scope, and
+// returns how many were deleted.
+func (m TokenModel) DeleteEveryForUser(userID int64) (int64, error) {
+	query := `
+			DELETE FROM tokens
+			WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// DeleteOthersForUser deletes the user's tokens with the scope except the one with
+// keepPlaintext, and returns how many were deleted.
+func (m TokenModel) DeleteOthersForUser(scope string, userID int64, keepPlaintext string) (int64, error) {
+	keepHash := sha256.Sum256([]byte(keepPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash <> $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, scope, userID, keepHash[:])
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// DeleteExpired deletes every token which has passed its expiry time, and returns how
+// many were deleted.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `DELETE FROM tokens WHERE expiry < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// Introspect looks up the authentication token with the plaintext. It returns
+// ErrRecordNotFound unless the token would be accepted by the API: it hasn't expired,
+// been unused for longer than idle (0 for no limit), and belongs to a user who is
+// activated and not frozen. Tokens of other scopes, such as unsubscribe links, never
+// count as active.
+func (m TokenModel) Introspect(plaintext string, idle time.Duration) (*TokenIntrospection, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	var idleSince time.Time
+	if idle > 0 {
+		idleSince = time.Now().Add(-idle)
+	}
+	query := `
+		SELECT tokens.scope, tokens.user_id, tokens.created_at, tokens.expiry, tokens.impersonator_id IS NOT NULL, tokens.scopes
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > NOW()
+		AND coalesce(tokens.last_used_at, tokens.created_at) >= $3
+		AND users.activated AND users.frozen_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	token := TokenIntrospection{Active: true, Type: "token"}
+	var issuedAt, expiry time.Time
+	err := m.DB.QueryRow(ctx, query, hash[:], ScopeAuthentication, idleSince).Scan(&token.Scope, &token.UserID, &issuedAt, &expiry, &token.Impersonated, &token.Scopes)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	token.IssuedAt = &issuedAt
+	token.Expiry = &expiry
+	return &token, nil
+}
+
+// DeleteIdle deletes tokens with the scope which haven't been used for longer than
+// idle, or since they were issued if they've never been used, and returns how many
+// were deleted.
+func (m TokenModel) DeleteIdle(scope string, idle time.Duration) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND coalesce(last_used_at, created_at) < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, scope, time.Now().Add(-idle))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// RecordUsage saves when, where from and by what client tokens were last used, in a
+// single statement for the whole batch. Uses older than the one already recorded are
+// ignored, as are uses of tokens which have since been deleted.
+func (m TokenModel) RecordUsage(uses []TokenUse) error {
+	hashes := make([][]byte, len(uses))
+	times := make([]time.Time, len(uses))
+	ips := make([]string, len(uses))
+	userAgents := make([]string, len(uses))
+	for i, use := range uses {
+		hashes[i] = use.Hash
+		times[i] = use.At
+		ips[i] = use.IP
+		userAgents[i] = use.UserAgent
+		if len(userAgents[i]) > 500 {
+			userAgents[i] = userAgents[i][:500]
+		}
+	}
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = uses.at, last_used_ip = uses.ip, last_used_user_agent = uses.user_agent
+		FROM unnest($1::bytea[], $2::timestamptz[], $3::text[], $4::text[]) AS uses(hash, at, ip, user_agent)
+		WHERE tokens.hash = uses.hash AND (tokens.last_used_at IS NULL OR tokens.last_used_at < uses.at)`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, hashes, times, ips, userAgents)
+	return err
+}
+
+// GetAllForUser returns the user's unexpired tokens, newest first, apart from those
+// with unlistedScopes. currentPlaintext is the token used for the request, if any, and
+// is only used to set TokenInfo.Current.
+func (m TokenModel) GetAllForUser(userID int64, currentPlaintext string) ([]*TokenInfo, error) {
+	query := `
+		SELECT id, scope, created_at, expiry, user_agent, ip, hash = $3, impersonator_id IS NOT NULL, scopes,
+			last_used_at, last_used_ip, last_used_user_agent
+		FROM tokens
+		WHERE user_id = $1 AND expiry > $2 AND scope <> ALL($4)
+		ORDER BY created_at DESC, id DESC`
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userID, time.Now(), currentHash[:], unlistedScopes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*TokenInfo{}
+	for rows.Next() {
+		var token TokenInfo
+		err := rows.Scan(&token.ID, &token.Scope, &token.CreatedAt, &token.Expiry, &token.UserAgent, &token.IP, &token.Current, &token.Impersonated, &token.Scopes,
+			&token.LastUsedAt, &token.LastUsedIP, &token.LastUsedUserAgent)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Delete revokes one of the user's tokens.
+func (m TokenModel) Delete(id, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is the number of single-use recovery codes issued on enrollment.
+const RecoveryCodeCount = 10
+
+// TwoFactor is a user's TOTP enrollment. Secret is encrypted, and the enrollment only
+// takes effect once the user has proved their app works by verifying a code.
+type TwoFactor struct {
+	UserID       int64
+	Secret       []byte
+	Enabled      bool
+	LastUsedStep int64
+}
+
+// GenerateRecoveryCodes returns RecoveryCodeCount new codes in the form
+// "abcde-fghij", along with the hashes that should be stored.
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a code so that the dash and case don't matter.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+type TwoFactorModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the user's enrollment, or ErrRecordNotFound if they haven't started one.
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+		SELECT user_id, secret, enabled, last_used_step
+		FROM user_totp
+		WHERE user_id = $1`
+	var tf TwoFactor
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&tf.UserID, &tf.Secret, &tf.Enabled, &tf.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &tf, nil
+}
+
+// Enroll stores a new, not yet enabled, secret and recovery codes for the user,
+// replacing any earlier unfinished enrollment. It returns ErrEditConflict if two-factor
+// authentication is already enabled.
+func (m TwoFactorModel) Enroll(userID int64, secret []byte, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE NOT user_totp.enabled`
+	result, err := tx.Exec(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO totp_recovery_codes (user_id, hash)
+		SELECT $1, unnest($2::bytea[])`, userID, recoveryHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Enable turns on two-factor authentication after the first code has been verified.
+func (m TwoFactorModel) Enable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, `UPDATE user_totp SET enabled = true WHERE user_id = $1`, userID)
+	return err
+}
+
+// UseStep records that the code for step was used. It returns false if that step, or a
+// later one, has already been used, so a code can't be replayed.
+func (m TwoFactorModel) UseStep(userID, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `
+		UPDATE user_totp SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes. It returns false if the
+// code isn't valid or has already been used.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, `
+		DELETE FROM totp_recovery_codes
+		WHERE user_id = $1 AND hash = $2`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// Delete turns two-factor authentication off and removes the secret and recovery codes.
+func (m TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
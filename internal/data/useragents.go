@@ -0,0 +1,60 @@
+package data
+
+import "strings"
+
+// deviceOSes and deviceBrowsers map a token found in a user agent to the operating
+// system or browser it means, checked in order as browsers include each other's
+// tokens: Edge's user agent also says Chrome and Safari, and Chrome's says Safari.
+var (
+	deviceOSes = []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+	deviceBrowsers = []struct{ token, name string }{
+		{"Edg", "Edge"},
+		{"OPR/", "Opera"},
+		{"Opera", "Opera"},
+		{"YaBrowser/", "Yandex"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+)
+
+// DeviceFamily returns the browser and operating system a user agent names, without
+// their versions, such as "Chrome on Windows", so that a device's user agent stays the
+// same when its software is updated. A client which isn't a known browser is named
+// by the first product in its user agent, such as "okhttp".
+func DeviceFamily(userAgent string) string {
+	var os, browser string
+	for _, o := range deviceOSes {
+		if strings.Contains(userAgent, o.token) {
+			os = o.name
+			break
+		}
+	}
+	for _, b := range deviceBrowsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	if browser == "" {
+		product, _, _ := strings.Cut(strings.TrimSpace(userAgent), " ")
+		browser, _, _ = strings.Cut(product, "/")
+		browser = strings.ToLower(browser)
+	}
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
@@ -6,11 +6,16 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
+	_ "time/tzdata"
+	"unicode"
 )
 
 var (
@@ -24,13 +29,78 @@ type UserModel struct {
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   string    `json:"-"`
+	ID int64 `json:"id"`
+	// ExternalID identifies the user as a string, for clients which can't handle
+	// 64-bit integers. User routes accept it in place of the numeric ID.
+	ExternalID string    `json:"external_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	Password   password  `json:"-"`
+	// PasswordLogin is whether the user can log in with their password. It's false
+	// for users who only log in with a social login or passkey.
+	PasswordLogin bool `json:"-"`
+	Activated     bool `json:"activated"`
+	// APIVersion is the API version the user's integration is pinned to. It's set
+	// the first time they send an X-API-Version header.
+	APIVersion string `json:"api_version,omitempty"`
+	// PendingEmail is the address the user has asked to change their email to. It
+	// only replaces Email once the change has been confirmed.
+	PendingEmail string `json:"pending_email,omitempty"`
+	// The profile fields are shown to other users through Profile(), but only while
+	// ProfilePublic is true.
+	DisplayName   string `json:"display_name"`
+	Bio           string `json:"bio"`
+	AvatarURL     string `json:"avatar_url"`
+	ProfilePublic bool   `json:"profile_public"`
+	// Timezone is the IANA name of the user's timezone. Reading stats and streaks
+	// are split into days in this timezone.
+	Timezone string `json:"timezone"`
+	// LastLoginAt is when the user last logged in, and LastSeenAt when they last made
+	// an authenticated request. LastSeenAt is only updated every few minutes.
+	LastLoginAt *time.Time `json:"last_login_at"`
+	LastSeenAt  *time.Time `json:"last_seen_at"`
+	// FrozenAt is set while the account is under a legal hold, which stops the user
+	// logging in or changing anything and keeps their data from being deleted.
+	FrozenAt *time.Time `json:"frozen_at,omitempty"`
+	// ImpersonatorID is only set when the user was loaded from an impersonation token,
+	// and is the ID of the admin acting as them.
+	ImpersonatorID int64 `json:"-"`
+	// TokenScopes is only set when the user was loaded from an authentication token
+	// limited to some of their permissions, and lists them.
+	TokenScopes []string `json:"-"`
+	// AuthenticatedAt is only set when the user was loaded from an authentication
+	// token or JWT, and is when it was issued, so when they last logged in with it.
+	AuthenticatedAt time.Time `json:"-"`
+	// TokenVersion is copied into the JWTs issued to the user, and bumped by
+	// RevokeJWTs to stop the ones already issued working. It's only loaded by Get and
+	// GetByEmail.
+	TokenVersion int32  `json:"-"`
+	Version      string `json:"-"`
+}
+
+// Profile is the public view of a user. It leaves out the email address and anything
+// else which is only meant for the user themselves.
+type Profile struct {
+	ID          int64     `json:"id"`
+	ExternalID  string    `json:"external_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+}
+
+func (u *User) Profile() Profile {
+	return Profile{
+		ID:          u.ID,
+		ExternalID:  u.ExternalID,
+		CreatedAt:   u.CreatedAt,
+		Name:        u.Name,
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		AvatarURL:   u.AvatarURL,
+	}
 }
 
 // Create a custom password type which is a struct containing the plaintext and hashed
@@ -42,14 +112,22 @@ type password struct {
 	hash      []byte
 }
 
+// isDuplicateEmail reports whether err is a violation of the UNIQUE "users_email_key"
+// constraint. We check the SQLSTATE code rather than the message, because the message
+// is translated according to the database server's locale.
+func isDuplicateEmail(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "users_email_key"
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method hashes a plaintext password with the configured PasswordHashing,
+// and stores both the hash and the plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -58,37 +136,82 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// Matches reports whether plaintextPassword is the user's password. Anonymized
+// accounts have an empty hash, which never matches.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return comparePassword(p.hash, plaintextPassword)
+}
+
+// NeedsRehash reports whether the password was hashed with different settings from
+// the current PasswordHashing, and should be hashed again once the user has proved
+// they know it.
+func (p *password) NeedsRehash() bool {
+	return passwordNeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
+
+// ValidatePasswordPlaintext checks a new password. As well as the length limits it
+// turns away passwords which are on the deny-list or are too easy to guess, with a
+// message telling the user what to do instead. Only the first problem found is
+// reported.
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
+	ValidatePasswordInput(v, password)
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
+	v.Check(!IsCommonPassword(password), "password", "is too common and appears in lists of leaked passwords, choose something less predictable")
+	v.Check(PasswordEntropy(password) >= MinPasswordEntropy, "password", "is too easy to guess, make it longer or mix in upper case letters, numbers and symbols, and avoid repeated characters and sequences like abc or 123")
+}
+
+// ValidatePasswordForUser checks a new password for an existing user. As well as
+// everything ValidatePasswordPlaintext checks, the password mustn't contain the
+// user's name or email address, which are the first things someone guessing it would
+// try. Every way of setting a password must use this or ValidateUser.
+func ValidatePasswordForUser(v *validator.Validator, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+	v.Check(!passwordContains(password, user.Name, user.Email), "password", "must not contain your name or email address")
+}
+
+// ValidatePasswordInput checks a password the user typed to prove who they are, such
+// as when logging in. The strength rules aren't applied, so that users with a password
+// set before they existed can still log in.
+func ValidatePasswordInput(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
+func ValidateProfile(v *validator.Validator, user *User) {
+	v.Check(len(user.DisplayName) <= 100, "display_name", "must not be more than 100 bytes long")
+	v.Check(len(user.Bio) <= 2000, "bio", "must not be more than 2000 bytes long")
+	if user.AvatarURL != "" {
+		u, err := url.Parse(user.AvatarURL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "avatar_url", "must be an absolute http or https URL")
+		v.Check(len(user.AvatarURL) <= 2000, "avatar_url", "must not be more than 2000 bytes long")
+	}
+	v.Check(ValidTimezone(user.Timezone), "timezone", "must be a valid IANA timezone name, like Asia/Almaty")
+}
+
+// ValidTimezone reports whether name is a timezone we can split days in. The days are
+// worked out in Go with the embedded timezone database, never by Postgres, so a name
+// which passes here can always be used.
+func ValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 	// If the plaintext password is not nil, call the standalone
-	// ValidatePasswordPlaintext() helper.
+	// ValidatePasswordForUser() helper.
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordForUser(v, *user.Password.plaintext, user)
 	}
 	// If the password hash is ever nil, this will be due to a logic error in our
 	// codebase (probably because we forgot to set a password for the user). It's a
@@ -102,20 +225,20 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 func (m UserModel) Insert(user *User, r *http.Request) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+		INSERT INTO users (name, email, password_hash, password_login, activated)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, timezone, external_id, version`
+	args := []any{user.Name, user.Email, user.Password.hash, user.PasswordLogin, user.Activated}
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
 	// constraint that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
-	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Timezone, &user.ExternalID, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `ОШИБКА: повторяющееся значение ключа нарушает ограничение уникальности "users_email_key" (SQLSTATE 23505)`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -126,7 +249,7 @@ func (m UserModel) Insert(user *User, r *http.Request) error {
 
 func (m UserModel) GetByEmail(email string, r *http.Request) (*User, error) {
 	query := `
-SELECT id, created_at, name, email, password_hash, activated, version
+SELECT id, created_at, name, email, password_hash, password_login, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version, token_version
 FROM users
 WHERE email = $1`
 	var user User
@@ -138,8 +261,21 @@ WHERE email = $1`
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
+		&user.PasswordLogin,
 		&user.Activated,
+		&user.APIVersion,
+		&user.PendingEmail,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.ProfilePublic,
+		&user.Timezone,
+		&user.LastLoginAt,
+		&user.LastSeenAt,
+		&user.FrozenAt,
+		&user.ExternalID,
 		&user.Version,
+		&user.TokenVersion,
 	)
 	if err != nil {
 		switch {
@@ -154,17 +290,208 @@ WHERE email = $1`
 	return &user, nil
 }
 
+// Get returns the user with the given ID.
+func (m UserModel) Get(id int64, r *http.Request) (*User, error) {
+	query := `
+SELECT id, created_at, name, email, password_hash, password_login, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version, token_version
+FROM users
+WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.PasswordLogin,
+		&user.Activated,
+		&user.APIVersion,
+		&user.PendingEmail,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.ProfilePublic,
+		&user.Timezone,
+		&user.LastLoginAt,
+		&user.LastSeenAt,
+		&user.FrozenAt,
+		&user.ExternalID,
+		&user.Version,
+		&user.TokenVersion,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAll returns a page of users whose email contains email and, unless activated is
+// nil, whose activation status matches it. If inactiveSince is set, only users who
+// haven't been seen since then are returned.
+func (m UserModel) GetAll(email string, activated *bool, inactiveSince *time.Time, filters Filters, r *http.Request) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, email, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version
+FROM users
+WHERE (email ILIKE '%%' || $1 || '%%' OR $1 = '')
+AND ($2::boolean IS NULL OR activated = $2)
+AND ($3::timestamptz IS NULL OR last_seen_at IS NULL OR last_seen_at < $3)
+ORDER BY %s %s, id ASC
+LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, escapeLike(email), activated, inactiveSince, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.APIVersion,
+			&user.PendingEmail,
+			&user.DisplayName,
+			&user.Bio,
+			&user.AvatarURL,
+			&user.ProfilePublic,
+			&user.Timezone,
+			&user.LastLoginAt,
+			&user.LastSeenAt,
+			&user.FrozenAt,
+			&user.ExternalID,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// userSearchQuery turns what an admin typed into a tsquery matching users whose name
+// or email has words starting with each of the words typed, so "ali exa" finds
+// alice@example.com. Anything but letters, digits and dots is treated as a space,
+// which keeps tsquery operators out of the query.
+func userSearchQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.'
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.Trim(word, ".")
+		if word != "" {
+			terms = append(terms, word+":*")
+		}
+	}
+	return strings.Join(terms, " & ")
+}
+
+func ValidateUserSearch(v *validator.Validator, q string) {
+	v.Check(len(q) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(userSearchQuery(q) != "", "q", "must contain a letter or digit")
+}
+
+// Search finds users by prefixes of the words in their name and email, using the
+// users_search_idx index. It takes the same filters as GetAll, and filters.Sort can
+// also be relevance or -relevance to order the best matches first or last.
+func (m UserModel) Search(q string, activated *bool, inactiveSince *time.Time, filters Filters, r *http.Request) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, email, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version,
+	ts_rank(to_tsvector('simple', name || ' ' || replace(email, '@', ' ')), to_tsquery('simple', $1)) AS relevance
+FROM users
+WHERE to_tsvector('simple', name || ' ' || replace(email, '@', ' ')) @@ to_tsquery('simple', $1)
+AND ($2::boolean IS NULL OR activated = $2)
+AND ($3::timestamptz IS NULL OR last_seen_at IS NULL OR last_seen_at < $3)
+ORDER BY %s %s, id ASC
+LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query, userSearchQuery(q), activated, inactiveSince, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		var relevance float32
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.APIVersion,
+			&user.PendingEmail,
+			&user.DisplayName,
+			&user.Bio,
+			&user.AvatarURL,
+			&user.ProfilePublic,
+			&user.Timezone,
+			&user.LastLoginAt,
+			&user.LastSeenAt,
+			&user.FrozenAt,
+			&user.ExternalID,
+			&user.Version,
+			&relevance,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
 func (m UserModel) Update(user *User, r *http.Request) error {
 	query := `
 UPDATE users
-SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-WHERE id = $5 AND version = $6
+SET name = $1, email = $2, password_hash = $3, activated = $4, pending_email = nullif($5, ''),
+	display_name = $6, bio = $7, avatar_url = $8, profile_public = $9, timezone = $10, version = uuid_generate_v4()
+WHERE id = $11 AND version = $12
 RETURNING version`
 	args := []any{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.PendingEmail,
+		user.DisplayName,
+		user.Bio,
+		user.AvatarURL,
+		user.ProfilePublic,
+		user.Timezone,
 		user.ID,
 		user.Version,
 	}
@@ -173,7 +500,7 @@ RETURNING version`
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `ОШИБКА: повторяющееся значение ключа нарушает ограничение уникальности "users_email_key" (SQLSTATE 23505)`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -192,7 +519,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
-SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.password_login, users.activated, users.api_version, coalesce(users.pending_email, ''), users.display_name, users.bio, users.avatar_url, users.profile_public, users.timezone, users.last_login_at, users.last_seen_at, users.frozen_at, users.external_id, users.version, coalesce(tokens.impersonator_id, 0), tokens.scopes, tokens.created_at
 FROM users
 INNER JOIN tokens
 ON users.id = tokens.user_id
@@ -215,13 +542,30 @@ AND tokens.expiry > $3`
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
+		&user.PasswordLogin,
 		&user.Activated,
+		&user.APIVersion,
+		&user.PendingEmail,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.ProfilePublic,
+		&user.Timezone,
+		&user.LastLoginAt,
+		&user.LastSeenAt,
+		&user.FrozenAt,
+		&user.ExternalID,
 		&user.Version,
+		&user.ImpersonatorID,
+		&user.TokenScopes,
+		&user.AuthenticatedAt,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
 		default:
 			return nil, err
 		}
@@ -229,3 +573,294 @@ AND tokens.expiry > $3`
 	// Return the matching user.
 	return &user, nil
 }
+
+// ActivationReplayWindow is how long an activation token can be used again after it
+// has activated its user, so that a link clicked twice, or a request retried after
+// its response was lost, gets the same response rather than an error.
+const ActivationReplayWindow = 10 * time.Minute
+
+// Activate consumes the activation token and activates its user in one transaction,
+// deleting the user's other activation tokens as well. The user's row is locked
+// first, in the same order as TokenModel.Replace takes its locks so the two can't
+// deadlock, and then the token's, so if the same token is used twice at once the
+// second use waits for the first. Using it again within ActivationReplayWindow
+// returns the user without changing anything, and after that it gets
+// ErrRecordNotFound, as for an unknown or expired token.
+func (m UserModel) Activate(tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int64
+	query := `
+SELECT users.id
+FROM users
+INNER JOIN tokens ON tokens.user_id = users.id
+WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3
+FOR UPDATE OF users`
+	err = tx.QueryRow(ctx, query, tokenHash[:], ScopeActivation, time.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	// The token may have been replaced while we waited for the user's lock.
+	query = `
+SELECT last_used_at IS NOT NULL
+FROM tokens
+WHERE hash = $1 AND scope = $2 AND expiry > $3
+FOR UPDATE`
+	var used bool
+	err = tx.QueryRow(ctx, query, tokenHash[:], ScopeActivation, time.Now()).Scan(&used)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	columns := `id, created_at, name, email, activated, api_version, coalesce(pending_email, ''), display_name, bio, avatar_url, profile_public, timezone, last_login_at, last_seen_at, frozen_at, external_id, version`
+	if used {
+		query = `SELECT ` + columns + ` FROM users WHERE id = $1`
+	} else {
+		query = `
+UPDATE users
+SET activated = true, version = uuid_generate_v4()
+WHERE id = $1
+RETURNING ` + columns
+	}
+	var user User
+	err = tx.QueryRow(ctx, query, userID).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.APIVersion,
+		&user.PendingEmail,
+		&user.DisplayName,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.ProfilePublic,
+		&user.Timezone,
+		&user.LastLoginAt,
+		&user.LastSeenAt,
+		&user.FrozenAt,
+		&user.ExternalID,
+		&user.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return &user, nil
+	}
+
+	// The token is marked as used and kept until the replay window is over, when it
+	// expires and is cleaned up with the others.
+	query = `
+UPDATE tokens
+SET last_used_at = NOW(), expiry = least(expiry, NOW() + $2::interval)
+WHERE hash = $1`
+	_, err = tx.Exec(ctx, query, tokenHash[:], ActivationReplayWindow)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2 AND hash <> $3`, ScopeActivation, userID, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RehashPassword hashes the user's password again with the current settings. It must
+// only be called with a plaintext password which Matches. The hash is only replaced
+// if it hasn't changed since the user was read, so a password changed in the
+// meantime isn't undone. The user's version is left alone, as nothing clients see has
+// changed.
+func (m UserModel) RehashPassword(user *User, plaintextPassword string) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	query := `
+UPDATE users
+SET password_hash = $1
+WHERE id = $2 AND password_hash = $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.Exec(ctx, query, hash, user.ID, user.Password.hash)
+	return err
+}
+
+// RecordLogin records that the user has just logged in, which also counts as seeing
+// them.
+func (m UserModel) RecordLogin(userID int64) error {
+	query := `
+UPDATE users
+SET last_login_at = NOW(), last_seen_at = NOW()
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// RecordSeen records that the user has just made a request.
+func (m UserModel) RecordSeen(userID int64) error {
+	query := `
+UPDATE users
+SET last_seen_at = NOW()
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// SetAPIVersion pins the user to the given API version.
+func (m UserModel) SetAPIVersion(userID int64, apiVersion string) error {
+	query := `
+UPDATE users
+SET api_version = $1
+WHERE id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, apiVersion, userID)
+	return err
+}
+
+// RevokeJWTs stops every JWT issued to the user so far from working, by bumping their
+// token version, and returns the new version for any JWT issued from now on.
+func (m UserModel) RevokeJWTs(userID int64) (int32, error) {
+	query := `
+UPDATE users
+SET token_version = token_version + 1
+WHERE id = $1
+RETURNING token_version`
+	var version int32
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// ClaimActivationResend records that another activation email is being sent to the
+// user, as long as none has been sent in the last interval, whether by an earlier
+// resend or at registration. The check and the update are one statement, so of two
+// requests racing each other only one gets to send. It returns the zero time if the
+// email can be sent, and otherwise when the next one can be.
+func (m UserModel) ClaimActivationResend(userID int64, interval time.Duration) (time.Time, error) {
+	query := `
+UPDATE users
+SET activation_sent_at = NOW()
+WHERE id = $1
+AND (activation_sent_at IS NULL OR activation_sent_at <= NOW() - $2::interval)
+AND NOT EXISTS (
+	SELECT 1 FROM tokens
+	WHERE scope = $3 AND user_id = users.id AND created_at > NOW() - $2::interval)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, userID, interval, ScopeActivation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if result.RowsAffected() == 1 {
+		return time.Time{}, nil
+	}
+
+	query = `
+SELECT GREATEST(activation_sent_at, (SELECT max(created_at) FROM tokens WHERE scope = $2 AND user_id = users.id))
+FROM users
+WHERE id = $1`
+	var sent *time.Time
+	err = m.DB.QueryRow(ctx, query, userID, ScopeActivation).Scan(&sent)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return time.Time{}, ErrRecordNotFound
+	case err != nil:
+		return time.Time{}, err
+	case sent == nil:
+		// Nothing has been sent after all, so the row changed in between. Asking
+		// again will succeed.
+		return time.Now().Add(time.Second), nil
+	}
+	return sent.Add(interval), nil
+}
+
+// Delete permanently removes a user and everything that belongs to them inside a
+// single transaction. Most of the related rows would be removed by ON DELETE CASCADE
+// anyway, but deleting them explicitly keeps this correct if a table is added without
+// the cascade. It returns ErrAccountFrozen for an account under a legal hold.
+func (m UserModel) Delete(userID int64, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Accounts under a legal hold are kept until it's released.
+	var frozen bool
+	err = tx.QueryRow(ctx, `SELECT frozen_at IS NOT NULL FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&frozen)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if frozen {
+		return ErrAccountFrozen
+	}
+
+	queries := []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM users_roles WHERE user_id = $1`,
+	}
+	for _, query := range queries {
+		_, err = tx.Exec(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit(ctx)
+}
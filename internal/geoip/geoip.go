@@ -0,0 +1,108 @@
+// Package geoip looks up roughly where IP addresses are, from a CSV database of
+// networks such as those derived from the free GeoLite2 data.
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Location is where a network is. Country is an ISO 3166 code such as "KZ".
+type Location struct {
+	Country   string  `json:"country"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type network struct {
+	prefix   netip.Prefix
+	location Location
+}
+
+// Database maps networks to locations. A nil *Database is valid and knows nothing.
+type Database struct {
+	networks []network
+}
+
+// Read reads a database in CSV, one network per line, without a header:
+//
+//	2.132.0.0/14,KZ,43.25,76.95
+//
+// Networks mustn't overlap.
+func Read(r io.Reader) (*Database, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	cr.Comment = '#'
+
+	db := &Database{}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+		latitude, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %s: invalid latitude", record[0])
+		}
+		longitude, err := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %s: invalid longitude", record[0])
+		}
+		db.networks = append(db.networks, network{
+			prefix:   prefix.Masked(),
+			location: Location{Country: strings.ToUpper(strings.TrimSpace(record[1])), Latitude: latitude, Longitude: longitude},
+		})
+	}
+
+	sort.Slice(db.networks, func(i, j int) bool {
+		return db.networks[i].prefix.Addr().Less(db.networks[j].prefix.Addr())
+	})
+	return db, nil
+}
+
+// Lookup returns the location of the network the IP address is in, or false if it
+// isn't in any of them or isn't a valid address.
+func (db *Database) Lookup(ip string) (Location, bool) {
+	if db == nil {
+		return Location{}, false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Location{}, false
+	}
+	addr = addr.Unmap()
+
+	// Find the last network starting at or before the address; as networks don't
+	// overlap, it's the only one which can contain it.
+	i := sort.Search(len(db.networks), func(i int) bool {
+		return addr.Less(db.networks[i].prefix.Addr())
+	})
+	if i == 0 || !db.networks[i-1].prefix.Contains(addr) {
+		return Location{}, false
+	}
+	return db.networks[i-1].location, true
+}
+
+// Distance returns the great circle distance between two locations in kilometres.
+func Distance(a, b Location) float64 {
+	const earthRadius = 6371
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,197 @@
+// Package jsoncase rewrites the object keys of encoded JSON between snake_case and
+// camelCase. Doing it on the encoded JSON, rather than with struct tags, means every
+// response gets the same casing, and every request body is accepted in either, without
+// the types knowing about it.
+package jsoncase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Camel returns js with every snake_case object key converted to camelCase, indented
+// with indent like json.MarshalIndent. Values, and keys which aren't snake_case
+// identifiers such as permission codes or dates used as map keys, are left alone.
+func Camel(js []byte, indent string) ([]byte, error) {
+	return rewriteKeys(js, indent, Key)
+}
+
+// Snake returns js, compacted, with every camelCase object key converted to
+// snake_case. It undoes Camel, so that request bodies can be sent with the same keys
+// as the responses.
+func Snake(js []byte) ([]byte, error) {
+	return rewriteKeys(js, "", SnakeKey)
+}
+
+// rewriteKeys returns js with every object key passed through rewrite.
+func rewriteKeys(js []byte, indent string, rewrite func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var out bytes.Buffer
+	// stack holds the objects and arrays being written. The decoder doesn't return
+	// commas and colons, so they're put back from what's known about each one: whether
+	// it's an object, whether its next token is a key, and whether it's empty so far.
+	type container struct{ object, key, empty bool }
+	var stack []*container
+
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var top *container
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			out.WriteByte(byte(delim))
+			stack = stack[:len(stack)-1]
+			// The closed container was a value, so what follows it in an object
+			// is a key.
+			if len(stack) > 0 {
+				stack[len(stack)-1].key = true
+			}
+			continue
+		}
+
+		isKey := top != nil && top.object && top.key
+		switch {
+		case top == nil:
+		case top.object && !isKey:
+			out.WriteByte(':')
+		case !top.empty:
+			out.WriteByte(',')
+		}
+		if top != nil {
+			top.empty = false
+			top.key = false
+		}
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(tok))
+			stack = append(stack, &container{object: tok == '{', key: tok == '{', empty: true})
+			continue
+		case string:
+			if isKey {
+				tok = rewrite(tok)
+			}
+			b, err := json.Marshal(tok)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(b)
+		case json.Number:
+			out.WriteString(tok.String())
+		case bool:
+			if tok {
+				out.WriteString("true")
+			} else {
+				out.WriteString("false")
+			}
+		case nil:
+			out.WriteString("null")
+		}
+		// After a key comes its value, and after a value the next key.
+		if top != nil && top.object {
+			top.key = !isKey
+		}
+	}
+
+	if indent == "" {
+		return out.Bytes(), nil
+	}
+	var indented bytes.Buffer
+	err := json.Indent(&indented, out.Bytes(), "", indent)
+	if err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+// Key converts a snake_case identifier, such as created_at, to camelCase. Anything
+// else is returned unchanged.
+func Key(key string) string {
+	if !isSnake(key) {
+		return key
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range key {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// isSnake reports whether key is lower case letters and digits in words joined by
+// single underscores, with at least one underscore.
+func isSnake(key string) bool {
+	if key == "" || key[0] < 'a' || key[0] > 'z' || !strings.Contains(key, "_") {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '_':
+			if i == len(key)-1 || key[i+1] == '_' {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SnakeKey converts a camelCase identifier, such as createdAt, to snake_case. Anything
+// else, including keys which are already snake_case, is returned unchanged.
+func SnakeKey(key string) string {
+	if !isCamel(key) {
+		return key
+	}
+	var b strings.Builder
+	for _, r := range key {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isCamel reports whether key is letters and digits starting with a lower case letter,
+// with at least one upper case letter.
+func isCamel(key string) bool {
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		return false
+	}
+	upper := false
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		default:
+			return false
+		}
+	}
+	return upper
+}
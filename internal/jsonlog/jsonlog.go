@@ -2,26 +2,35 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Level int8
 
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota - 1 // Has the value -1.
+	LevelInfo                   // Has the value 0.
+	LevelWarn                   // Has the value 1.
+	LevelError                  // Has the value 2.
+	LevelFatal                  // Has the value 3.
+	LevelOff                    // Has the value 4.
 )
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
@@ -31,17 +40,43 @@ func (l Level) String() string {
 	}
 }
 
+// ParseLevel returns the level with the given name, in any case, such as "debug".
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("jsonlog: unknown level %q", name)
+}
+
 type Logger struct {
-	out      io.Writer
-	minLevel Level
+	out io.Writer
+	// minLevel is a Level, stored atomically so it can be changed while the logger is
+	// in use.
+	minLevel atomic.Int32
 	mu       sync.Mutex
 }
 
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
-	}
+	l := &Logger{out: out}
+	l.minLevel.Store(int32(minLevel))
+	return l
+}
+
+// MinLevel returns the minimum severity of the entries which are written.
+func (l *Logger) MinLevel() Level {
+	return Level(l.minLevel.Load())
+}
+
+// SetMinLevel changes the minimum severity of the entries which are written. It's
+// safe to call while the logger is in use.
+func (l *Logger) SetMinLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, properties)
 }
 
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
@@ -56,10 +91,15 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 }
 
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+	return l.printAt(level, time.Now(), message, properties)
+}
+
+// printAt writes an entry which happened at the given time, which for entries from
+// the slog Handler is when they were logged rather than when they reached us.
+func (l *Logger) printAt(level Level, at time.Time, message string, properties map[string]string) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
-		return 0, nil
+	if level < l.MinLevel() {
 		return 0, nil
 	}
 
@@ -71,7 +111,7 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 		Trace      string            `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
-		Time:       time.Now().UTC().Format(time.RFC3339),
+		Time:       at.UTC().Format(time.RFC3339),
 		Message:    message,
 		Properties: properties,
 	}
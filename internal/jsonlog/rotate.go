@@ -0,0 +1,147 @@
+package jsonlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix rotated files are given, which sorts them oldest
+// first.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is a log file which is rotated once it reaches MaxSize bytes or has
+// been written to for MaxAge, for deployments without a log collector. The old file
+// is renamed with the time it was rotated appended, such as
+// api.log.2024-03-01T12-00-00.000, and only the newest MaxBackups of those are kept.
+// Zero turns each of the limits off.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// openedAt is when the file was started or, for one left by an earlier run, when
+	// it was opened again, which its age is counted from.
+	openedAt time.Time
+	// rotateErr is the error the last rotation failed with, so that it's only reported
+	// once while rotating keeps failing the same way.
+	rotateErr string
+}
+
+// OpenRotatingFile opens the log file at path, appending to it if it exists.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file. Logs can hold email addresses and IP addresses, so a new one is
+// only readable by its owner and group.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would take it over MaxSize or
+// it's older than MaxAge. If rotating fails p is still written to the old file, the
+// error is reported on stderr, as the log can't be relied on to report it, and
+// rotating is tried again on the next write.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.due(int64(len(p))) {
+		err := f.rotate()
+		switch {
+		case err != nil && err.Error() != f.rotateErr:
+			f.rotateErr = err.Error()
+			fmt.Fprintf(os.Stderr, "jsonlog: rotating %s: %v\n", f.Path, err)
+		case err == nil:
+			f.rotateErr = ""
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) due(size int64) bool {
+	if f.MaxSize > 0 && f.size+size > f.MaxSize {
+		return true
+	}
+	return f.MaxAge > 0 && time.Since(f.openedAt) >= f.MaxAge
+}
+
+// rotate moves the file aside and starts a new one, then removes the oldest backups.
+func (f *RotatingFile) rotate() error {
+	backup := f.Path + "." + time.Now().UTC().Format(backupTimeFormat)
+	err := os.Rename(f.Path, backup)
+	if err != nil {
+		return err
+	}
+	old := f.file
+	err = f.open()
+	if err != nil {
+		// Carry on with the renamed file rather than lose entries.
+		return err
+	}
+	old.Close()
+	return f.removeOldBackups()
+}
+
+func (f *RotatingFile) removeOldBackups() error {
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, match := range matches {
+		_, err := time.Parse(backupTimeFormat, strings.TrimPrefix(match, f.Path+"."))
+		if err == nil {
+			backups = append(backups, match)
+		}
+	}
+	if len(backups) <= f.MaxBackups {
+		return nil
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-f.MaxBackups] {
+		err := os.Remove(backup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,113 @@
+//go:build go1.21
+
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Handler is a slog.Handler which writes through a Logger, so that code using
+// log/slog, including third-party libraries logging to slog's default logger, ends up
+// in the same JSON log as the rest of the application. Attributes become properties,
+// with the names of the groups they're in joined to their keys with dots.
+type Handler struct {
+	logger *Logger
+	// attrs are the properties added with WithAttrs, already formatted.
+	attrs map[string]string
+	// prefix is the groups opened with WithGroup, each followed by a dot.
+	prefix string
+}
+
+// NewHandler returns a slog.Handler which writes to logger, at its minimum level.
+func NewHandler(logger *Logger) *Handler {
+	return &Handler{logger: logger}
+}
+
+// fromSlog returns the Level a slog level is logged at. slog's levels between the
+// named ones round down.
+func fromSlog(level slog.Level) Level {
+	switch {
+	case level >= slog.LevelError:
+		return LevelError
+	case level >= slog.LevelWarn:
+		return LevelWarn
+	case level >= slog.LevelInfo:
+		return LevelInfo
+	default:
+		return LevelDebug
+	}
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return fromSlog(level) >= h.logger.MinLevel()
+}
+
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	var properties map[string]string
+	if len(h.attrs) > 0 || r.NumAttrs() > 0 {
+		properties = make(map[string]string, len(h.attrs)+r.NumAttrs())
+		for key, value := range h.attrs {
+			properties[key] = value
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(properties, h.prefix, a)
+			return true
+		})
+	}
+
+	at := r.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	_, err := h.logger.printAt(fromSlog(r.Level), at, r.Message, properties)
+	return err
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.attrs = make(map[string]string, len(h.attrs)+len(attrs))
+	for key, value := range h.attrs {
+		h2.attrs[key] = value
+	}
+	for _, a := range attrs {
+		addAttr(h2.attrs, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// addAttr adds the attribute to properties under its key with prefix in front,
+// following slog's rules: empty attributes are left out, and so are empty groups,
+// while the attributes of groups without a key are added as if they weren't grouped.
+func addAttr(properties map[string]string, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			addAttr(properties, prefix, ga)
+		}
+	case slog.KindTime:
+		properties[prefix+a.Key] = a.Value.Time().UTC().Format(time.RFC3339)
+	default:
+		properties[prefix+a.Key] = a.Value.String()
+	}
+}
@@ -0,0 +1,136 @@
+// Package jwt issues and verifies the HS256 signed JSON Web Tokens used by the
+// stateless authentication mode. It only implements what we need: a fixed set of
+// claims, and several keys identified by the "kid" header so that keys can be rotated.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// Claims is the payload of our tokens.
+type Claims struct {
+	Subject     int64    `json:"sub"`
+	Permissions []string `json:"perms"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+	// Scoped is set when Permissions were restricted to scopes asked for at login.
+	Scoped bool `json:"scoped,omitempty"`
+	// Version is the user's token version when the token was issued. The token stops
+	// being accepted once the user's version moves on.
+	Version int32 `json:"ver,omitempty"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Keys holds the signing keys. New tokens are signed with the first key, and tokens
+// signed with any of the keys are accepted. To rotate, put the new key first and keep
+// the old one until the tokens signed with it have expired.
+type Keys struct {
+	current string
+	secrets map[string][]byte
+}
+
+// ParseKeys parses a comma separated list of "id:secret" pairs.
+func ParseKeys(s string) (*Keys, error) {
+	keys := &Keys{secrets: make(map[string][]byte)}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[1]) < 32 {
+			return nil, errors.New("jwt keys must be id:secret pairs with secrets of at least 32 bytes")
+		}
+		if _, exists := keys.secrets[parts[0]]; exists {
+			return nil, fmt.Errorf("duplicate jwt key id %q", parts[0])
+		}
+		if keys.current == "" {
+			keys.current = parts[0]
+		}
+		keys.secrets[parts[0]] = []byte(parts[1])
+	}
+	return keys, nil
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign returns a signed token containing the claims.
+func (k *Keys) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: k.current})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return unsigned + "." + encoding.EncodeToString(sign(k.secrets[k.current], unsigned)), nil
+}
+
+// Verify checks the token's signature and expiry, and returns its claims.
+func (k *Keys) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	err := decode(parts[0], &h)
+	if err != nil || h.Algorithm != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	secret, ok := k.secrets[h.KeyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = decode(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// IsToken reports whether s is shaped like a JWT rather than one of our opaque
+// authentication tokens.
+func IsToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+func sign(secret []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decode(segment string, v any) error {
+	b, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
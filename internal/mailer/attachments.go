@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// MaxAttachmentSize caps the total size of an email's attachments before encoding.
+// Base64 adds a third, which keeps the email well inside the 25MB most mail servers
+// and the providers' APIs accept.
+const MaxAttachmentSize = 10 << 20
+
+// ErrAttachmentTooLarge is returned when an email's attachments add up to more than
+// MaxAttachmentSize.
+var ErrAttachmentTooLarge = fmt.Errorf("mailer: attachments exceed %d bytes", MaxAttachmentSize)
+
+// Attachment is a file sent with an email, such as an exported reading report.
+// ContentType may be empty, in which case it's guessed from the Filename's extension.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"-"`
+}
+
+// contentType returns the attachment's MIME type, falling back to the one registered
+// for its extension and then to application/octet-stream.
+func (a Attachment) contentType() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(a.Filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// checkAttachments returns an error if any attachment hasn't got a usable file name,
+// or they're too large to send together.
+func checkAttachments(attachments []Attachment) error {
+	var total int
+	for _, a := range attachments {
+		if a.Filename == "" || strings.ContainsAny(a.Filename, "/\\\r\n") {
+			return errors.New("mailer: attachment file names must be bare names")
+		}
+		total += len(a.Data)
+	}
+	if total > MaxAttachmentSize {
+		return ErrAttachmentTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The log and file providers are for development, where emails don't need to reach
+// anyone: they're written somewhere a developer can read them, such as to copy an
+// activation token. For a local SMTP catcher like MailHog, use the smtp provider with
+// host localhost and port 1025.
+
+type logProvider struct {
+	log func(message string, properties map[string]string)
+}
+
+// Log returns a provider which writes each email, plain-text body included, to log,
+// which is normally a jsonlog.Logger's PrintInfo. Attachments are only listed.
+func Log(log func(message string, properties map[string]string)) Provider {
+	return logProvider{log: log}
+}
+
+func (p logProvider) Deliver(message Message) error {
+	properties := map[string]string{
+		"message_id": message.MessageID,
+		"template":   message.Template,
+		"to":         message.To,
+		"from":       message.From,
+		"subject":    message.Subject,
+		"body":       message.PlainBody,
+	}
+	if len(message.Attachments) > 0 {
+		names := make([]string, len(message.Attachments))
+		for i, a := range message.Attachments {
+			names[i] = fmt.Sprintf("%s (%s, %d bytes)", a.Filename, a.contentType(), len(a.Data))
+		}
+		properties["attachments"] = strings.Join(names, ", ")
+	}
+	p.log("email", properties)
+	return nil
+}
+
+type fileProvider struct {
+	dir string
+}
+
+// File returns a provider which saves each email in the Maildir at dir, creating it
+// if need be, so it can be read with any mail client which opens a Maildir.
+func File(dir string) (Provider, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("mailer: %w", err)
+		}
+	}
+	return fileProvider{dir: dir}, nil
+}
+
+func (p fileProvider) Deliver(message Message) error {
+	var raw bytes.Buffer
+	_, err := buildMessage(message).WriteTo(&raw)
+	if err != nil {
+		return err
+	}
+
+	// Maildir readers pick up files in new, so each email is written to tmp first and
+	// moved there once it's complete.
+	b := make([]byte, 8)
+	rand.Read(b)
+	host, _ := os.Hostname()
+	name := strconv.FormatInt(time.Now().Unix(), 10) + "." + hex.EncodeToString(b) + "." + host
+	tmp := filepath.Join(p.dir, "tmp", name)
+	err = os.WriteFile(tmp, raw.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	err = os.Rename(tmp, filepath.Join(p.dir, "new", name))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("mailer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are the header fields DKIM signatures cover, those of them an email
+// has. From is required by RFC 6376; the rest are what a forwarder mustn't change.
+var dkimHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIM signs emails for a domain, so receiving servers can check that they came
+// from it with the public key published at <selector>._domainkey.<domain>. Emails
+// sent straight over SMTP without a signature are often taken for spam.
+type DKIM struct {
+	Domain   string
+	Selector string
+	key      crypto.Signer
+	// algorithm is the a= tag of the signatures: rsa-sha256 or ed25519-sha256.
+	algorithm string
+}
+
+// NewDKIM returns a DKIM signer for the domain and selector, with the private key
+// in PEM form. RSA keys, in PKCS #1 or PKCS #8, and Ed25519 keys in PKCS #8 are
+// supported.
+func NewDKIM(domain, selector string, keyPEM []byte) (*DKIM, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("mailer: DKIM needs a domain and selector")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("mailer: DKIM private key isn't PEM encoded")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("mailer: unsupported DKIM private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mailer: DKIM private key: %w", err)
+	}
+
+	d := &DKIM{Domain: domain, Selector: selector}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		// RFC 8301 forbids keys shorter than 1024 bits, and receivers ignore them.
+		if key.N.BitLen() < 1024 {
+			return nil, errors.New("mailer: DKIM RSA key must be at least 1024 bits")
+		}
+		d.key, d.algorithm = key, "rsa-sha256"
+	case ed25519.PrivateKey:
+		d.key, d.algorithm = key, "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("mailer: unsupported DKIM private key %T", key)
+	}
+	return d, nil
+}
+
+// Sign returns the raw email msg, with CRLF line endings, with a DKIM-Signature
+// header added to the top. Headers and body are canonicalized with the relaxed
+// algorithm, which survives the whitespace changes relays tend to make.
+func (d *DKIM) Sign(msg []byte, now time.Time) ([]byte, error) {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("mailer: DKIM: email has no body")
+	}
+	fields := splitHeaderFields(string(header) + "\r\n")
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	var signed []string
+	var hashed strings.Builder
+	for _, name := range dkimHeaders {
+		// When a header field appears more than once, verifiers take the last one.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				hashed.WriteString(relaxedHeader(fields[i]) + "\r\n")
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	value := "v=1; a=" + d.algorithm + "; c=relaxed/relaxed; d=" + d.Domain + "; s=" + d.Selector +
+		"; t=" + strconv.FormatInt(now.Unix(), 10) + "; h=" + strings.Join(signed, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	// The signature covers its own header field, with b= empty and no trailing CRLF.
+	hashed.WriteString(relaxedHeader("DKIM-Signature: " + value))
+
+	digest := sha256.Sum256([]byte(hashed.String()))
+	var sig []byte
+	var err error
+	if d.algorithm == "ed25519-sha256" {
+		// RFC 8463 signs the SHA-256 hash with PureEdDSA, rather than the data itself.
+		sig, err = d.key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		sig, err = d.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mailer: DKIM: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: " + foldSignature(value+base64.StdEncoding.EncodeToString(sig)) + "\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// splitHeaderFields splits a header block ending in CRLF into its fields, each with
+// its continuation lines but without the final CRLF.
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// relaxedHeader canonicalizes a header field as RFC 6376 section 3.4.2 says: the
+// name lower cased, the value unfolded with runs of whitespace reduced to one space,
+// and no whitespace around the colon or at the end.
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// relaxedBody canonicalizes a body as RFC 6376 section 3.4.4 says: whitespace at the
+// ends of lines removed, runs of it within lines reduced to one space, and empty
+// lines at the end removed.
+func relaxedBody(body []byte) []byte {
+	var b bytes.Buffer
+	for _, line := range strings.Split(string(body), "\r\n") {
+		space := false
+		for i := 0; i < len(line); i++ {
+			if line[i] == ' ' || line[i] == '\t' {
+				space = true
+				continue
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteByte(line[i])
+		}
+		b.WriteString("\r\n")
+	}
+	canonical := bytes.TrimRight(b.Bytes(), "\r\n")
+	if len(canonical) == 0 {
+		return nil
+	}
+	return append(canonical, '\r', '\n')
+}
+
+// foldSignature folds the DKIM-Signature value so its lines stay under the 78
+// characters RFC 5322 recommends. Whitespace is ignored in the b= tag, so the
+// signature can be broken anywhere.
+func foldSignature(value string) string {
+	const width = 72
+	var b strings.Builder
+	line := len("DKIM-Signature: ")
+	for _, tag := range strings.SplitAfter(value, "; ") {
+		if line+len(tag) > width {
+			b.WriteString("\r\n\t")
+			line = 1
+		}
+		for len(tag) > width {
+			b.WriteString(tag[:width-line])
+			tag = tag[width-line:]
+			b.WriteString("\r\n\t")
+			line = 1
+		}
+		b.WriteString(tag)
+		line += len(tag)
+	}
+	return b.String()
+}
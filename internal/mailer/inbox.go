@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// Message is a rendered email captured by an Inbox.
+type Message struct {
+	ID     int64     `json:"id"`
+	SentAt time.Time `json:"sent_at"`
+	// MessageID is the email's Message-ID header, without the angle brackets, and
+	// Template the file it was rendered from.
+	MessageID string `json:"message_id"`
+	Template  string `json:"template,omitempty"`
+	To        string `json:"to"`
+	From      string `json:"from"`
+	Subject   string `json:"subject"`
+	PlainBody string `json:"plain_body"`
+	HTMLBody  string `json:"html_body"`
+	// Attachments are listed by name and type; an Inbox doesn't serve their contents.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Headers are extra headers, such as List-Unsubscribe.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Inbox is an in-memory store for emails sent in sandbox mode, so developers can read
+// activation tokens and the like without a real SMTP server. It only keeps the most
+// recent messages.
+type Inbox struct {
+	mu       sync.Mutex
+	messages []Message
+	size     int
+	nextID   int64
+}
+
+func NewInbox(size int) *Inbox {
+	return &Inbox{size: size}
+}
+
+// Deliver stores an email in the inbox, which makes an Inbox the Provider of a
+// sandbox Mailer.
+func (i *Inbox) Deliver(msg Message) error {
+	msg.SentAt = time.Now()
+	i.add(msg)
+	return nil
+}
+
+func (i *Inbox) add(msg Message) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nextID++
+	msg.ID = i.nextID
+	i.messages = append(i.messages, msg)
+	if len(i.messages) > i.size {
+		i.messages = i.messages[len(i.messages)-i.size:]
+	}
+}
+
+// Messages returns the messages in the inbox, newest first. If recipient isn't empty
+// only messages sent to that address are returned.
+func (i *Inbox) Messages(recipient string) []Message {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	messages := []Message{}
+	for j := len(i.messages) - 1; j >= 0; j-- {
+		if recipient == "" || i.messages[j].To == recipient {
+			messages = append(messages, i.messages[j])
+		}
+	}
+	return messages
+}
+
+// Clear deletes every message in the inbox.
+func (i *Inbox) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.messages = nil
+}
@@ -2,9 +2,14 @@ package mailer
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"embed"
-	"github.com/go-mail/mail/v2"
+	"encoding/hex"
+	"errors"
 	"html/template"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,33 +22,140 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for your emails (the name and address you
-// want the email to be from, such as "Alice Smith <alice@example.com>").
+// Define a Mailer struct which contains the Provider emails are delivered through
+// and the sender information for your emails (the name and address you want the
+// email to be from, such as "Alice Smith <alice@example.com>").
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	provider Provider
+	sender   string
+	// retry says how hard to try sending each email, and deadLetter is called with
+	// those which couldn't be sent. Both are set with WithRetries.
+	retry      RetryPolicy
+	deadLetter func(Failure)
+	// overrides are templates loaded from disk which replace the embedded ones with
+	// the same file names. They're set with WithTemplateDir.
+	overrides map[string]*template.Template
+	// observe is called after every attempt at delivering an email. It's set with
+	// WithObserver.
+	observe func(Attempt)
+	// quota is what each attempt is counted against, so that it stays inside the
+	// provider's limits, and deferSend queues the transactional emails over it. Both
+	// are set with WithQuota, and a nil quota means no limit. bulk is set by Bulk.
+	quota     Quota
+	deferSend func(Message, time.Duration) error
+	bulk      bool
+	// headers are added to every email sent. They're set with WithHeaders.
+	headers map[string]string
 }
 
+// RetryPolicy says how many times sending an email is attempted. The wait before
+// each retry doubles from Backoff up to MaxBackoff, and is jittered by up to half
+// so that emails which failed together aren't retried together.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Failure is an email which couldn't be sent however many times it was attempted.
+// It carries the rendered message, so it can be sent again later.
+type Failure struct {
+	Template string
+	Message  Message
+	Attempts int
+	Err      error
+}
+
+// Attempt is one try at delivering an email, as reported to the observer set with
+// WithObserver. Number counts from 1, and Final is true if there won't be another
+// try, because this one succeeded or the retries have run out.
+type Attempt struct {
+	Template  string
+	MessageID string
+	Number    int
+	Final     bool
+	Duration  time.Duration
+	Err       error
+}
+
+// New returns a Mailer which sends through an SMTP server.
 func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5-second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-	// Return a Mailer instance containing the dialer and sender information.
+	return NewWithProvider(SMTP(host, port, username, password), sender)
+}
+
+// NewWithProvider returns a Mailer which delivers emails through the given provider.
+func NewWithProvider(provider Provider, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		provider: provider,
+		sender:   sender,
+	}
+}
+
+// WithRetries returns a copy of the Mailer which attempts to send each email as
+// the policy says, and calls deadLetter, if it isn't nil, with each email which
+// still couldn't be sent. deadLetter is called on the sending goroutine.
+func (m Mailer) WithRetries(policy RetryPolicy, deadLetter func(Failure)) Mailer {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
 	}
+	m.retry = policy
+	m.deadLetter = deadLetter
+	return m
+}
+
+// WithObserver returns a copy of the Mailer which calls observe after every attempt
+// at delivering an email, for metrics and logging. observe is called on the sending
+// goroutine, so it should be quick.
+func (m Mailer) WithObserver(observe func(Attempt)) Mailer {
+	m.observe = observe
+	return m
+}
+
+// WithHeaders returns a copy of the Mailer which adds headers to the emails it sends,
+// such as List-Unsubscribe for an email to a particular recipient.
+func (m Mailer) WithHeaders(headers map[string]string) Mailer {
+	m.headers = headers
+	return m
+}
+
+// NewSandbox returns a Mailer which doesn't send anything, but stores every email it
+// renders in the given inbox.
+func NewSandbox(sender string, inbox *Inbox) Mailer {
+	return NewWithProvider(inbox, sender)
 }
 
 // Define a Send() method on the Mailer type. This takes the recipient email address
 // as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// dynamic data for the templates as an any parameter, followed by any files to attach,
+// which together can't be larger than MaxAttachmentSize. The email is in the default
+// language; use SendLocalized for emails to users.
+func (m Mailer) Send(recipient, templateFile string, data any, attachments ...Attachment) error {
+	return m.SendLocalized(recipient, DefaultLanguage, templateFile, data, attachments...)
+}
+
+// SendLocalized is Send with the template translated into the given language, or the
+// closest one it has been translated into, as LanguageChain says.
+func (m Mailer) SendLocalized(recipient, language, templateFile string, data any, attachments ...Attachment) error {
+	err := checkAttachments(attachments)
+	if err != nil {
+		return err
+	}
+	tmpl, err := m.template(language, templateFile)
 	if err != nil {
 		return err
 	}
@@ -68,24 +180,94 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	if err != nil {
 		return err
 	}
-	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
-	// Then we use the SetHeader() method to set the email recipient, sender and subject
-	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
-	// method to set the HTML body. It's important to note that AddAlternative() should
-	// always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-	// Call the DialAndSend() method on the dialer, passing in the message to send. This
-	// opens a connection to the SMTP server, sends the message, then closes the
-	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
-	// error.
-	err = m.dialer.DialAndSend(msg)
+	message := Message{
+		SentAt:      time.Now(),
+		MessageID:   m.newMessageID(),
+		Template:    templateFile,
+		To:          recipient,
+		From:        m.sender,
+		Subject:     subject.String(),
+		PlainBody:   plainBody.String(),
+		HTMLBody:    htmlBody.String(),
+		Attachments: attachments,
+		Headers:     m.headers,
+	}
+	// Retry sending with backoff, which only covers trouble reaching the provider; a
+	// template which doesn't render fails above without being retried.
+	attempts := m.retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	attempt := 1
+	for ; ; attempt++ {
+		// Each attempt counts against the quota, as the provider counts it.
+		err = m.take()
+		var over *OverQuotaError
+		if errors.As(err, &over) {
+			return m.overQuota(message, attempt-1, over)
+		}
+		if err == nil {
+			err = m.deliver(message, attempt, attempt == attempts)
+			if err == nil {
+				return nil
+			}
+		}
+		if attempt == attempts {
+			break
+		}
+		time.Sleep(m.retry.delay(attempt))
+	}
+	if m.deadLetter != nil {
+		m.deadLetter(Failure{Template: templateFile, Message: message, Attempts: attempt, Err: err})
+	}
+	return err
+}
+
+// SendMessage makes a single attempt to send an email which has already been
+// rendered, such as one which failed earlier or was deferred. It's given a Message-ID
+// if it hasn't got one. It fails with an *OverQuotaError rather than being deferred
+// if there's no room for it in the quota.
+func (m Mailer) SendMessage(message Message) error {
+	err := checkAttachments(message.Attachments)
 	if err != nil {
 		return err
 	}
-	return nil
+	if message.MessageID == "" {
+		message.MessageID = m.newMessageID()
+	}
+	err = m.take()
+	if err != nil {
+		return err
+	}
+	return m.deliver(message, 1, true)
+}
+
+// deliver hands message to the provider and reports the attempt to the observer.
+// final says whether this is the last attempt if it fails.
+func (m Mailer) deliver(message Message, attempt int, final bool) error {
+	start := time.Now()
+	err := m.provider.Deliver(message)
+	if m.observe != nil {
+		m.observe(Attempt{
+			Template:  message.Template,
+			MessageID: message.MessageID,
+			Number:    attempt,
+			Final:     final || err == nil,
+			Duration:  time.Since(start),
+			Err:       err,
+		})
+	}
+	return err
+}
+
+// newMessageID returns a unique Message-ID in the sender's domain, which mail servers
+// and providers log so that an email can be followed through them.
+func (m Mailer) newMessageID() string {
+	domain := "localhost"
+	if i := strings.LastIndex(m.sender, "@"); i >= 0 {
+		domain = strings.TrimRight(m.sender[i+1:], ">")
+	}
+	b := make([]byte, 12)
+	crand.Read(b)
+	return strconv.FormatInt(time.Now().Unix(), 36) + "." + hex.EncodeToString(b) + "@" + domain
 }
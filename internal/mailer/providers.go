@@ -0,0 +1,358 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-mail/mail/v2"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Provider delivers emails which have already been rendered. SMTP is one provider;
+// the others send through the HTTP APIs of email services, which don't have the
+// sending limits of a mailbox's SMTP account.
+type Provider interface {
+	Deliver(message Message) error
+}
+
+// Providers lists the names NewProvider accepts.
+var Providers = []string{"smtp", "sendgrid", "mailgun", "ses", "log", "file"}
+
+// ProviderConfig holds the settings of every provider; each only reads its own.
+type ProviderConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+
+	// APIKey is the SendGrid or Mailgun API key, and BaseURL optionally replaces
+	// the service's API address, such as for Mailgun's EU region.
+	APIKey        string
+	BaseURL       string
+	MailgunDomain string
+
+	SESRegion          string
+	SESAccessKeyID     string
+	SESSecretAccessKey string
+	SESSessionToken    string
+
+	// DKIM, if set, signs the emails the smtp provider sends. The other providers
+	// sign with the keys set up in the service.
+	DKIM *DKIM
+
+	// Log is what the log provider writes emails with, and Dir is the Maildir the
+	// file provider saves them in.
+	Log func(message string, properties map[string]string)
+	Dir string
+}
+
+// NewProvider returns the named provider, or an error if it's unknown or missing
+// settings it needs.
+func NewProvider(name string, cfg ProviderConfig) (Provider, error) {
+	switch name {
+	case "smtp":
+		return SignedSMTP(cfg.Host, cfg.Port, cfg.Username, cfg.Password, cfg.DKIM), nil
+	case "sendgrid":
+		if cfg.APIKey == "" {
+			return nil, errors.New("mailer: sendgrid needs an API key")
+		}
+		return SendGrid(cfg.APIKey, cfg.BaseURL), nil
+	case "mailgun":
+		if cfg.APIKey == "" || cfg.MailgunDomain == "" {
+			return nil, errors.New("mailer: mailgun needs an API key and domain")
+		}
+		return Mailgun(cfg.MailgunDomain, cfg.APIKey, cfg.BaseURL), nil
+	case "ses":
+		if cfg.SESRegion == "" || cfg.SESAccessKeyID == "" || cfg.SESSecretAccessKey == "" {
+			return nil, errors.New("mailer: ses needs a region, access key ID and secret access key")
+		}
+		return SES(cfg.SESRegion, cfg.SESAccessKeyID, cfg.SESSecretAccessKey, cfg.SESSessionToken, cfg.BaseURL), nil
+	case "log":
+		if cfg.Log == nil {
+			return nil, errors.New("mailer: log needs a logger")
+		}
+		return Log(cfg.Log), nil
+	case "file":
+		if cfg.Dir == "" {
+			return nil, errors.New("mailer: file needs a directory")
+		}
+		return File(cfg.Dir)
+	}
+	return nil, fmt.Errorf("mailer: unknown provider %q, must be one of %s", name, strings.Join(Providers, ", "))
+}
+
+type smtpProvider struct {
+	dialer *mail.Dialer
+	dkim   *DKIM
+}
+
+// SMTP returns a provider which sends through an SMTP server, opening a new
+// connection for each email.
+func SMTP(host string, port int, username, password string) Provider {
+	return SignedSMTP(host, port, username, password, nil)
+}
+
+// SignedSMTP is SMTP with the emails signed with dkim, unless it's nil.
+func SignedSMTP(host string, port int, username, password string, dkim *DKIM) Provider {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	return smtpProvider{dialer: dialer, dkim: dkim}
+}
+
+func (p smtpProvider) Deliver(message Message) error {
+	msg := buildMessage(message)
+	if p.dkim != nil {
+		return p.deliverSigned(message, msg)
+	}
+	// Call the DialAndSend() method on the dialer, passing in the message to send. This
+	// opens a connection to the SMTP server, sends the message, then closes the
+	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
+	// error.
+	return p.dialer.DialAndSend(msg)
+}
+
+// buildMessage turns message into a MIME email with plain-text and HTML parts, and
+// its attachments base64-encoded after them.
+func buildMessage(message Message) *mail.Message {
+	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
+	// Then we use the SetHeader() method to set the email recipient, sender and subject
+	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
+	// method to set the HTML body. It's important to note that AddAlternative() should
+	// always be called *after* SetBody().
+	msg := mail.NewMessage()
+	msg.SetHeader("To", message.To)
+	msg.SetHeader("From", message.From)
+	msg.SetHeader("Subject", message.Subject)
+	if message.MessageID != "" {
+		msg.SetHeader("Message-ID", "<"+message.MessageID+">")
+	}
+	for name, value := range message.Headers {
+		msg.SetHeader(name, value)
+	}
+	msg.SetBody("text/plain", message.PlainBody)
+	msg.AddAlternative("text/html", message.HTMLBody)
+	for _, a := range message.Attachments {
+		data := a.Data
+		msg.Attach(a.Filename,
+			mail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+			mail.SetHeader(map[string][]string{"Content-Type": {a.contentType()}}),
+		)
+	}
+	return msg
+}
+
+// deliverSigned sends msg with a DKIM signature. The signature has to cover the
+// exact bytes sent, so the message is rendered here rather than by the dialer.
+func (p smtpProvider) deliverSigned(message Message, msg *mail.Message) error {
+	var raw bytes.Buffer
+	_, err := msg.WriteTo(&raw)
+	if err != nil {
+		return err
+	}
+	signed, err := p.dkim.Sign(raw.Bytes(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	from := message.From
+	if addr, err := netmail.ParseAddress(message.From); err == nil {
+		from = addr.Address
+	}
+	s, err := p.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Send(from, []string{message.To}, bytes.NewReader(signed))
+}
+
+// apiClient is shared by the HTTP providers. The timeout matches the SMTP dialer's
+// order of magnitude, leaving retries to the Mailer.
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+
+// doAPI sends req and returns an error unless the response is a 2xx, including the
+// start of the body since that's where the services explain what was wrong.
+func doAPI(provider string, req *http.Request) error {
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("mailer: %s: %w", provider, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("mailer: %s responded %s: %s", provider, res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+type sendGridProvider struct {
+	apiKey  string
+	baseURL string
+}
+
+// SendGrid returns a provider which sends through SendGrid's v3 mail API. baseURL
+// may be empty.
+func SendGrid(apiKey, baseURL string) Provider {
+	if baseURL == "" {
+		baseURL = "https://api.sendgrid.com"
+	}
+	return sendGridProvider{apiKey: apiKey, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (p sendGridProvider) Deliver(message Message) error {
+	type address struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type attachment struct {
+		Content     string `json:"content"`
+		Type        string `json:"type"`
+		Filename    string `json:"filename"`
+		Disposition string `json:"disposition"`
+	}
+	// SendGrid wants the sender's name and address separately.
+	from := address{Email: message.From}
+	if addr, err := netmail.ParseAddress(message.From); err == nil {
+		from = address{Email: addr.Address, Name: addr.Name}
+	}
+	payload := map[string]any{
+		"personalizations": []map[string]any{{"to": []address{{Email: message.To}}}},
+		"from":             from,
+		"subject":          message.Subject,
+		"content": []content{
+			{Type: "text/plain", Value: message.PlainBody},
+			{Type: "text/html", Value: message.HTMLBody},
+		},
+	}
+	if len(message.Attachments) > 0 {
+		attachments := make([]attachment, len(message.Attachments))
+		for i, a := range message.Attachments {
+			attachments[i] = attachment{
+				Content:     base64.StdEncoding.EncodeToString(a.Data),
+				Type:        a.contentType(),
+				Filename:    a.Filename,
+				Disposition: "attachment",
+			}
+		}
+		payload["attachments"] = attachments
+	}
+	if len(message.Headers) > 0 {
+		payload["headers"] = message.Headers
+	}
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/v3/mail/send", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	return doAPI("sendgrid", req)
+}
+
+type mailgunProvider struct {
+	domain  string
+	apiKey  string
+	baseURL string
+}
+
+// Mailgun returns a provider which sends through Mailgun's messages API for the
+// given sending domain. baseURL may be empty, and should be
+// https://api.eu.mailgun.net for domains in the EU region.
+func Mailgun(domain, apiKey, baseURL string) Provider {
+	if baseURL == "" {
+		baseURL = "https://api.mailgun.net"
+	}
+	return mailgunProvider{domain: domain, apiKey: apiKey, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (p mailgunProvider) Deliver(message Message) error {
+	form := url.Values{
+		"from":    {message.From},
+		"to":      {message.To},
+		"subject": {message.Subject},
+		"text":    {message.PlainBody},
+		"html":    {message.HTMLBody},
+	}
+	if message.MessageID != "" {
+		form.Set("h:Message-Id", "<"+message.MessageID+">")
+	}
+	for name, value := range message.Headers {
+		form.Set("h:"+name, value)
+	}
+	endpoint := p.baseURL + "/v3/" + url.PathEscape(p.domain) + "/messages"
+	if len(message.Attachments) > 0 {
+		return p.deliverMultipart(endpoint, form, message.Attachments)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", p.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doAPI("mailgun", req)
+}
+
+// deliverMultipart sends an email with attachments, which Mailgun only takes as
+// files in a multipart form.
+func (p mailgunProvider) deliverMultipart(endpoint string, form url.Values, attachments []Attachment) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range form {
+		for _, value := range values {
+			err := mw.WriteField(name, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, a := range attachments {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     "attachment",
+			"filename": a.Filename,
+		}))
+		h.Set("Content-Type", a.contentType())
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(a.Data)
+		if err != nil {
+			return err
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", p.apiKey)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return doAPI("mailgun", req)
+}
@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Quota counts the emails sent against the provider's rate limits. Take counts another
+// email and returns zero if there's room for it now, and otherwise returns how long
+// until there might be. bulk says whether the email is bulk mail, such as a campaign
+// or digest, which should only get part of the limits so that transactional mail
+// isn't held up behind it. A Quota shared by every instance keeps them all inside the
+// provider's limits together.
+type Quota interface {
+	Take(bulk bool) (time.Duration, error)
+}
+
+// OverQuotaError is the error of an email which wasn't sent because the quota was used
+// up. It can be tried again after RetryAfter.
+type OverQuotaError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OverQuotaError) Error() string {
+	return fmt.Sprintf("mailer: over the sending quota, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// WithQuota returns a copy of the Mailer which only sends the emails quota has room
+// for. Nothing waits for room: a transactional email over the quota is handed to
+// deferSend, which should queue it durably to be sent with SendMessage after the
+// delay, and bulk mail over the quota fails with an *OverQuotaError, for its sender to
+// try again later.
+func (m Mailer) WithQuota(quota Quota, deferSend func(message Message, delay time.Duration) error) Mailer {
+	m.quota = quota
+	m.deferSend = deferSend
+	return m
+}
+
+// Bulk returns a copy of the Mailer for sending bulk mail, which only gets the part
+// of the quota set aside for it.
+func (m Mailer) Bulk() Mailer {
+	m.bulk = true
+	return m
+}
+
+// take counts an email against the quota, returning an *OverQuotaError if there's no
+// room for it.
+func (m Mailer) take() error {
+	if m.quota == nil {
+		return nil
+	}
+	wait, err := m.quota.Take(m.bulk)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &OverQuotaError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// overQuota deals with an email which there's no room for: a transactional one is
+// deferred, and dead-lettered if that fails, and bulk mail fails with err.
+func (m Mailer) overQuota(message Message, attempts int, err *OverQuotaError) error {
+	if m.bulk || m.deferSend == nil {
+		return err
+	}
+	deferErr := m.deferSend(message, err.RetryAfter)
+	if deferErr != nil && m.deadLetter != nil {
+		m.deadLetter(Failure{Template: message.Template, Message: message, Attempts: attempts, Err: fmt.Errorf("%v, and deferring it failed: %w", err, deferErr)})
+	}
+	return deferErr
+}
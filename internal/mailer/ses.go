@@ -0,0 +1,159 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type sesProvider struct {
+	region       string
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+	baseURL      string
+}
+
+// SES returns a provider which sends through the Amazon SES v2 API. sessionToken is
+// only needed with temporary credentials, and baseURL may be empty.
+func SES(region, accessKeyID, secretAccessKey, sessionToken, baseURL string) Provider {
+	if baseURL == "" {
+		baseURL = "https://email." + region + ".amazonaws.com"
+	}
+	return sesProvider{
+		region:       region,
+		accessKeyID:  accessKeyID,
+		secretKey:    secretAccessKey,
+		sessionToken: sessionToken,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (p sesProvider) Deliver(message Message) error {
+	type text struct {
+		Data    string `json:"Data"`
+		Charset string `json:"Charset"`
+	}
+	type simple struct {
+		Subject text
+		Body    struct {
+			Text text
+			Html text
+		}
+	}
+	var payload struct {
+		FromEmailAddress string
+		Destination      struct {
+			ToAddresses []string
+		}
+		Content struct {
+			Simple *simple `json:",omitempty"`
+			// Raw is a whole MIME email, which encoding/json base64-encodes as the
+			// API expects.
+			Raw *struct {
+				Data []byte
+			} `json:",omitempty"`
+		}
+	}
+	payload.FromEmailAddress = message.From
+	payload.Destination.ToAddresses = []string{message.To}
+	if len(message.Attachments) > 0 || len(message.Headers) > 0 {
+		// Simple content has no attachments or headers of our own, so the email is
+		// built here as for SMTP.
+		var raw bytes.Buffer
+		_, err := buildMessage(message).WriteTo(&raw)
+		if err != nil {
+			return err
+		}
+		payload.Content.Raw = &struct{ Data []byte }{raw.Bytes()}
+	} else {
+		content := &simple{Subject: text{message.Subject, "UTF-8"}}
+		content.Body.Text = text{message.PlainBody, "UTF-8"}
+		content.Body.Html = text{message.HTMLBody, "UTF-8"}
+		payload.Content.Simple = content
+	}
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/v2/email/outbound-emails", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.sign(req, js, time.Now().UTC())
+	return doAPI("ses", req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing the
+// host, date, content type and, with temporary credentials, the session token.
+func (p sesProvider) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         req.URL.Host,
+		"x-amz-date":   amzDate,
+	}
+	names := []string{"content-type", "host", "x-amz-date"}
+	if p.sessionToken != "" {
+		headers["x-amz-security-token"] = p.sessionToken
+		names = append(names, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + p.region + "/ses/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+p.secretKey), date)
+	key = hmacSHA256(key, p.region)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+p.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,131 @@
+package mailer
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// templateNames are the templates every email template file must define.
+var templateNames = []string{"subject", "plainBody", "htmlBody"}
+
+// DefaultLanguage is the language of the templates at the top of the templates
+// directory. Translations are in subdirectories named after their language.
+const DefaultLanguage = "en"
+
+// Fallbacks are the languages, for each language, whose templates are used when a
+// template hasn't been translated into it, before falling back to DefaultLanguage.
+// Kazakh speakers can generally read Russian.
+var Fallbacks = map[string][]string{
+	"kk": {"ru"},
+}
+
+// LanguageChain returns the languages whose templates are tried for an email in the
+// given language, in order. It always ends with DefaultLanguage.
+func LanguageChain(language string) []string {
+	var chain []string
+	if language != "" && language != DefaultLanguage {
+		chain = append(chain, language)
+		chain = append(chain, Fallbacks[language]...)
+	}
+	return append(chain, DefaultLanguage)
+}
+
+// templatePath is where the template file for a language is, relative to a templates
+// directory.
+func templatePath(language, templateFile string) string {
+	if language == DefaultLanguage {
+		return templateFile
+	}
+	return language + "/" + templateFile
+}
+
+// WithTemplateDir returns a copy of the Mailer which uses the templates in dir instead
+// of the embedded ones with the same file names, so emails can be rebranded without
+// recompiling. Translations go in a subdirectory named after their language, like the
+// embedded ones. The files are parsed once, here, and each has to define subject,
+// plainBody and htmlBody and replace an embedded template, so that mistakes are
+// caught at startup rather than when an email is sent. Files without the .tmpl
+// extension are ignored.
+func (m Mailer) WithTemplateDir(dir string) (Mailer, error) {
+	overrides := make(map[string]*template.Template)
+	err := loadOverrides(overrides, dir, DefaultLanguage)
+	if err != nil {
+		return m, err
+	}
+	m.overrides = overrides
+	return m, nil
+}
+
+// loadOverrides parses the templates for a language in dir into overrides, and for
+// the default language carries on into the subdirectories of the translations.
+func loadOverrides(overrides map[string]*template.Template, dir, language string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if entry.IsDir() {
+			if language != DefaultLanguage {
+				continue
+			}
+			if name == DefaultLanguage {
+				return fmt.Errorf("mailer: %s should be at the top of the template directory", path)
+			}
+			_, err := fs.Stat(templateFS, "templates/"+name)
+			if err != nil {
+				return fmt.Errorf("mailer: %s isn't a language emails are translated into", path)
+			}
+			err = loadOverrides(overrides, path, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if filepath.Ext(name) != ".tmpl" {
+			continue
+		}
+		_, err := fs.Stat(templateFS, "templates/"+name)
+		if err != nil {
+			return fmt.Errorf("mailer: %s doesn't override any email template", path)
+		}
+		tmpl, err := template.New("email").ParseFiles(path)
+		if err != nil {
+			return fmt.Errorf("mailer: %w", err)
+		}
+		var missing []string
+		for _, defined := range templateNames {
+			if tmpl.Lookup(defined) == nil {
+				missing = append(missing, defined)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("mailer: %s doesn't define %s", path, strings.Join(missing, ", "))
+		}
+		overrides[templatePath(language, name)] = tmpl
+	}
+	return nil
+}
+
+// template returns the parsed template file in the first language of the language's
+// chain which has it, preferring an override from disk to the embedded template.
+func (m Mailer) template(language, templateFile string) (*template.Template, error) {
+	for _, lang := range LanguageChain(language) {
+		path := templatePath(lang, templateFile)
+		if tmpl, ok := m.overrides[path]; ok {
+			return tmpl, nil
+		}
+		if _, err := fs.Stat(templateFS, "templates/"+path); err == nil {
+			// Use the ParseFS() method to parse the required template file from the
+			// embedded file system.
+			return template.New("email").ParseFS(templateFS, "templates/"+path)
+		}
+	}
+	// There's no such template, which ParseFS reports.
+	return template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+}
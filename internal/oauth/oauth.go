@@ -0,0 +1,214 @@
+// Package oauth implements the OAuth 2.0 authorization code flow for the social login
+// providers we support. It only goes as far as we need: sending the user to the
+// provider, exchanging the code for an access token, and fetching who they are.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrExchangeFailed   = errors.New("oauth: code exchange failed")
+	ErrNoVerifiedEmail  = errors.New("oauth: provider did not return a verified email address")
+	errUnexpectedStatus = errors.New("oauth: unexpected response status")
+)
+
+// Identity is the user as the provider knows them. Subject is the provider's stable
+// ID for the user, which unlike the email address never changes.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is a configured OAuth 2.0 identity provider.
+type Provider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+
+	client   *http.Client
+	identify func(ctx context.Context, p *Provider, accessToken string) (*Identity, error)
+}
+
+// Google returns the Google provider. The user is looked up with the OpenID Connect
+// userinfo endpoint.
+func Google(clientID, clientSecret string) *Provider {
+	return &Provider{
+		Name:         "google",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:     "https://oauth2.googleapis.com/token",
+		Scopes:       []string{"openid", "email", "profile"},
+		client:       &http.Client{Timeout: 10 * time.Second},
+		identify:     identifyGoogle,
+	}
+}
+
+// GitHub returns the GitHub provider. GitHub doesn't support OpenID Connect, so the
+// user and their verified email addresses are fetched from the REST API.
+func GitHub(clientID, clientSecret string) *Provider {
+	return &Provider{
+		Name:         "github",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AuthURL:      "https://github.com/login/oauth/authorize",
+		TokenURL:     "https://github.com/login/oauth/access_token",
+		Scopes:       []string{"read:user", "user:email"},
+		client:       &http.Client{Timeout: 10 * time.Second},
+		identify:     identifyGitHub,
+	}
+}
+
+// AuthCodeURL returns the provider's consent page URL that the user should be
+// redirected to.
+func (p *Provider) AuthCodeURL(state, redirectURI string) string {
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+	}
+	return p.AuthURL + "?" + params.Encode()
+}
+
+// Exchange swaps the authorization code from the callback for an access token, and
+// uses it to look up the user's identity.
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI string) (*Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	err = p.do(req, &token)
+	if err != nil {
+		return nil, err
+	}
+	// GitHub reports a bad code with a 200 response and an error field.
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("%w: %s", ErrExchangeFailed, token.Error)
+	}
+
+	identity, err := p.identify(ctx, p, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	identity.Provider = p.Name
+	return identity, nil
+}
+
+// get makes an authenticated GET request to the provider's API and decodes the JSON
+// response into dst.
+func (p *Provider) get(ctx context.Context, url, accessToken string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return p.do(req, dst)
+}
+
+func (p *Provider) do(req *http.Request, dst any) error {
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		if req.URL.String() == p.TokenURL {
+			return fmt.Errorf("%w: %s", ErrExchangeFailed, res.Status)
+		}
+		return fmt.Errorf("%w: %s %s", errUnexpectedStatus, req.URL, res.Status)
+	}
+	return json.Unmarshal(body, dst)
+}
+
+func identifyGoogle(ctx context.Context, p *Provider, accessToken string) (*Identity, error) {
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	err := p.get(ctx, "https://openidconnect.googleapis.com/v1/userinfo", accessToken, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		Name:          info.Name,
+	}, nil
+}
+
+func identifyGitHub(ctx context.Context, p *Provider, accessToken string) (*Identity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	err := p.get(ctx, "https://api.github.com/user", accessToken, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err = p.get(ctx, "https://api.github.com/user/emails", accessToken, &emails)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Subject: fmt.Sprint(user.ID),
+		Name:    user.Name,
+	}
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+	return identity, nil
+}
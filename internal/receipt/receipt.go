@@ -0,0 +1,160 @@
+// Package receipt lays out the slips printed at the circulation desk when a copy is
+// lent or returned. Receipts are plain text sized for 58mm thermal printers, and can
+// be wrapped in the ESC/POS commands those printers understand.
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Width is the number of characters on a line of a 58mm receipt.
+const Width = 32
+
+// Receipt is everything printed on a loan or return receipt. Fines are in the
+// smallest unit of Currency. ReturnedAt is nil on loan receipts.
+type Receipt struct {
+	Branch       string
+	Address      string
+	Phone        string
+	LoanID       int64
+	Member       string
+	Title        string
+	Barcode      string
+	CheckedOutAt time.Time
+	DueAt        time.Time
+	ReturnedAt   *time.Time
+	DailyFine    int32
+	MaxFine      int32
+	Fine         int64
+	Currency     string
+	// Location is the timezone dates are printed in.
+	Location *time.Location
+}
+
+// Text returns the receipt as plain text.
+func (rc *Receipt) Text() string {
+	var b strings.Builder
+	for _, line := range []string{rc.Branch, rc.Address, rc.Phone} {
+		if line != "" {
+			for _, l := range wrap(line) {
+				b.WriteString(center(l) + "\n")
+			}
+		}
+	}
+	b.WriteString(strings.Repeat("-", Width) + "\n")
+
+	heading := "LOAN RECEIPT"
+	if rc.ReturnedAt != nil {
+		heading = "RETURN RECEIPT"
+	}
+	b.WriteString(center(heading) + "\n\n")
+
+	b.WriteString(field("Loan", fmt.Sprintf("#%d", rc.LoanID)))
+	b.WriteString(field("Member", rc.Member))
+	b.WriteString("\n")
+	for _, l := range wrap(rc.Title) {
+		b.WriteString(l + "\n")
+	}
+	b.WriteString(field("Barcode", rc.Barcode))
+	b.WriteString(field("Borrowed", rc.in(rc.CheckedOutAt).Format("02 Jan 2006 15:04")))
+	b.WriteString(field("Due", rc.in(rc.DueAt).Format("02 Jan 2006")))
+	if rc.ReturnedAt != nil {
+		b.WriteString(field("Returned", rc.in(*rc.ReturnedAt).Format("02 Jan 2006 15:04")))
+		if rc.Fine > 0 {
+			b.WriteString(field("Fine due", rc.money(rc.Fine)))
+		}
+	}
+
+	b.WriteString(strings.Repeat("-", Width) + "\n")
+	var policy string
+	switch {
+	case rc.DailyFine == 0:
+		policy = "No fines are charged for overdue items."
+	case rc.MaxFine == 0:
+		policy = fmt.Sprintf("Overdue items are fined %s a day.", rc.money(int64(rc.DailyFine)))
+	default:
+		policy = fmt.Sprintf("Overdue items are fined %s a day, up to %s.", rc.money(int64(rc.DailyFine)), rc.money(int64(rc.MaxFine)))
+	}
+	for _, l := range wrap(policy) {
+		b.WriteString(l + "\n")
+	}
+	return b.String()
+}
+
+// ESCPOS returns the receipt as ESC/POS commands: it resets the printer, prints the
+// text and cuts the paper.
+func (rc *Receipt) ESCPOS() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x1b, '@'})
+	b.WriteString(rc.Text())
+	// Feed a few lines so the text clears the cutter, then do a partial cut.
+	b.Write([]byte{0x1d, 'V', 66, 3})
+	return b.Bytes()
+}
+
+func (rc *Receipt) in(t time.Time) time.Time {
+	if rc.Location == nil {
+		return t
+	}
+	return t.In(rc.Location)
+}
+
+func (rc *Receipt) money(amount int64) string {
+	return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, rc.Currency)
+}
+
+// field lays out a label on the left and its value on the right, moving the value to
+// the following lines if they don't fit together.
+func field(label, value string) string {
+	label += ":"
+	gap := Width - len([]rune(label)) - len([]rune(value))
+	if gap < 1 {
+		return label + "\n" + strings.Join(wrap(value), "\n") + "\n"
+	}
+	return label + strings.Repeat(" ", gap) + value + "\n"
+}
+
+func center(s string) string {
+	return strings.Repeat(" ", max0((Width-len([]rune(s)))/2)) + s
+}
+
+// wrap breaks s into lines of at most Width characters at spaces. Words longer than a
+// line are split.
+func wrap(s string) []string {
+	var lines []string
+	var line []rune
+	for _, word := range strings.Fields(s) {
+		w := []rune(word)
+		for len(w) > Width {
+			if len(line) > 0 {
+				lines = append(lines, string(line))
+				line = nil
+			}
+			lines = append(lines, string(w[:Width]))
+			w = w[Width:]
+		}
+		switch {
+		case len(line) == 0:
+			line = w
+		case len(line)+1+len(w) <= Width:
+			line = append(append(line, ' '), w...)
+		default:
+			lines = append(lines, string(line))
+			line = w
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
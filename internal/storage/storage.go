@@ -0,0 +1,78 @@
+// Package storage saves files produced by the API, such as analytics exports, for
+// other teams to pick up.
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store is somewhere files can be saved. Names are slash separated paths.
+type Store interface {
+	Exists(name string) (bool, error)
+	Put(name string, r io.Reader) error
+}
+
+// Dir is a Store which keeps files in a directory on the local disk, such as a
+// mounted network share.
+type Dir struct {
+	Root string
+}
+
+func (d Dir) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", errors.New("storage: invalid file name " + name)
+	}
+	return filepath.Join(d.Root, clean), nil
+}
+
+func (d Dir) Exists(name string) (bool, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Put writes the file to a temporary name and renames it into place, so a reader
+// never sees a partly written file.
+func (d Dir) Put(name string, r io.Reader) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
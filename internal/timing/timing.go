@@ -0,0 +1,110 @@
+package timing
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"strings"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+const recorderContextKey = contextKey("timing")
+
+// Metric is a single entry in a Server-Timing header.
+type Metric struct {
+	Name        string
+	Description string
+	Duration    time.Duration
+}
+
+// Recorder collects the metrics for one request. All of its methods are safe to call
+// on a nil Recorder, so code can record timings without checking whether Server-Timing
+// debugging is enabled.
+type Recorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	metrics []Metric
+	queries int
+}
+
+func New() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// NewContext returns a copy of ctx carrying the recorder.
+func NewContext(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderContextKey, r)
+}
+
+// FromContext returns the recorder stored in ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderContextKey).(*Recorder)
+	return r
+}
+
+func (r *Recorder) Add(name, description string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, Metric{Name: name, Description: description, Duration: d})
+}
+
+// Track starts timing something and returns a function which records the metric
+// when called. It's intended to be used with defer.
+func (r *Recorder) Track(name, description string) func() {
+	start := time.Now()
+	return func() {
+		r.Add(name, description, time.Since(start))
+	}
+}
+
+// Header formats the recorded metrics, plus the total time since the recorder was
+// created, as a Server-Timing header value.
+func (r *Recorder) Header() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parts := make([]string, 0, len(r.metrics)+1)
+	for _, m := range r.metrics {
+		part := fmt.Sprintf("%s;dur=%.3f", m.Name, float64(m.Duration.Microseconds())/1000)
+		if m.Description != "" {
+			part += fmt.Sprintf(";desc=%q", m.Description)
+		}
+		parts = append(parts, part)
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.3f", float64(time.Since(r.start).Microseconds())/1000))
+	return strings.Join(parts, ", ")
+}
+
+type queryStartKey struct{}
+
+// QueryTracer is a pgx.QueryTracer which records the duration of every database query
+// made with a context carrying a Recorder.
+type QueryTracer struct{}
+
+func (QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	if FromContext(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryStartKey{}, time.Now())
+}
+
+func (QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	r := FromContext(ctx)
+	start, ok := ctx.Value(queryStartKey{}).(time.Time)
+	if r == nil || !ok {
+		return
+	}
+	r.mu.Lock()
+	r.queries++
+	name := fmt.Sprintf("db-%d", r.queries)
+	r.mu.Unlock()
+	r.Add(name, data.CommandTag.String(), time.Since(start))
+}
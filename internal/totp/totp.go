@@ -0,0 +1,139 @@
+// Package totp implements the time-based one-time passwords (RFC 6238) used for
+// two-factor authentication, with the settings every authenticator app supports:
+// HMAC-SHA1, 6 digits and a 30 second step. It also encrypts the shared secrets so they
+// aren't stored in plaintext.
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	digits = 6
+	step   = 30
+	// skew is how many steps either side of the current one are accepted, to allow
+	// for clocks which are a little out.
+	skew = 1
+)
+
+var (
+	ErrInvalidKey = errors.New("totp: key must be 32 bytes, base64 encoded")
+	errDecrypt    = errors.New("totp: unable to decrypt secret")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random 160 bit secret.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the secret in the base32 form users type into their app.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URL returns the otpauth:// URL for the secret, which apps can scan as a QR code.
+func URL(issuer, account string, secret []byte) string {
+	params := url.Values{
+		"secret": {EncodeSecret(secret)},
+		"issuer": {issuer},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Code returns the code for the step containing t.
+func Code(secret []byte, t time.Time) string {
+	return code(secret, t.Unix()/step)
+}
+
+func code(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
+
+// Validate checks the code against the steps around t. If it matches, the step it
+// matched is returned so the caller can refuse to accept it a second time.
+func Validate(secret []byte, input string, t time.Time) (int64, bool) {
+	if len(input) != digits {
+		return 0, false
+	}
+	current := t.Unix() / step
+	for counter := current - skew; counter <= current+skew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(code(secret, counter)), []byte(input)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// Cipher encrypts secrets with AES-256-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher using the base64 encoded 32 byte key.
+func NewCipher(key string) (*Cipher, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Seal encrypts the secret. The random nonce is stored in front of the ciphertext.
+func (c *Cipher) Seal(secret []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+// Open decrypts a secret encrypted by Seal.
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errDecrypt
+	}
+	secret, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return secret, nil
+}
@@ -0,0 +1,125 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// errCBOR is returned for CBOR this decoder doesn't understand, which is anything
+// authenticators don't send: indefinite lengths, tags and floats among them.
+var errCBOR = errors.New("webauthn: malformed or unsupported CBOR")
+
+// maxCBORDepth limits how deeply arrays and maps can nest, so a crafted attestation
+// can't exhaust the stack.
+const maxCBORDepth = 8
+
+// decodeCBOR decodes the first CBOR item in b (RFC 8949) and returns it along with
+// whatever follows it. Unsigned and negative integers become int64, byte strings
+// []byte, text strings string, arrays []any and maps map[any]any with int64 or
+// string keys.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		default:
+			return nil, nil, errCBOR
+		}
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(b) >= 1:
+		n, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		n, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		n, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		n, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(n), b, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		s := b[:n]
+		if major == 3 {
+			return string(s), b[n:], nil
+		}
+		return append([]byte(nil), s...), b[n:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the length before
+		// anything is allocated for it.
+		if n > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item any
+			var err error
+			item, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if n > uint64(len(b))/2 {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value any
+			var err error
+			key, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			value, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, b, nil
+	default:
+		return nil, nil, errCBOR
+	}
+}
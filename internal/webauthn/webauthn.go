@@ -0,0 +1,343 @@
+// Package webauthn implements the relying party's side of WebAuthn (passkey)
+// registration and login, as far as this API needs it. Attestation isn't asked for,
+// so any authenticator the user has is accepted, and attestation statements aren't
+// checked. Credentials can use ES256, EdDSA or RS256, which covers every platform and
+// security key in use.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+)
+
+var (
+	// ErrInvalidResponse is returned, wrapped with the reason, for a response from
+	// the browser which isn't for this relying party, doesn't match the challenge or
+	// is malformed.
+	ErrInvalidResponse = errors.New("webauthn: invalid response")
+	// ErrInvalidSignature is returned when the assertion's signature doesn't verify.
+	ErrInvalidSignature = errors.New("webauthn: invalid signature")
+	// ErrCloned is returned when the authenticator's signature counter has gone
+	// backwards, which is a sign that its key has been copied.
+	ErrCloned = errors.New("webauthn: signature counter went backwards, the authenticator may have been cloned")
+	// ErrNotVerified is returned when the authenticator didn't verify the user, with
+	// a PIN or biometric, so the response only shows someone has it.
+	ErrNotVerified = errors.New("webauthn: user wasn't verified")
+)
+
+// COSE algorithm identifiers of the supported signatures, in the order they're
+// offered to the authenticator.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms are the signature algorithms credentials can use.
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// ChallengeSize is the length of challenges in bytes, twice the minimum the
+// specification recommends.
+const ChallengeSize = 32
+
+// Encoding is how binary values are sent to and from the browser.
+var Encoding = base64.RawURLEncoding
+
+// RelyingParty is the site credentials are registered with. ID is its domain, which
+// credentials are scoped to, and Origins are the origins of the pages allowed to use
+// them, such as https://books.example.kz.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// New returns the relying party for the given domain. With no origins, only
+// https://<id> is allowed.
+func New(id, name string, origins []string) (*RelyingParty, error) {
+	if id == "" {
+		return nil, errors.New("webauthn: the relying party ID must be set")
+	}
+	if len(origins) == 0 {
+		origins = []string{"https://" + id}
+	}
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("webauthn: %q is not an origin", origin)
+		}
+	}
+	return &RelyingParty{ID: id, Name: name, Origins: origins}, nil
+}
+
+// NewChallenge returns a new random challenge.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Credential is a newly registered public key credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is the credential's COSE key, as the authenticator sent it.
+	PublicKey    []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+// clientData is the part of the client data JSON (collectedClientData) checked here.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Challenge returns the challenge the client data JSON says it's answering, so that
+// the caller can look up what it was issued for.
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+	challenge, err := Encoding.DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, fmt.Errorf("%w: client data: bad challenge", ErrInvalidResponse)
+	}
+	return challenge, nil
+}
+
+// checkClientData checks the client data JSON is from one of our origins and answers
+// the challenge in a ceremony of the given type.
+func (rp *RelyingParty) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type is %q, not %q", ErrInvalidResponse, cd.Type, ceremony)
+	}
+	got, err := Encoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge doesn't match", ErrInvalidResponse)
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: origin %q isn't allowed", ErrInvalidResponse, cd.Origin)
+}
+
+// authenticatorData is the parsed authenticator data.
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses the authenticator data and checks it's for this
+// relying party and that the user was present.
+func (rp *RelyingParty) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data is too short", ErrInvalidResponse)
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: credential is for another relying party", ErrInvalidResponse)
+	}
+	ad := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user wasn't present", ErrInvalidResponse)
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// The attested credential data is the AAGUID, the credential ID's length and
+	// the ID, then the COSE key, whose length is only known by decoding it.
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data is too short", ErrInvalidResponse)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, fmt.Errorf("%w: bad credential ID", ErrInvalidResponse)
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// Register checks the response to a registration ceremony with the given challenge
+// and returns the new credential. The attestation statement isn't checked.
+func (rp *RelyingParty) Register(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidResponse, err)
+	}
+	object, _ := decoded.(map[any]any)
+	rawAuthData, _ := object["authData"].([]byte)
+	if rawAuthData == nil {
+		return nil, fmt.Errorf("%w: attestation object has no authenticator data", ErrInvalidResponse)
+	}
+	ad, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidResponse)
+	}
+	_, err = parsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:           ad.credentialID,
+		PublicKey:    ad.publicKey,
+		SignCount:    ad.signCount,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// Login checks the response to a login ceremony with the given challenge, made with
+// the credential which has the given public key and last reported signCount. The
+// user must have been verified, as the credential stands in for a second factor as
+// well as the password. It returns the new signature count, which should be stored
+// for the next login.
+func (rp *RelyingParty) Login(challenge, publicKey []byte, signCount uint32, clientDataJSON, authenticatorData, signature []byte) (uint32, error) {
+	err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	ad, err := rp.parseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, ErrInvalidSignature
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return 0, ErrNotVerified
+	}
+
+	// Authenticators which don't count always send zero.
+	if (ad.signCount != 0 || signCount != 0) && ad.signCount <= signCount {
+		return 0, ErrCloned
+	}
+	return ad.signCount, nil
+}
+
+// publicKey is a credential's public key with its algorithm.
+type publicKey struct {
+	alg int64
+	key any
+}
+
+// parsePublicKey parses a COSE key (RFC 9053) using one of the supported algorithms.
+func parsePublicKey(raw []byte) (*publicKey, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+	}
+	m, _ := decoded.(map[any]any)
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			break
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			break
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			break
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return &publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %d with algorithm %d", ErrInvalidResponse, kty, alg)
+	}
+	return nil, fmt.Errorf("%w: malformed credential public key", ErrInvalidResponse)
+}
+
+// verify reports whether signature is the key's signature of message.
+func (k *publicKey) verify(message, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
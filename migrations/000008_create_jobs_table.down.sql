@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS jobs;
+ALTER TABLE books DROP COLUMN IF EXISTS word_count;
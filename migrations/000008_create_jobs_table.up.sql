@@ -0,0 +1,14 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS word_count integer;
+
+CREATE TABLE IF NOT EXISTS jobs (
+                                    id bigserial PRIMARY KEY,
+                                    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                    kind text NOT NULL,
+                                    status text NOT NULL,
+                                    processed bigint NOT NULL DEFAULT 0,
+                                    total bigint NOT NULL DEFAULT 0,
+                                    cursor bigint NOT NULL DEFAULT 0,
+                                    batch_size integer NOT NULL,
+                                    error text NOT NULL DEFAULT ''
+);
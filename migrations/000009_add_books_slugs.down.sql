@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS book_slugs;
+DROP INDEX IF EXISTS books_slug_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS slug;
@@ -0,0 +1,13 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS slug text;
+
+UPDATE books SET slug = trim(both '-' from lower(regexp_replace(title, '[^[:alnum:]]+', '-', 'g'))) || '-' || year;
+UPDATE books SET slug = slug || '-' || id WHERE id NOT IN (SELECT min(id) FROM books GROUP BY slug);
+
+ALTER TABLE books ALTER COLUMN slug SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS books_slug_idx ON books (slug);
+
+CREATE TABLE IF NOT EXISTS book_slugs (
+                                          slug text PRIMARY KEY,
+                                          book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+                                          created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
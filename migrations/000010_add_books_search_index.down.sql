@@ -0,0 +1 @@
+DROP INDEX IF EXISTS books_search_idx;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS books_search_idx ON books USING GIN (to_tsvector('simple', title || ' ' || content));
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS api_version text NOT NULL DEFAULT '';
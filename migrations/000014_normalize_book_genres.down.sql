@@ -0,0 +1,17 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS genres text[] NOT NULL DEFAULT '{}';
+
+UPDATE books
+SET genres = ARRAY(
+    SELECT genres.name
+    FROM book_genres
+    INNER JOIN genres ON genres.id = book_genres.genre_id
+    WHERE book_genres.book_id = books.id
+    ORDER BY book_genres.position
+);
+
+ALTER TABLE books ALTER COLUMN genres DROP DEFAULT;
+ALTER TABLE books ADD CONSTRAINT genres_length_check CHECK (array_length(genres, 1) BETWEEN 1 AND 5);
+CREATE INDEX IF NOT EXISTS books_genres_idx ON books USING GIN (genres);
+
+DROP TABLE IF EXISTS book_genres;
+DROP TABLE IF EXISTS genres;
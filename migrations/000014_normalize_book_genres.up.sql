@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS book_genres (
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE,
+    position smallint NOT NULL,
+    PRIMARY KEY (book_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS book_genres_genre_id_idx ON book_genres (genre_id);
+
+INSERT INTO genres (name)
+SELECT DISTINCT unnest(genres) FROM books
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO book_genres (book_id, genre_id, position)
+SELECT books.id, genres.id, t.position
+FROM books
+CROSS JOIN LATERAL unnest(books.genres) WITH ORDINALITY AS t(name, position)
+INNER JOIN genres ON genres.name = t.name
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE books DROP CONSTRAINT IF EXISTS genres_length_check;
+DROP INDEX IF EXISTS books_genres_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS genres;
@@ -0,0 +1,53 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- The permissions migration only created the movies:* codes, so make sure the codes
+-- which the API actually checks exist.
+INSERT INTO permissions (code)
+SELECT t.code FROM unnest(ARRAY['books:read', 'books:write']) AS t(code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = t.code);
+
+INSERT INTO roles (name)
+VALUES
+    ('reader'),
+    ('editor'),
+    ('admin')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code = ANY(CASE roles.name
+    WHEN 'reader' THEN ARRAY['books:read']
+    WHEN 'editor' THEN ARRAY['books:read', 'books:write']
+    WHEN 'admin' THEN ARRAY['books:read', 'books:write', 'admin']
+END)
+ON CONFLICT DO NOTHING;
+
+-- Give every existing user the smallest role which covers each permission they had.
+INSERT INTO users_roles (user_id, role_id)
+SELECT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+INNER JOIN roles ON roles.name = CASE
+    WHEN permissions.code = 'admin' THEN 'admin'
+    WHEN permissions.code IN ('books:write', 'movies:write') THEN 'editor'
+    ELSE 'reader'
+END
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS users_permissions;
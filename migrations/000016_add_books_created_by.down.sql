@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'books:moderate';
+DROP INDEX IF EXISTS books_created_by_idx;
+ALTER TABLE books DROP COLUMN IF EXISTS created_by;
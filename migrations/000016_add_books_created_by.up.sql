@@ -0,0 +1,12 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS books_created_by_idx ON books (created_by);
+
+INSERT INTO permissions (code)
+SELECT 'books:moderate'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'books:moderate');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'books:moderate'
+ON CONFLICT DO NOTHING;
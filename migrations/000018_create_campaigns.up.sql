@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS campaigns (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    template text NOT NULL,
+    audience jsonb NOT NULL DEFAULT '{}',
+    scheduled_at timestamp(0) with time zone NOT NULL,
+    status text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS campaign_recipients (
+    campaign_id bigint NOT NULL REFERENCES campaigns ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    email citext NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    error text NOT NULL DEFAULT '',
+    open_token uuid NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    sent_at timestamp(0) with time zone,
+    opened_at timestamp(0) with time zone,
+    PRIMARY KEY (campaign_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS campaign_recipients_status_idx ON campaign_recipients (campaign_id, status);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users_followed_genres;
+ALTER TABLE users DROP COLUMN IF EXISTS last_digest_at;
+ALTER TABLE users DROP COLUMN IF EXISTS weekly_digest;
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS weekly_digest boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_digest_at timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS users_followed_genres (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE,
+    PRIMARY KEY (user_id, genre_id)
+);
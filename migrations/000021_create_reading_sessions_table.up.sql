@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS reading_sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ended_at timestamp(0) with time zone,
+    timed_out boolean NOT NULL DEFAULT false,
+    CHECK (ended_at IS NULL OR ended_at >= started_at)
+);
+
+-- A user can only have one session open at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS reading_sessions_open_idx ON reading_sessions (user_id) WHERE ended_at IS NULL;
+CREATE INDEX IF NOT EXISTS reading_sessions_user_id_started_at_idx ON reading_sessions (user_id, started_at);
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS reading_lists (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS reading_lists_user_id_idx ON reading_lists (user_id);
+
+-- Positions are 1-based and contiguous within a list. The constraint is deferred so a
+-- move can shift the other items in one transaction.
+CREATE TABLE IF NOT EXISTS reading_list_items (
+    list_id bigint NOT NULL REFERENCES reading_lists ON DELETE CASCADE,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    position integer NOT NULL CHECK (position > 0),
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (list_id, book_id),
+    UNIQUE (list_id, position) DEFERRABLE INITIALLY DEFERRED
+);
+
+CREATE INDEX IF NOT EXISTS reading_list_items_book_id_idx ON reading_list_items (book_id);
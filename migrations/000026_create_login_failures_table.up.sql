@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    ip text NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    lockouts integer NOT NULL DEFAULT 0,
+    locked_until timestamp(0) with time zone,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, ip)
+);
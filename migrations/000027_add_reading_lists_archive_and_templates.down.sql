@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS reading_lists_templates_idx;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS cloned_from;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS clone_count;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS is_template;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS archived_at;
@@ -0,0 +1,6 @@
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS archived_at timestamp(0) with time zone;
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS is_template boolean NOT NULL DEFAULT false;
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS clone_count integer NOT NULL DEFAULT 0;
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS cloned_from bigint REFERENCES reading_lists ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS reading_lists_templates_idx ON reading_lists (clone_count DESC) WHERE is_template AND archived_at IS NULL;
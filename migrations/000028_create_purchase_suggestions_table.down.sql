@@ -0,0 +1,3 @@
+DELETE FROM roles WHERE name = 'librarian';
+DELETE FROM permissions WHERE code = 'suggestions:triage';
+DROP TABLE IF EXISTS purchase_suggestions;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS purchase_suggestions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    title text NOT NULL,
+    isbn text NOT NULL DEFAULT '',
+    reason text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending',
+    note text NOT NULL DEFAULT '',
+    book_id bigint REFERENCES books ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS purchase_suggestions_user_id_idx ON purchase_suggestions (user_id);
+CREATE INDEX IF NOT EXISTS purchase_suggestions_status_idx ON purchase_suggestions (status);
+
+INSERT INTO permissions (code)
+SELECT 'suggestions:triage'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'suggestions:triage');
+
+INSERT INTO roles (name)
+VALUES ('librarian')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code = ANY(CASE roles.name
+    WHEN 'librarian' THEN ARRAY['books:read', 'books:write', 'suggestions:triage']
+    WHEN 'admin' THEN ARRAY['suggestions:triage']
+END)
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'loans:manage';
+DROP TABLE IF EXISTS interlibrary_loans;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS interlibrary_loans (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    title text NOT NULL,
+    isbn text NOT NULL DEFAULT '',
+    partner_library text NOT NULL,
+    partner_contact text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'requested',
+    note text NOT NULL DEFAULT '',
+    due_date date,
+    shipped_at timestamp(0) with time zone,
+    received_at timestamp(0) with time zone,
+    returned_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS interlibrary_loans_user_id_idx ON interlibrary_loans (user_id);
+CREATE INDEX IF NOT EXISTS interlibrary_loans_status_idx ON interlibrary_loans (status);
+
+INSERT INTO permissions (code)
+SELECT 'loans:manage'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'loans:manage');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code = 'loans:manage'
+WHERE roles.name IN ('librarian', 'admin')
+ON CONFLICT DO NOTHING;
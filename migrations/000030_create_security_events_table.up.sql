@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS security_events (
+    id bigserial PRIMARY KEY,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    email citext NOT NULL DEFAULT '',
+    event text NOT NULL,
+    outcome text NOT NULL,
+    detail text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS security_events_user_id_created_at_idx ON security_events (user_id, created_at);
+CREATE INDEX IF NOT EXISTS security_events_created_at_idx ON security_events (created_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS book_copies (
+    id bigserial PRIMARY KEY,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    barcode text NOT NULL UNIQUE,
+    branch text NOT NULL,
+    room text NOT NULL DEFAULT '',
+    shelf text NOT NULL DEFAULT '',
+    call_number text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS book_copies_book_id_idx ON book_copies (book_id);
+CREATE INDEX IF NOT EXISTS book_copies_location_idx ON book_copies (branch, room, shelf);
+CREATE INDEX IF NOT EXISTS book_copies_call_number_idx ON book_copies (call_number text_pattern_ops);
@@ -0,0 +1,2 @@
+ALTER TABLE book_copies DROP CONSTRAINT IF EXISTS book_copies_branch_fkey;
+DROP TABLE IF EXISTS branches;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS branches (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    address text NOT NULL DEFAULT '',
+    phone text NOT NULL DEFAULT '',
+    loan_period_days integer NOT NULL DEFAULT 21,
+    max_renewals integer NOT NULL DEFAULT 2,
+    max_loans integer NOT NULL DEFAULT 10,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+-- Copies name their branch, so every branch already in use becomes a branch with the
+-- default loan policy.
+INSERT INTO branches (name)
+SELECT DISTINCT branch FROM book_copies
+ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE book_copies ADD CONSTRAINT book_copies_branch_fkey
+    FOREIGN KEY (branch) REFERENCES branches (name) ON UPDATE CASCADE;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS pickups;
+DROP TABLE IF EXISTS branch_hours;
+ALTER TABLE branches DROP COLUMN IF EXISTS pickup_capacity;
+ALTER TABLE branches DROP COLUMN IF EXISTS pickup_slot_minutes;
+ALTER TABLE branches DROP COLUMN IF EXISTS timezone;
@@ -0,0 +1,23 @@
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT 'UTC';
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS pickup_slot_minutes integer NOT NULL DEFAULT 30;
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS pickup_capacity integer NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS branch_hours (
+    branch_id bigint NOT NULL REFERENCES branches ON DELETE CASCADE,
+    weekday smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    opens time NOT NULL,
+    closes time NOT NULL CHECK (closes > opens),
+    PRIMARY KEY (branch_id, weekday)
+);
+
+CREATE TABLE IF NOT EXISTS pickups (
+    id bigserial PRIMARY KEY,
+    branch_id bigint NOT NULL REFERENCES branches ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    slot timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (branch_id, user_id, slot)
+);
+
+CREATE INDEX IF NOT EXISTS pickups_branch_id_slot_idx ON pickups (branch_id, slot);
+CREATE INDEX IF NOT EXISTS pickups_user_id_idx ON pickups (user_id);
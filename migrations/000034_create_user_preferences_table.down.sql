@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS weekly_digest boolean NOT NULL DEFAULT false;
+
+UPDATE users SET weekly_digest = true
+FROM user_preferences
+WHERE user_preferences.user_id = users.id AND user_preferences.digest_frequency <> 'never';
+
+DROP TABLE IF EXISTS user_preferences;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_preferences (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    email_opt_ins text[] NOT NULL DEFAULT '{campaigns,suggestions,interlibrary,pickups}',
+    digest_frequency text NOT NULL DEFAULT 'never',
+    language text NOT NULL DEFAULT 'en',
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO user_preferences (user_id, digest_frequency)
+SELECT id, 'weekly' FROM users WHERE weekly_digest
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS weekly_digest;
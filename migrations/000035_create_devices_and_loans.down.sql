@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS loans;
+DROP TABLE IF EXISTS devices;
+DROP TABLE IF EXISTS library_cards;
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS library_cards (
+    number text PRIMARY KEY,
+    user_id bigint NOT NULL UNIQUE REFERENCES users ON DELETE CASCADE,
+    issued_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    branch_id bigint NOT NULL REFERENCES branches ON DELETE CASCADE,
+    prefix text NOT NULL,
+    hash bytea NOT NULL UNIQUE,
+    status text NOT NULL DEFAULT '',
+    software_version text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_seen_at timestamp(0) with time zone
+);
+
+CREATE TABLE IF NOT EXISTS loans (
+    id bigserial PRIMARY KEY,
+    copy_id bigint NOT NULL REFERENCES book_copies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    device_id bigint REFERENCES devices ON DELETE SET NULL,
+    checked_out_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    due_at timestamp(0) with time zone NOT NULL,
+    returned_at timestamp(0) with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_copy_idx ON loans (copy_id) WHERE returned_at IS NULL;
+CREATE INDEX IF NOT EXISTS loans_open_user_idx ON loans (user_id) WHERE returned_at IS NULL;
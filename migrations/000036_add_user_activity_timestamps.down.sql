@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_last_seen_at_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS last_seen_at;
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_at;
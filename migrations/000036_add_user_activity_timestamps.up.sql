@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_last_seen_at_idx ON users (last_seen_at);
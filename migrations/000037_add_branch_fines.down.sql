@@ -0,0 +1,2 @@
+ALTER TABLE branches DROP COLUMN IF EXISTS max_fine;
+ALTER TABLE branches DROP COLUMN IF EXISTS daily_fine;
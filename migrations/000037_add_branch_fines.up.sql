@@ -0,0 +1,2 @@
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS daily_fine integer NOT NULL DEFAULT 0;
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS max_fine integer NOT NULL DEFAULT 0;
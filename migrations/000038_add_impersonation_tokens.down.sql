@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'users:impersonate';
+DELETE FROM tokens WHERE impersonator_id IS NOT NULL;
+ALTER TABLE tokens DROP COLUMN IF EXISTS impersonator_id;
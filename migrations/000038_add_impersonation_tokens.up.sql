@@ -0,0 +1,12 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
+
+INSERT INTO permissions (code)
+SELECT 'users:impersonate'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:impersonate');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code = 'users:impersonate'
+WHERE roles.name = 'admin'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS loans_open_due_at_idx;
+DROP TABLE IF EXISTS loan_escalations;
+
+ALTER TABLE loans DROP COLUMN IF EXISTS forgive_note;
+ALTER TABLE loans DROP COLUMN IF EXISTS forgiven_by;
+ALTER TABLE loans DROP COLUMN IF EXISTS forgiven_at;
+
+ALTER TABLE branches DROP COLUMN IF EXISTS replacement_fee;
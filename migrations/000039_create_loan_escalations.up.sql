@@ -0,0 +1,15 @@
+ALTER TABLE branches ADD COLUMN IF NOT EXISTS replacement_fee integer NOT NULL DEFAULT 0;
+
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS forgiven_at timestamp(0) with time zone;
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS forgiven_by bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS forgive_note text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS loan_escalations (
+    loan_id bigint NOT NULL REFERENCES loans ON DELETE CASCADE,
+    step text NOT NULL,
+    amount bigint NOT NULL DEFAULT 0,
+    executed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (loan_id, step)
+);
+
+CREATE INDEX IF NOT EXISTS loans_open_due_at_idx ON loans (due_at) WHERE returned_at IS NULL AND forgiven_at IS NULL;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS users_search_idx ON users USING GIN (to_tsvector('simple', name || ' ' || replace(email, '@', ' ')));
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS loans_checked_out_at_idx;
+DROP INDEX IF EXISTS reading_sessions_started_at_idx;
+DROP TABLE IF EXISTS searches;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS searches (
+    id bigserial PRIMARY KEY,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    query text NOT NULL,
+    results integer NOT NULL,
+    searched_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS searches_searched_at_idx ON searches (searched_at);
+CREATE INDEX IF NOT EXISTS reading_sessions_started_at_idx ON reading_sessions (started_at);
+CREATE INDEX IF NOT EXISTS loans_checked_out_at_idx ON loans (checked_out_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS security_events_ip_created_at_idx;
+ALTER TABLE security_events DROP COLUMN IF EXISTS country;
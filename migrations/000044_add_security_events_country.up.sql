@@ -0,0 +1,2 @@
+ALTER TABLE security_events ADD COLUMN IF NOT EXISTS country text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS security_events_ip_created_at_idx ON security_events (ip, created_at);
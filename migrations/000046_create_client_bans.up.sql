@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS client_bans (
+    id bigserial PRIMARY KEY,
+    ip text NOT NULL,
+    action text NOT NULL,
+    reason text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL,
+    lifted_at timestamp(0) with time zone,
+    lifted_by bigint REFERENCES users ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS client_bans_expires_at_idx ON client_bans (expires_at) WHERE lifted_at IS NULL;
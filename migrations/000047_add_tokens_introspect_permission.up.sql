@@ -0,0 +1,10 @@
+INSERT INTO permissions (code)
+SELECT 'tokens:introspect'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'tokens:introspect');
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code = 'tokens:introspect'
+WHERE roles.name = 'admin'
+ON CONFLICT DO NOTHING;
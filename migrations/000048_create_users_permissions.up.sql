@@ -0,0 +1,8 @@
+-- Permissions granted to a user directly, on top of those their roles grant.
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_permissions_permission_id_idx ON users_permissions (permission_id);
@@ -0,0 +1,7 @@
+-- Wildcard codes grant every permission under a prefix, and the prefix itself, so
+-- books:* covers books:read, books:write and books:moderate. They're resolved when
+-- permissions are checked, so they also cover permissions added later.
+INSERT INTO permissions (code)
+SELECT code
+FROM (VALUES ('admin:*'), ('books:*'), ('loans:*'), ('suggestions:*'), ('tokens:*'), ('users:*')) AS wildcards (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = wildcards.code);
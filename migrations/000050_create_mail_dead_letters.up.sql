@@ -0,0 +1,17 @@
+-- Emails which couldn't be sent after every retry, kept rendered so that an admin
+-- can send them again once the mail server is back.
+CREATE TABLE IF NOT EXISTS mail_dead_letters (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    sender text NOT NULL,
+    template text NOT NULL,
+    subject text NOT NULL,
+    plain_body text NOT NULL,
+    html_body text NOT NULL,
+    attempts integer NOT NULL,
+    error text NOT NULL,
+    resent_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS mail_dead_letters_pending_idx ON mail_dead_letters (id) WHERE resent_at IS NULL;
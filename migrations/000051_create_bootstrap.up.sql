@@ -0,0 +1,8 @@
+-- Records that the initial admin was created through the bootstrap endpoint. There's
+-- only ever one row, so bootstrapping can't happen twice.
+CREATE TABLE IF NOT EXISTS bootstrap (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    email citext NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    completed_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
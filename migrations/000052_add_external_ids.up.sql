@@ -0,0 +1,8 @@
+-- External IDs are opaque strings which identify books and users in the API alongside
+-- their numeric IDs, which JavaScript clients can't represent exactly above 2^53.
+-- They're text so that other formats than UUIDs can be used for new records.
+ALTER TABLE books ADD COLUMN IF NOT EXISTS external_id text NOT NULL DEFAULT uuid_generate_v4()::text;
+CREATE UNIQUE INDEX IF NOT EXISTS books_external_id_idx ON books (external_id);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id text NOT NULL DEFAULT uuid_generate_v4()::text;
+CREATE UNIQUE INDEX IF NOT EXISTS users_external_id_idx ON users (external_id);
@@ -0,0 +1,9 @@
+DROP TRIGGER IF EXISTS users_external_id ON users;
+ALTER TABLE users ALTER COLUMN external_id SET DEFAULT uuid_generate_v4()::text;
+DROP TRIGGER IF EXISTS books_external_id ON books;
+ALTER TABLE books ALTER COLUMN external_id SET DEFAULT uuid_generate_v4()::text;
+DROP FUNCTION IF EXISTS set_external_id();
+DROP FUNCTION IF EXISTS snowflake_id(integer);
+DROP SEQUENCE IF EXISTS snowflake_seq;
+DROP FUNCTION IF EXISTS uuid_generate_v7();
+DROP TABLE IF EXISTS id_generation;
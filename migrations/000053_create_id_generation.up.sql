@@ -0,0 +1,61 @@
+-- How the external IDs of new books and users are generated. There's only ever one
+-- row, which the API sets at startup from its configuration. node_id is the shard
+-- number put into Snowflake IDs, 0 to 1023.
+CREATE TABLE IF NOT EXISTS id_generation (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    strategy text NOT NULL DEFAULT 'uuidv4' CHECK (strategy IN ('uuidv4', 'uuidv7', 'serial', 'snowflake')),
+    node_id integer NOT NULL DEFAULT 0 CHECK (node_id BETWEEN 0 AND 1023)
+);
+INSERT INTO id_generation DEFAULT VALUES ON CONFLICT DO NOTHING;
+
+-- A UUIDv7 is a random UUID with its first 48 bits replaced by the Unix time in
+-- milliseconds and its version set to 7, so they sort in the order they were made.
+CREATE OR REPLACE FUNCTION uuid_generate_v7() RETURNS uuid AS $$
+    SELECT encode(
+        set_bit(set_bit(
+            overlay(uuid_send(uuid_generate_v4())
+                placing substring(int8send(floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint) FROM 3)
+                FROM 1 FOR 6),
+            52, 1), 53, 1),
+        'hex')::uuid
+$$ LANGUAGE sql VOLATILE;
+
+-- Snowflake IDs are 41 bits of milliseconds since 2024-01-01, 10 bits of node ID and
+-- 12 bits of sequence, so they sort by time and don't clash between shards.
+CREATE SEQUENCE IF NOT EXISTS snowflake_seq;
+CREATE OR REPLACE FUNCTION snowflake_id(node integer) RETURNS bigint AS $$
+    SELECT ((floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint - 1704067200000) << 22)
+        | ((node & 1023)::bigint << 12)
+        | (nextval('snowflake_seq') % 4096)
+$$ LANGUAGE sql VOLATILE;
+
+-- set_external_id fills in the external ID of a new row the way id_generation says,
+-- unless the insert gave one. It's a trigger rather than a column default because
+-- serial external IDs are the row's own ID.
+CREATE OR REPLACE FUNCTION set_external_id() RETURNS trigger AS $$
+DECLARE
+    gen id_generation%ROWTYPE;
+BEGIN
+    IF NEW.external_id IS NOT NULL THEN
+        RETURN NEW;
+    END IF;
+    SELECT * INTO gen FROM id_generation;
+    NEW.external_id := CASE gen.strategy
+        WHEN 'uuidv7' THEN uuid_generate_v7()::text
+        WHEN 'serial' THEN NEW.id::text
+        WHEN 'snowflake' THEN snowflake_id(gen.node_id)::text
+        ELSE uuid_generate_v4()::text
+    END;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE books ALTER COLUMN external_id DROP DEFAULT;
+DROP TRIGGER IF EXISTS books_external_id ON books;
+CREATE TRIGGER books_external_id BEFORE INSERT ON books
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
+
+ALTER TABLE users ALTER COLUMN external_id DROP DEFAULT;
+DROP TRIGGER IF EXISTS users_external_id ON users;
+CREATE TRIGGER users_external_id BEFORE INSERT ON users
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
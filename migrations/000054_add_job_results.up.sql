@@ -0,0 +1,5 @@
+-- Jobs are also made for long-running requests the client asked to be answered
+-- asynchronously. They belong to the user who made the request, and keep the
+-- response body as their result once they're done.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE CASCADE;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS result jsonb;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS jobs_queue_idx;
+UPDATE jobs SET status = 'cancelled' WHERE status = 'queued';
+ALTER TABLE jobs DROP COLUMN IF EXISTS payload;
+ALTER TABLE jobs DROP COLUMN IF EXISTS cancel_requested;
+ALTER TABLE jobs DROP COLUMN IF EXISTS locked_by;
+ALTER TABLE jobs DROP COLUMN IF EXISTS run_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS max_attempts;
+ALTER TABLE jobs DROP COLUMN IF EXISTS attempts;
+ALTER TABLE jobs DROP COLUMN IF EXISTS priority;
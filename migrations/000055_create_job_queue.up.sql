@@ -0,0 +1,13 @@
+-- Jobs are queued and claimed by whichever instance has a free worker, so they
+-- survive restarts and are shared out across instances. locked_by names the
+-- instance running a job, whose updated_at it refreshes as a heartbeat, and
+-- payload holds what the job needs to run, such as an asynchronous request's input.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_attempts integer NOT NULL DEFAULT 1;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS locked_by text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS cancel_requested boolean NOT NULL DEFAULT false;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS payload jsonb;
+
+CREATE INDEX IF NOT EXISTS jobs_queue_idx ON jobs (priority DESC, run_at, id) WHERE status = 'queued';
@@ -0,0 +1,9 @@
+-- Whether the user can log in with their email address and password. Users made by
+-- a social login were given a random password they don't know, which is assumed of
+-- those linked to an identity within a minute of signing up.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_login boolean NOT NULL DEFAULT true;
+UPDATE users SET password_login = false
+WHERE EXISTS (
+    SELECT 1 FROM user_identities
+    WHERE user_identities.user_id = users.id
+    AND user_identities.created_at <= users.created_at + interval '1 minute');
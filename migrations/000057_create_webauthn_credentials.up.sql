@@ -0,0 +1,25 @@
+-- Passkeys users have registered to log in with. public_key is the COSE key the
+-- authenticator sent, and sign_count its signature counter at the last login.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    name text NOT NULL DEFAULT '',
+    transports text[] NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+-- Challenges issued for registering or logging in with a passkey, which can each be
+-- answered once. Registration challenges are for a user; login ones aren't, as the
+-- passkey says who is logging in.
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    hash bytea PRIMARY KEY,
+    ceremony text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,2 @@
+DELETE FROM tokens WHERE session_id IS NOT NULL;
+ALTER TABLE tokens DROP COLUMN IF EXISTS session_id;
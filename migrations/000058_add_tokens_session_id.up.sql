@@ -0,0 +1,3 @@
+-- session_id is set on the tokens in new device emails, and is the session they sign
+-- out. They go when the session does.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS session_id bigint REFERENCES tokens (id) ON DELETE CASCADE;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS legal_holds;
+ALTER TABLE users DROP COLUMN IF EXISTS frozen_at;
@@ -0,0 +1,18 @@
+-- frozen_at is set while the account is under a legal hold.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS frozen_at timestamp(0) with time zone;
+
+-- Legal holds admins have placed on accounts, with why and by whom. Released holds
+-- are kept as the record of the investigation. An account has at most one active
+-- hold at a time.
+CREATE TABLE IF NOT EXISTS legal_holds (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    reason text NOT NULL,
+    placed_by bigint REFERENCES users ON DELETE SET NULL,
+    placed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    released_by bigint REFERENCES users ON DELETE SET NULL,
+    released_at timestamp(0) with time zone,
+    release_reason text NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS legal_holds_active_idx ON legal_holds (user_id) WHERE released_at IS NULL;
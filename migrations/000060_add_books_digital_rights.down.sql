@@ -0,0 +1,2 @@
+ALTER TABLE books DROP COLUMN IF EXISTS institution_only;
+ALTER TABLE books DROP COLUMN IF EXISTS stream_only;
@@ -0,0 +1,4 @@
+-- The licence terms of a book's digital edition. stream_only books can be read
+-- online but not downloaded, and institution_only ones only by library members.
+ALTER TABLE books ADD COLUMN IF NOT EXISTS stream_only boolean NOT NULL DEFAULT false;
+ALTER TABLE books ADD COLUMN IF NOT EXISTS institution_only boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS book_word_count(text);
@@ -0,0 +1,5 @@
+-- The one definition of a book's word count, used both when a book is saved and by
+-- the word_count backfill: the number of runs of non-whitespace characters.
+CREATE OR REPLACE FUNCTION book_word_count(content text) RETURNS integer
+LANGUAGE sql IMMUTABLE
+AS $$ SELECT cardinality(array_remove(regexp_split_to_array(content, '\s+'), ''))::integer $$;
@@ -0,0 +1,3 @@
+-- Integrations which authenticate with an API key are pinned to an API version
+-- per key, rather than sharing their owner's.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS api_version text;
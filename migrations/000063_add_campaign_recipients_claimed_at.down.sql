@@ -0,0 +1,2 @@
+UPDATE campaign_recipients SET status = 'pending' WHERE status = 'sending';
+ALTER TABLE campaign_recipients DROP COLUMN IF EXISTS claimed_at;
@@ -0,0 +1,3 @@
+-- Recipients are claimed by the instance which sends to them, so that several
+-- instances can dispatch the same campaign without emailing anyone twice.
+ALTER TABLE campaign_recipients ADD COLUMN IF NOT EXISTS claimed_at timestamp(0) with time zone;
@@ -0,0 +1,6 @@
+-- Security events outlive the user they're about, so that the audit trail still
+-- shows what happened to an account after it was deleted. They're removed by the
+-- retention policy instead.
+ALTER TABLE security_events DROP CONSTRAINT IF EXISTS security_events_user_id_fkey;
+ALTER TABLE security_events ADD CONSTRAINT security_events_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users ON DELETE SET NULL;
@@ -0,0 +1,3 @@
+-- When an activation email was last resent, so that concurrent requests can't get
+-- around the resend interval.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activation_sent_at timestamp(0) with time zone;
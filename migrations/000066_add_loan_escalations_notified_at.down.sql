@@ -0,0 +1,2 @@
+ALTER TABLE loan_escalations DROP COLUMN IF EXISTS attempted_at;
+ALTER TABLE loan_escalations DROP COLUMN IF EXISTS notified_at;
@@ -0,0 +1,6 @@
+-- A step is taken as soon as it's claimed, but the member may not have been emailed
+-- about it yet. attempted_at is when the email was last tried, so that failed emails
+-- are retried without lifting a block or invoice.
+ALTER TABLE loan_escalations ADD COLUMN IF NOT EXISTS notified_at timestamp(0) with time zone;
+ALTER TABLE loan_escalations ADD COLUMN IF NOT EXISTS attempted_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+UPDATE loan_escalations SET notified_at = executed_at, attempted_at = executed_at;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS loans_returned_at_idx;
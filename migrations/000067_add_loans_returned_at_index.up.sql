@@ -0,0 +1,2 @@
+-- The analytics export finds loans returned on a day as well as those checked out.
+CREATE INDEX IF NOT EXISTS loans_returned_at_idx ON loans (returned_at) WHERE returned_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Copied into every JWT issued to the user. Bumping it revokes the JWTs issued so far.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version integer NOT NULL DEFAULT 0;
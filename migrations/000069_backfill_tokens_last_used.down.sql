@@ -0,0 +1 @@
+-- The backfilled times can't be told apart from real ones, so they're left in place.
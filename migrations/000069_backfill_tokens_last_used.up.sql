@@ -0,0 +1,4 @@
+-- Tokens issued before their use was tracked would otherwise look idle since they
+-- were issued, and be deleted by the idle timeout on the first run after deploying.
+-- Count them as used now instead.
+UPDATE tokens SET last_used_at = NOW() WHERE last_used_at IS NULL AND scope = 'authentication';
@@ -0,0 +1 @@
+ALTER TABLE mail_dead_letters DROP COLUMN IF EXISTS redacted;
@@ -0,0 +1,7 @@
+-- Emails with a one-time link in them, such as activation and email change tokens,
+-- are dead-lettered without their bodies, so the tokens aren't kept at rest. They
+-- can't be resent; the user asks for a new one instead.
+ALTER TABLE mail_dead_letters ADD COLUMN IF NOT EXISTS redacted boolean NOT NULL DEFAULT false;
+UPDATE mail_dead_letters
+SET plain_body = '', html_body = '', redacted = true
+WHERE template IN ('user_welcome.tmpl', 'email_change.tmpl', 'new_device.tmpl', 'weekly_digest.tmpl');
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS loans_external_id ON loans;
+ALTER TABLE loans DROP COLUMN IF EXISTS external_id;
+DROP TRIGGER IF EXISTS reading_sessions_external_id ON reading_sessions;
+ALTER TABLE reading_sessions DROP COLUMN IF EXISTS external_id;
+DROP TRIGGER IF EXISTS reading_lists_external_id ON reading_lists;
+ALTER TABLE reading_lists DROP COLUMN IF EXISTS external_id;
+DROP TRIGGER IF EXISTS book_copies_external_id ON book_copies;
+ALTER TABLE book_copies DROP COLUMN IF EXISTS external_id;
@@ -0,0 +1,35 @@
+-- Copies, reading lists, reading sessions and loans get external IDs like books and
+-- users, generated by the same trigger so they follow the deployment's ID strategy.
+-- Existing rows get UUIDs.
+
+ALTER TABLE book_copies ADD COLUMN IF NOT EXISTS external_id text;
+UPDATE book_copies SET external_id = uuid_generate_v4()::text WHERE external_id IS NULL;
+ALTER TABLE book_copies ALTER COLUMN external_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS book_copies_external_id_idx ON book_copies (external_id);
+DROP TRIGGER IF EXISTS book_copies_external_id ON book_copies;
+CREATE TRIGGER book_copies_external_id BEFORE INSERT ON book_copies
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
+
+ALTER TABLE reading_lists ADD COLUMN IF NOT EXISTS external_id text;
+UPDATE reading_lists SET external_id = uuid_generate_v4()::text WHERE external_id IS NULL;
+ALTER TABLE reading_lists ALTER COLUMN external_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS reading_lists_external_id_idx ON reading_lists (external_id);
+DROP TRIGGER IF EXISTS reading_lists_external_id ON reading_lists;
+CREATE TRIGGER reading_lists_external_id BEFORE INSERT ON reading_lists
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
+
+ALTER TABLE reading_sessions ADD COLUMN IF NOT EXISTS external_id text;
+UPDATE reading_sessions SET external_id = uuid_generate_v4()::text WHERE external_id IS NULL;
+ALTER TABLE reading_sessions ALTER COLUMN external_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS reading_sessions_external_id_idx ON reading_sessions (external_id);
+DROP TRIGGER IF EXISTS reading_sessions_external_id ON reading_sessions;
+CREATE TRIGGER reading_sessions_external_id BEFORE INSERT ON reading_sessions
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
+
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS external_id text;
+UPDATE loans SET external_id = uuid_generate_v4()::text WHERE external_id IS NULL;
+ALTER TABLE loans ALTER COLUMN external_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS loans_external_id_idx ON loans (external_id);
+DROP TRIGGER IF EXISTS loans_external_id ON loans;
+CREATE TRIGGER loans_external_id BEFORE INSERT ON loans
+    FOR EACH ROW EXECUTE FUNCTION set_external_id();
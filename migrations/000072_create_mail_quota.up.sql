@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS mail_quota (
+    period text NOT NULL,
+    window_start timestamp(0) with time zone NOT NULL,
+    sent integer NOT NULL DEFAULT 0,
+    bulk integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (period, window_start)
+);
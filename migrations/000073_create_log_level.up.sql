@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS log_level (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    level text NOT NULL,
+    changed_by text NOT NULL,
+    changed_on text NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
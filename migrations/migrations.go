@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migrations, so that tools which set up a
+// database, such as pkg/testkit, don't depend on the source tree being on disk.
+// They're numbered for, and normally applied by, the migrate tool.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
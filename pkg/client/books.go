@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Book is a book in the catalog.
+type Book struct {
+	ID         int64  `json:"id"`
+	ExternalID string `json:"external_id"`
+	Title      string `json:"title"`
+	Slug       string `json:"slug"`
+	// CreatedBy is the ID of the user who added the book, or zero if it isn't
+	// known.
+	CreatedBy int64    `json:"created_by"`
+	Content   string   `json:"content"`
+	Year      int32    `json:"year"`
+	Pages     int32    `json:"pages"`
+	Genres    []string `json:"genres"`
+	WordCount int32    `json:"word_count"`
+	// Version changes whenever the book does. Pass it to UpdateBook to make sure
+	// the update doesn't overwrite changes made since the book was fetched.
+	Version string `json:"version"`
+}
+
+// BookInput is a new book, or the fields of a book to change. Nil fields are left
+// alone by UpdateBook.
+type BookInput struct {
+	Title   *string  `json:"title,omitempty"`
+	Content *string  `json:"content,omitempty"`
+	Year    *int32   `json:"year,omitempty"`
+	Pages   *int32   `json:"pages,omitempty"`
+	Genres  []string `json:"genres,omitempty"`
+}
+
+// BookFilter selects the books ListBooks and Books return.
+type BookFilter struct {
+	// Title matches books with titles containing all of its words.
+	Title string
+	// Search is a full-text search of titles and content.
+	Search string
+	// Genres matches books in all of the genres.
+	Genres []string
+	// Branch only matches books with a copy at the branch.
+	Branch string
+	// Mine only matches books the client's user added.
+	Mine bool
+	Page
+}
+
+func (f BookFilter) query() url.Values {
+	qs := url.Values{}
+	if f.Title != "" {
+		qs.Set("title", f.Title)
+	}
+	if f.Search != "" {
+		qs.Set("q", f.Search)
+	}
+	if len(f.Genres) > 0 {
+		qs.Set("genres", strings.Join(f.Genres, ","))
+	}
+	if f.Branch != "" {
+		qs.Set("branch", f.Branch)
+	}
+	if f.Mine {
+		qs.Set("mine", "true")
+	}
+	f.Page.encode(qs)
+	return qs
+}
+
+// GetBook fetches a book by its ID.
+func (c *Client) GetBook(ctx context.Context, id int64) (*Book, error) {
+	var env struct {
+		Book *Book `json:"book"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: fmt.Sprintf("/v1/books/%d", id)}, &env)
+	return env.Book, err
+}
+
+// GetBookBySlug fetches a book by its slug, including slugs it used to have.
+func (c *Client) GetBookBySlug(ctx context.Context, slug string) (*Book, error) {
+	var env struct {
+		Book *Book `json:"book"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/books/slug/" + url.PathEscape(slug)}, &env)
+	return env.Book, err
+}
+
+// ListBooks fetches one page of the books matching the filter.
+func (c *Client) ListBooks(ctx context.Context, filter BookFilter) ([]*Book, Metadata, error) {
+	var env struct {
+		Books    []*Book  `json:"books"`
+		Metadata Metadata `json:"metadata"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/books", query: filter.query()}, &env)
+	return env.Books, env.Metadata, err
+}
+
+// Books iterates over every book matching the filter, starting from filter.Page.
+func (c *Client) Books(ctx context.Context, filter BookFilter) *Iterator[*Book] {
+	return newIterator(filter.Page.Page, func(page int) ([]*Book, Metadata, error) {
+		filter.Page.Page = page
+		return c.ListBooks(ctx, filter)
+	})
+}
+
+// CreateBook adds a book to the catalog. It needs the books:write permission.
+func (c *Client) CreateBook(ctx context.Context, input BookInput) (*Book, error) {
+	var env struct {
+		Book *Book `json:"book"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/v1/books", body: input}, &env)
+	return env.Book, err
+}
+
+// UpdateBook changes the fields of the book which are set in input. If version isn't
+// empty, the update fails with ErrEditConflict unless the book is still at that
+// version.
+func (c *Client) UpdateBook(ctx context.Context, id int64, input BookInput, version string) (*Book, error) {
+	req := request{method: http.MethodPatch, path: fmt.Sprintf("/v1/books/%d", id), body: input}
+	if version != "" {
+		req.header = http.Header{"If-Match": {`"` + version + `"`}}
+	}
+	var env struct {
+		Book *Book `json:"book"`
+	}
+	err := c.do(ctx, req, &env)
+	return env.Book, err
+}
+
+// DeleteBook removes a book from the catalog.
+func (c *Client) DeleteBook(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: fmt.Sprintf("/v1/books/%d", id)}, nil)
+}
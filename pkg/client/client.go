@@ -0,0 +1,354 @@
+// Package client is a Go client for the Book-Inspire API. It covers books, reading
+// lists, users and tokens with typed methods, retries requests which failed for
+// reasons worth retrying, pages through listings with iterators and maps error
+// responses to errors which can be checked with errors.Is:
+//
+//	c := client.New("https://api.example.com")
+//	err := c.Login(ctx, "alice@example.com", "pa55word1234")
+//	if err != nil {
+//		return err
+//	}
+//	books := c.Books(ctx, client.BookFilter{Genres: []string{"fiction"}})
+//	for books.Next() {
+//		fmt.Println(books.Value().Title)
+//	}
+//	if err := books.Err(); err != nil {
+//		return err
+//	}
+//
+// The client is versioned with the API: it pins requests to APIVersion with the
+// X-API-Version header, and its types follow that version's encoding.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// APIVersion is the API version this client was written against. It's sent with
+// every request, so the server keeps encoding responses the way the client expects
+// after newer versions are released.
+const APIVersion = "2026-10-15"
+
+var (
+	// ErrRecordNotFound is returned when the resource doesn't exist, or the user
+	// isn't allowed to know that it does.
+	ErrRecordNotFound = errors.New("client: record not found")
+	// ErrEditConflict is returned when an update lost a race with another one, or
+	// the resource changed since the version given to an update was fetched.
+	ErrEditConflict = errors.New("client: edit conflict")
+	// ErrUnauthorized is returned when the client's token is missing, invalid or
+	// has expired, or the login details were wrong.
+	ErrUnauthorized = errors.New("client: unauthorized")
+	// ErrForbidden is returned when the user doesn't have the permission needed.
+	ErrForbidden = errors.New("client: forbidden")
+	// ErrRateLimited is returned when requests were still being rate limited after
+	// every retry.
+	ErrRateLimited = errors.New("client: rate limited")
+)
+
+// Error is an error response from the API. It matches the sentinel errors above
+// with errors.Is according to its status code.
+type Error struct {
+	StatusCode int
+	// Message is the error message, for errors which have one.
+	Message string
+	// Fields maps fields to what's wrong with them, for failed validations.
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	if len(e.Fields) > 0 {
+		return fmt.Sprintf("client: %d: invalid %v", e.StatusCode, e.Fields)
+	}
+	return fmt.Sprintf("client: %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrRecordNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrEditConflict:
+		return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// RetryPolicy says how many times a request is attempted. The wait before each retry
+// doubles from Backoff up to MaxBackoff and is jittered, unless the server said how
+// long to wait with Retry-After.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the policy clients made with New start with.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// Client makes requests to the API. Its fields can be changed after New, but not
+// while requests are being made.
+type Client struct {
+	BaseURL string
+	// Token is sent as a bearer token if it's set. Login sets it.
+	Token string
+	// UserAgent is sent with every request if it's set.
+	UserAgent string
+	HTTP      *http.Client
+	Retry     RetryPolicy
+}
+
+// New returns a client for the API at baseURL, such as https://api.example.com.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: baseURL,
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+		Retry:   DefaultRetryPolicy,
+	}
+}
+
+// Metadata describes a page of results.
+type Metadata struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	FirstPage    int `json:"first_page"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+}
+
+// Page selects a page of a listing and how it's sorted. Zero values leave the
+// server's defaults.
+type Page struct {
+	Page     int
+	PageSize int
+	// Sort is a field name, prefixed with - to sort in descending order.
+	Sort string
+}
+
+func (p Page) encode(qs url.Values) {
+	if p.Page > 0 {
+		qs.Set("page", strconv.Itoa(p.Page))
+	}
+	if p.PageSize > 0 {
+		qs.Set("page_size", strconv.Itoa(p.PageSize))
+	}
+	if p.Sort != "" {
+		qs.Set("sort", p.Sort)
+	}
+}
+
+// Iterator pages through a listing, fetching each page when it's reached:
+//
+//	for it.Next() {
+//		use(it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator[T any] struct {
+	fetch func(page int) ([]T, Metadata, error)
+	page  int
+	items []T
+	index int
+	last  bool
+	value T
+	err   error
+}
+
+func newIterator[T any](first int, fetch func(page int) ([]T, Metadata, error)) *Iterator[T] {
+	if first < 1 {
+		first = 1
+	}
+	return &Iterator[T]{fetch: fetch, page: first, index: -1}
+}
+
+// Next advances to the next item, fetching the next page if needed. It returns
+// false when there are no more items or a request failed.
+func (it *Iterator[T]) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.index++
+	for it.index >= len(it.items) {
+		if it.last {
+			return false
+		}
+		items, metadata, err := it.fetch(it.page)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.items, it.index = items, 0
+		it.last = len(items) == 0 || it.page >= metadata.LastPage
+		it.page++
+	}
+	it.value = it.items[it.index]
+	return true
+}
+
+// Value returns the current item.
+func (it *Iterator[T]) Value() T {
+	return it.value
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// request describes a call to the API.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   any
+	header http.Header
+}
+
+// do sends the request, retrying it as the policy allows, and decodes the response
+// envelope into dst unless it's nil.
+func (c *Client) do(ctx context.Context, req request, dst any) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		body, err = json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+	}
+	target := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	attempts := c.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		res, err := c.send(ctx, req, target, body)
+		if err == nil && res.StatusCode < 300 {
+			defer res.Body.Close()
+			if dst == nil {
+				return nil
+			}
+			return json.NewDecoder(res.Body).Decode(dst)
+		}
+
+		retry, wait := c.shouldRetry(req.method, res, err)
+		if err == nil {
+			err = readError(res)
+		}
+		if !retry || attempt == attempts || ctx.Err() != nil {
+			return err
+		}
+		if wait == 0 {
+			wait = c.Retry.delay(attempt)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, target string, body []byte) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, req.method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range req.header {
+		r.Header[key] = values
+	}
+	// Ask for snake_case, which the types here are tagged with, whatever the server's
+	// default.
+	r.Header.Set("Accept", `application/json; profile="snake_case"`)
+	r.Header.Set("X-API-Version", APIVersion)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.UserAgent != "" {
+		r.Header.Set("User-Agent", c.UserAgent)
+	}
+	return c.HTTP.Do(r)
+}
+
+// shouldRetry reports whether a failed attempt is worth retrying, and how long the
+// server asked to wait first. Requests which were turned away by the rate limiter
+// were never handled, so they're always retried; other failures are only retried
+// for methods which are safe to repeat.
+func (c *Client) shouldRetry(method string, res *http.Response, err error) (bool, time.Duration) {
+	idempotent := method == http.MethodGet || method == http.MethodHead || method == http.MethodPut || method == http.MethodDelete
+	if err != nil {
+		return idempotent, 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		wait = time.Duration(seconds) * time.Second
+		if c.Retry.MaxBackoff > 0 && wait > c.Retry.MaxBackoff {
+			return false, 0
+		}
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true, wait
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent, wait
+	}
+	return false, 0
+}
+
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// readError turns an error response into an *Error, and closes its body.
+func readError(res *http.Response) error {
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	apiErr := &Error{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+
+	var env struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &env) != nil || env.Error == nil {
+		return apiErr
+	}
+	// The error is a message for most responses, but a map of fields to problems
+	// for failed validations.
+	if json.Unmarshal(env.Error, &apiErr.Message) != nil {
+		if json.Unmarshal(env.Error, &apiErr.Fields) == nil {
+			apiErr.Message = "failed validation"
+		}
+	}
+	return apiErr
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// List is a reading list. Templates are lists their owner has published for others
+// to clone.
+type List struct {
+	ID          int64       `json:"id"`
+	ExternalID  string      `json:"external_id"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Archived    bool        `json:"archived"`
+	Template    bool        `json:"template"`
+	CloneCount  int         `json:"clone_count"`
+	ClonedFrom  *int64      `json:"cloned_from"`
+	Version     int32       `json:"version"`
+	Items       []*ListItem `json:"items"`
+}
+
+// ListItem is a book on a reading list.
+type ListItem struct {
+	BookID   int64     `json:"book_id"`
+	Title    string    `json:"title"`
+	Slug     string    `json:"slug"`
+	Position int       `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// ListInput is a new list, or the fields of a list to change. Nil fields are left
+// alone by UpdateList.
+type ListInput struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Archived    *bool   `json:"archived,omitempty"`
+	Template    *bool   `json:"template,omitempty"`
+}
+
+// Lists fetches the current user's reading lists, or only their archived ones if
+// archived is set.
+func (c *Client) Lists(ctx context.Context, archived bool) ([]*List, error) {
+	req := request{method: http.MethodGet, path: "/v1/lists"}
+	if archived {
+		req.query = url.Values{"archived": {"true"}}
+	}
+	var env struct {
+		Lists []*List `json:"lists"`
+	}
+	err := c.do(ctx, req, &env)
+	return env.Lists, err
+}
+
+// GetList fetches one of the current user's lists with its books.
+func (c *Client) GetList(ctx context.Context, id int64) (*List, error) {
+	return c.doList(ctx, request{method: http.MethodGet, path: fmt.Sprintf("/v1/lists/%d", id)})
+}
+
+func (c *Client) CreateList(ctx context.Context, input ListInput) (*List, error) {
+	return c.doList(ctx, request{method: http.MethodPost, path: "/v1/lists", body: input})
+}
+
+func (c *Client) UpdateList(ctx context.Context, id int64, input ListInput) (*List, error) {
+	return c.doList(ctx, request{method: http.MethodPatch, path: fmt.Sprintf("/v1/lists/%d", id), body: input})
+}
+
+func (c *Client) DeleteList(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: fmt.Sprintf("/v1/lists/%d", id)}, nil)
+}
+
+// AddListItem adds a book to the end of a list.
+func (c *Client) AddListItem(ctx context.Context, listID, bookID int64) (*List, error) {
+	body := map[string]int64{"book_id": bookID}
+	return c.doList(ctx, request{method: http.MethodPost, path: fmt.Sprintf("/v1/lists/%d/items", listID), body: body})
+}
+
+func (c *Client) RemoveListItem(ctx context.Context, listID, bookID int64) (*List, error) {
+	return c.doList(ctx, request{method: http.MethodDelete, path: fmt.Sprintf("/v1/lists/%d/items/%d", listID, bookID)})
+}
+
+// MoveListItem moves a book to a new position in a list, counting from 1.
+func (c *Client) MoveListItem(ctx context.Context, listID, bookID int64, position int) (*List, error) {
+	body := map[string]int{"position": position}
+	return c.doList(ctx, request{method: http.MethodPatch, path: fmt.Sprintf("/v1/lists/%d/items/%d/position", listID, bookID), body: body})
+}
+
+// ListTemplates fetches one page of published templates, filtered by name if it
+// isn't empty.
+func (c *Client) ListTemplates(ctx context.Context, name string, page Page) ([]*List, Metadata, error) {
+	qs := url.Values{}
+	if name != "" {
+		qs.Set("name", name)
+	}
+	page.encode(qs)
+	var env struct {
+		Templates []*List  `json:"templates"`
+		Metadata  Metadata `json:"metadata"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/list-templates", query: qs}, &env)
+	return env.Templates, env.Metadata, err
+}
+
+// Templates iterates over every published template, starting from page.Page.
+func (c *Client) Templates(ctx context.Context, name string, page Page) *Iterator[*List] {
+	return newIterator(page.Page, func(n int) ([]*List, Metadata, error) {
+		page.Page = n
+		return c.ListTemplates(ctx, name, page)
+	})
+}
+
+// CloneTemplate copies a published template into a new list of the current user's.
+func (c *Client) CloneTemplate(ctx context.Context, id int64) (*List, error) {
+	return c.doList(ctx, request{method: http.MethodPost, path: fmt.Sprintf("/v1/list-templates/%d/clone", id)})
+}
+
+func (c *Client) doList(ctx context.Context, req request) (*List, error) {
+	var env struct {
+		List *List `json:"list"`
+	}
+	err := c.do(ctx, req, &env)
+	return env.List, err
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ReadingSession is a stretch of time the user spent reading a book. It's open
+// until it's stopped, or times out if it's left running.
+type ReadingSession struct {
+	ID         int64      `json:"id"`
+	ExternalID string     `json:"external_id"`
+	BookID     int64      `json:"book_id"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at"`
+	Duration   int64      `json:"duration_seconds"`
+	TimedOut   bool       `json:"timed_out"`
+}
+
+// ReadingStats sums up how much the user has read recently, split into days in
+// their timezone.
+type ReadingStats struct {
+	MinutesPerDay []struct {
+		Date    string `json:"date"`
+		Minutes int64  `json:"minutes"`
+	} `json:"minutes_per_day"`
+	TotalMinutes int64  `json:"total_minutes"`
+	Timezone     string `json:"timezone"`
+	Streak       struct {
+		Current    int    `json:"current"`
+		Longest    int    `json:"longest"`
+		LastReadOn string `json:"last_read_on"`
+	} `json:"streak"`
+}
+
+// StartReading starts a reading session on a book. If the user is already reading
+// it, the open session is returned.
+func (c *Client) StartReading(ctx context.Context, bookID int64) (*ReadingSession, error) {
+	var env struct {
+		Session *ReadingSession `json:"reading_session"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: fmt.Sprintf("/v1/books/%d/sessions", bookID)}, &env)
+	return env.Session, err
+}
+
+// StopReading ends a reading session. Stopping a session which has already ended
+// returns it unchanged.
+func (c *Client) StopReading(ctx context.Context, id int64) (*ReadingSession, error) {
+	var env struct {
+		Session *ReadingSession `json:"reading_session"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: fmt.Sprintf("/v1/reading-sessions/%d/stop", id)}, &env)
+	return env.Session, err
+}
+
+// ReadingStats fetches the minutes read on each of the last days days, and the
+// user's reading streak.
+func (c *Client) ReadingStats(ctx context.Context, days int) (*ReadingStats, error) {
+	var env struct {
+		Stats *ReadingStats `json:"stats"`
+	}
+	qs := url.Values{"days": {strconv.Itoa(days)}}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/users/me/stats", query: qs}, &env)
+	return env.Stats, err
+}
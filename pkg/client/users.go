@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// User is a user account, as seen by its owner or an admin.
+type User struct {
+	ID            int64      `json:"id"`
+	ExternalID    string     `json:"external_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Name          string     `json:"name"`
+	Email         string     `json:"email"`
+	Activated     bool       `json:"activated"`
+	PendingEmail  string     `json:"pending_email"`
+	DisplayName   string     `json:"display_name"`
+	Bio           string     `json:"bio"`
+	AvatarURL     string     `json:"avatar_url"`
+	ProfilePublic bool       `json:"profile_public"`
+	Timezone      string     `json:"timezone"`
+	LastLoginAt   *time.Time `json:"last_login_at"`
+	LastSeenAt    *time.Time `json:"last_seen_at"`
+}
+
+// Token is an authentication token.
+type Token struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// Session describes one of the current user's authentication tokens, without the
+// token itself.
+type Session struct {
+	ID           int64      `json:"id"`
+	Scope        string     `json:"scope"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Expiry       time.Time  `json:"expiry"`
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	Current      bool       `json:"current"`
+	Impersonated bool       `json:"impersonated"`
+	Scopes       []string   `json:"scopes"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+	LastUsedIP   string     `json:"last_used_ip"`
+}
+
+// Register creates an account. The user can't log in until it's activated with the
+// token emailed to them.
+func (c *Client) Register(ctx context.Context, name, email, password string) (*User, error) {
+	input := map[string]string{"name": name, "email": email, "password": password}
+	var env struct {
+		User *User `json:"user"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/v1/users", body: input}, &env)
+	return env.User, err
+}
+
+// Activate activates an account with the token emailed to its user.
+func (c *Client) Activate(ctx context.Context, token string) (*User, error) {
+	var env struct {
+		User *User `json:"user"`
+	}
+	err := c.do(ctx, request{method: http.MethodPut, path: "/v1/users/activated", body: map[string]string{"token": token}}, &env)
+	return env.User, err
+}
+
+// CurrentUser fetches the user the client is authenticated as.
+func (c *Client) CurrentUser(ctx context.Context) (*User, error) {
+	var env struct {
+		User *User `json:"user"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/users/me"}, &env)
+	return env.User, err
+}
+
+// CreateToken logs in with an email address and password and returns a new
+// authentication token. otp is the two-factor code, for users who have enabled it,
+// and scopes optionally limits the token to some of the user's permissions.
+func (c *Client) CreateToken(ctx context.Context, email, password, otp string, scopes []string) (*Token, error) {
+	input := struct {
+		Email    string   `json:"email"`
+		Password string   `json:"password"`
+		OTP      string   `json:"otp,omitempty"`
+		Scopes   []string `json:"scopes,omitempty"`
+	}{email, password, otp, scopes}
+	// Database tokens and JWTs are encoded differently.
+	var env struct {
+		Token struct {
+			Plaintext string    `json:"Plaintext"`
+			PExpiry   time.Time `json:"Expiry"`
+			Token     string    `json:"token"`
+			Expiry    time.Time `json:"expiry"`
+		} `json:"authentication_token"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: "/v1/tokens/authentication", body: input}, &env)
+	if err != nil {
+		return nil, err
+	}
+	if env.Token.Token != "" {
+		return &Token{Token: env.Token.Token, Expiry: env.Token.Expiry}, nil
+	}
+	return &Token{Token: env.Token.Plaintext, Expiry: env.Token.PExpiry}, nil
+}
+
+// Login creates an authentication token and makes the client use it.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	token, err := c.CreateToken(ctx, email, password, "", nil)
+	if err != nil {
+		return err
+	}
+	c.Token = token.Token
+	return nil
+}
+
+// Sessions lists the current user's authentication tokens.
+func (c *Client) Sessions(ctx context.Context) ([]*Session, error) {
+	var env struct {
+		Tokens []*Session `json:"tokens"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/v1/users/me/tokens"}, &env)
+	return env.Tokens, err
+}
+
+// RevokeSession revokes one of the current user's authentication tokens.
+func (c *Client) RevokeSession(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: fmt.Sprintf("/v1/users/me/tokens/%d", id)}, nil)
+}
@@ -0,0 +1,502 @@
+// Package testkit runs the API server against a throwaway database, for integration
+// tests which want to exercise real behavior rather than mocks. A test starts a server
+// with New, sets up the data it needs with the fixture helpers, and then talks to the
+// server over HTTP with a Client:
+//
+//	func TestListBooks(t *testing.T) {
+//		srv := testkit.New(t, testkit.Options{})
+//		srv.CreateUser("Alice", "alice@example.com", "pa55word1234", "books:read")
+//		client := srv.Login("alice@example.com", "pa55word1234")
+//		res := client.Get("/v1/books")
+//		if res.StatusCode != http.StatusOK {
+//			t.Fatalf("got status %d: %s", res.StatusCode, res.Body)
+//		}
+//	}
+//
+// It needs a PostgreSQL server which the test can create databases on, given by
+// Options.DSN or the BOOK_TEST_DB_DSN environment variable, and the go command to
+// build the server with. Tests are skipped if no database is configured.
+package testkit
+
+import (
+	"books.reading.kz/internal/data"
+	"books.reading.kz/migrations"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Options configures the server New starts.
+type Options struct {
+	// DSN is a PostgreSQL server the test can create databases on. It defaults to
+	// the BOOK_TEST_DB_DSN environment variable.
+	DSN string
+	// Flags are extra command line flags for the server, such as -jwt-enabled.
+	// testkit already sets -port, -db-dsn and -env, turns the rate limiter off and
+	// points the mailer at a port nothing listens on, without retries.
+	Flags []string
+	// StartTimeout is how long the server has to become healthy. It defaults to 30
+	// seconds.
+	StartTimeout time.Duration
+}
+
+// Server is a running API server with its own database, which are both torn down
+// when the test finishes.
+type Server struct {
+	// URL is the server's base URL, like http://127.0.0.1:54321.
+	URL string
+	// DB is a connection pool to the server's database, for fixtures and for
+	// checking what requests did.
+	DB *pgxpool.Pool
+	// Models are the data models backed by DB.
+	Models data.Models
+
+	t      testing.TB
+	cmd    *exec.Cmd
+	output *syncBuffer
+}
+
+var (
+	buildOnce   sync.Once
+	buildBinary string
+	buildErr    error
+)
+
+// build compiles the API server once per test binary. The binary is left in the
+// temporary directory, as there's no hook for when the last test has finished.
+func build() (string, error) {
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "books-testkit-")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		buildBinary = filepath.Join(dir, "api")
+		out, err := exec.Command("go", "build", "-o", buildBinary, "books.reading.kz/cmd/api").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("building the API server: %w\n%s", err, out)
+		}
+	})
+	return buildBinary, buildErr
+}
+
+// New creates a database, migrates it to the latest schema and starts the API server
+// against it. Everything is cleaned up when the test finishes.
+func New(t testing.TB, opts Options) *Server {
+	t.Helper()
+	if opts.DSN == "" {
+		opts.DSN = os.Getenv("BOOK_TEST_DB_DSN")
+	}
+	if opts.DSN == "" {
+		t.Skip("testkit: set BOOK_TEST_DB_DSN to run integration tests")
+	}
+	if opts.StartTimeout == 0 {
+		opts.StartTimeout = 30 * time.Second
+	}
+
+	binary, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsn := createDatabase(t, opts.DSN)
+	db, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("testkit: connecting to the test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+	err = migrate(db)
+	if err != nil {
+		t.Fatalf("testkit: migrating the test database: %v", err)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		URL:    "http://127.0.0.1:" + strconv.Itoa(port),
+		DB:     db,
+		Models: data.NewModels(db, nil),
+		t:      t,
+		output: &syncBuffer{},
+	}
+
+	args := []string{
+		"-port", strconv.Itoa(port),
+		"-db-dsn", dsn,
+		"-env", "development",
+		"-limiter-enabled=false",
+		"-mail-provider", "smtp",
+		"-smtp-host", "127.0.0.1",
+		"-smtp-port", "1",
+		"-smtp-attempts", "1",
+	}
+	s.cmd = exec.Command(binary, append(args, opts.Flags...)...)
+	s.cmd.Stdout = s.output
+	s.cmd.Stderr = s.output
+	err = s.cmd.Start()
+	if err != nil {
+		t.Fatalf("testkit: starting the API server: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		s.cmd.Wait()
+		close(exited)
+	}()
+	// The server is stopped before the database pool is closed and the database
+	// dropped, as cleanups run last added first.
+	t.Cleanup(func() {
+		s.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			s.cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("testkit: API server output:\n%s", s.output.String())
+		}
+	})
+
+	deadline := time.Now().Add(opts.StartTimeout)
+	for {
+		res, err := http.Get(s.URL + "/v1/healthcheck")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return s
+			}
+		}
+		select {
+		case <-exited:
+			t.Fatalf("testkit: the API server exited during startup:\n%s", s.output.String())
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("testkit: the API server didn't become healthy within %s:\n%s", opts.StartTimeout, s.output.String())
+		}
+	}
+}
+
+// createDatabase creates a database with a unique name on the server dsn points to
+// and returns a DSN for it. The database is dropped when the test finishes.
+func createDatabase(t testing.TB, dsn string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	admin, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("testkit: connecting to %s: %v", redact(dsn), err)
+	}
+
+	suffix := make([]byte, 6)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	name := "books_test_" + hex.EncodeToString(suffix)
+	_, err = admin.Exec(ctx, `CREATE DATABASE `+name)
+	if err != nil {
+		admin.Close()
+		t.Fatalf("testkit: creating the test database: %v", err)
+	}
+	t.Cleanup(func() {
+		defer admin.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// Anything still connected, such as a pool a test forgot to close, would
+		// stop the database being dropped.
+		admin.Exec(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1`, name)
+		_, err := admin.Exec(ctx, `DROP DATABASE IF EXISTS `+name)
+		if err != nil {
+			t.Logf("testkit: dropping the test database %s: %v", name, err)
+		}
+	})
+
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		u.Path = "/" + name
+		return u.String()
+	}
+	// Later keywords override earlier ones in keyword/value DSNs.
+	return dsn + " dbname=" + name
+}
+
+// migrate applies every up migration in order, and records the version reached in
+// schema_migrations the way the migrate tool does, so the server's schema check
+// passes.
+func migrate(db *pgxpool.Pool) error {
+	names, err := fs.Glob(migrations.FS, "*.up.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	var version int64
+	for _, name := range names {
+		script, err := fs.ReadFile(migrations.FS, name)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(ctx, string(script))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err = strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	_, err = db.Exec(ctx, `CREATE TABLE schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	return err
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// redact hides the password in a URL DSN, for error messages.
+func redact(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return dsn
+}
+
+// syncBuffer collects the server's output, which is written from the goroutines
+// exec starts while tests may be reading it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Output returns everything the server has logged so far.
+func (s *Server) Output() string {
+	return s.output.String()
+}
+
+// Exec runs a statement against the server's database, failing the test if it
+// errors. It's for fixtures the helpers don't cover.
+func (s *Server) Exec(query string, args ...any) {
+	s.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.DB.Exec(ctx, query, args...)
+	if err != nil {
+		s.t.Fatalf("testkit: %v", err)
+	}
+}
+
+// LoadFixtures runs the SQL files matching the patterns in fsys, in name order. Each
+// file can hold several statements.
+func (s *Server) LoadFixtures(fsys fs.FS, patterns ...string) {
+	s.t.Helper()
+	var names []string
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			s.t.Fatalf("testkit: %v", err)
+		}
+		names = append(names, matches...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		script, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			s.t.Fatalf("testkit: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		_, err = s.DB.Exec(ctx, string(script))
+		cancel()
+		if err != nil {
+			s.t.Fatalf("testkit: fixture %s: %v", name, err)
+		}
+	}
+}
+
+// CreateUser adds an activated user with the given password, granted permissions
+// directly rather than through a role.
+func (s *Server) CreateUser(name, email, password string, permissions ...string) *data.User {
+	s.t.Helper()
+	user := &data.User{Name: name, Email: email, Activated: true}
+	err := user.Password.Set(password)
+	if err != nil {
+		s.t.Fatalf("testkit: %v", err)
+	}
+	// The models only use the request for its context.
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	err = s.Models.Users.Insert(user, r)
+	if err != nil {
+		s.t.Fatalf("testkit: creating user %s: %v", email, err)
+	}
+	if len(permissions) > 0 {
+		err = s.Models.Permissions.AddForUser(user.ID, permissions...)
+		if err != nil {
+			s.t.Fatalf("testkit: granting %s permissions: %v", email, err)
+		}
+	}
+	return user
+}
+
+// Client returns a client which makes unauthenticated requests.
+func (s *Server) Client() *Client {
+	return &Client{BaseURL: s.URL, HTTP: &http.Client{Timeout: 30 * time.Second}, t: s.t}
+}
+
+// Login logs in with an email and password and returns a client which sends the
+// authentication token it was given with each request.
+func (s *Server) Login(email, password string) *Client {
+	s.t.Helper()
+	client := s.Client()
+	res := client.Post("/v1/tokens/authentication", map[string]string{"email": email, "password": password})
+	if res.StatusCode != http.StatusCreated {
+		s.t.Fatalf("testkit: logging in as %s: got status %d: %s", email, res.StatusCode, res.Body)
+	}
+	var body struct {
+		Token struct {
+			// Database tokens and JWTs are encoded differently.
+			Plaintext string `json:"Plaintext"`
+			Token     string `json:"token"`
+		} `json:"authentication_token"`
+	}
+	res.Decode(&body)
+	client.Token = body.Token.Token
+	if client.Token == "" {
+		client.Token = body.Token.Plaintext
+	}
+	return client
+}
+
+// Client makes requests to the server, failing the test on transport errors rather
+// than returning them, so tests only have to check the responses.
+type Client struct {
+	BaseURL string
+	// Token is sent as a bearer token if it's set.
+	Token string
+	// Header is added to every request.
+	Header http.Header
+	HTTP   *http.Client
+
+	t testing.TB
+}
+
+// Response is a response with its body read.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	t testing.TB
+}
+
+// Decode unmarshals the JSON body into dst, failing the test if it can't.
+func (r *Response) Decode(dst any) {
+	r.t.Helper()
+	err := json.Unmarshal(r.Body, dst)
+	if err != nil {
+		r.t.Fatalf("testkit: decoding response: %v: %s", err, r.Body)
+	}
+}
+
+// Do sends a request to the path, with body encoded as JSON unless it's nil.
+func (c *Client) Do(method, path string, body any) *Response {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("testkit: encoding request: %v", err)
+		}
+		reader = bytes.NewReader(js)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, reader)
+	if err != nil {
+		c.t.Fatalf("testkit: %v", err)
+	}
+	for key, values := range c.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		c.t.Fatalf("testkit: %s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res.Body)
+	if err != nil {
+		c.t.Fatalf("testkit: reading response to %s %s: %v", method, path, err)
+	}
+	return &Response{StatusCode: res.StatusCode, Header: res.Header, Body: buf.Bytes(), t: c.t}
+}
+
+func (c *Client) Get(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodGet, path, nil)
+}
+
+func (c *Client) Post(path string, body any) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPost, path, body)
+}
+
+func (c *Client) Patch(path string, body any) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPatch, path, body)
+}
+
+func (c *Client) Delete(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodDelete, path, nil)
+}